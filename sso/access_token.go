@@ -0,0 +1,51 @@
+package sso
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"ssoauth2/sso/jwt"
+	"strings"
+)
+
+// access token 的格式
+const (
+	// AccessTokenFormatOpaque 随机字符串，资源服务器只能通过 /introspect 校验
+	AccessTokenFormatOpaque = "opaque"
+	// AccessTokenFormatJWT RFC 9068 格式的 JWT，资源服务器可以用 JWKS 离线校验
+	AccessTokenFormatJWT = "jwt"
+)
+
+// signAccessToken 把 access token 签名成 RFC 9068 格式的 JWT
+// 注意离线校验感知不到吊销，所以 JWT 格式的 access token 有效期不宜太长
+func (s *Server) signAccessToken(ctx context.Context, tk *Token) (string, error) {
+	// 客户端可以单独设置更长的有效期，轮换之后密钥要保留到这个 token 过期
+	s.keyManager.RetainAtLeast(tk.ExpiresAt.Sub(tk.IssuedAt))
+	key, err := s.keyManager.SigningKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	claims := accessTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.issuer,
+			Subject:   tk.subject(),
+			Audience:  jwt.Audience{s.accessTokenAudience},
+			ExpiresAt: tk.ExpiresAt.Unix(),
+			IssuedAt:  tk.IssuedAt.Unix(),
+			ID:        uuid.New().String(),
+		},
+		ClientID: tk.ClientID,
+		Scope:    strings.Join(tk.Scopes, " "),
+	}
+	// RFC 9068 要求 typ 是 at+jwt，避免和 ID token 混用
+	return jwt.Sign(key, "at+jwt", claims)
+}
+
+func (c *Client) jwtAccessToken() bool {
+	return c.AccessTokenFormat == AccessTokenFormatJWT
+}
+
+type accessTokenClaims struct {
+	jwt.RegisteredClaims
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope,omitempty"`
+}
@@ -0,0 +1,96 @@
+package sso
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/url"
+	"ssoauth2/sso/jwt"
+	"ssoauth2/sso/keys"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_JWTAccessToken(t *testing.T) {
+	s := newTestServer(ServerWithIssuer("https://sso.example.com"),
+		ServerWithAccessTokenAudience("https://api.example.com"))
+	resp := postForm(s, "/token", url.Values{
+		"grant_type":    {GrantTypeClientCredentials},
+		"client_id":     {"reports"},
+		"client_secret": {"reports-secret"},
+	})
+	require.Equal(t, http.StatusOK, resp.Code)
+	var tkResp tokenResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &tkResp))
+	assert.Len(t, strings.Split(tkResp.AccessToken, "."), 3)
+
+	// 资源服务器只需要 JWKS 就可以离线校验
+	set, err := s.keyManager.JWKS(context.Background())
+	require.NoError(t, err)
+	var claims accessTokenClaims
+	header, err := jwt.Parse(tkResp.AccessToken, func(header *jwt.Header) (crypto.PublicKey, error) {
+		jwk, ok := set.Key(header.Kid)
+		require.True(t, ok)
+		return jwk.PublicKey()
+	}, &claims)
+	require.NoError(t, err)
+	assert.Equal(t, "at+jwt", header.Typ)
+	assert.NoError(t, claims.Validate(time.Now(), 0))
+	assert.Equal(t, "https://sso.example.com", claims.Issuer)
+	assert.Equal(t, jwt.Audience{"https://api.example.com"}, claims.Audience)
+	assert.Equal(t, "reports", claims.Subject)
+	assert.Equal(t, "reports", claims.ClientID)
+	assert.Equal(t, "reports.read", claims.Scope)
+	assert.NotEmpty(t, claims.ID)
+	assert.Equal(t, tkResp.ExpiresIn, claims.ExpiresAt-claims.IssuedAt)
+
+	// 依旧可以通过 /introspect 校验，吊销之后就失效了
+	introspect := func() introspectionResponse {
+		resp := postForm(s, "/introspect", url.Values{
+			"token":         {tkResp.AccessToken},
+			"client_id":     {"reports"},
+			"client_secret": {"reports-secret"},
+		})
+		require.Equal(t, http.StatusOK, resp.Code)
+		var res introspectionResponse
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &res))
+		return res
+	}
+	assert.True(t, introspect().Active)
+	resp = postForm(s, "/revoke", url.Values{
+		"token":         {tkResp.AccessToken},
+		"client_id":     {"reports"},
+		"client_secret": {"reports-secret"},
+	})
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.False(t, introspect().Active)
+}
+
+func TestServer_JWTAccessTokenKeyRetention(t *testing.T) {
+	// 重启之前轮换掉的密钥，已经超过了默认的保留期，但是还没有超过客户端设置的 access token 有效期
+	retired, err := keys.Generate(jwt.ES256)
+	require.NoError(t, err)
+	retired.CreatedAt = time.Now().Add(-time.Hour * 72)
+	retired.RetiredAt = time.Now().Add(-time.Hour * 30)
+	active := *testSigningKey
+	active.CreatedAt = time.Now()
+	s := newTestServer(
+		ServerWithClientStore(NewMemoryClientStore(&Client{
+			ID:                    "reports",
+			Secret:                "reports-secret",
+			GrantTypes:            []string{GrantTypeClientCredentials},
+			AccessTokenFormat:     AccessTokenFormatJWT,
+			AccessTokenExpiration: time.Hour * 48,
+		})),
+		ServerWithKeyManager(keys.NewManager(keys.NewMemoryKeyStore(retired, &active),
+			keys.ManagerWithAlgorithm(jwt.ES256))),
+	)
+	set, err := s.keyManager.JWKS(context.Background())
+	require.NoError(t, err)
+	_, ok := set.Key(retired.ID)
+	assert.True(t, ok)
+}
@@ -0,0 +1,316 @@
+package sso
+
+import (
+	"crypto/subtle"
+	"errors"
+	"github.com/google/uuid"
+	"net/http"
+	"slices"
+	webContext "ssoauth2/web/context"
+	"ssoauth2/web/handler"
+	"strings"
+	"time"
+)
+
+// adminOnly 管理接口只允许带着管理员 token 的请求访问
+func (s *Server) adminOnly(next handler.HandleFunc) handler.HandleFunc {
+	return func(ctx *webContext.Context) {
+		token := bearerToken(ctx)
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			ctx.Response.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			_ = ctx.RespString(http.StatusUnauthorized, "")
+			return
+		}
+		next(ctx)
+	}
+}
+
+func (s *Server) listClients(ctx *webContext.Context) {
+	clients, err := s.clients.List(ctx.Request.Context())
+	if err != nil {
+		respOAuth2Error(ctx, newOAuth2Error(errServerError, "failed to list clients"))
+		return
+	}
+	res := make([]clientResponse, 0, len(clients))
+	for _, c := range clients {
+		res = append(res, newClientResponse(c, ""))
+	}
+	respOAuth2JSON(ctx, http.StatusOK, res)
+}
+
+// createClient 创建客户端，机密客户端的密钥只会在这里返回一次
+func (s *Server) createClient(ctx *webContext.Context) {
+	var req clientRequest
+	if err := ctx.BindJSON(&req); err != nil {
+		respOAuth2Error(ctx, newOAuth2Error(errInvalidRequest, "malformed request body"))
+		return
+	}
+	if req.ID == "" {
+		req.ID = uuid.New().String()
+	}
+	reqCtx := ctx.Request.Context()
+	if _, err := s.clients.Get(reqCtx, req.ID); err == nil {
+		respOAuth2Error(ctx, &oauth2Error{Code: errInvalidClientMetadata,
+			Description: "client_id already exists", status: http.StatusConflict})
+		return
+	} else if !errors.Is(err, ErrClientNotFound) {
+		respOAuth2Error(ctx, newOAuth2Error(errServerError, "failed to load client"))
+		return
+	}
+	client := req.client()
+	if oerr := validateClient(client); oerr != nil {
+		respOAuth2Error(ctx, oerr)
+		return
+	}
+	secret, oerr := s.saveClient(ctx, client, !client.Public)
+	if oerr != nil {
+		respOAuth2Error(ctx, oerr)
+		return
+	}
+	respOAuth2JSON(ctx, http.StatusCreated, newClientResponse(client, secret))
+}
+
+func (s *Server) getClient(ctx *webContext.Context) {
+	client, ok := s.pathClient(ctx)
+	if !ok {
+		return
+	}
+	respOAuth2JSON(ctx, http.StatusOK, newClientResponse(client, ""))
+}
+
+// updateClient 整体替换客户端的配置，请求里面没有的字段，例如密钥和禁用状态，保持不变
+func (s *Server) updateClient(ctx *webContext.Context) {
+	old, ok := s.pathClient(ctx)
+	if !ok {
+		return
+	}
+	var req clientRequest
+	if err := ctx.BindJSON(&req); err != nil {
+		respOAuth2Error(ctx, newOAuth2Error(errInvalidRequest, "malformed request body"))
+		return
+	}
+	if req.ID != "" && req.ID != old.ID {
+		respOAuth2Error(ctx, newOAuth2Error(errInvalidRequest, "client_id can not be changed"))
+		return
+	}
+	req.ID = old.ID
+	client := req.client()
+	client.Name = old.Name
+	client.TokenEndpointAuthMethod = old.TokenEndpointAuthMethod
+	client.RegistrationTokenHash = old.RegistrationTokenHash
+	client.Disabled = old.Disabled
+	if !client.Public {
+		client.SecretHash = old.SecretHash
+	}
+	if oerr := validateClient(client); oerr != nil {
+		respOAuth2Error(ctx, oerr)
+		return
+	}
+	// 从公开客户端改成机密客户端的时候，需要生成一个密钥
+	secret, oerr := s.saveClient(ctx, client, !client.Public && client.SecretHash == "")
+	if oerr != nil {
+		respOAuth2Error(ctx, oerr)
+		return
+	}
+	respOAuth2JSON(ctx, http.StatusOK, newClientResponse(client, secret))
+}
+
+// rotateClientSecret 生成新的密钥，旧的密钥立刻失效
+func (s *Server) rotateClientSecret(ctx *webContext.Context) {
+	client, ok := s.pathClient(ctx)
+	if !ok {
+		return
+	}
+	if client.Public {
+		respOAuth2Error(ctx, newOAuth2Error(errInvalidRequest, "public clients do not have secrets"))
+		return
+	}
+	secret, oerr := s.saveClient(ctx, client, true)
+	if oerr != nil {
+		respOAuth2Error(ctx, oerr)
+		return
+	}
+	respOAuth2JSON(ctx, http.StatusOK, newClientResponse(client, secret))
+}
+
+// setClientDisabled 禁用或者启用客户端
+func (s *Server) setClientDisabled(disabled bool) handler.HandleFunc {
+	return func(ctx *webContext.Context) {
+		client, ok := s.pathClient(ctx)
+		if !ok {
+			return
+		}
+		client.Disabled = disabled
+		if _, oerr := s.saveClient(ctx, client, false); oerr != nil {
+			respOAuth2Error(ctx, oerr)
+			return
+		}
+		respOAuth2JSON(ctx, http.StatusOK, newClientResponse(client, ""))
+	}
+}
+
+// pathClient 根据路径参数里面的 id 找到客户端
+func (s *Server) pathClient(ctx *webContext.Context) (*Client, bool) {
+	id, _ := ctx.PathValue("id").String()
+	client, err := s.clients.Get(ctx.Request.Context(), id)
+	if errors.Is(err, ErrClientNotFound) {
+		_ = ctx.RespString(http.StatusNotFound, "")
+		return nil, false
+	}
+	if err != nil {
+		respOAuth2Error(ctx, newOAuth2Error(errServerError, "failed to load client"))
+		return nil, false
+	}
+	return client, true
+}
+
+// saveClient 保存客户端，newSecret 为 true 的时候生成新的密钥，并且返回明文
+func (s *Server) saveClient(ctx *webContext.Context, client *Client, newSecret bool) (string, *oauth2Error) {
+	var secret string
+	if newSecret {
+		var err error
+		if secret, err = NewClientSecret(); err != nil {
+			return "", newOAuth2Error(errServerError, "failed to generate client secret")
+		}
+		client.Secret = secret
+		client.SecretHash = ""
+	}
+	if err := s.clients.Save(ctx.Request.Context(), client); err != nil {
+		return "", newOAuth2Error(errServerError, "failed to save client")
+	}
+	client.Secret = ""
+	return secret, nil
+}
+
+// validateClient 校验客户端的配置
+func validateClient(c *Client) *oauth2Error {
+	for _, grantType := range c.GrantTypes {
+		switch grantType {
+		case GrantTypeAuthorizationCode, GrantTypeRefreshToken, GrantTypeClientCredentials, GrantTypeDeviceCode:
+		default:
+			return newOAuth2Error(errInvalidClientMetadata, "unsupported grant_type "+grantType)
+		}
+	}
+	if c.Public && slices.Contains(c.GrantTypes, GrantTypeClientCredentials) {
+		return newOAuth2Error(errInvalidClientMetadata, "public clients can not use client_credentials")
+	}
+	if c.allowGrant(GrantTypeAuthorizationCode) && len(c.RedirectURIs) == 0 {
+		return newOAuth2Error(errInvalidRedirectURI, "redirect_uris is required")
+	}
+	for _, uri := range c.RedirectURIs {
+		if _, err := parseRedirectURI(uri); err != nil {
+			return newOAuth2Error(errInvalidRedirectURI, "invalid redirect_uri "+uri)
+		}
+	}
+	// 退出登录的通知地址和回调地址的要求一样
+	for _, uri := range []string{c.BackchannelLogoutURI, c.FrontchannelLogoutURI} {
+		if _, err := parseRedirectURI(uri); uri != "" && err != nil {
+			return newOAuth2Error(errInvalidClientMetadata, "invalid logout uri "+uri)
+		}
+	}
+	for _, uri := range c.PostLogoutRedirectURIs {
+		if _, err := parseRedirectURI(uri); err != nil {
+			return newOAuth2Error(errInvalidClientMetadata, "invalid post_logout_redirect_uri "+uri)
+		}
+	}
+	// Host 只是域名和端口，匹配的时候不会再解析
+	if strings.ContainsAny(c.Host, "/?#@\\ ") {
+		return newOAuth2Error(errInvalidClientMetadata, "invalid host")
+	}
+	if _, err := parseRedirectURI(c.CallbackURL); c.CallbackURL != "" && err != nil {
+		return newOAuth2Error(errInvalidClientMetadata, "invalid callback_url")
+	}
+	for _, scope := range c.Scopes {
+		if scope == "" || strings.ContainsAny(scope, " \"\\") {
+			return newOAuth2Error(errInvalidClientMetadata, "invalid scope")
+		}
+	}
+	switch c.AccessTokenFormat {
+	case "", AccessTokenFormatOpaque, AccessTokenFormatJWT:
+	default:
+		return newOAuth2Error(errInvalidClientMetadata, "unsupported access_token_format")
+	}
+	if c.AccessTokenExpiration < 0 || c.RefreshTokenExpiration < 0 {
+		return newOAuth2Error(errInvalidClientMetadata, "token lifetimes must not be negative")
+	}
+	return nil
+}
+
+// clientRequest 是创建和更新客户端的请求，有效期都以秒为单位
+type clientRequest struct {
+	ID                     string   `json:"client_id"`
+	RedirectURIs           []string `json:"redirect_uris"`
+	Scopes                 []string `json:"scopes"`
+	GrantTypes             []string `json:"grant_types"`
+	Public                 bool     `json:"public"`
+	RequirePKCE            bool     `json:"require_pkce"`
+	AccessTokenExpiration  int64    `json:"access_token_expires_in"`
+	RefreshTokenExpiration int64    `json:"refresh_token_expires_in"`
+	AccessTokenFormat      string   `json:"access_token_format"`
+	BackchannelLogoutURI   string   `json:"backchannel_logout_uri"`
+	FrontchannelLogoutURI  string   `json:"frontchannel_logout_uri"`
+	PostLogoutRedirectURIs []string `json:"post_logout_redirect_uris"`
+	// Host 和 CallbackURL 是老的 /check_login 流程使用的
+	Host        string `json:"host"`
+	CallbackURL string `json:"callback_url"`
+}
+
+func (r clientRequest) client() *Client {
+	return &Client{
+		ID:                     r.ID,
+		RedirectURIs:           r.RedirectURIs,
+		Scopes:                 r.Scopes,
+		GrantTypes:             r.GrantTypes,
+		Public:                 r.Public,
+		RequirePKCE:            r.RequirePKCE,
+		AccessTokenExpiration:  time.Duration(r.AccessTokenExpiration) * time.Second,
+		RefreshTokenExpiration: time.Duration(r.RefreshTokenExpiration) * time.Second,
+		AccessTokenFormat:      r.AccessTokenFormat,
+		BackchannelLogoutURI:   r.BackchannelLogoutURI,
+		FrontchannelLogoutURI:  r.FrontchannelLogoutURI,
+		PostLogoutRedirectURIs: r.PostLogoutRedirectURIs,
+		Host:                   r.Host,
+		CallbackURL:            r.CallbackURL,
+	}
+}
+
+type clientResponse struct {
+	ID string `json:"client_id"`
+	// Secret 只有创建和轮换密钥的时候才会返回
+	Secret                 string   `json:"client_secret,omitempty"`
+	RedirectURIs           []string `json:"redirect_uris"`
+	Scopes                 []string `json:"scopes"`
+	GrantTypes             []string `json:"grant_types"`
+	Public                 bool     `json:"public"`
+	RequirePKCE            bool     `json:"require_pkce"`
+	AccessTokenExpiration  int64    `json:"access_token_expires_in"`
+	RefreshTokenExpiration int64    `json:"refresh_token_expires_in"`
+	AccessTokenFormat      string   `json:"access_token_format"`
+	BackchannelLogoutURI   string   `json:"backchannel_logout_uri,omitempty"`
+	FrontchannelLogoutURI  string   `json:"frontchannel_logout_uri,omitempty"`
+	PostLogoutRedirectURIs []string `json:"post_logout_redirect_uris,omitempty"`
+	Host                   string   `json:"host,omitempty"`
+	CallbackURL            string   `json:"callback_url,omitempty"`
+	Disabled               bool     `json:"disabled"`
+}
+
+func newClientResponse(c *Client, secret string) clientResponse {
+	return clientResponse{
+		ID:                     c.ID,
+		Secret:                 secret,
+		RedirectURIs:           c.RedirectURIs,
+		Scopes:                 c.Scopes,
+		GrantTypes:             c.GrantTypes,
+		Public:                 c.Public,
+		RequirePKCE:            c.RequirePKCE,
+		AccessTokenExpiration:  int64(c.AccessTokenExpiration / time.Second),
+		RefreshTokenExpiration: int64(c.RefreshTokenExpiration / time.Second),
+		AccessTokenFormat:      c.AccessTokenFormat,
+		BackchannelLogoutURI:   c.BackchannelLogoutURI,
+		FrontchannelLogoutURI:  c.FrontchannelLogoutURI,
+		PostLogoutRedirectURIs: c.PostLogoutRedirectURIs,
+		Host:                   c.Host,
+		CallbackURL:            c.CallbackURL,
+		Disabled:               c.Disabled,
+	}
+}
@@ -0,0 +1,246 @@
+package sso
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func adminRequest(s http.Handler, method string, path string, body string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer admin-token")
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	return resp
+}
+
+func clientCredentials(s http.Handler, id string, secret string) *httptest.ResponseRecorder {
+	return postForm(s, "/token", url.Values{
+		"grant_type":    {GrantTypeClientCredentials},
+		"client_id":     {id},
+		"client_secret": {secret},
+	})
+}
+
+func TestServer_AdminClients(t *testing.T) {
+	s := newTestServer(ServerWithAdminToken("admin-token"))
+
+	// 没有带上管理员 token
+	req := httptest.NewRequest(http.MethodGet, "/admin/clients", nil)
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	resp = adminRequest(s, http.MethodPost, "/admin/clients", `{
+		"client_id": "inventory",
+		"scopes": ["stock.read"],
+		"grant_types": ["client_credentials"],
+		"access_token_expires_in": 600
+	}`)
+	require.Equal(t, http.StatusCreated, resp.Code)
+	var created clientResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &created))
+	assert.Equal(t, "inventory", created.ID)
+	assert.Equal(t, int64(600), created.AccessTokenExpiration)
+	require.NotEmpty(t, created.Secret)
+
+	// 密钥只会以哈希的形式保存
+	stored, err := s.clients.Get(req.Context(), "inventory")
+	require.NoError(t, err)
+	assert.Empty(t, stored.Secret)
+	assert.NotContains(t, stored.SecretHash, created.Secret)
+
+	resp = clientCredentials(s, "inventory", created.Secret)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var tkResp tokenResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &tkResp))
+	assert.Equal(t, int64(600), tkResp.ExpiresIn)
+
+	// 查询的时候不会返回密钥
+	resp = adminRequest(s, http.MethodGet, "/admin/clients/inventory", "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	var got clientResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &got))
+	assert.Empty(t, got.Secret)
+
+	// 轮换密钥之后，旧的密钥立刻失效
+	resp = adminRequest(s, http.MethodPost, "/admin/clients/inventory/secret", "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	var rotated clientResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &rotated))
+	assert.NotEqual(t, created.Secret, rotated.Secret)
+	assert.Equal(t, http.StatusUnauthorized, clientCredentials(s, "inventory", created.Secret).Code)
+	assert.Equal(t, http.StatusOK, clientCredentials(s, "inventory", rotated.Secret).Code)
+
+	// 更新配置，密钥保持不变
+	resp = adminRequest(s, http.MethodPut, "/admin/clients/inventory", `{
+		"scopes": ["stock.read", "stock.write"],
+		"grant_types": ["client_credentials"]
+	}`)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var updated clientResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &updated))
+	assert.Empty(t, updated.Secret)
+	assert.Equal(t, []string{"stock.read", "stock.write"}, updated.Scopes)
+	assert.Equal(t, http.StatusOK, clientCredentials(s, "inventory", rotated.Secret).Code)
+
+	// 禁用之后不能再申请 token，已经颁发的 token 也失效了
+	resp = adminRequest(s, http.MethodPost, "/admin/clients/inventory/disable", "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, http.StatusUnauthorized, clientCredentials(s, "inventory", rotated.Secret).Code)
+	resp = postForm(s, "/introspect", url.Values{
+		"token":         {tkResp.AccessToken},
+		"client_id":     {"billing"},
+		"client_secret": {"billing-secret"},
+	})
+	assert.JSONEq(t, `{"active":false}`, resp.Body.String())
+
+	resp = adminRequest(s, http.MethodPost, "/admin/clients/inventory/enable", "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, http.StatusOK, clientCredentials(s, "inventory", rotated.Secret).Code)
+
+	resp = adminRequest(s, http.MethodGet, "/admin/clients", "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	var list []clientResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &list))
+	ids := make([]string, 0, len(list))
+	for _, c := range list {
+		ids = append(ids, c.ID)
+	}
+	assert.Equal(t, []string{"app1", "billing", "cli", "inventory", "reports", "spa"}, ids)
+}
+
+func TestServer_AdminUpdateLegacyClient(t *testing.T) {
+	s := newTestServer(ServerWithAdminToken("admin-token"))
+	resp := adminRequest(s, http.MethodPut, "/admin/clients/app1", `{
+		"redirect_uris": ["http://app1.com:8081/oauth2/callback"],
+		"scopes": ["openid", "profile"],
+		"host": "app1.com:8081",
+		"callback_url": "http://app1.com:8081/token"
+	}`)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var updated clientResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &updated))
+	assert.Equal(t, "app1.com:8081", updated.Host)
+	assert.Equal(t, "http://app1.com:8081/token", updated.CallbackURL)
+
+	// 更新之后，老的 check_login 流程依旧可以用
+	ssid := login(t, s)
+	resp = postForm(s, "/check_login", url.Values{
+		"app_id":       {"app1"},
+		"redirect_uri": {"http://app1.com:8081/profile"},
+	}, ssid)
+	require.Equal(t, http.StatusFound, resp.Code)
+	assert.True(t, strings.HasPrefix(resp.Header().Get("Location"), "http://app1.com:8081/token?"))
+}
+
+func TestServer_AdminClientsErrors(t *testing.T) {
+	s := newTestServer(ServerWithAdminToken("admin-token"))
+	testCases := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+
+		wantCode  int
+		wantError string
+	}{
+		{
+			name:      "client_id 已经存在",
+			method:    http.MethodPost,
+			path:      "/admin/clients",
+			body:      `{"client_id": "app1", "redirect_uris": ["https://app1.com/cb"]}`,
+			wantCode:  http.StatusConflict,
+			wantError: errInvalidClientMetadata,
+		},
+		{
+			name:      "授权码模式没有回调地址",
+			method:    http.MethodPost,
+			path:      "/admin/clients",
+			body:      `{"scopes": ["profile"]}`,
+			wantCode:  http.StatusBadRequest,
+			wantError: errInvalidRedirectURI,
+		},
+		{
+			name:      "非法的回调地址",
+			method:    http.MethodPost,
+			path:      "/admin/clients",
+			body:      `{"redirect_uris": ["javascript:alert(1)"]}`,
+			wantCode:  http.StatusBadRequest,
+			wantError: errInvalidRedirectURI,
+		},
+		{
+			name:      "非法的退出登录通知地址",
+			method:    http.MethodPost,
+			path:      "/admin/clients",
+			body:      `{"redirect_uris": ["https://app1.com/cb"], "backchannel_logout_uri": "javascript:alert(1)"}`,
+			wantCode:  http.StatusBadRequest,
+			wantError: errInvalidClientMetadata,
+		},
+		{
+			name:      "非法的 host",
+			method:    http.MethodPost,
+			path:      "/admin/clients",
+			body:      `{"redirect_uris": ["https://app1.com/cb"], "host": "evil.com/app1.com"}`,
+			wantCode:  http.StatusBadRequest,
+			wantError: errInvalidClientMetadata,
+		},
+		{
+			name:      "公开客户端使用客户端模式",
+			method:    http.MethodPost,
+			path:      "/admin/clients",
+			body:      `{"public": true, "grant_types": ["client_credentials"]}`,
+			wantCode:  http.StatusBadRequest,
+			wantError: errInvalidClientMetadata,
+		},
+		{
+			name:      "不支持的 grant_type",
+			method:    http.MethodPost,
+			path:      "/admin/clients",
+			body:      `{"grant_types": ["password"]}`,
+			wantCode:  http.StatusBadRequest,
+			wantError: errInvalidClientMetadata,
+		},
+		{
+			name:      "未知的字段",
+			method:    http.MethodPost,
+			path:      "/admin/clients",
+			body:      `{"client_secret": "abc"}`,
+			wantCode:  http.StatusBadRequest,
+			wantError: errInvalidRequest,
+		},
+		{
+			name:     "客户端不存在",
+			method:   http.MethodPost,
+			path:     "/admin/clients/unknown/disable",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:      "公开客户端没有密钥",
+			method:    http.MethodPost,
+			path:      "/admin/clients/spa/secret",
+			wantCode:  http.StatusBadRequest,
+			wantError: errInvalidRequest,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := adminRequest(s, tc.method, tc.path, tc.body)
+			assert.Equal(t, tc.wantCode, resp.Code)
+			if tc.wantError != "" {
+				assertOAuth2Error(t, resp, tc.wantError)
+			}
+		})
+	}
+}
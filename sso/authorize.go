@@ -0,0 +1,246 @@
+package sso
+
+import (
+	"github.com/google/uuid"
+	"net/http"
+	"net/url"
+	"slices"
+	webContext "ssoauth2/web/context"
+	"strings"
+	"time"
+)
+
+// authorize 是 OAuth2 授权码模式的入口
+// 没有登录就先去登录，登录了就展示授权页面，以前已经同意过的直接颁发授权码
+// prompt=none 的时候不能展示任何页面，需要用户参与的地方都直接返回错误
+func (s *Server) authorize(ctx *webContext.Context) {
+	req, ok := s.parseAuthorizeRequest(ctx)
+	if !ok {
+		return
+	}
+	sess, err := s.currentSession(ctx)
+	if err != nil {
+		sess = nil
+	}
+	if req.needLogin(sess, time.Now()) {
+		if req.hasPrompt(promptNone) {
+			s.redirectError(ctx, req, newOAuth2Error(errLoginRequired, "the end-user is not authenticated"))
+			return
+		}
+		// 登录成功之后再回到这里
+		_ = ctx.Render("login.gohtml", loginPage{
+			Continue:  "/authorize?" + reauthQuery(ctx.Request.URL.Query()).Encode(),
+			Email:     req.loginHint,
+			CSRFToken: s.csrf.Token(ctx),
+		})
+		return
+	}
+	if req.requireMFA() && !sess.hasMFA() {
+		if req.hasPrompt(promptNone) {
+			s.redirectError(ctx, req, newOAuth2Error(errInteractionRequired, "multi-factor authentication is required"))
+			return
+		}
+		s.stepUpMFA(ctx, req, sess)
+		return
+	}
+	if s.consented(ctx.Request.Context(), req, sess) {
+		s.issueCode(ctx, req, sess, req.scopes)
+		return
+	}
+	if req.hasPrompt(promptNone) {
+		s.redirectError(ctx, req, newOAuth2Error(errConsentRequired, "the end-user has not granted consent"))
+		return
+	}
+	_ = ctx.Render("confirm.gohtml", consentPage{
+		ClientId:     req.client.ID,
+		ClientName:   req.client.displayName(),
+		Scopes:       s.describeScopes(req.scopes),
+		Scope:        strings.Join(req.scopes, " "),
+		ResponseType: req.responseType,
+		RedirectURI:  req.rawRedirectURI,
+		State:        req.state,
+
+		CodeChallenge:       req.codeChallenge,
+		CodeChallengeMethod: req.codeChallengeMethod,
+		Nonce:               req.nonce,
+		ACRValues:           req.acrValues,
+		CSRFToken:           s.csrf.Token(ctx),
+	})
+}
+
+// authorizeDecision 处理用户在授权页面上的选择
+func (s *Server) authorizeDecision(ctx *webContext.Context) {
+	req, ok := s.parseAuthorizeRequest(ctx)
+	if !ok {
+		return
+	}
+	sess, err := s.currentSession(ctx)
+	if err != nil {
+		_ = ctx.RespString(http.StatusUnauthorized, "请登录")
+		return
+	}
+	decision, _ := ctx.FormValue("decision").String()
+	if decision != "approve" {
+		s.redirectError(ctx, req, newOAuth2Error(errAccessDenied, "the resource owner denied the request"))
+		return
+	}
+	if req.requireMFA() && !sess.hasMFA() {
+		s.redirectError(ctx, req, newOAuth2Error(errAccessDenied, "multi-factor authentication is required"))
+		return
+	}
+	// parseAuthorizeRequest 已经解析过表单了，勾选框会提交多个同名的字段
+	scopes := grantedScopes(req.scopes, ctx.Request.Form["granted_scope"])
+	if len(scopes) == 0 && len(req.scopes) > 0 {
+		s.redirectError(ctx, req, newOAuth2Error(errAccessDenied, "the resource owner granted no scope"))
+		return
+	}
+	if err = s.rememberConsent(ctx.Request.Context(), sess.UserID, req.client.ID, scopes); err != nil {
+		s.redirectError(ctx, req, newOAuth2Error(errServerError, "failed to save consent"))
+		return
+	}
+	s.issueCode(ctx, req, sess, scopes)
+}
+
+// issueCode 颁发授权码并且跳转回客户端，scopes 是用户实际同意的权限
+func (s *Server) issueCode(ctx *webContext.Context, req *authorizeRequest, sess *Session, scopes []string) {
+	if err := s.trackClient(ctx.Request.Context(), sess, req.client.ID); err != nil {
+		s.redirectError(ctx, req, newOAuth2Error(errServerError, "failed to update session"))
+		return
+	}
+	code := &AuthorizationCode{
+		Code:        uuid.New().String(),
+		ClientID:    req.client.ID,
+		UserID:      sess.UserID,
+		RedirectURI: req.rawRedirectURI,
+		Scopes:      scopes,
+
+		CodeChallenge:       req.codeChallenge,
+		CodeChallengeMethod: req.codeChallengeMethod,
+		Nonce:               req.nonce,
+		AuthTime:            sess.AuthTime,
+		AMR:                 sess.AMR,
+		SID:                 sess.SID,
+		ExpiresAt:           time.Now().Add(s.codeExpiration),
+	}
+	if err := s.codes.Save(ctx.Request.Context(), code); err != nil {
+		s.redirectError(ctx, req, newOAuth2Error(errServerError, "failed to issue authorization code"))
+		return
+	}
+	query := url.Values{}
+	query.Set("code", code.Code)
+	if req.state != "" {
+		query.Set("state", req.state)
+	}
+	ctx.Redirect(appendQuery(req.redirectURI, query))
+}
+
+// parseAuthorizeRequest 校验授权请求
+// 在确认 client_id 和 redirect_uri 合法之前，不能跳转，只能直接返回错误，
+// 否则就成了一个开放重定向的漏洞
+func (s *Server) parseAuthorizeRequest(ctx *webContext.Context) (*authorizeRequest, bool) {
+	clientId, _ := ctx.FormValue("client_id").String()
+	client, err := s.activeClient(ctx.Request.Context(), clientId)
+	if err != nil {
+		_ = ctx.RespString(http.StatusBadRequest, "非法的 client_id")
+		return nil, false
+	}
+	req := &authorizeRequest{client: client}
+	req.rawRedirectURI, _ = ctx.FormValue("redirect_uri").String()
+	switch {
+	case req.rawRedirectURI != "" && matchRedirectURI(client, req.rawRedirectURI):
+		req.redirectURI = req.rawRedirectURI
+	case req.rawRedirectURI == "" && len(client.RedirectURIs) == 1 && matchRedirectURI(client, client.RedirectURIs[0]):
+		// 只注册了一个回调地址的时候，允许不传 redirect_uri
+		req.redirectURI = client.RedirectURIs[0]
+	default:
+		_ = ctx.RespString(http.StatusBadRequest, "非法的 redirect_uri")
+		return nil, false
+	}
+
+	// 从这里开始，错误都通过跳转告诉客户端
+	// RFC 6749 只是推荐带上 state，用 PKCE 或者 nonce 防 CSRF 的客户端可以不带
+	req.state, _ = ctx.FormValue("state").String()
+	req.responseType, _ = ctx.FormValue("response_type").String()
+	if req.responseType != "code" {
+		s.redirectError(ctx, req, newOAuth2Error(errUnsupportedResponseType, "only code is supported"))
+		return nil, false
+	}
+	if !client.allowGrant(GrantTypeAuthorizationCode) {
+		s.redirectError(ctx, req, newOAuth2Error(errUnauthorizedClient, "authorization code grant is not allowed"))
+		return nil, false
+	}
+	var oerr *oauth2Error
+	scope, _ := ctx.FormValue("scope").String()
+	req.scopes = parseScope(scope)
+	if !containsAll(client.Scopes, req.scopes) {
+		s.redirectError(ctx, req, newOAuth2Error(errInvalidScope, "the requested scope is not allowed"))
+		return nil, false
+	}
+	req.codeChallenge, _ = ctx.FormValue("code_challenge").String()
+	method, _ := ctx.FormValue("code_challenge_method").String()
+	req.codeChallengeMethod, oerr = parseCodeChallenge(client, req.codeChallenge, method)
+	if oerr != nil {
+		s.redirectError(ctx, req, oerr)
+		return nil, false
+	}
+	req.nonce, _ = ctx.FormValue("nonce").String()
+	req.acrValues, _ = ctx.FormValue("acr_values").String()
+	req.authParams, oerr = parseAuthParams(ctx)
+	if oerr != nil {
+		s.redirectError(ctx, req, oerr)
+		return nil, false
+	}
+	return req, true
+}
+
+// redirectError 把错误通过 redirect_uri 带回给客户端
+func (s *Server) redirectError(ctx *webContext.Context, req *authorizeRequest, e *oauth2Error) {
+	query := url.Values{}
+	query.Set("error", e.Code)
+	if e.Description != "" {
+		query.Set("error_description", e.Description)
+	}
+	if req.state != "" {
+		query.Set("state", req.state)
+	}
+	ctx.Redirect(appendQuery(req.redirectURI, query))
+}
+
+type authorizeRequest struct {
+	client       *Client
+	responseType string
+	// rawRedirectURI 请求里面带的 redirect_uri，可能为空
+	rawRedirectURI string
+	// redirectURI 实际跳转回去的地址
+	redirectURI string
+	scopes      []string
+	state       string
+
+	codeChallenge       string
+	codeChallengeMethod string
+	nonce               string
+	// acrValues 客户端要求的认证级别，空格分隔，按照偏好排序
+	acrValues string
+	authParams
+}
+
+// requireMFA 只要客户端列出了 acrMFA，就要求多因素认证
+func (req *authorizeRequest) requireMFA() bool {
+	return slices.Contains(strings.Fields(req.acrValues), acrMFA)
+}
+
+type consentPage struct {
+	ClientId     string
+	ClientName   string
+	Scopes       []scopeItem
+	Scope        string
+	ResponseType string
+	RedirectURI  string
+	State        string
+
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Nonce               string
+	ACRValues           string
+	CSRFToken           string
+}
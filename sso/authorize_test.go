@@ -0,0 +1,273 @@
+package sso
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func getWithCookies(s http.Handler, path string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for _, ck := range cookies {
+		req.AddCookie(ck)
+	}
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func authorizeQuery() url.Values {
+	return url.Values{
+		"response_type": {"code"},
+		"client_id":     {"app1"},
+		"redirect_uri":  {"http://app1.com:8081/oauth2/callback"},
+		"scope":         {"profile"},
+		"state":         {"xyz"},
+	}
+}
+
+// authorizeCode 走完授权流程，拿到授权码，申请的权限全部同意
+func authorizeCode(t *testing.T, s http.Handler, ssid *http.Cookie, query url.Values) string {
+	form := url.Values{"decision": {"approve"}}
+	for key, vals := range query {
+		form[key] = vals
+	}
+	form["granted_scope"] = parseScope(query.Get("scope"))
+	resp := postForm(s, "/authorize", form, ssid)
+	require.Equal(t, http.StatusFound, resp.Code)
+	location, err := url.Parse(resp.Header().Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, "xyz", location.Query().Get("state"))
+	code := location.Query().Get("code")
+	require.NotEmpty(t, code)
+	return code
+}
+
+func TestServer_Authorize(t *testing.T) {
+	s := newTestServer()
+	ssid := login(t, s)
+	testCases := []struct {
+		name    string
+		query   func() url.Values
+		cookies []*http.Cookie
+
+		wantCode int
+		// wantError 跳转回客户端的时候带上的错误码
+		wantError string
+	}{
+		{
+			name:     "未登录展示登录页面",
+			query:    authorizeQuery,
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "已登录展示授权页面",
+			query:    authorizeQuery,
+			cookies:  []*http.Cookie{ssid},
+			wantCode: http.StatusOK,
+		},
+		{
+			name: "未知的 client_id",
+			query: func() url.Values {
+				q := authorizeQuery()
+				q.Set("client_id", "unknown")
+				return q
+			},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name: "没有注册的 redirect_uri",
+			query: func() url.Values {
+				q := authorizeQuery()
+				q.Set("redirect_uri", "http://evil.com/oauth2/callback")
+				return q
+			},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name: "只注册了一个回调地址，可以不传 redirect_uri",
+			query: func() url.Values {
+				q := authorizeQuery()
+				q.Del("redirect_uri")
+				return q
+			},
+			wantCode: http.StatusOK,
+		},
+		{
+			name: "不支持的 response_type",
+			query: func() url.Values {
+				q := authorizeQuery()
+				q.Set("response_type", "token")
+				return q
+			},
+			wantCode:  http.StatusFound,
+			wantError: errUnsupportedResponseType,
+		},
+		{
+			name: "没有 state",
+			query: func() url.Values {
+				q := authorizeQuery()
+				q.Del("state")
+				return q
+			},
+			cookies:  []*http.Cookie{ssid},
+			wantCode: http.StatusOK,
+		},
+		{
+			name: "超出范围的 scope",
+			query: func() url.Values {
+				q := authorizeQuery()
+				q.Set("scope", "profile admin")
+				return q
+			},
+			wantCode:  http.StatusFound,
+			wantError: errInvalidScope,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := getWithCookies(s, "/authorize?"+tc.query().Encode(), tc.cookies...)
+			assert.Equal(t, tc.wantCode, resp.Code)
+			if tc.wantError == "" {
+				return
+			}
+			location, err := url.Parse(resp.Header().Get("Location"))
+			require.NoError(t, err)
+			assert.Equal(t, "app1.com:8081", location.Host)
+			assert.Equal(t, tc.wantError, location.Query().Get("error"))
+		})
+	}
+}
+
+func TestServer_AuthorizeDeny(t *testing.T) {
+	s := newTestServer()
+	ssid := login(t, s)
+	form := authorizeQuery()
+	form.Set("decision", "deny")
+	resp := postForm(s, "/authorize", form, ssid)
+	require.Equal(t, http.StatusFound, resp.Code)
+	location, err := url.Parse(resp.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, errAccessDenied, location.Query().Get("error"))
+	assert.Equal(t, "xyz", location.Query().Get("state"))
+}
+
+func TestServer_TokenAuthorizationCode(t *testing.T) {
+	s := newTestServer()
+	ssid := login(t, s)
+	code := authorizeCode(t, s, ssid, authorizeQuery())
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {"http://app1.com:8081/oauth2/callback"},
+	}
+	req := httptest.NewRequest(http.MethodPost, "/token", nil)
+	req.PostForm = form
+	req.SetBasicAuth("app1", "app1-secret")
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "no-store", resp.Header().Get("Cache-Control"))
+	var tkResp tokenResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &tkResp))
+	assert.NotEmpty(t, tkResp.AccessToken)
+	assert.Equal(t, "Bearer", tkResp.TokenType)
+	assert.Equal(t, "profile", tkResp.Scope)
+	assert.Equal(t, int64(3600), tkResp.ExpiresIn)
+
+	// 授权码只能用一次
+	form.Set("client_id", "app1")
+	form.Set("client_secret", "app1-secret")
+	resp = postForm(s, "/token", form)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assertOAuth2Error(t, resp, errInvalidGrant)
+}
+
+func TestServer_TokenWithoutRefreshGrant(t *testing.T) {
+	s := newTestServer()
+	require.NoError(t, s.clients.Save(context.Background(), &Client{
+		ID:           "app1",
+		Secret:       "app1-secret",
+		RedirectURIs: []string{"http://app1.com:8081/oauth2/callback"},
+		Scopes:       []string{"profile"},
+		GrantTypes:   []string{GrantTypeAuthorizationCode},
+	}))
+	ssid := login(t, s)
+	tkResp := exchangeCode(t, s, authorizeCode(t, s, ssid, authorizeQuery()))
+	assert.NotEmpty(t, tkResp.AccessToken)
+	// 客户端不能用 refresh token，就不给它
+	assert.Empty(t, tkResp.RefreshToken)
+}
+
+func TestServer_TokenErrors(t *testing.T) {
+	s := newTestServer()
+	ssid := login(t, s)
+	testCases := []struct {
+		name string
+		form func(code string) url.Values
+
+		wantCode  int
+		wantError string
+	}{
+		{
+			name: "密钥错误",
+			form: func(code string) url.Values {
+				return url.Values{
+					"grant_type":    {"authorization_code"},
+					"code":          {code},
+					"redirect_uri":  {"http://app1.com:8081/oauth2/callback"},
+					"client_id":     {"app1"},
+					"client_secret": {"wrong"},
+				}
+			},
+			wantCode:  http.StatusUnauthorized,
+			wantError: errInvalidClient,
+		},
+		{
+			name: "redirect_uri 不一致",
+			form: func(code string) url.Values {
+				return url.Values{
+					"grant_type":    {"authorization_code"},
+					"code":          {code},
+					"redirect_uri":  {"http://app1.com:8081/other"},
+					"client_id":     {"app1"},
+					"client_secret": {"app1-secret"},
+				}
+			},
+			wantCode:  http.StatusBadRequest,
+			wantError: errInvalidGrant,
+		},
+		{
+			name: "不支持的 grant_type",
+			form: func(code string) url.Values {
+				return url.Values{
+					"grant_type":    {"password"},
+					"client_id":     {"app1"},
+					"client_secret": {"app1-secret"},
+				}
+			},
+			wantCode:  http.StatusBadRequest,
+			wantError: errUnsupportedGrantType,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			code := authorizeCode(t, s, ssid, authorizeQuery())
+			resp := postForm(s, "/token", tc.form(code))
+			assert.Equal(t, tc.wantCode, resp.Code)
+			assertOAuth2Error(t, resp, tc.wantError)
+		})
+	}
+}
+
+func assertOAuth2Error(t *testing.T, resp *httptest.ResponseRecorder, wantError string) {
+	var oerr oauth2Error
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &oerr))
+	assert.Equal(t, wantError, oerr.Code)
+}
@@ -0,0 +1,129 @@
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"slices"
+	"strings"
+)
+
+var errMalformedSecretHash = errors.New("sso: 非法的密钥哈希")
+
+// HashSecret 计算客户端密钥的哈希，格式是 sha256$盐$哈希值
+// 客户端密钥都是随机生成的长字符串，所以加盐的 SHA-256 就足够了，不需要 bcrypt 这种慢哈希
+func HashSecret(secret string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return "sha256$" + base64.RawStdEncoding.EncodeToString(salt) + "$" +
+		base64.RawStdEncoding.EncodeToString(hashSecret(salt, secret)), nil
+}
+
+func hashSecret(salt []byte, secret string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(secret))
+	return h.Sum(nil)
+}
+
+// NewClientSecret 随机生成一个客户端密钥
+func NewClientSecret() (string, error) {
+	bs := make([]byte, 32)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bs), nil
+}
+
+// VerifySecret 校验客户端密钥，优先使用 SecretHash，没有的话再比较明文的 Secret
+func (c *Client) VerifySecret(secret string) bool {
+	if secret == "" {
+		return false
+	}
+	if c.SecretHash == "" {
+		return c.Secret != "" && subtle.ConstantTimeCompare([]byte(c.Secret), []byte(secret)) == 1
+	}
+	return verifyHash(c.SecretHash, secret)
+}
+
+// verifyHash 校验 value 和 HashSecret 计算出来的 hash 是否匹配
+func verifyHash(hash string, value string) bool {
+	salt, sum, err := parseSecretHash(hash)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(sum, hashSecret(salt, value)) == 1
+}
+
+func parseSecretHash(hash string) ([]byte, []byte, error) {
+	segs := strings.Split(hash, "$")
+	if len(segs) != 3 || segs[0] != "sha256" {
+		return nil, nil, errMalformedSecretHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(segs[1])
+	if err != nil {
+		return nil, nil, errMalformedSecretHash
+	}
+	sum, err := base64.RawStdEncoding.DecodeString(segs[2])
+	if err != nil {
+		return nil, nil, errMalformedSecretHash
+	}
+	return salt, sum, nil
+}
+
+// hashClientSecret 保存之前把明文的 Secret 换成 SecretHash，返回的是一个副本
+func hashClientSecret(c *Client) (*Client, error) {
+	cp := *c
+	if cp.Secret != "" {
+		hash, err := HashSecret(cp.Secret)
+		if err != nil {
+			return nil, err
+		}
+		cp.SecretHash = hash
+		cp.Secret = ""
+	}
+	return &cp, nil
+}
+
+// displayName 在页面上展示的名字，没有设置 Name 的时候就用 ID
+func (c *Client) displayName() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.ID
+}
+
+// activeClient 查找客户端，被禁用的客户端当成不存在
+func (s *Server) activeClient(ctx context.Context, id string) (*Client, error) {
+	client, err := s.clients.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if client.Disabled {
+		return nil, ErrClientNotFound
+	}
+	return client, nil
+}
+
+// allowGrant 判断客户端能不能使用 grantType
+func (c *Client) allowGrant(grantType string) bool {
+	if len(c.GrantTypes) == 0 {
+		return grantType == GrantTypeAuthorizationCode || grantType == GrantTypeRefreshToken
+	}
+	// 公开客户端没有办法证明自己的身份，所以不能使用客户端模式
+	if grantType == GrantTypeClientCredentials && c.Public {
+		return false
+	}
+	return slices.Contains(c.GrantTypes, grantType)
+}
+
+// ownerActive 客户端被禁用，或者用户撤销了授权之后，它的 token 也一起失效
+func (s *Server) ownerActive(ctx context.Context, tk *Token) bool {
+	_, err := s.activeClient(ctx, tk.ClientID)
+	return err == nil && s.consentActive(ctx, tk)
+}
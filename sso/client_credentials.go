@@ -0,0 +1,22 @@
+package sso
+
+import (
+	webContext "ssoauth2/web/context"
+)
+
+// exchangeClientCredentials 客户端模式，用于服务之间的调用。
+// 这时候 token 代表的是客户端自己，没有用户，也不会颁发 refresh token
+func (s *Server) exchangeClientCredentials(ctx *webContext.Context, client *Client) (*tokenResponse, *oauth2Error) {
+	scopes := client.Scopes
+	if scope, _ := ctx.FormValue("scope").String(); scope != "" {
+		scopes = parseScope(scope)
+		if !containsAll(client.Scopes, scopes) {
+			return nil, newOAuth2Error(errInvalidScope, "the requested scope is not allowed")
+		}
+	}
+	access, err := s.issueAccessToken(ctx.Request.Context(), client, "", scopes, "")
+	if err != nil {
+		return nil, newOAuth2Error(errServerError, "failed to issue access token")
+	}
+	return newTokenResponse(access, nil), nil
+}
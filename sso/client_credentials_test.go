@@ -0,0 +1,101 @@
+package sso
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestServer_ClientCredentials(t *testing.T) {
+	s := newTestServer()
+	testCases := []struct {
+		name string
+		form url.Values
+
+		wantCode  int
+		wantScope string
+		wantError string
+	}{
+		{
+			name: "默认申请所有的 scope",
+			form: url.Values{
+				"grant_type":    {GrantTypeClientCredentials},
+				"client_id":     {"billing"},
+				"client_secret": {"billing-secret"},
+			},
+			wantCode:  http.StatusOK,
+			wantScope: "orders.read orders.write",
+		},
+		{
+			name: "申请部分 scope",
+			form: url.Values{
+				"grant_type":    {GrantTypeClientCredentials},
+				"scope":         {"orders.read"},
+				"client_id":     {"billing"},
+				"client_secret": {"billing-secret"},
+			},
+			wantCode:  http.StatusOK,
+			wantScope: "orders.read",
+		},
+		{
+			name: "超出范围的 scope",
+			form: url.Values{
+				"grant_type":    {GrantTypeClientCredentials},
+				"scope":         {"orders.delete"},
+				"client_id":     {"billing"},
+				"client_secret": {"billing-secret"},
+			},
+			wantCode:  http.StatusBadRequest,
+			wantError: errInvalidScope,
+		},
+		{
+			name: "没有开通客户端模式",
+			form: url.Values{
+				"grant_type":    {GrantTypeClientCredentials},
+				"client_id":     {"app1"},
+				"client_secret": {"app1-secret"},
+			},
+			wantCode:  http.StatusBadRequest,
+			wantError: errUnauthorizedClient,
+		},
+		{
+			name: "只开通了客户端模式",
+			form: url.Values{
+				"grant_type":    {GrantTypeAuthorizationCode},
+				"code":          {"some-code"},
+				"client_id":     {"billing"},
+				"client_secret": {"billing-secret"},
+			},
+			wantCode:  http.StatusBadRequest,
+			wantError: errUnauthorizedClient,
+		},
+		{
+			name: "公开客户端",
+			form: url.Values{
+				"grant_type": {GrantTypeClientCredentials},
+				"client_id":  {"spa"},
+			},
+			wantCode:  http.StatusBadRequest,
+			wantError: errUnauthorizedClient,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := postForm(s, "/token", tc.form)
+			require.Equal(t, tc.wantCode, resp.Code)
+			if tc.wantError != "" {
+				assertOAuth2Error(t, resp, tc.wantError)
+				return
+			}
+			var tkResp tokenResponse
+			require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &tkResp))
+			assert.Equal(t, tc.wantScope, tkResp.Scope)
+			// 客户端自己配置的有效期
+			assert.Equal(t, int64(300), tkResp.ExpiresIn)
+			assert.Empty(t, tkResp.RefreshToken)
+		})
+	}
+}
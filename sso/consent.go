@@ -0,0 +1,173 @@
+package sso
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	webContext "ssoauth2/web/context"
+	"strings"
+	"time"
+)
+
+// promptConsent 客户端要求用户重新确认授权，即使以前已经同意过了
+const promptConsent = "consent"
+
+// DefaultScopeDescriptions 授权页面上展示的权限说明，没有说明的 scope 直接展示名字
+var DefaultScopeDescriptions = map[string]string{
+	ScopeOpenID:  "使用你的 SSO 账号登录",
+	ScopeProfile: "读取你的昵称",
+	ScopeEmail:   "读取你的邮箱地址",
+	ScopeGroups:  "读取你所在的用户组",
+}
+
+// listConsents 展示用户授权过的所有应用，用户可以在这里撤销授权
+func (s *Server) listConsents(ctx *webContext.Context) {
+	sess, err := s.currentSession(ctx)
+	if err != nil {
+		_ = ctx.Render("login.gohtml", loginPage{
+			Continue:  "/consents",
+			CSRFToken: s.csrf.Token(ctx),
+		})
+		return
+	}
+	reqCtx := ctx.Request.Context()
+	consents, err := s.consents.List(reqCtx, sess.UserID)
+	if err != nil {
+		_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+		return
+	}
+	page := consentListPage{CSRFToken: s.csrf.Token(ctx)}
+	for _, c := range consents {
+		name := c.ClientID
+		// 客户端被删除之后，授权记录还在，依旧允许用户撤销
+		if client, err := s.clients.Get(reqCtx, c.ClientID); err == nil {
+			name = client.displayName()
+		}
+		page.Apps = append(page.Apps, consentItem{
+			ClientID:   c.ClientID,
+			ClientName: name,
+			Scopes:     s.describeScopes(c.Scopes),
+			GrantedAt:  c.UpdatedAt.Format(time.DateTime),
+		})
+	}
+	_ = ctx.Render("consents.gohtml", page)
+}
+
+// revokeConsent 撤销用户对一个应用的授权，之前颁发的 token 也一起失效
+func (s *Server) revokeConsent(ctx *webContext.Context) {
+	sess, err := s.currentSession(ctx)
+	if err != nil {
+		_ = ctx.RespString(http.StatusUnauthorized, "请登录")
+		return
+	}
+	clientID, _ := ctx.FormValue("client_id").String()
+	err = s.consents.Delete(ctx.Request.Context(), sess.UserID, clientID)
+	if err != nil && !errors.Is(err, ErrConsentNotFound) {
+		_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+		return
+	}
+	ctx.Redirect("/consents")
+}
+
+// consented 用户以前已经同意过这些权限了，不需要再确认
+func (s *Server) consented(ctx context.Context, req *authorizeRequest, sess *Session) bool {
+	if req.hasPrompt(promptConsent) {
+		return false
+	}
+	c, err := s.consents.Get(ctx, sess.UserID, req.client.ID)
+	return err == nil && containsAll(c.Scopes, req.scopes)
+}
+
+// rememberConsent 记住用户同意过的权限，和以前同意过的合并在一起
+func (s *Server) rememberConsent(ctx context.Context, userID string, clientID string, scopes []string) error {
+	now := time.Now()
+	c, err := s.consents.Get(ctx, userID, clientID)
+	switch {
+	case errors.Is(err, ErrConsentNotFound):
+		c = &Consent{UserID: userID, ClientID: clientID, CreatedAt: now}
+	case err != nil:
+		return err
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(c.Scopes, scope) {
+			c.Scopes = append(c.Scopes, scope)
+		}
+	}
+	c.UpdatedAt = now
+	return s.consents.Save(ctx, c)
+}
+
+// consentActive 用户撤销授权之后，之前颁发的 token 都不能再用了
+// 只有授权码模式颁发的 token 才有家族，client_credentials 和老的 check_login 流程都不需要用户授权
+// JWT 格式的 access token 离线校验是感知不到的，只能等它过期
+func (s *Server) consentActive(ctx context.Context, tk *Token) bool {
+	if tk.UserID == "" || tk.FamilyID == "" {
+		return true
+	}
+	c, err := s.consents.Get(ctx, tk.UserID, tk.ClientID)
+	return err == nil && !tk.IssuedAt.Before(c.CreatedAt)
+}
+
+// describeScopes 把 scope 转换成授权页面上展示的说明
+func (s *Server) describeScopes(scopes []string) []scopeItem {
+	res := make([]scopeItem, 0, len(scopes))
+	for _, scope := range scopes {
+		desc, ok := s.scopeDescriptions[scope]
+		if !ok {
+			desc = scope
+		}
+		res = append(res, scopeItem{
+			Name:        scope,
+			Description: desc,
+			// 不给 openid 就没有办法登录，所以不能取消
+			Required: scope == ScopeOpenID,
+		})
+	}
+	return res
+}
+
+// grantedScopes 用户可以只同意一部分权限，但是不能超出请求的范围
+func grantedScopes(requested []string, granted []string) []string {
+	res := make([]string, 0, len(requested))
+	for _, scope := range requested {
+		if scope == ScopeOpenID || slices.Contains(granted, scope) {
+			res = append(res, scope)
+		}
+	}
+	return res
+}
+
+func consentKey(userID string, clientID string) string {
+	return userID + "\x00" + clientID
+}
+
+func sortConsents(consents []*Consent) {
+	slices.SortFunc(consents, func(a, b *Consent) int {
+		return strings.Compare(a.ClientID, b.ClientID)
+	})
+}
+
+func (c *Consent) clone() *Consent {
+	cp := *c
+	cp.Scopes = slices.Clone(c.Scopes)
+	return &cp
+}
+
+type scopeItem struct {
+	Name        string
+	Description string
+	Required    bool
+}
+
+type consentListPage struct {
+	Apps      []consentItem
+	CSRFToken string
+}
+
+type consentItem struct {
+	ClientID   string
+	ClientName string
+	Scopes     []scopeItem
+	GrantedAt  string
+}
@@ -0,0 +1,109 @@
+package sso
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// decide 在授权页面上提交，granted 是用户勾选的权限
+func decide(t *testing.T, s http.Handler, ssid *http.Cookie, query url.Values, granted ...string) *url.URL {
+	form := url.Values{"decision": {"approve"}, "granted_scope": granted}
+	for key, vals := range query {
+		form[key] = vals
+	}
+	resp := postForm(s, "/authorize", form, ssid)
+	require.Equal(t, http.StatusFound, resp.Code)
+	location, err := url.Parse(resp.Header().Get("Location"))
+	require.NoError(t, err)
+	return location
+}
+
+func TestServer_Consent(t *testing.T) {
+	s := newTestServer()
+	ssid := login(t, s)
+	query := authorizeQuery()
+	query.Set("scope", "openid profile email")
+
+	resp := getWithCookies(s, "/authorize?"+query.Encode(), ssid)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), DefaultScopeDescriptions[ScopeEmail])
+	assert.Contains(t, resp.Body.String(), `name="granted_scope" type="checkbox" value="profile" checked`)
+	assert.NotContains(t, resp.Body.String(), `value="openid" checked`)
+
+	// 只同意了一部分，openid 是必须的
+	location := decide(t, s, ssid, query, "profile", "groups")
+	code, err := s.codes.Take(context.Background(), location.Query().Get("code"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"openid", "profile"}, code.Scopes)
+	c, err := s.consents.Get(context.Background(), "123", "app1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"openid", "profile"}, c.Scopes)
+
+	// 同意过的权限不用再确认了
+	query.Set("scope", "openid profile")
+	resp = getWithCookies(s, "/authorize?"+query.Encode(), ssid)
+	require.Equal(t, http.StatusFound, resp.Code)
+	assert.Contains(t, resp.Header().Get("Location"), "code=")
+	// 除非客户端要求重新确认
+	query.Set("prompt", "consent")
+	resp = getWithCookies(s, "/authorize?"+query.Encode(), ssid)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	query.Del("prompt")
+	// 申请了新的权限，也要确认
+	query.Set("scope", "openid email")
+	resp = getWithCookies(s, "/authorize?"+query.Encode(), ssid)
+	require.Equal(t, http.StatusOK, resp.Code)
+	decide(t, s, ssid, query, "email")
+	c, err = s.consents.Get(context.Background(), "123", "app1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"openid", "profile", "email"}, c.Scopes)
+
+	// 什么都没有同意
+	query.Set("scope", "profile")
+	location = decide(t, s, ssid, query)
+	assert.Equal(t, errAccessDenied, location.Query().Get("error"))
+}
+
+func TestServer_RevokeConsent(t *testing.T) {
+	s := newTestServer()
+	tkResp := issueTestTokens(t, s)
+	ssid := login(t, s)
+
+	resp := getWithCookies(s, "/consents", ssid)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), `name="client_id" type="hidden" value="app1"`)
+	assert.Contains(t, resp.Body.String(), DefaultScopeDescriptions[ScopeProfile])
+
+	resp = postForm(s, "/consents/revoke", url.Values{"client_id": {"app1"}}, ssid)
+	require.Equal(t, http.StatusFound, resp.Code)
+	assert.Equal(t, "/consents", resp.Header().Get("Location"))
+	resp = getWithCookies(s, "/consents", ssid)
+	assert.NotContains(t, resp.Body.String(), `value="app1"`)
+
+	// 之前颁发的 token 都不能再用了
+	resp = postForm(s, "/token", refreshForm(tkResp.RefreshToken))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	resp = postForm(s, "/introspect", url.Values{
+		"token":         {tkResp.AccessToken},
+		"client_id":     {"app1"},
+		"client_secret": {"app1-secret"},
+	})
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), `"active":false`)
+
+	// 重新授权之后，老的 token 也不会复活
+	query := authorizeQuery()
+	resp = getWithCookies(s, "/authorize?"+query.Encode(), ssid)
+	require.Equal(t, http.StatusOK, resp.Code)
+	decide(t, s, ssid, query, "profile")
+	resp = postForm(s, "/token", refreshForm(tkResp.RefreshToken))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	// 没有登录
+	resp = getWithCookies(s, "/consents")
+	assert.Contains(t, resp.Body.String(), `action="/login"`)
+}
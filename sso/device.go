@@ -0,0 +1,344 @@
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"github.com/google/uuid"
+	"math"
+	"net/http"
+	"slices"
+	webContext "ssoauth2/web/context"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// userCodeCharset 没有元音，避免拼出单词，也没有 0 和 O 这种容易混淆的字符
+	userCodeCharset = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength  = 8
+	// devicePollInterval 设备轮询的默认间隔，轮询太快的时候每次增加这么多
+	devicePollInterval = time.Second * 5
+)
+
+// deviceAuthorization 是 RFC 8628 的设备授权接口，设备拿到 user code 之后展示给用户
+func (s *Server) deviceAuthorization(ctx *webContext.Context) {
+	client, oerr := s.authenticateClient(ctx)
+	if oerr != nil {
+		respOAuth2Error(ctx, oerr)
+		return
+	}
+	if !client.allowGrant(GrantTypeDeviceCode) {
+		respOAuth2Error(ctx, newOAuth2Error(errUnauthorizedClient, "device code grant is not allowed for this client"))
+		return
+	}
+	scope, _ := ctx.FormValue("scope").String()
+	scopes := parseScope(scope)
+	if !containsAll(client.Scopes, scopes) {
+		respOAuth2Error(ctx, newOAuth2Error(errInvalidScope, "the requested scope is not allowed"))
+		return
+	}
+	reqCtx := ctx.Request.Context()
+	userCode, err := s.newUserCode(reqCtx)
+	if err != nil {
+		respOAuth2Error(ctx, newOAuth2Error(errServerError, "failed to generate user code"))
+		return
+	}
+	d := &DeviceAuthorization{
+		DeviceCode: uuid.New().String(),
+		UserCode:   userCode,
+		ClientID:   client.ID,
+		Scopes:     scopes,
+		Status:     DeviceAuthorizationPending,
+		Interval:   devicePollInterval,
+		ExpiresAt:  time.Now().Add(s.deviceCodeExpiration),
+	}
+	if err = s.devices.Save(reqCtx, d); err != nil {
+		respOAuth2Error(ctx, newOAuth2Error(errServerError, "failed to save device authorization"))
+		return
+	}
+	verificationURI := strings.TrimSuffix(s.issuer, "/") + "/device"
+	respOAuth2JSON(ctx, http.StatusOK, deviceAuthorizationResponse{
+		DeviceCode:              d.DeviceCode,
+		UserCode:                formatUserCode(userCode),
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?user_code=" + formatUserCode(userCode),
+		ExpiresIn:               int64(s.deviceCodeExpiration / time.Second),
+		Interval:                int64(devicePollInterval / time.Second),
+	})
+}
+
+// device 用户输入 user code 的页面，
+// 扫码之类带着 user_code 过来的，直接展示授权页面
+func (s *Server) device(ctx *webContext.Context) {
+	sess, err := s.currentSession(ctx)
+	if err != nil {
+		_ = ctx.Render("login.gohtml", loginPage{
+			Continue:  "/device?" + ctx.Request.URL.RawQuery,
+			CSRFToken: s.csrf.Token(ctx),
+		})
+		return
+	}
+	userCode, _ := ctx.FormValue("user_code").String()
+	if userCode == "" {
+		_ = ctx.Render("device.gohtml", devicePage{})
+		return
+	}
+	d, client, ok := s.lookupDevice(ctx, sess, userCode)
+	if !ok {
+		return
+	}
+	_ = ctx.Render("device_confirm.gohtml", deviceConfirmPage{
+		ClientName: client.displayName(),
+		Scopes:     s.describeScopes(d.Scopes),
+		UserCode:   formatUserCode(d.UserCode),
+		CSRFToken:  s.csrf.Token(ctx),
+	})
+}
+
+// deviceDecision 处理用户在设备授权页面上的选择，设备下一次轮询的时候就能拿到结果
+func (s *Server) deviceDecision(ctx *webContext.Context) {
+	sess, err := s.currentSession(ctx)
+	if err != nil {
+		_ = ctx.RespString(http.StatusUnauthorized, "请登录")
+		return
+	}
+	userCode, _ := ctx.FormValue("user_code").String()
+	reqCtx := ctx.Request.Context()
+	d, client, ok := s.lookupDevice(ctx, sess, userCode)
+	if !ok {
+		return
+	}
+	decision, _ := ctx.FormValue("decision").String()
+	// FormValue 已经解析过表单了，勾选框会提交多个同名的字段
+	scopes := grantedScopes(d.Scopes, ctx.Request.Form["granted_scope"])
+	d.Status = DeviceAuthorizationDenied
+	if decision == "approve" && (len(scopes) > 0 || len(d.Scopes) == 0) {
+		d.Status = DeviceAuthorizationApproved
+		d.Scopes = scopes
+		d.UserID = sess.UserID
+		d.AuthTime = sess.AuthTime
+		d.AMR = sess.AMR
+		d.SID = sess.SID
+	}
+	// 只更新批准的结果，不能用 Save，否则会覆盖掉设备同时轮询更新的 Interval
+	if err = s.devices.Decide(reqCtx, d); err != nil {
+		s.renderDeviceError(ctx, err)
+		return
+	}
+	msg := "已拒绝授权"
+	if d.Status == DeviceAuthorizationApproved {
+		// 批准的结果保存成功之后才记住同意，否则授权没有发生，同意却留下来了
+		if err = s.rememberConsent(reqCtx, sess.UserID, client.ID, scopes); err != nil {
+			_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+			return
+		}
+		if err = s.trackClient(reqCtx, sess, client.ID); err != nil {
+			_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+			return
+		}
+		msg = "授权成功，请回到设备上继续操作"
+	}
+	_ = ctx.Render("device.gohtml", devicePage{Message: msg})
+}
+
+// exchangeDeviceCode 设备轮询 token 接口，
+// 用户还没有批准的时候返回 authorization_pending，轮询太快的时候返回 slow_down
+func (s *Server) exchangeDeviceCode(ctx *webContext.Context, client *Client) (*tokenResponse, *oauth2Error) {
+	deviceCode, _ := ctx.FormValue("device_code").String()
+	if deviceCode == "" {
+		return nil, newOAuth2Error(errInvalidRequest, "device_code is required")
+	}
+	reqCtx := ctx.Request.Context()
+	d, err := s.devices.Get(reqCtx, deviceCode)
+	if errors.Is(err, ErrDeviceCodeNotFound) {
+		return nil, newOAuth2Error(errInvalidGrant, "invalid device code")
+	}
+	if err != nil {
+		return nil, newOAuth2Error(errServerError, "failed to load device authorization")
+	}
+	if d.ClientID != client.ID {
+		return nil, newOAuth2Error(errInvalidGrant, "device code was issued to another client")
+	}
+	now := time.Now()
+	if now.After(d.ExpiresAt) {
+		return nil, newOAuth2Error(errExpiredToken, "the device code has expired")
+	}
+	switch d.Status {
+	case DeviceAuthorizationPending:
+		oerr := newOAuth2Error(errAuthorizationPending, "the user has not yet approved the request")
+		interval := d.Interval
+		if !d.LastPolledAt.IsZero() && now.Sub(d.LastPolledAt) < d.Interval {
+			interval += devicePollInterval
+			oerr = newOAuth2Error(errSlowDown, "polling too frequently")
+		}
+		if err = s.devices.Poll(reqCtx, deviceCode, now, interval); err != nil {
+			return nil, newOAuth2Error(errServerError, "failed to update device authorization")
+		}
+		return nil, oerr
+	case DeviceAuthorizationDenied:
+		_, _ = s.devices.Take(reqCtx, deviceCode)
+		return nil, newOAuth2Error(errAccessDenied, "the user denied the request")
+	}
+
+	// 并发轮询的时候，只有一个请求能拿到 token
+	d, err = s.devices.Take(reqCtx, deviceCode)
+	if err != nil || d.Status != DeviceAuthorizationApproved {
+		return nil, newOAuth2Error(errInvalidGrant, "invalid device code")
+	}
+	familyID := uuid.New().String()
+	access, err := s.issueAccessToken(reqCtx, client, d.UserID, d.Scopes, familyID)
+	if err != nil {
+		return nil, newOAuth2Error(errServerError, "failed to issue access token")
+	}
+	// 不允许使用 refresh token 的客户端，给了它也换不了 token
+	var refresh *Token
+	if client.allowGrant(GrantTypeRefreshToken) {
+		refresh, err = s.issueRefreshToken(reqCtx, client, d.UserID, d.Scopes, familyID)
+		if err != nil {
+			return nil, newOAuth2Error(errServerError, "failed to issue refresh token")
+		}
+	}
+	resp := newTokenResponse(access, refresh)
+	if slices.Contains(d.Scopes, ScopeOpenID) {
+		resp.IDToken, err = s.issueIDToken(reqCtx, client, &AuthorizationCode{
+			UserID:   d.UserID,
+			AuthTime: d.AuthTime,
+			AMR:      d.AMR,
+			SID:      d.SID,
+		})
+		if err != nil {
+			return nil, newOAuth2Error(errServerError, "failed to issue id token")
+		}
+	}
+	return resp, nil
+}
+
+// lookupDevice 查找用户输入的 user code，失败次数过多的时候直接拒绝
+// 处理失败的时候已经写好了响应，返回 false
+func (s *Server) lookupDevice(ctx *webContext.Context, sess *Session,
+	userCode string) (*DeviceAuthorization, *Client, bool) {
+	reqCtx := ctx.Request.Context()
+	status, err := s.limiter.checkUserCode(reqCtx, sess.UserID, ctx.Request)
+	if err != nil {
+		_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+		return nil, nil, false
+	}
+	if status.retryAfter > 0 {
+		seconds := int(math.Ceil(status.retryAfter.Seconds()))
+		ctx.Response.Header().Set("Retry-After", strconv.Itoa(seconds))
+		_ = ctx.RespString(http.StatusTooManyRequests, "验证码错误次数过多，请稍后再试")
+		return nil, nil, false
+	}
+	d, client, err := s.pendingDevice(reqCtx, userCode)
+	if errors.Is(err, ErrDeviceCodeNotFound) {
+		_, err = s.limiter.failUserCode(reqCtx, sess.UserID, ctx.Request)
+		if err == nil {
+			err = ErrDeviceCodeNotFound
+		}
+	}
+	if err != nil {
+		s.renderDeviceError(ctx, err)
+		return nil, nil, false
+	}
+	return d, client, true
+}
+
+// pendingDevice 找到用户输入的 user code 对应的、还在等待批准的设备授权
+func (s *Server) pendingDevice(ctx context.Context, userCode string) (*DeviceAuthorization, *Client, error) {
+	d, err := s.devices.GetByUserCode(ctx, normalizeUserCode(userCode))
+	if err != nil {
+		return nil, nil, err
+	}
+	// 已经处理过的不能再改，过期了的 store 可能还没来得及清理
+	if d.Status != DeviceAuthorizationPending || time.Now().After(d.ExpiresAt) {
+		return nil, nil, ErrDeviceCodeNotFound
+	}
+	client, err := s.activeClient(ctx, d.ClientID)
+	if err != nil {
+		return nil, nil, ErrDeviceCodeNotFound
+	}
+	return d, client, nil
+}
+
+func (s *Server) renderDeviceError(ctx *webContext.Context, err error) {
+	if !errors.Is(err, ErrDeviceCodeNotFound) {
+		_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+		return
+	}
+	if ctx.Render("device.gohtml", devicePage{Error: "验证码错误或者已经过期"}) == nil {
+		ctx.RespStatusCode = http.StatusBadRequest
+	}
+}
+
+// newUserCode 生成一个还没有被使用的 user code
+func (s *Server) newUserCode(ctx context.Context) (string, error) {
+	// 8 位的空间有 20^8，冲突的概率很低，重试几次就够了
+	for i := 0; i < 3; i++ {
+		bs := make([]byte, userCodeLength)
+		if _, err := rand.Read(bs); err != nil {
+			return "", err
+		}
+		for j, b := range bs {
+			// 256 不是 20 的倍数，会有一点点偏差，但是不影响猜中的难度
+			bs[j] = userCodeCharset[int(b)%len(userCodeCharset)]
+		}
+		code := string(bs)
+		_, err := s.devices.GetByUserCode(ctx, code)
+		if errors.Is(err, ErrDeviceCodeNotFound) {
+			return code, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", errors.New("sso: 生成 user code 失败")
+}
+
+// formatUserCode 中间加上分隔符，方便用户阅读，例如 BCDF-GHJK
+func formatUserCode(code string) string {
+	if len(code) != userCodeLength {
+		return code
+	}
+	return code[:userCodeLength/2] + "-" + code[userCodeLength/2:]
+}
+
+// normalizeUserCode 用户输入的时候可能是小写，也可能带着分隔符和空格
+func normalizeUserCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(code))
+}
+
+func (d *DeviceAuthorization) clone() *DeviceAuthorization {
+	cp := *d
+	cp.Scopes = slices.Clone(d.Scopes)
+	cp.AMR = slices.Clone(d.AMR)
+	return &cp
+}
+
+type deviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+type devicePage struct {
+	// Message 用户处理完之后的提示
+	Message string
+	Error   string
+}
+
+type deviceConfirmPage struct {
+	ClientName string
+	Scopes     []scopeItem
+	UserCode   string
+	CSRFToken  string
+}
@@ -0,0 +1,280 @@
+package sso
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startDeviceAuthorization 模拟设备发起授权
+func startDeviceAuthorization(t *testing.T, s http.Handler, scope string) deviceAuthorizationResponse {
+	resp := postForm(s, "/device_authorization", url.Values{
+		"client_id": {"cli"},
+		"scope":     {scope},
+	})
+	require.Equal(t, http.StatusOK, resp.Code)
+	var res deviceAuthorizationResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &res))
+	return res
+}
+
+func pollDeviceToken(s http.Handler, deviceCode string) *httptest.ResponseRecorder {
+	return postForm(s, "/token", url.Values{
+		"grant_type":  {GrantTypeDeviceCode},
+		"device_code": {deviceCode},
+		"client_id":   {"cli"},
+	})
+}
+
+// allowNextPoll 把上一次轮询的时间往前挪，避免测试里面真的等待
+func allowNextPoll(t *testing.T, s *Server, deviceCode string) {
+	d, err := s.devices.Get(context.Background(), deviceCode)
+	require.NoError(t, err)
+	require.NoError(t, s.devices.Poll(context.Background(), deviceCode, time.Now().Add(-d.Interval), d.Interval))
+}
+
+func TestServer_DeviceAuthorization(t *testing.T) {
+	s := newTestServer()
+	res := startDeviceAuthorization(t, s, "openid profile")
+	assert.Regexp(t, `^[A-Z]{4}-[A-Z]{4}$`, res.UserCode)
+	assert.Equal(t, "http://sso.com:8083/device", res.VerificationURI)
+	assert.Equal(t, "http://sso.com:8083/device?user_code="+res.UserCode, res.VerificationURIComplete)
+	assert.Equal(t, int64(600), res.ExpiresIn)
+	assert.Equal(t, int64(5), res.Interval)
+
+	// 用户还没有批准
+	resp := pollDeviceToken(s, res.DeviceCode)
+	assertOAuth2Error(t, resp, errAuthorizationPending)
+	// 轮询太快了，间隔增加 5 秒
+	resp = pollDeviceToken(s, res.DeviceCode)
+	assertOAuth2Error(t, resp, errSlowDown)
+	d, err := s.devices.Get(context.Background(), res.DeviceCode)
+	require.NoError(t, err)
+	assert.Equal(t, time.Second*10, d.Interval)
+
+	// 没有登录的时候先去登录
+	resp = getWithCookies(s, "/device")
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), `name="continue" type="hidden" value="/device?"`)
+
+	ssid := login(t, s)
+	resp = getWithCookies(s, "/device", ssid)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), `name="user_code"`)
+	// 输入的时候不区分大小写，也可以不带分隔符
+	resp = getWithCookies(s, "/device?user_code="+url.QueryEscape(" "+strings.ToLower(strings.ReplaceAll(res.UserCode, "-", ""))), ssid)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), res.UserCode)
+	assert.Contains(t, resp.Body.String(), DefaultScopeDescriptions[ScopeProfile])
+	resp = getWithCookies(s, "/device?user_code=BBBB-BBBB", ssid)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	resp = postForm(s, "/device", url.Values{
+		"user_code":     {res.UserCode},
+		"decision":      {"approve"},
+		"granted_scope": {"profile"},
+	}, ssid)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), "授权成功")
+	// 已经批准过了，不能再改
+	resp = postForm(s, "/device", url.Values{"user_code": {res.UserCode}, "decision": {"deny"}}, ssid)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	allowNextPoll(t, s, res.DeviceCode)
+	resp = pollDeviceToken(s, res.DeviceCode)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var tkResp tokenResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &tkResp))
+	assert.NotEmpty(t, tkResp.AccessToken)
+	assert.NotEmpty(t, tkResp.RefreshToken)
+	assert.NotEmpty(t, tkResp.IDToken)
+	assert.Equal(t, "openid profile", tkResp.Scope)
+	tk, err := s.tokens.Get(context.Background(), tkResp.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, "123", tk.UserID)
+
+	// device code 只能换一次
+	resp = pollDeviceToken(s, res.DeviceCode)
+	assertOAuth2Error(t, resp, errInvalidGrant)
+}
+
+func TestServer_DeviceAuthorizationWithoutRefreshGrant(t *testing.T) {
+	s := newTestServer()
+	require.NoError(t, s.clients.Save(context.Background(), &Client{
+		ID:         "cli",
+		Scopes:     []string{"profile"},
+		GrantTypes: []string{GrantTypeDeviceCode},
+		Public:     true,
+	}))
+	res := startDeviceAuthorization(t, s, "profile")
+	ssid := login(t, s)
+	resp := postForm(s, "/device", url.Values{
+		"user_code":     {res.UserCode},
+		"decision":      {"approve"},
+		"granted_scope": {"profile"},
+	}, ssid)
+	require.Equal(t, http.StatusOK, resp.Code)
+	resp = pollDeviceToken(s, res.DeviceCode)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var tkResp tokenResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &tkResp))
+	assert.NotEmpty(t, tkResp.AccessToken)
+	assert.Empty(t, tkResp.RefreshToken)
+}
+
+func TestServer_DeviceAuthorizationDeny(t *testing.T) {
+	s := newTestServer()
+	res := startDeviceAuthorization(t, s, "profile")
+	ssid := login(t, s)
+	resp := postForm(s, "/device", url.Values{"user_code": {res.UserCode}, "decision": {"deny"}}, ssid)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), "已拒绝授权")
+
+	resp = pollDeviceToken(s, res.DeviceCode)
+	assertOAuth2Error(t, resp, errAccessDenied)
+	resp = pollDeviceToken(s, res.DeviceCode)
+	assertOAuth2Error(t, resp, errInvalidGrant)
+}
+
+// racingDeviceCodeStore 模拟另一个请求抢先处理了同一个设备授权
+type racingDeviceCodeStore struct {
+	*MemoryDeviceCodeStore
+}
+
+func (racingDeviceCodeStore) Decide(ctx context.Context, d *DeviceAuthorization) error {
+	return ErrDeviceCodeNotFound
+}
+
+func TestServer_DeviceDecideFailed(t *testing.T) {
+	s := newTestServer(ServerWithDeviceCodeStore(racingDeviceCodeStore{NewMemoryDeviceCodeStore()}))
+	res := startDeviceAuthorization(t, s, "profile")
+	ssid := login(t, s)
+	resp := postForm(s, "/device", url.Values{
+		"user_code":     {res.UserCode},
+		"decision":      {"approve"},
+		"granted_scope": {"profile"},
+	}, ssid)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	// 授权没有发生，不能留下同意的记录
+	_, err := s.consents.Get(context.Background(), "123", "cli")
+	assert.ErrorIs(t, err, ErrConsentNotFound)
+}
+
+func TestServer_DeviceUserCodeLimit(t *testing.T) {
+	s := newTestServer()
+	res := startDeviceAuthorization(t, s, "profile")
+	ssid := login(t, s)
+	for i := 0; i <= DefaultAccountPolicy.FreeAttempts; i++ {
+		resp := getWithCookies(s, "/device?user_code=BBBB-BBBB", ssid)
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+	}
+	// 猜错太多次之后，正确的 user code 也要等待
+	resp := getWithCookies(s, "/device?user_code="+res.UserCode, ssid)
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.NotEmpty(t, resp.Header().Get("Retry-After"))
+	resp = postForm(s, "/device", url.Values{"user_code": {res.UserCode}, "decision": {"approve"}}, ssid)
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+
+	// 不影响账号本身的登录
+	login(t, s)
+}
+
+func TestServer_DeviceAuthorizationErrors(t *testing.T) {
+	s := newTestServer()
+	testCases := []struct {
+		name      string
+		form      url.Values
+		wantError string
+	}{
+		{
+			name:      "grant not allowed",
+			form:      url.Values{"client_id": {"spa"}},
+			wantError: errUnauthorizedClient,
+		},
+		{
+			name:      "invalid scope",
+			form:      url.Values{"client_id": {"cli"}, "scope": {"email"}},
+			wantError: errInvalidScope,
+		},
+		{
+			name:      "unknown client",
+			form:      url.Values{"client_id": {"unknown"}},
+			wantError: errInvalidClient,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := postForm(s, "/device_authorization", tc.form)
+			assertOAuth2Error(t, resp, tc.wantError)
+		})
+	}
+
+	// 别的客户端不能拿这个 device code 换 token
+	res := startDeviceAuthorization(t, s, "profile")
+	resp := postForm(s, "/token", url.Values{
+		"grant_type":    {GrantTypeDeviceCode},
+		"device_code":   {res.DeviceCode},
+		"client_id":     {"app1"},
+		"client_secret": {"app1-secret"},
+	})
+	assertOAuth2Error(t, resp, errUnauthorizedClient)
+
+	// 过期了
+	d, err := s.devices.Get(context.Background(), res.DeviceCode)
+	require.NoError(t, err)
+	d.ExpiresAt = time.Now().Add(-time.Second)
+	require.NoError(t, s.devices.Save(context.Background(), d))
+	resp = pollDeviceToken(s, res.DeviceCode)
+	assertOAuth2Error(t, resp, errExpiredToken)
+	// 用户也不能再批准了
+	resp = getWithCookies(s, "/device?user_code="+res.UserCode, login(t, s))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestMemoryDeviceCodeStore(t *testing.T) {
+	store := NewMemoryDeviceCodeStore()
+	ctx := context.Background()
+	d := &DeviceAuthorization{
+		DeviceCode: "device",
+		UserCode:   "BCDFGHJK",
+		Status:     DeviceAuthorizationPending,
+		ExpiresAt:  time.Now().Add(time.Minute),
+	}
+	require.NoError(t, store.Save(ctx, d))
+	got, err := store.GetByUserCode(ctx, "BCDFGHJK")
+	require.NoError(t, err)
+	assert.Equal(t, "device", got.DeviceCode)
+
+	// 轮询和批准互相不会覆盖
+	require.NoError(t, store.Poll(ctx, "device", time.Now(), time.Second*10))
+	require.NoError(t, store.Decide(ctx, &DeviceAuthorization{
+		DeviceCode: "device",
+		Status:     DeviceAuthorizationApproved,
+		UserID:     "123",
+	}))
+	require.NoError(t, store.Poll(ctx, "device", time.Now(), time.Second*15))
+	// 已经处理过的不能再改
+	assert.ErrorIs(t, store.Decide(ctx, &DeviceAuthorization{
+		DeviceCode: "device",
+		Status:     DeviceAuthorizationDenied,
+	}), ErrDeviceCodeNotFound)
+	got, err = store.Take(ctx, "device")
+	require.NoError(t, err)
+	assert.Equal(t, DeviceAuthorizationApproved, got.Status)
+	assert.Equal(t, "123", got.UserID)
+	assert.Equal(t, time.Second*15, got.Interval)
+
+	_, err = store.Get(ctx, "device")
+	assert.ErrorIs(t, err, ErrDeviceCodeNotFound)
+	_, err = store.GetByUserCode(ctx, "BCDFGHJK")
+	assert.ErrorIs(t, err, ErrDeviceCodeNotFound)
+	assert.ErrorIs(t, store.Poll(ctx, "device", time.Now(), time.Second), ErrDeviceCodeNotFound)
+	assert.ErrorIs(t, store.Decide(ctx, d), ErrDeviceCodeNotFound)
+}
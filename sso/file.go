@@ -0,0 +1,545 @@
+package sso
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+func (s *FileClientStore) Get(ctx context.Context, id string) (*Client, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	c, ok := s.clients[id]
+	if !ok {
+		return nil, ErrClientNotFound
+	}
+	cp := *c
+	return &cp, nil
+}
+
+func (s *FileClientStore) List(ctx context.Context) ([]*Client, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	res := make([]*Client, 0, len(s.clients))
+	for _, c := range s.clients {
+		cp := *c
+		res = append(res, &cp)
+	}
+	slices.SortFunc(res, func(a, b *Client) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return res, nil
+}
+
+// Save 每次都把所有的客户端重新写一遍，客户端的数量不多，而且很少修改
+func (s *FileClientStore) Save(ctx context.Context, c *Client) error {
+	c, err := hashClientSecret(c)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	clients := make(map[string]*Client, len(s.clients)+1)
+	for id, old := range s.clients {
+		clients[id] = old
+	}
+	clients[c.ID] = c
+	if err = s.flush(clients); err != nil {
+		return err
+	}
+	s.clients = clients
+	return nil
+}
+
+func (s *FileClientStore) Delete(ctx context.Context, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.clients[id]; !ok {
+		return ErrClientNotFound
+	}
+	clients := make(map[string]*Client, len(s.clients))
+	for key, c := range s.clients {
+		if key != id {
+			clients[key] = c
+		}
+	}
+	if err := s.flush(clients); err != nil {
+		return err
+	}
+	s.clients = clients
+	return nil
+}
+
+func (s *FileClientStore) flush(clients map[string]*Client) error {
+	records := make([]clientRecord, 0, len(clients))
+	for _, c := range clients {
+		records = append(records, newClientRecord(c))
+	}
+	slices.SortFunc(records, func(a, b clientRecord) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// NewFileClientStore 把客户端保存在 path 这个 JSON 文件里面，文件不存在的时候会自动创建
+// 密钥只会以哈希的形式保存
+func NewFileClientStore(path string) (*FileClientStore, error) {
+	s := &FileClientStore{path: path, clients: map[string]*Client{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []clientRecord
+	if err = json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		s.clients[r.ID] = r.client()
+	}
+	return s, nil
+}
+
+type FileClientStore struct {
+	path    string
+	mutex   sync.RWMutex
+	clients map[string]*Client
+}
+
+// clientRecord 是客户端在文件里面的格式，有效期都以秒为单位
+type clientRecord struct {
+	ID                     string   `json:"client_id"`
+	Name                   string   `json:"client_name,omitempty"`
+	SecretHash             string   `json:"client_secret_hash,omitempty"`
+	RedirectURIs           []string `json:"redirect_uris,omitempty"`
+	Scopes                 []string `json:"scopes,omitempty"`
+	Public                 bool     `json:"public,omitempty"`
+	RequirePKCE            bool     `json:"require_pkce,omitempty"`
+	GrantTypes             []string `json:"grant_types,omitempty"`
+	AccessTokenExpiration  int64    `json:"access_token_expires_in,omitempty"`
+	RefreshTokenExpiration int64    `json:"refresh_token_expires_in,omitempty"`
+	AccessTokenFormat      string   `json:"access_token_format,omitempty"`
+	AuthMethod             string   `json:"token_endpoint_auth_method,omitempty"`
+	RegistrationTokenHash  string   `json:"registration_access_token_hash,omitempty"`
+	Disabled               bool     `json:"disabled,omitempty"`
+	BackchannelLogoutURI   string   `json:"backchannel_logout_uri,omitempty"`
+	FrontchannelLogoutURI  string   `json:"frontchannel_logout_uri,omitempty"`
+	PostLogoutRedirectURIs []string `json:"post_logout_redirect_uris,omitempty"`
+	Host                   string   `json:"host,omitempty"`
+	CallbackURL            string   `json:"callback_url,omitempty"`
+}
+
+func newClientRecord(c *Client) clientRecord {
+	return clientRecord{
+		ID:                     c.ID,
+		Name:                   c.Name,
+		SecretHash:             c.SecretHash,
+		RedirectURIs:           c.RedirectURIs,
+		Scopes:                 c.Scopes,
+		Public:                 c.Public,
+		RequirePKCE:            c.RequirePKCE,
+		GrantTypes:             c.GrantTypes,
+		AccessTokenExpiration:  int64(c.AccessTokenExpiration / time.Second),
+		RefreshTokenExpiration: int64(c.RefreshTokenExpiration / time.Second),
+		AccessTokenFormat:      c.AccessTokenFormat,
+		AuthMethod:             c.TokenEndpointAuthMethod,
+		RegistrationTokenHash:  c.RegistrationTokenHash,
+		Disabled:               c.Disabled,
+		BackchannelLogoutURI:   c.BackchannelLogoutURI,
+		FrontchannelLogoutURI:  c.FrontchannelLogoutURI,
+		PostLogoutRedirectURIs: c.PostLogoutRedirectURIs,
+		Host:                   c.Host,
+		CallbackURL:            c.CallbackURL,
+	}
+}
+
+func (r clientRecord) client() *Client {
+	return &Client{
+		ID:                      r.ID,
+		Name:                    r.Name,
+		SecretHash:              r.SecretHash,
+		RedirectURIs:            r.RedirectURIs,
+		Scopes:                  r.Scopes,
+		Public:                  r.Public,
+		RequirePKCE:             r.RequirePKCE,
+		GrantTypes:              r.GrantTypes,
+		AccessTokenExpiration:   time.Duration(r.AccessTokenExpiration) * time.Second,
+		RefreshTokenExpiration:  time.Duration(r.RefreshTokenExpiration) * time.Second,
+		AccessTokenFormat:       r.AccessTokenFormat,
+		TokenEndpointAuthMethod: r.AuthMethod,
+		RegistrationTokenHash:   r.RegistrationTokenHash,
+		Disabled:                r.Disabled,
+		BackchannelLogoutURI:    r.BackchannelLogoutURI,
+		FrontchannelLogoutURI:   r.FrontchannelLogoutURI,
+		PostLogoutRedirectURIs:  r.PostLogoutRedirectURIs,
+		Host:                    r.Host,
+		CallbackURL:             r.CallbackURL,
+	}
+}
+
+func (s *FileUserStore) FindByID(ctx context.Context, id string) (*User, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	u, ok := s.users[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	cp := *u
+	return &cp, nil
+}
+
+func (s *FileUserStore) FindByEmail(ctx context.Context, email string) (*User, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, u := range s.users {
+		if strings.EqualFold(u.Email, email) {
+			cp := *u
+			return &cp, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+// Save 和 FileClientStore 一样，每次都把所有的用户重新写一遍
+// 适合用户不多的内部系统，用户多的话应该实现自己的 UserStore
+func (s *FileUserStore) Save(ctx context.Context, u *User) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	users := make(map[string]*User, len(s.users)+1)
+	for id, old := range s.users {
+		if id != u.ID && u.Email != "" && strings.EqualFold(old.Email, u.Email) {
+			return ErrUserExists
+		}
+		users[id] = old
+	}
+	cp := *u
+	users[u.ID] = &cp
+	if err := s.flush(users); err != nil {
+		return err
+	}
+	s.users = users
+	return nil
+}
+
+func (s *FileUserStore) flush(users map[string]*User) error {
+	records := make([]userRecord, 0, len(users))
+	for _, u := range users {
+		records = append(records, newUserRecord(u))
+	}
+	slices.SortFunc(records, func(a, b userRecord) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// NewFileUserStore 把用户保存在 path 这个 JSON 文件里面，文件不存在的时候会自动创建
+func NewFileUserStore(path string) (*FileUserStore, error) {
+	s := &FileUserStore{path: path, users: map[string]*User{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []userRecord
+	if err = json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		s.users[r.ID] = r.user()
+	}
+	return s, nil
+}
+
+type FileUserStore struct {
+	path  string
+	mutex sync.RWMutex
+	users map[string]*User
+}
+
+// userRecord 是用户在文件里面的格式
+type userRecord struct {
+	ID           string   `json:"id"`
+	Email        string   `json:"email"`
+	Name         string   `json:"name,omitempty"`
+	Groups       []string `json:"groups,omitempty"`
+	PasswordHash string   `json:"password_hash,omitempty"`
+}
+
+func newUserRecord(u *User) userRecord {
+	return userRecord{
+		ID:           u.ID,
+		Email:        u.Email,
+		Name:         u.Name,
+		Groups:       u.Groups,
+		PasswordHash: u.PasswordHash,
+	}
+}
+
+func (r userRecord) user() *User {
+	return &User{
+		ID:           r.ID,
+		Email:        r.Email,
+		Name:         r.Name,
+		Groups:       r.Groups,
+		PasswordHash: r.PasswordHash,
+	}
+}
+
+func (s *FileMFAStore) Get(ctx context.Context, userID string) (*MFAEnrollment, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	e, ok := s.enrollments[userID]
+	if !ok {
+		return nil, ErrMFANotEnrolled
+	}
+	return e.clone(), nil
+}
+
+func (s *FileMFAStore) Save(ctx context.Context, e *MFAEnrollment) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	enrollments := make(map[string]*MFAEnrollment, len(s.enrollments)+1)
+	for id, old := range s.enrollments {
+		enrollments[id] = old
+	}
+	enrollments[e.UserID] = e.clone()
+	records := make([]mfaRecord, 0, len(enrollments))
+	for _, e := range enrollments {
+		records = append(records, newMFARecord(e))
+	}
+	slices.SortFunc(records, func(a, b mfaRecord) int {
+		return strings.Compare(a.UserID, b.UserID)
+	})
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(s.path, data); err != nil {
+		return err
+	}
+	s.enrollments = enrollments
+	return nil
+}
+
+// NewFileMFAStore 把 TOTP 密钥保存在 path 这个 JSON 文件里面，文件的权限是 0600
+func NewFileMFAStore(path string) (*FileMFAStore, error) {
+	s := &FileMFAStore{path: path, enrollments: map[string]*MFAEnrollment{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []mfaRecord
+	if err = json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		s.enrollments[r.UserID] = r.enrollment()
+	}
+	return s, nil
+}
+
+type FileMFAStore struct {
+	path        string
+	mutex       sync.RWMutex
+	enrollments map[string]*MFAEnrollment
+}
+
+type mfaRecord struct {
+	UserID             string   `json:"user_id"`
+	TOTPSecret         string   `json:"totp_secret"`
+	RecoveryCodeHashes []string `json:"recovery_code_hashes,omitempty"`
+	LastUsedStep       int64    `json:"last_used_step,omitempty"`
+	CreatedAt          int64    `json:"created_at"`
+}
+
+func newMFARecord(e *MFAEnrollment) mfaRecord {
+	return mfaRecord{
+		UserID:             e.UserID,
+		TOTPSecret:         e.TOTPSecret,
+		RecoveryCodeHashes: e.RecoveryCodeHashes,
+		LastUsedStep:       e.LastUsedStep,
+		CreatedAt:          e.CreatedAt.Unix(),
+	}
+}
+
+func (r mfaRecord) enrollment() *MFAEnrollment {
+	return &MFAEnrollment{
+		UserID:             r.UserID,
+		TOTPSecret:         r.TOTPSecret,
+		RecoveryCodeHashes: r.RecoveryCodeHashes,
+		LastUsedStep:       r.LastUsedStep,
+		CreatedAt:          time.Unix(r.CreatedAt, 0),
+	}
+}
+
+func (s *FileConsentStore) Get(ctx context.Context, userID string, clientID string) (*Consent, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	c, ok := s.consents[consentKey(userID, clientID)]
+	if !ok {
+		return nil, ErrConsentNotFound
+	}
+	return c.clone(), nil
+}
+
+func (s *FileConsentStore) List(ctx context.Context, userID string) ([]*Consent, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var res []*Consent
+	for _, c := range s.consents {
+		if c.UserID == userID {
+			res = append(res, c.clone())
+		}
+	}
+	sortConsents(res)
+	return res, nil
+}
+
+func (s *FileConsentStore) Save(ctx context.Context, c *Consent) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	consents := make(map[string]*Consent, len(s.consents)+1)
+	for key, old := range s.consents {
+		consents[key] = old
+	}
+	consents[consentKey(c.UserID, c.ClientID)] = c.clone()
+	if err := s.flush(consents); err != nil {
+		return err
+	}
+	s.consents = consents
+	return nil
+}
+
+func (s *FileConsentStore) Delete(ctx context.Context, userID string, clientID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := consentKey(userID, clientID)
+	if _, ok := s.consents[key]; !ok {
+		return ErrConsentNotFound
+	}
+	consents := make(map[string]*Consent, len(s.consents))
+	for k, old := range s.consents {
+		if k != key {
+			consents[k] = old
+		}
+	}
+	if err := s.flush(consents); err != nil {
+		return err
+	}
+	s.consents = consents
+	return nil
+}
+
+func (s *FileConsentStore) flush(consents map[string]*Consent) error {
+	list := make([]*Consent, 0, len(consents))
+	for _, c := range consents {
+		list = append(list, c)
+	}
+	sortConsents(list)
+	records := make([]consentRecord, 0, len(list))
+	for _, c := range list {
+		records = append(records, newConsentRecord(c))
+	}
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// NewFileConsentStore 把用户的授权保存在 path 这个 JSON 文件里面
+func NewFileConsentStore(path string) (*FileConsentStore, error) {
+	s := &FileConsentStore{path: path, consents: map[string]*Consent{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []consentRecord
+	if err = json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		s.consents[consentKey(r.UserID, r.ClientID)] = r.consent()
+	}
+	return s, nil
+}
+
+type FileConsentStore struct {
+	path     string
+	mutex    sync.RWMutex
+	consents map[string]*Consent
+}
+
+type consentRecord struct {
+	UserID    string   `json:"user_id"`
+	ClientID  string   `json:"client_id"`
+	Scopes    []string `json:"scopes,omitempty"`
+	CreatedAt int64    `json:"created_at"`
+	UpdatedAt int64    `json:"updated_at"`
+}
+
+func newConsentRecord(c *Consent) consentRecord {
+	return consentRecord{
+		UserID:    c.UserID,
+		ClientID:  c.ClientID,
+		Scopes:    c.Scopes,
+		CreatedAt: c.CreatedAt.Unix(),
+		UpdatedAt: c.UpdatedAt.Unix(),
+	}
+}
+
+func (r consentRecord) consent() *Consent {
+	return &Consent{
+		UserID:    r.UserID,
+		ClientID:  r.ClientID,
+		Scopes:    r.Scopes,
+		CreatedAt: time.Unix(r.CreatedAt, 0),
+		UpdatedAt: time.Unix(r.UpdatedAt, 0),
+	}
+}
+
+// writeFileAtomic 先写临时文件再重命名，避免写到一半的时候进程退出，把文件写坏
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = tmp.Chmod(0600); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,140 @@
+package sso
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileClientStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clients.json")
+	store, err := NewFileClientStore(path)
+	require.NoError(t, err)
+	_, err = store.Get(context.Background(), "app1")
+	assert.Equal(t, ErrClientNotFound, err)
+
+	require.NoError(t, store.Save(context.Background(), &Client{
+		ID:                    "app1",
+		Secret:                "app1-secret",
+		RedirectURIs:          []string{"http://app1.com:8081/oauth2/callback"},
+		Scopes:                []string{"openid", "profile"},
+		GrantTypes:            []string{GrantTypeAuthorizationCode},
+		AccessTokenExpiration: time.Minute * 10,
+		AccessTokenFormat:     AccessTokenFormatJWT,
+	}))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "app1-secret")
+
+	// 重新加载
+	store, err = NewFileClientStore(path)
+	require.NoError(t, err)
+	client, err := store.Get(context.Background(), "app1")
+	require.NoError(t, err)
+	assert.Empty(t, client.Secret)
+	assert.True(t, client.VerifySecret("app1-secret"))
+	assert.False(t, client.VerifySecret("app2-secret"))
+	assert.Equal(t, []string{"http://app1.com:8081/oauth2/callback"}, client.RedirectURIs)
+	assert.Equal(t, time.Minute*10, client.AccessTokenExpiration)
+	assert.Equal(t, AccessTokenFormatJWT, client.AccessTokenFormat)
+
+	clients, err := store.List(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, clients, 1)
+}
+
+func TestFileUserStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	store, err := NewFileUserStore(path)
+	require.NoError(t, err)
+	authn := NewPasswordAuthenticator(store, PasswordAuthenticatorWithHasher(testHasher))
+	require.NoError(t, authn.SetPassword(context.Background(),
+		&User{ID: "123", Email: "123@qq.com", Name: "小明"}, "123456"))
+	assert.Equal(t, ErrUserExists, store.Save(context.Background(), &User{ID: "456", Email: "123@qq.com"}))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "123456")
+
+	// 重新加载
+	store, err = NewFileUserStore(path)
+	require.NoError(t, err)
+	u, err := store.FindByEmail(context.Background(), "123@QQ.com")
+	require.NoError(t, err)
+	assert.Equal(t, "小明", u.Name)
+	_, err = store.FindByID(context.Background(), "456")
+	assert.Equal(t, ErrUserNotFound, err)
+
+	authn = NewPasswordAuthenticator(store, PasswordAuthenticatorWithHasher(testHasher))
+	u, err = authn.Authenticate(context.Background(), "123@qq.com", "123456")
+	require.NoError(t, err)
+	assert.Equal(t, "123", u.ID)
+}
+
+func TestFileMFAStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mfa.json")
+	store, err := NewFileMFAStore(path)
+	require.NoError(t, err)
+	_, err = store.Get(context.Background(), "123")
+	assert.Equal(t, ErrMFANotEnrolled, err)
+	require.NoError(t, store.Save(context.Background(), &MFAEnrollment{
+		UserID:             "123",
+		TOTPSecret:         "GEZDGNBVGY3TQOJQ",
+		RecoveryCodeHashes: []string{"hash1", "hash2"},
+		LastUsedStep:       100,
+		CreatedAt:          time.Now(),
+	}))
+
+	// 重新加载
+	store, err = NewFileMFAStore(path)
+	require.NoError(t, err)
+	e, err := store.Get(context.Background(), "123")
+	require.NoError(t, err)
+	assert.Equal(t, "GEZDGNBVGY3TQOJQ", e.TOTPSecret)
+	assert.Equal(t, []string{"hash1", "hash2"}, e.RecoveryCodeHashes)
+	assert.Equal(t, int64(100), e.LastUsedStep)
+
+	// 修改返回值不会影响保存的数据
+	e.RecoveryCodeHashes[0] = "changed"
+	e, err = store.Get(context.Background(), "123")
+	require.NoError(t, err)
+	assert.Equal(t, "hash1", e.RecoveryCodeHashes[0])
+}
+
+func TestFileConsentStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "consents.json")
+	store, err := NewFileConsentStore(path)
+	require.NoError(t, err)
+	ctx := context.Background()
+	_, err = store.Get(ctx, "123", "app1")
+	assert.Equal(t, ErrConsentNotFound, err)
+	now := time.Now()
+	require.NoError(t, store.Save(ctx, &Consent{UserID: "123", ClientID: "app2", Scopes: []string{"openid"}, CreatedAt: now, UpdatedAt: now}))
+	require.NoError(t, store.Save(ctx, &Consent{UserID: "123", ClientID: "app1", Scopes: []string{"profile"}, CreatedAt: now, UpdatedAt: now}))
+	require.NoError(t, store.Save(ctx, &Consent{UserID: "456", ClientID: "app1", CreatedAt: now, UpdatedAt: now}))
+
+	// 重新加载
+	store, err = NewFileConsentStore(path)
+	require.NoError(t, err)
+	c, err := store.Get(ctx, "123", "app1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"profile"}, c.Scopes)
+	assert.Equal(t, now.Unix(), c.CreatedAt.Unix())
+	consents, err := store.List(ctx, "123")
+	require.NoError(t, err)
+	require.Len(t, consents, 2)
+	assert.Equal(t, "app1", consents[0].ClientID)
+	assert.Equal(t, "app2", consents[1].ClientID)
+
+	require.NoError(t, store.Delete(ctx, "123", "app1"))
+	assert.Equal(t, ErrConsentNotFound, store.Delete(ctx, "123", "app1"))
+	store, err = NewFileConsentStore(path)
+	require.NoError(t, err)
+	_, err = store.Get(ctx, "123", "app1")
+	assert.Equal(t, ErrConsentNotFound, err)
+	_, err = store.Get(ctx, "456", "app1")
+	assert.NoError(t, err)
+}
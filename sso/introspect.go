@@ -0,0 +1,89 @@
+package sso
+
+import (
+	"net/http"
+	webContext "ssoauth2/web/context"
+	"strings"
+	"time"
+)
+
+// introspect 是 RFC 7662 定义的 token 自省接口。
+// 资源服务器必须先认证自己，然后才能查询 token 的状态和用户信息
+func (s *Server) introspect(ctx *webContext.Context) {
+	client, oerr := s.authenticateClient(ctx)
+	if oerr != nil {
+		respOAuth2Error(ctx, oerr)
+		return
+	}
+	// 公开客户端没有办法认证自己，不能查询别人的 token
+	if client.Public {
+		respOAuth2Error(ctx, newOAuth2Error(errUnauthorizedClient, "public clients can not introspect tokens"))
+		return
+	}
+	value, _ := ctx.FormValue("token").String()
+	if value == "" {
+		respOAuth2Error(ctx, newOAuth2Error(errInvalidRequest, "token is required"))
+		return
+	}
+	// token_type_hint 只是用来加速查找的，我们所有的 token 都在一起，所以可以忽略
+	reqCtx := ctx.Request.Context()
+	tk, err := s.tokens.Get(reqCtx, value)
+	if err != nil || !tk.active(client) || !s.ownerActive(reqCtx, tk) {
+		respOAuth2JSON(ctx, http.StatusOK, introspectionResponse{Active: false})
+		return
+	}
+	respOAuth2JSON(ctx, http.StatusOK, s.newIntrospectionResponse(tk))
+}
+
+// active 判断 token 对于调用方来说是不是有效的
+func (t *Token) active(caller *Client) bool {
+	if time.Now().After(t.ExpiresAt) {
+		return false
+	}
+	if t.Type == TokenTypeRefresh {
+		// refresh token 只有持有它的客户端自己才能查询
+		return !t.Rotated && t.ClientID == caller.ID
+	}
+	return t.Type == TokenTypeAccess
+}
+
+// subject 是 token 代表的主体，客户端模式下没有用户，主体就是客户端自己
+func (t *Token) subject() string {
+	if t.UserID == "" {
+		return t.ClientID
+	}
+	return t.UserID
+}
+
+// newIntrospectionResponse access token 的 aud 和 JWT 格式的保持一致，
+// 否则资源服务器离线校验和调用 /introspect 看到的 aud 就不一样了。
+// refresh token 只有客户端自己会用，所以 aud 是客户端
+func (s *Server) newIntrospectionResponse(tk *Token) introspectionResponse {
+	res := introspectionResponse{
+		Active:   true,
+		Sub:      tk.subject(),
+		ClientID: tk.ClientID,
+		Scope:    strings.Join(tk.Scopes, " "),
+		Exp:      tk.ExpiresAt.Unix(),
+		Iat:      tk.IssuedAt.Unix(),
+		Aud:      tk.ClientID,
+	}
+	if tk.Type == TokenTypeAccess {
+		res.TokenType = "Bearer"
+		res.Aud = s.accessTokenAudience
+	} else {
+		res.TokenType = tk.Type
+	}
+	return res
+}
+
+type introspectionResponse struct {
+	Active    bool   `json:"active"`
+	Sub       string `json:"sub,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Aud       string `json:"aud,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+}
@@ -0,0 +1,137 @@
+package sso
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestServer_Introspect(t *testing.T) {
+	s := newTestServer()
+	tkResp := issueTestTokens(t, s)
+
+	resp := postForm(s, "/token", url.Values{
+		"grant_type":    {GrantTypeClientCredentials},
+		"client_id":     {"billing"},
+		"client_secret": {"billing-secret"},
+	})
+	require.Equal(t, http.StatusOK, resp.Code)
+	var ccResp tokenResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &ccResp))
+
+	testCases := []struct {
+		name string
+		form url.Values
+
+		wantCode int
+		wantResp introspectionResponse
+	}{
+		{
+			name: "access token",
+			form: url.Values{
+				"token":         {tkResp.AccessToken},
+				"client_id":     {"billing"},
+				"client_secret": {"billing-secret"},
+			},
+			wantCode: http.StatusOK,
+			wantResp: introspectionResponse{
+				Active:    true,
+				Sub:       "123",
+				ClientID:  "app1",
+				Scope:     "profile email",
+				Aud:       "http://sso.com:8083",
+				TokenType: "Bearer",
+			},
+		},
+		{
+			name: "客户端模式的 token，主体是客户端自己",
+			form: url.Values{
+				"token":         {ccResp.AccessToken},
+				"client_id":     {"app1"},
+				"client_secret": {"app1-secret"},
+			},
+			wantCode: http.StatusOK,
+			wantResp: introspectionResponse{
+				Active:    true,
+				Sub:       "billing",
+				ClientID:  "billing",
+				Scope:     "orders.read orders.write",
+				Aud:       "http://sso.com:8083",
+				TokenType: "Bearer",
+			},
+		},
+		{
+			name: "自己的 refresh token",
+			form: url.Values{
+				"token":           {tkResp.RefreshToken},
+				"token_type_hint": {TokenTypeRefresh},
+				"client_id":       {"app1"},
+				"client_secret":   {"app1-secret"},
+			},
+			wantCode: http.StatusOK,
+			wantResp: introspectionResponse{
+				Active:    true,
+				Sub:       "123",
+				ClientID:  "app1",
+				Scope:     "profile email",
+				Aud:       "app1",
+				TokenType: TokenTypeRefresh,
+			},
+		},
+		{
+			name: "别人的 refresh token",
+			form: url.Values{
+				"token":         {tkResp.RefreshToken},
+				"client_id":     {"billing"},
+				"client_secret": {"billing-secret"},
+			},
+			wantCode: http.StatusOK,
+			wantResp: introspectionResponse{Active: false},
+		},
+		{
+			name: "不存在的 token",
+			form: url.Values{
+				"token":         {"not-exist"},
+				"client_id":     {"billing"},
+				"client_secret": {"billing-secret"},
+			},
+			wantCode: http.StatusOK,
+			wantResp: introspectionResponse{Active: false},
+		},
+		{
+			name: "没有认证",
+			form: url.Values{
+				"token": {tkResp.AccessToken},
+			},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name: "公开客户端",
+			form: url.Values{
+				"token":     {tkResp.AccessToken},
+				"client_id": {"spa"},
+			},
+			wantCode: http.StatusBadRequest,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := postForm(s, "/introspect", tc.form)
+			require.Equal(t, tc.wantCode, resp.Code)
+			if tc.wantCode != http.StatusOK {
+				return
+			}
+			var res introspectionResponse
+			require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &res))
+			if res.Active {
+				assert.NotZero(t, res.Exp)
+				assert.NotZero(t, res.Iat)
+				res.Exp, res.Iat = 0, 0
+			}
+			assert.Equal(t, tc.wantResp, res)
+		})
+	}
+}
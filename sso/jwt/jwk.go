@@ -0,0 +1,149 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var ErrUnsupportedKey = errors.New("jwt: 不支持的密钥类型")
+
+// NewJWK 把公钥转换成 RFC 7517 的 JWK，目前支持 RSA、P-256 和 Ed25519
+func NewJWK(kid string, alg string, pub crypto.PublicKey) (*JWK, error) {
+	jwk := &JWK{Kid: kid, Use: "sig", Alg: alg}
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = encodeSegment(key.N.Bytes())
+		jwk.E = encodeSegment(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return nil, ErrUnsupportedKey
+		}
+		ecdhKey, err := key.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		// 未压缩的格式是 0x04 || x || y
+		point := ecdhKey.Bytes()
+		size := (len(point) - 1) / 2
+		jwk.Kty = "EC"
+		jwk.Crv = "P-256"
+		jwk.X = encodeSegment(point[1 : 1+size])
+		jwk.Y = encodeSegment(point[1+size:])
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = encodeSegment(key)
+	default:
+		return nil, ErrUnsupportedKey
+	}
+	return jwk, nil
+}
+
+// PublicKey 把 JWK 还原成公钥
+func (j *JWK) PublicKey() (crypto.PublicKey, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeSegment(j.N)
+		if err != nil {
+			return nil, ErrMalformed
+		}
+		e, err := decodeSegment(j.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, ErrMalformed
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if j.Crv != "P-256" {
+			return nil, ErrUnsupportedKey
+		}
+		x, err := decodeSegment(j.X)
+		if err != nil || len(x) != 32 {
+			return nil, ErrMalformed
+		}
+		y, err := decodeSegment(j.Y)
+		if err != nil || len(y) != 32 {
+			return nil, ErrMalformed
+		}
+		// 借助 ecdh 校验这个点确实在曲线上
+		point := append(append([]byte{4}, x...), y...)
+		if _, err = ecdh.P256().NewPublicKey(point); err != nil {
+			return nil, ErrMalformed
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	case "OKP":
+		if j.Crv != "Ed25519" {
+			return nil, ErrUnsupportedKey
+		}
+		x, err := decodeSegment(j.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, ErrMalformed
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, ErrUnsupportedKey
+	}
+}
+
+// Thumbprint 计算 RFC 7638 的 JWK thumbprint，适合用来做 kid
+func (j *JWK) Thumbprint() (string, error) {
+	var canonical string
+	// 只包含必需的字段，并且按照字典序排列
+	switch j.Kty {
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, j.E, j.N)
+	case "EC":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, j.Crv, j.X, j.Y)
+	case "OKP":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, j.Crv, j.X)
+	default:
+		return "", ErrUnsupportedKey
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return encodeSegment(sum[:]), nil
+}
+
+// Key 根据 kid 找到对应的 JWK
+func (s *JWKSet) Key(kid string) (*JWK, bool) {
+	for i := range s.Keys {
+		if s.Keys[i].Kid == kid {
+			return &s.Keys[i], true
+		}
+	}
+	return nil, false
+}
+
+// JWK 是 JSON 格式的公钥，字段的含义见 RFC 7517 和 RFC 7518
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	// N 和 E 是 RSA 公钥的参数
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Crv、X 和 Y 是 EC 和 OKP 公钥的参数，OKP 没有 Y
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKSet 就是 /.well-known/jwks.json 返回的内容
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
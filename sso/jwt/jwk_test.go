@@ -0,0 +1,79 @@
+package jwt
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestJWK_PublicKey(t *testing.T) {
+	for _, key := range newTestKeys(t) {
+		t.Run(key.Algorithm, func(t *testing.T) {
+			jwk, err := NewJWK(key.ID, key.Algorithm, key.Key.Public())
+			require.NoError(t, err)
+			bs, err := json.Marshal(JWKSet{Keys: []JWK{*jwk}})
+			require.NoError(t, err)
+
+			var set JWKSet
+			require.NoError(t, json.Unmarshal(bs, &set))
+			res, ok := set.Key(key.ID)
+			require.True(t, ok)
+			pub, err := res.PublicKey()
+			require.NoError(t, err)
+			assert.Equal(t, key.Key.Public(), pub)
+		})
+	}
+}
+
+func TestJWK_Thumbprint(t *testing.T) {
+	// RFC 7638 3.1 里面的例子
+	jwk := &JWK{
+		Kty: "RSA",
+		N: "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn" +
+			"64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91" +
+			"CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:   "AQAB",
+		Alg: RS256,
+		Kid: "2011-04-29",
+	}
+	thumbprint, err := jwk.Thumbprint()
+	require.NoError(t, err)
+	assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", thumbprint)
+}
+
+func TestJWK_Malformed(t *testing.T) {
+	testCases := []struct {
+		name    string
+		jwk     JWK
+		wantErr error
+	}{
+		{
+			name:    "不支持的 kty",
+			jwk:     JWK{Kty: "oct"},
+			wantErr: ErrUnsupportedKey,
+		},
+		{
+			name:    "不支持的曲线",
+			jwk:     JWK{Kty: "EC", Crv: "P-384"},
+			wantErr: ErrUnsupportedKey,
+		},
+		{
+			name: "不在曲线上的点",
+			jwk: JWK{Kty: "EC", Crv: "P-256",
+				X: encodeSegment(make([]byte, 32)), Y: encodeSegment(make([]byte, 32))},
+			wantErr: ErrMalformed,
+		},
+		{
+			name:    "长度不对的 Ed25519 公钥",
+			jwk:     JWK{Kty: "OKP", Crv: "Ed25519", X: encodeSegment([]byte("short"))},
+			wantErr: ErrMalformed,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.jwk.PublicKey()
+			assert.Equal(t, tc.wantErr, err)
+		})
+	}
+}
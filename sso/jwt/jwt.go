@@ -0,0 +1,244 @@
+package jwt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// 支持的签名算法
+const (
+	RS256 = "RS256"
+	ES256 = "ES256"
+	EdDSA = "EdDSA"
+)
+
+var (
+	ErrMalformed        = errors.New("jwt: 格式错误")
+	ErrInvalidSignature = errors.New("jwt: 签名错误")
+	ErrUnsupportedAlg   = errors.New("jwt: 不支持的签名算法")
+	ErrExpired          = errors.New("jwt: 已经过期")
+	ErrNotValidYet      = errors.New("jwt: 还没有生效")
+)
+
+// Sign 使用 key 签名 claims，typ 是 header 里面的 typ，例如 JWT
+func Sign(key *SigningKey, typ string, claims any) (string, error) {
+	header, err := json.Marshal(Header{Alg: key.Algorithm, Typ: typ, Kid: key.ID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := encodeSegment(header) + "." + encodeSegment(payload)
+	sig, err := sign(key, []byte(signingInput))
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + encodeSegment(sig), nil
+}
+
+// Parse 校验签名，并且把 payload 解析到 claims 里面。
+// keyFunc 根据 header 找到对应的公钥，一般是根据 kid 去 JWKS 里面找。
+// 注意 Parse 不会校验过期时间之类的声明，需要调用方自己校验
+func Parse(token string, keyFunc func(header *Header) (crypto.PublicKey, error), claims any) (*Header, error) {
+	segs := strings.Split(token, ".")
+	if len(segs) != 3 {
+		return nil, ErrMalformed
+	}
+	headerBytes, err := decodeSegment(segs[0])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	header := &Header{}
+	if err = json.Unmarshal(headerBytes, header); err != nil {
+		return nil, ErrMalformed
+	}
+	sig, err := decodeSegment(segs[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	pub, err := keyFunc(header)
+	if err != nil {
+		return nil, err
+	}
+	if err = verify(header.Alg, pub, []byte(segs[0]+"."+segs[1]), sig); err != nil {
+		return nil, err
+	}
+	payload, err := decodeSegment(segs[1])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if err = json.Unmarshal(payload, claims); err != nil {
+		return nil, ErrMalformed
+	}
+	return header, nil
+}
+
+func sign(key *SigningKey, input []byte) ([]byte, error) {
+	switch key.Algorithm {
+	case RS256:
+		if _, ok := key.Key.(*rsa.PrivateKey); !ok {
+			return nil, fmt.Errorf("jwt: %s 需要 RSA 私钥", key.Algorithm)
+		}
+		sum := sha256.Sum256(input)
+		return key.Key.Sign(rand.Reader, sum[:], crypto.SHA256)
+	case ES256:
+		priv, ok := key.Key.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("jwt: %s 需要 ECDSA 私钥", key.Algorithm)
+		}
+		sum := sha256.Sum256(input)
+		r, s, err := ecdsa.Sign(rand.Reader, priv, sum[:])
+		if err != nil {
+			return nil, err
+		}
+		// JWS 要求的格式是定长的 r || s，而不是 ASN.1
+		size := (priv.Curve.Params().BitSize + 7) / 8
+		sig := make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+		return sig, nil
+	case EdDSA:
+		if _, ok := key.Key.(ed25519.PrivateKey); !ok {
+			return nil, fmt.Errorf("jwt: %s 需要 Ed25519 私钥", key.Algorithm)
+		}
+		return key.Key.Sign(rand.Reader, input, crypto.Hash(0))
+	default:
+		return nil, ErrUnsupportedAlg
+	}
+}
+
+func verify(alg string, pub crypto.PublicKey, input []byte, sig []byte) error {
+	switch alg {
+	case RS256:
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return ErrInvalidSignature
+		}
+		sum := sha256.Sum256(input)
+		if rsa.VerifyPKCS1v15(rsaPub, crypto.SHA256, sum[:], sig) != nil {
+			return ErrInvalidSignature
+		}
+		return nil
+	case ES256:
+		ecPub, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return ErrInvalidSignature
+		}
+		size := (ecPub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return ErrInvalidSignature
+		}
+		sum := sha256.Sum256(input)
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(ecPub, sum[:], r, s) {
+			return ErrInvalidSignature
+		}
+		return nil
+	case EdDSA:
+		edPub, ok := pub.(ed25519.PublicKey)
+		if !ok {
+			return ErrInvalidSignature
+		}
+		if !ed25519.Verify(edPub, input, sig) {
+			return ErrInvalidSignature
+		}
+		return nil
+	default:
+		// 包括 none，绝对不能接受没有签名的 token
+		return ErrUnsupportedAlg
+	}
+}
+
+func encodeSegment(seg []byte) string {
+	return base64.RawURLEncoding.EncodeToString(seg)
+}
+
+func decodeSegment(seg string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(seg)
+}
+
+// Validate 校验过期时间和生效时间，leeway 是允许的时钟误差
+func (c *RegisteredClaims) Validate(now time.Time, leeway time.Duration) error {
+	if c.ExpiresAt != 0 && now.Add(-leeway).Unix() >= c.ExpiresAt {
+		return ErrExpired
+	}
+	if c.NotBefore != 0 && now.Add(leeway).Unix() < c.NotBefore {
+		return ErrNotValidYet
+	}
+	return nil
+}
+
+// Contains 判断 aud 里面有没有 target
+func (a Audience) Contains(target string) bool {
+	return slices.Contains(a, target)
+}
+
+// MarshalJSON 只有一个受众的时候，按照惯例输出成字符串
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+// UnmarshalJSON aud 既可以是字符串，也可以是字符串数组
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		var auds []string
+		if err := json.Unmarshal(data, &auds); err != nil {
+			return err
+		}
+		*a = auds
+		return nil
+	}
+	var aud string
+	if err := json.Unmarshal(data, &aud); err != nil {
+		return err
+	}
+	*a = Audience{aud}
+	return nil
+}
+
+type Header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// SigningKey 签名用的私钥
+type SigningKey struct {
+	// ID 会放在 header 的 kid 里面，验证方根据它找到公钥
+	ID        string
+	Algorithm string
+	Key       crypto.Signer
+}
+
+// RegisteredClaims 是 RFC 7519 里面注册的声明，时间都是 Unix 秒
+type RegisteredClaims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	ID        string   `json:"jti,omitempty"`
+}
+
+// Audience 是 aud 声明
+type Audience []string
@@ -0,0 +1,138 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestKeys(t *testing.T) []*SigningKey {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return []*SigningKey{
+		{ID: "rsa", Algorithm: RS256, Key: rsaKey},
+		{ID: "ec", Algorithm: ES256, Key: ecKey},
+		{ID: "ed", Algorithm: EdDSA, Key: edKey},
+	}
+}
+
+func TestSignAndParse(t *testing.T) {
+	for _, key := range newTestKeys(t) {
+		t.Run(key.Algorithm, func(t *testing.T) {
+			claims := RegisteredClaims{
+				Issuer:   "http://sso.com:8083",
+				Subject:  "123",
+				Audience: Audience{"app1"},
+			}
+			token, err := Sign(key, "JWT", claims)
+			require.NoError(t, err)
+
+			var res RegisteredClaims
+			header, err := Parse(token, func(header *Header) (crypto.PublicKey, error) {
+				return key.Key.Public(), nil
+			}, &res)
+			require.NoError(t, err)
+			assert.Equal(t, key.ID, header.Kid)
+			assert.Equal(t, key.Algorithm, header.Alg)
+			assert.Equal(t, claims, res)
+
+			// 篡改 payload 之后签名就对不上了
+			segs := strings.Split(token, ".")
+			tampered, _ := json.Marshal(RegisteredClaims{Subject: "456"})
+			segs[1] = encodeSegment(tampered)
+			_, err = Parse(strings.Join(segs, "."), func(header *Header) (crypto.PublicKey, error) {
+				return key.Key.Public(), nil
+			}, &res)
+			assert.Equal(t, ErrInvalidSignature, err)
+		})
+	}
+}
+
+func TestParse_WrongKey(t *testing.T) {
+	keys := newTestKeys(t)
+	token, err := Sign(keys[0], "JWT", RegisteredClaims{Subject: "123"})
+	require.NoError(t, err)
+	var res RegisteredClaims
+	_, err = Parse(token, func(header *Header) (crypto.PublicKey, error) {
+		return keys[1].Key.Public(), nil
+	}, &res)
+	assert.Equal(t, ErrInvalidSignature, err)
+}
+
+func TestParse_AlgNone(t *testing.T) {
+	header, _ := json.Marshal(Header{Alg: "none", Typ: "JWT"})
+	payload, _ := json.Marshal(RegisteredClaims{Subject: "123"})
+	token := encodeSegment(header) + "." + encodeSegment(payload) + "."
+	var res RegisteredClaims
+	_, err := Parse(token, func(header *Header) (crypto.PublicKey, error) {
+		return nil, nil
+	}, &res)
+	assert.Equal(t, ErrUnsupportedAlg, err)
+}
+
+func TestAudience_JSON(t *testing.T) {
+	testCases := []struct {
+		name string
+		aud  Audience
+		json string
+	}{
+		{name: "一个受众", aud: Audience{"app1"}, json: `"app1"`},
+		{name: "多个受众", aud: Audience{"app1", "app2"}, json: `["app1","app2"]`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			bs, err := json.Marshal(tc.aud)
+			require.NoError(t, err)
+			assert.Equal(t, tc.json, string(bs))
+			var aud Audience
+			require.NoError(t, json.Unmarshal(bs, &aud))
+			assert.Equal(t, tc.aud, aud)
+		})
+	}
+}
+
+func TestRegisteredClaims_Validate(t *testing.T) {
+	now := time.Now()
+	testCases := []struct {
+		name    string
+		claims  RegisteredClaims
+		wantErr error
+	}{
+		{
+			name:   "有效",
+			claims: RegisteredClaims{ExpiresAt: now.Add(time.Minute).Unix()},
+		},
+		{
+			name:    "过期",
+			claims:  RegisteredClaims{ExpiresAt: now.Add(-time.Minute).Unix()},
+			wantErr: ErrExpired,
+		},
+		{
+			name:   "过期了但是在误差范围内",
+			claims: RegisteredClaims{ExpiresAt: now.Add(-time.Second * 10).Unix()},
+		},
+		{
+			name:    "还没有生效",
+			claims:  RegisteredClaims{NotBefore: now.Add(time.Minute).Unix()},
+			wantErr: ErrNotValidYet,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.wantErr, tc.claims.Validate(now, time.Second*30))
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package keys
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"ssoauth2/sso/jwt"
+	"time"
+)
+
+var (
+	ErrKeyNotFound = errors.New("keys: 密钥不存在或者已经过期")
+	ErrInvalidPEM  = errors.New("keys: 非法的 PEM 私钥")
+)
+
+// KeyStore 持久化签名密钥
+// 密钥的数量很少，所以每次都是整体读写
+type KeyStore interface {
+	// Load 读取所有的密钥，还没有任何密钥的时候返回空切片
+	Load(ctx context.Context) ([]*Key, error)
+	Save(ctx context.Context, keys []*Key) error
+}
+
+// Generate 生成一个新的签名密钥，kid 是公钥的 RFC 7638 thumbprint
+func Generate(alg string) (*Key, error) {
+	var (
+		signer crypto.Signer
+		err    error
+	)
+	switch alg {
+	case jwt.RS256:
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	case jwt.ES256:
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jwt.EdDSA:
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, jwt.ErrUnsupportedAlg
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewKey(signer, time.Now())
+}
+
+// NewKey 把已有的私钥包装成 Key，签名算法根据私钥的类型推断
+func NewKey(signer crypto.Signer, createdAt time.Time) (*Key, error) {
+	alg, err := algorithmOf(signer)
+	if err != nil {
+		return nil, err
+	}
+	jwk, err := jwt.NewJWK("", alg, signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	kid, err := jwk.Thumbprint()
+	if err != nil {
+		return nil, err
+	}
+	return &Key{ID: kid, Algorithm: alg, Private: signer, CreatedAt: createdAt}, nil
+}
+
+// ParsePEM 加载 PEM 格式的私钥，
+// 支持 PKCS #8，以及 openssl 常见的 PKCS #1（RSA）和 SEC 1（EC）格式
+func ParsePEM(data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrInvalidPEM
+	}
+	var (
+		key any
+		err error
+	)
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, ErrInvalidPEM
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPEM, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, ErrInvalidPEM
+	}
+	return NewKey(signer, time.Now())
+}
+
+// MarshalPEM 把私钥编码成 PKCS #8 格式的 PEM
+func (k *Key) MarshalPEM() ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(k.Private)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// SigningKey 转换成 jwt 包签名用的私钥
+func (k *Key) SigningKey() *jwt.SigningKey {
+	return &jwt.SigningKey{ID: k.ID, Algorithm: k.Algorithm, Key: k.Private}
+}
+
+// JWK 返回公钥对应的 JWK
+func (k *Key) JWK() (*jwt.JWK, error) {
+	return jwt.NewJWK(k.ID, k.Algorithm, k.Private.Public())
+}
+
+// Retired 密钥已经不再用来签名了，但是在保留期内依旧会发布出去
+func (k *Key) Retired() bool {
+	return !k.RetiredAt.IsZero()
+}
+
+func algorithmOf(signer crypto.Signer) (string, error) {
+	switch key := signer.(type) {
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < 2048 {
+			return "", fmt.Errorf("keys: RSA 私钥至少需要 2048 位")
+		}
+		return jwt.RS256, nil
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return "", jwt.ErrUnsupportedKey
+		}
+		return jwt.ES256, nil
+	case ed25519.PrivateKey:
+		return jwt.EdDSA, nil
+	default:
+		return "", jwt.ErrUnsupportedKey
+	}
+}
+
+// Key 是一个签名密钥
+type Key struct {
+	// ID 就是 JWT header 和 JWKS 里面的 kid
+	ID        string
+	Algorithm string
+	Private   crypto.Signer
+	CreatedAt time.Time
+	// RetiredAt 被轮换掉的时间，为零值说明是正在使用的密钥
+	RetiredAt time.Time
+}
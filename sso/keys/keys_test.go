@@ -0,0 +1,103 @@
+package keys
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"ssoauth2/sso/jwt"
+	"testing"
+	"time"
+)
+
+func TestParsePEM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	require.NoError(t, err)
+	smallKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name  string
+		block *pem.Block
+
+		wantAlg string
+		wantErr bool
+	}{
+		{
+			name:    "PKCS #1",
+			block:   &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)},
+			wantAlg: jwt.RS256,
+		},
+		{
+			name:    "SEC 1",
+			block:   &pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER},
+			wantAlg: jwt.ES256,
+		},
+		{
+			name:    "太短的 RSA 私钥",
+			block:   &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(smallKey)},
+			wantErr: true,
+		},
+		{
+			name:    "公钥",
+			block:   &pem.Block{Type: "PUBLIC KEY", Bytes: []byte("abc")},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			key, err := ParsePEM(pem.EncodeToMemory(tc.block))
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantAlg, key.Algorithm)
+			assert.NotEmpty(t, key.ID)
+		})
+	}
+}
+
+func TestFileKeyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	store := NewFileKeyStore(path)
+	keys, err := store.Load(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	now := time.Now().Truncate(time.Second)
+	for _, alg := range []string{jwt.RS256, jwt.ES256, jwt.EdDSA} {
+		key, err := Generate(alg)
+		require.NoError(t, err)
+		key.CreatedAt = now
+		keys = append(keys, key)
+	}
+	keys[0].RetiredAt = now
+	require.NoError(t, store.Save(context.Background(), keys))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	res, err := store.Load(context.Background())
+	require.NoError(t, err)
+	require.Len(t, res, len(keys))
+	for i, key := range res {
+		assert.Equal(t, keys[i].ID, key.ID)
+		assert.Equal(t, keys[i].Algorithm, key.Algorithm)
+		assert.True(t, keys[i].CreatedAt.Equal(key.CreatedAt))
+		assert.True(t, keys[i].RetiredAt.Equal(key.RetiredAt))
+		assert.Equal(t, keys[i].Private.Public(), key.Private.Public())
+	}
+}
@@ -0,0 +1,212 @@
+package keys
+
+import (
+	"context"
+	"crypto"
+	"ssoauth2/sso/jwt"
+	"sync"
+	"time"
+)
+
+// ManagerWithAlgorithm 设置新生成的密钥使用的签名算法，默认是 RS256
+func ManagerWithAlgorithm(alg string) ManagerOption {
+	return func(m *Manager) {
+		m.algorithm = alg
+	}
+}
+
+// ManagerWithRotationPeriod 设置密钥的轮换周期，默认是 30 天
+func ManagerWithRotationPeriod(period time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.rotationPeriod = period
+	}
+}
+
+// ManagerWithRetention 设置被轮换掉的密钥还要继续发布多久，默认是一天。
+// 它不能比用这个密钥签名的 token 的最长有效期还短，否则这些 token 就验证不了了，
+// 所以 SSO 服务器启动的时候会通过 RetainAtLeast 把它延长到 access token 和 ID token 的最长有效期，
+// 包括客户端单独设置的有效期
+func ManagerWithRetention(retention time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.retention = retention
+	}
+}
+
+// SigningKey 返回当前用来签名的密钥
+// 没有密钥，或者密钥已经用满了一个轮换周期，就会生成一个新的
+func (m *Manager) SigningKey(ctx context.Context) (*jwt.SigningKey, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.load(ctx); err != nil {
+		return nil, err
+	}
+	active := m.active()
+	if active == nil || m.now().Sub(active.CreatedAt) >= m.rotationPeriod {
+		var err error
+		if active, err = m.rotate(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return active.SigningKey(), nil
+}
+
+// Rotate 立刻轮换密钥，例如怀疑私钥泄露的时候
+func (m *Manager) Rotate(ctx context.Context) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.load(ctx); err != nil {
+		return err
+	}
+	_, err := m.rotate(ctx)
+	return err
+}
+
+// PublicKey 根据 kid 查找公钥，已经过了保留期的密钥会返回 ErrKeyNotFound
+func (m *Manager) PublicKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	keys, err := m.PublishedKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key.ID == kid {
+			return key.Private.Public(), nil
+		}
+	}
+	return nil, ErrKeyNotFound
+}
+
+// PublishedKeys 返回需要发布出去的密钥，也就是正在使用的，和还在保留期内的
+func (m *Manager) PublishedKeys(ctx context.Context) ([]*Key, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.load(ctx); err != nil {
+		return nil, err
+	}
+	now := m.now()
+	res := make([]*Key, 0, len(m.keys))
+	for _, key := range m.keys {
+		if !m.expired(key, now) {
+			res = append(res, key)
+		}
+	}
+	return res, nil
+}
+
+// JWKS 返回 /.well-known/jwks.json 的内容
+func (m *Manager) JWKS(ctx context.Context) (*jwt.JWKSet, error) {
+	keys, err := m.PublishedKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	set := &jwt.JWKSet{Keys: make([]jwt.JWK, 0, len(keys))}
+	for _, key := range keys {
+		jwk, err := key.JWK()
+		if err != nil {
+			return nil, err
+		}
+		set.Keys = append(set.Keys, *jwk)
+	}
+	return set, nil
+}
+
+// RetainAtLeast 保证被轮换掉的密钥至少还会发布 d 这么久，保留期只会变长不会变短
+// 签名有效期为 d 的 token 之前调用，轮换之后这些 token 在过期之前依旧能够验证
+func (m *Manager) RetainAtLeast(d time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.retention = max(m.retention, d)
+}
+
+// Algorithm 返回签名算法
+func (m *Manager) Algorithm() string {
+	return m.algorithm
+}
+
+// load 第一次用到的时候才从 KeyStore 里面加载
+func (m *Manager) load(ctx context.Context) error {
+	if m.loaded {
+		return nil
+	}
+	keys, err := m.store.Load(ctx)
+	if err != nil {
+		return err
+	}
+	m.keys = keys
+	m.loaded = true
+	return nil
+}
+
+func (m *Manager) active() *Key {
+	// 最后一个没有退役的就是正在使用的密钥
+	for i := len(m.keys) - 1; i >= 0; i-- {
+		if !m.keys[i].Retired() {
+			return m.keys[i]
+		}
+	}
+	return nil
+}
+
+// rotate 生成新的密钥，让旧的密钥退役，并且清理掉过了保留期的密钥
+// 只有保存成功了才会修改内存里面的数据
+func (m *Manager) rotate(ctx context.Context) (*Key, error) {
+	key, err := Generate(m.algorithm)
+	if err != nil {
+		return nil, err
+	}
+	now := m.now()
+	key.CreatedAt = now
+	keys := make([]*Key, 0, len(m.keys)+1)
+	for _, k := range m.keys {
+		if m.expired(k, now) {
+			continue
+		}
+		cp := *k
+		if !cp.Retired() {
+			cp.RetiredAt = now
+		}
+		keys = append(keys, &cp)
+	}
+	keys = append(keys, key)
+	if err = m.store.Save(ctx, keys); err != nil {
+		return nil, err
+	}
+	m.keys = keys
+	return key, nil
+}
+
+func (m *Manager) expired(key *Key, now time.Time) bool {
+	return key.Retired() && now.Sub(key.RetiredAt) >= m.retention
+}
+
+// NewManager 创建一个密钥管理器
+// 密钥在第一次使用的时候才加载，所以 KeyStore 的错误会在签名或者发布公钥的时候返回。
+// 每个实例只会加载一次，多个实例共享同一个 KeyStore 的时候，最好由其中一个负责轮换
+func NewManager(store KeyStore, opts ...ManagerOption) *Manager {
+	m := &Manager{
+		store:          store,
+		algorithm:      jwt.RS256,
+		rotationPeriod: time.Hour * 24 * 30,
+		retention:      time.Hour * 24,
+		now:            time.Now,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Manager 管理签名密钥的生成、轮换和发布
+type Manager struct {
+	store          KeyStore
+	algorithm      string
+	rotationPeriod time.Duration
+	retention      time.Duration
+	// now 方便测试的时候模拟时间流逝
+	now func() time.Time
+
+	mutex  sync.Mutex
+	keys   []*Key
+	loaded bool
+}
+
+type ManagerOption func(m *Manager)
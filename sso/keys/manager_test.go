@@ -0,0 +1,100 @@
+package keys
+
+import (
+	"context"
+	"crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"ssoauth2/sso/jwt"
+	"testing"
+	"time"
+)
+
+func TestManager_Rotation(t *testing.T) {
+	store := NewMemoryKeyStore()
+	m := NewManager(store,
+		ManagerWithAlgorithm(jwt.ES256),
+		ManagerWithRotationPeriod(time.Hour*24),
+		ManagerWithRetention(time.Hour))
+	now := time.Now()
+	m.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	// 第一次使用的时候生成密钥
+	first, err := m.SigningKey(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, jwt.ES256, first.Algorithm)
+	token, err := jwt.Sign(first, "JWT", jwt.RegisteredClaims{Subject: "123"})
+	require.NoError(t, err)
+
+	// 没有到轮换周期，继续使用同一个密钥
+	now = now.Add(time.Hour)
+	key, err := m.SigningKey(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, first.ID, key.ID)
+
+	// 到了轮换周期，换一个新的密钥，但是旧的密钥依旧会发布出去
+	now = now.Add(time.Hour * 23)
+	second, err := m.SigningKey(ctx)
+	require.NoError(t, err)
+	assert.NotEqual(t, first.ID, second.ID)
+	set, err := m.JWKS(ctx)
+	require.NoError(t, err)
+	assert.Len(t, set.Keys, 2)
+
+	// 旧的 token 依旧能够验证
+	keyFunc := func(header *jwt.Header) (crypto.PublicKey, error) {
+		return m.PublicKey(ctx, header.Kid)
+	}
+	_, err = jwt.Parse(token, keyFunc, &jwt.RegisteredClaims{})
+	assert.NoError(t, err)
+
+	// 过了保留期，旧的密钥就不再发布了
+	now = now.Add(time.Hour)
+	set, err = m.JWKS(ctx)
+	require.NoError(t, err)
+	require.Len(t, set.Keys, 1)
+	assert.Equal(t, second.ID, set.Keys[0].Kid)
+	_, err = jwt.Parse(token, keyFunc, &jwt.RegisteredClaims{})
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 手动轮换的时候会清理掉过了保留期的密钥
+	require.NoError(t, m.Rotate(ctx))
+	keys, err := store.Load(ctx)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	assert.Equal(t, second.ID, keys[0].ID)
+	assert.True(t, keys[0].Retired())
+	assert.False(t, keys[1].Retired())
+}
+
+func TestManager_Load(t *testing.T) {
+	key, err := Generate(jwt.EdDSA)
+	require.NoError(t, err)
+	m := NewManager(NewMemoryKeyStore(key))
+	res, err := m.SigningKey(context.Background())
+	require.NoError(t, err)
+	// 沿用 KeyStore 里面已有的密钥，而不是生成一个新的
+	assert.Equal(t, key.ID, res.ID)
+	assert.Equal(t, jwt.EdDSA, res.Algorithm)
+}
+
+func TestManager_RetainAtLeast(t *testing.T) {
+	m := NewManager(NewMemoryKeyStore(), ManagerWithAlgorithm(jwt.ES256), ManagerWithRetention(time.Hour))
+	now := time.Now()
+	m.now = func() time.Time { return now }
+	ctx := context.Background()
+	first, err := m.SigningKey(ctx)
+	require.NoError(t, err)
+
+	// 只会变长，不会变短
+	m.RetainAtLeast(time.Minute)
+	m.RetainAtLeast(time.Hour * 3)
+	require.NoError(t, m.Rotate(ctx))
+	now = now.Add(time.Hour * 2)
+	_, err = m.PublicKey(ctx, first.ID)
+	assert.NoError(t, err)
+	now = now.Add(time.Hour)
+	_, err = m.PublicKey(ctx, first.ID)
+	assert.Equal(t, ErrKeyNotFound, err)
+}
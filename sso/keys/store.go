@@ -0,0 +1,129 @@
+package keys
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Load 读取密钥文件，文件不存在的时候说明还没有生成过密钥
+func (f *FileKeyStore) Load(ctx context.Context) ([]*Key, error) {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []keyFileEntry
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	res := make([]*Key, 0, len(entries))
+	for _, entry := range entries {
+		key, err := ParsePEM([]byte(entry.PrivateKey))
+		if err != nil {
+			return nil, err
+		}
+		key.CreatedAt = entry.CreatedAt
+		key.RetiredAt = entry.RetiredAt
+		res = append(res, key)
+	}
+	return res, nil
+}
+
+// Save 先写临时文件再重命名，避免写到一半的时候进程退出，把密钥文件写坏
+func (f *FileKeyStore) Save(ctx context.Context, keys []*Key) error {
+	entries := make([]keyFileEntry, 0, len(keys))
+	for _, key := range keys {
+		data, err := key.MarshalPEM()
+		if err != nil {
+			return err
+		}
+		entries = append(entries, keyFileEntry{
+			ID:         key.ID,
+			Algorithm:  key.Algorithm,
+			CreatedAt:  key.CreatedAt,
+			RetiredAt:  key.RetiredAt,
+			PrivateKey: string(data),
+		})
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	// 私钥只允许当前用户读写
+	if err = tmp.Chmod(0600); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// NewFileKeyStore 把密钥保存在 path 这个文件里面，文件不存在的时候会自动创建
+func NewFileKeyStore(path string) *FileKeyStore {
+	return &FileKeyStore{path: path}
+}
+
+// FileKeyStore 把密钥以 PEM 的格式保存在一个 JSON 文件里面
+type FileKeyStore struct {
+	path string
+}
+
+type keyFileEntry struct {
+	ID         string    `json:"kid"`
+	Algorithm  string    `json:"alg"`
+	CreatedAt  time.Time `json:"created_at"`
+	RetiredAt  time.Time `json:"retired_at"`
+	PrivateKey string    `json:"private_key"`
+}
+
+func (m *MemoryKeyStore) Load(ctx context.Context) ([]*Key, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return cloneKeys(m.keys), nil
+}
+
+func (m *MemoryKeyStore) Save(ctx context.Context, keys []*Key) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.keys = cloneKeys(keys)
+	return nil
+}
+
+// NewMemoryKeyStore 创建一个内存里面的 KeyStore，重启之后密钥就没了，适合测试
+func NewMemoryKeyStore(keys ...*Key) *MemoryKeyStore {
+	return &MemoryKeyStore{keys: cloneKeys(keys)}
+}
+
+type MemoryKeyStore struct {
+	mutex sync.RWMutex
+	keys  []*Key
+}
+
+// cloneKeys 复制一份，避免调用方修改 RetiredAt 的时候影响到 store 里面的数据
+func cloneKeys(keys []*Key) []*Key {
+	res := make([]*Key, 0, len(keys))
+	for _, key := range keys {
+		cp := *key
+		res = append(res, &cp)
+	}
+	return res
+}
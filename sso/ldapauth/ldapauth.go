@@ -0,0 +1,240 @@
+package ldapauth
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"net"
+	"net/url"
+	"ssoauth2/sso"
+	"strings"
+	"time"
+)
+
+// DefaultUserFilter 默认按照 uid 或者 mail 搜索用户
+const DefaultUserFilter = "(&(objectClass=person)(|(uid={username})(mail={username})))"
+
+var errAmbiguousUser = errors.New("ldapauth: 搜索到了多个用户，请检查 UserFilter")
+
+// AuthenticatorWithBindCredentials 设置搜索用户使用的服务账号，不设置的话匿名搜索
+func AuthenticatorWithBindCredentials(dn string, password string) AuthenticatorOption {
+	return func(a *Authenticator) {
+		a.bindDN = dn
+		a.bindPassword = password
+	}
+}
+
+// AuthenticatorWithUserFilter 设置搜索用户的过滤条件，{username} 会被替换成转义之后的用户名
+func AuthenticatorWithUserFilter(filter string) AuthenticatorOption {
+	return func(a *Authenticator) {
+		a.userFilter = filter
+	}
+}
+
+// AuthenticatorWithAttributes 设置 LDAP 属性和 sso.User 字段的对应关系
+// 为空的字段使用 DefaultAttributes 里面的值
+func AuthenticatorWithAttributes(attrs Attributes) AuthenticatorOption {
+	return func(a *Authenticator) {
+		if attrs.ID != "" {
+			a.attrs.ID = attrs.ID
+		}
+		if attrs.Email != "" {
+			a.attrs.Email = attrs.Email
+		}
+		if attrs.Name != "" {
+			a.attrs.Name = attrs.Name
+		}
+		if attrs.Groups != "" {
+			a.attrs.Groups = attrs.Groups
+		}
+	}
+}
+
+// AuthenticatorWithStartTLS 连接之后先通过 StartTLS 升级成加密连接，config 为 nil 的时候使用系统的根证书
+// 明文的 ldap:// 上面传输密码是很危险的，除非是在本机或者可信的网络里面
+func AuthenticatorWithStartTLS(config *tls.Config) AuthenticatorOption {
+	return func(a *Authenticator) {
+		a.startTLS = true
+		a.tlsConfig = config
+	}
+}
+
+// AuthenticatorWithTLSConfig 设置 ldaps:// 使用的 TLS 配置
+func AuthenticatorWithTLSConfig(config *tls.Config) AuthenticatorOption {
+	return func(a *Authenticator) {
+		a.tlsConfig = config
+	}
+}
+
+// AuthenticatorWithTimeout 设置连接和每个请求的超时时间，默认是 5 秒
+func AuthenticatorWithTimeout(timeout time.Duration) AuthenticatorOption {
+	return func(a *Authenticator) {
+		a.timeout = timeout
+	}
+}
+
+// Authenticate 先用服务账号搜索用户，再用用户的 DN 和密码 bind，bind 成功就说明密码正确
+func (a *Authenticator) Authenticate(ctx context.Context, username string, password string) (*sso.User, error) {
+	// 空密码的 bind 在 LDAP 里面是 unauthenticated bind，很多服务器会直接返回成功
+	if username == "" || password == "" {
+		return nil, sso.ErrInvalidCredentials
+	}
+	conn, err := a.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	entry, err := a.search(conn, strings.ReplaceAll(a.userFilter, "{username}", ldap.EscapeFilter(username)))
+	if errors.Is(err, sso.ErrUserNotFound) {
+		return nil, sso.ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, sso.ErrInvalidCredentials
+		}
+		return nil, err
+	}
+	return a.user(entry)
+}
+
+// FindByID 实现了 sso.UserFinder，用 ID 属性搜索用户，/userinfo 默认就会使用它
+func (a *Authenticator) FindByID(ctx context.Context, id string) (*sso.User, error) {
+	conn, err := a.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	entry, err := a.search(conn, fmt.Sprintf("(%s=%s)", a.attrs.ID, ldap.EscapeFilter(id)))
+	if err != nil {
+		return nil, err
+	}
+	return a.user(entry)
+}
+
+// dial 建立连接，并且用服务账号 bind
+func (a *Authenticator) dial(ctx context.Context) (*ldap.Conn, error) {
+	timeout := a.timeout
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	opts := []ldap.DialOpt{ldap.DialWithDialer(dialer)}
+	if a.tlsConfig != nil && !a.startTLS {
+		opts = append(opts, ldap.DialWithTLSDialer(a.tlsConfig, dialer))
+	}
+	conn, err := ldap.DialURL(a.url, opts...)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(timeout)
+	if a.startTLS {
+		config := a.tlsConfig
+		if config == nil {
+			// tls.Client 必须知道 ServerName 才能校验证书
+			u, _ := url.Parse(a.url)
+			config = &tls.Config{ServerName: u.Hostname()}
+		}
+		if err = conn.StartTLS(config); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	if a.bindDN != "" {
+		err = conn.Bind(a.bindDN, a.bindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// search 搜索唯一的用户，找不到的时候返回 sso.ErrUserNotFound
+func (a *Authenticator) search(conn *ldap.Conn, filter string) (*ldap.Entry, error) {
+	attrs := []string{a.attrs.ID, a.attrs.Email, a.attrs.Name, a.attrs.Groups}
+	// 只需要知道是不是唯一的，所以最多取两个
+	req := ldap.NewSearchRequest(a.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(a.timeout.Seconds()), false, filter, attrs, nil)
+	res, err := conn.Search(req)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, err
+	}
+	switch {
+	case res == nil || len(res.Entries) == 0:
+		return nil, sso.ErrUserNotFound
+	case len(res.Entries) > 1:
+		return nil, errAmbiguousUser
+	}
+	return res.Entries[0], nil
+}
+
+func (a *Authenticator) user(entry *ldap.Entry) (*sso.User, error) {
+	id := entry.GetEqualFoldAttributeValue(a.attrs.ID)
+	if id == "" {
+		return nil, fmt.Errorf("ldapauth: %s 缺少 %s 属性", entry.DN, a.attrs.ID)
+	}
+	u := &sso.User{
+		ID:    id,
+		Email: entry.GetEqualFoldAttributeValue(a.attrs.Email),
+		Name:  entry.GetEqualFoldAttributeValue(a.attrs.Name),
+	}
+	if groups := entry.GetEqualFoldAttributeValues(a.attrs.Groups); len(groups) > 0 {
+		u.Groups = groups
+	}
+	return u, nil
+}
+
+// NewAuthenticator 创建一个 LDAP 的 sso.Authenticator
+// ldapURL 例如 ldap://ldap.example.com:389 或者 ldaps://ldap.example.com:636，baseDN 是搜索用户的根节点
+func NewAuthenticator(ldapURL string, baseDN string, opts ...AuthenticatorOption) *Authenticator {
+	a := &Authenticator{
+		url:        ldapURL,
+		baseDN:     baseDN,
+		userFilter: DefaultUserFilter,
+		attrs:      DefaultAttributes,
+		timeout:    time.Second * 5,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// Authenticator 每次登录都会建立一个新的连接，登录不是高频操作，所以没有做连接池
+type Authenticator struct {
+	url          string
+	baseDN       string
+	bindDN       string
+	bindPassword string
+	userFilter   string
+	attrs        Attributes
+	startTLS     bool
+	tlsConfig    *tls.Config
+	timeout      time.Duration
+}
+
+type AuthenticatorOption func(a *Authenticator)
+
+// DefaultAttributes 是 inetOrgPerson 常用的属性，groups 需要服务器开启 memberOf
+var DefaultAttributes = Attributes{
+	ID:     "uid",
+	Email:  "mail",
+	Name:   "cn",
+	Groups: "memberOf",
+}
+
+// Attributes 是 sso.User 每个字段对应的 LDAP 属性名
+type Attributes struct {
+	// ID 必须是稳定并且唯一的，它就是 token 里面的 sub
+	ID     string
+	Email  string
+	Name   string
+	Groups string
+}
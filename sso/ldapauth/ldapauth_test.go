@@ -0,0 +1,385 @@
+package ldapauth
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net"
+	"ssoauth2/sso"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	serviceDN       = "cn=sso,ou=services,dc=example,dc=com"
+	servicePassword = "service-secret"
+)
+
+func TestAuthenticator(t *testing.T) {
+	srv := newTestLDAPServer(t, false)
+	authn := NewAuthenticator(srv.url(), "ou=people,dc=example,dc=com",
+		AuthenticatorWithBindCredentials(serviceDN, servicePassword))
+	testCases := []struct {
+		name     string
+		username string
+		password string
+		wantUser *sso.User
+		wantErr  error
+	}{
+		{
+			name:     "用 uid 登录",
+			username: "alice",
+			password: "alice-password",
+			wantUser: &sso.User{ID: "alice", Email: "alice@example.com", Name: "Alice",
+				Groups: []string{"cn=dev,ou=groups,dc=example,dc=com", "cn=ops,ou=groups,dc=example,dc=com"}},
+		},
+		{
+			name:     "用邮箱登录",
+			username: "bob@example.com",
+			password: "bob-password",
+			wantUser: &sso.User{ID: "bob", Email: "bob@example.com", Name: "Bob"},
+		},
+		{name: "密码错误", username: "alice", password: "bob-password", wantErr: sso.ErrInvalidCredentials},
+		{name: "用户不存在", username: "carol", password: "carol-password", wantErr: sso.ErrInvalidCredentials},
+		{name: "空密码", username: "alice", password: "", wantErr: sso.ErrInvalidCredentials},
+		{
+			// 转义之后 * 不会变成通配符
+			name:     "过滤条件注入",
+			username: "*",
+			password: "alice-password",
+			wantErr:  sso.ErrInvalidCredentials,
+		},
+		{
+			name:     "过滤条件注入 or",
+			username: "x)(uid=alice",
+			password: "alice-password",
+			wantErr:  sso.ErrInvalidCredentials,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			user, err := authn.Authenticate(context.Background(), tc.username, tc.password)
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantUser, user)
+		})
+	}
+
+	user, err := authn.FindByID(context.Background(), "bob")
+	require.NoError(t, err)
+	assert.Equal(t, "Bob", user.Name)
+	_, err = authn.FindByID(context.Background(), "carol")
+	assert.Equal(t, sso.ErrUserNotFound, err)
+}
+
+func TestAuthenticator_ServiceAccount(t *testing.T) {
+	srv := newTestLDAPServer(t, false)
+	authn := NewAuthenticator(srv.url(), "ou=people,dc=example,dc=com",
+		AuthenticatorWithBindCredentials(serviceDN, "wrong"))
+	_, err := authn.Authenticate(context.Background(), "alice", "alice-password")
+	// 服务账号配置错误不能当成用户的密码错误
+	assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials))
+	assert.NotEqual(t, sso.ErrInvalidCredentials, err)
+}
+
+func TestAuthenticator_CustomFilterAndAttributes(t *testing.T) {
+	srv := newTestLDAPServer(t, false)
+	authn := NewAuthenticator(srv.url(), "ou=people,dc=example,dc=com",
+		AuthenticatorWithBindCredentials(serviceDN, servicePassword),
+		AuthenticatorWithUserFilter("(employeeNumber={username})"),
+		AuthenticatorWithAttributes(Attributes{ID: "employeeNumber", Name: "displayName"}))
+	user, err := authn.Authenticate(context.Background(), "1001", "alice-password")
+	require.NoError(t, err)
+	assert.Equal(t, "1001", user.ID)
+	assert.Equal(t, "爱丽丝", user.Name)
+	assert.Equal(t, "alice@example.com", user.Email)
+
+	// 有多个用户匹配的时候，拒绝登录
+	authn = NewAuthenticator(srv.url(), "ou=people,dc=example,dc=com",
+		AuthenticatorWithBindCredentials(serviceDN, servicePassword),
+		AuthenticatorWithUserFilter("(|(uid={username})(objectClass=person))"))
+	_, err = authn.Authenticate(context.Background(), "alice", "alice-password")
+	assert.Equal(t, errAmbiguousUser, err)
+}
+
+func TestAuthenticator_StartTLS(t *testing.T) {
+	srv := newTestLDAPServer(t, true)
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.cert)
+	authn := NewAuthenticator(srv.url(), "ou=people,dc=example,dc=com",
+		AuthenticatorWithBindCredentials(serviceDN, servicePassword),
+		AuthenticatorWithStartTLS(&tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}))
+	user, err := authn.Authenticate(context.Background(), "alice", "alice-password")
+	require.NoError(t, err)
+	assert.Equal(t, "alice", user.ID)
+
+	// 服务器要求 StartTLS，明文连接连服务账号都 bind 不了
+	authn = NewAuthenticator(srv.url(), "ou=people,dc=example,dc=com",
+		AuthenticatorWithBindCredentials(serviceDN, servicePassword))
+	_, err = authn.Authenticate(context.Background(), "alice", "alice-password")
+	assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultConfidentialityRequired))
+
+	// 不信任服务器的证书
+	authn = NewAuthenticator(srv.url(), "ou=people,dc=example,dc=com",
+		AuthenticatorWithBindCredentials(serviceDN, servicePassword),
+		AuthenticatorWithStartTLS(&tls.Config{ServerName: "127.0.0.1"}))
+	_, err = authn.Authenticate(context.Background(), "alice", "alice-password")
+	assert.Error(t, err)
+}
+
+// testLDAPServer 是一个进程内的 LDAP 服务器，只实现了 bind、search 和 StartTLS，
+// 过滤条件只支持 and、or、not、等值和 present
+type testLDAPServer struct {
+	listener    net.Listener
+	cert        *x509.Certificate
+	tlsConfig   *tls.Config
+	requireTLS  bool
+	entries     []*testEntry
+	serviceDN   string
+	servicePass string
+	wg          sync.WaitGroup
+}
+
+type testEntry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+func newTestLDAPServer(t *testing.T, requireTLS bool) *testLDAPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &testLDAPServer{
+		listener:    listener,
+		requireTLS:  requireTLS,
+		serviceDN:   serviceDN,
+		servicePass: servicePassword,
+		entries: []*testEntry{
+			{
+				dn:       "uid=alice,ou=people,dc=example,dc=com",
+				password: "alice-password",
+				attrs: map[string][]string{
+					"objectClass":    {"person", "inetOrgPerson"},
+					"uid":            {"alice"},
+					"mail":           {"alice@example.com"},
+					"cn":             {"Alice"},
+					"displayName":    {"爱丽丝"},
+					"employeeNumber": {"1001"},
+					"memberOf":       {"cn=dev,ou=groups,dc=example,dc=com", "cn=ops,ou=groups,dc=example,dc=com"},
+				},
+			},
+			{
+				dn:       "uid=bob,ou=people,dc=example,dc=com",
+				password: "bob-password",
+				attrs: map[string][]string{
+					"objectClass": {"person", "inetOrgPerson"},
+					"uid":         {"bob"},
+					"mail":        {"bob@example.com"},
+					"cn":          {"Bob"},
+				},
+			},
+		},
+	}
+	srv.cert, srv.tlsConfig = newTestCertificate(t)
+	srv.wg.Add(1)
+	go srv.serve()
+	t.Cleanup(func() {
+		_ = listener.Close()
+		srv.wg.Wait()
+	})
+	return srv
+}
+
+func (s *testLDAPServer) url() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+func (s *testLDAPServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *testLDAPServer) handle(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 10))
+	reader := bufio.NewReader(conn)
+	isTLS := false
+	for {
+		packet, err := ber.ReadPacket(reader)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			code := uint16(ldap.LDAPResultInvalidCredentials)
+			dn := op.Children[1].Value.(string)
+			pwd := op.Children[2].Data.String()
+			switch {
+			case s.requireTLS && !isTLS:
+				code = ldap.LDAPResultConfidentialityRequired
+			case dn == "" && pwd == "":
+				code = ldap.LDAPResultSuccess
+			case dn == s.serviceDN && pwd == s.servicePass:
+				code = ldap.LDAPResultSuccess
+			default:
+				for _, e := range s.entries {
+					if e.dn == dn && e.password == pwd && pwd != "" {
+						code = ldap.LDAPResultSuccess
+					}
+				}
+			}
+			s.write(conn, id, ldapResult(ldap.ApplicationBindResponse, code))
+		case ldap.ApplicationSearchRequest:
+			s.search(conn, id, op)
+		case ldap.ApplicationExtendedRequest:
+			if op.Children[0].Data.String() != "1.3.6.1.4.1.1466.20037" || isTLS {
+				s.write(conn, id, ldapResult(ldap.ApplicationExtendedResponse, ldap.LDAPResultProtocolError))
+				continue
+			}
+			s.write(conn, id, ldapResult(ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess))
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err = tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, reader, isTLS = tlsConn, bufio.NewReader(tlsConn), true
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+func (s *testLDAPServer) search(conn net.Conn, id int64, op *ber.Packet) {
+	sizeLimit := op.Children[3].Value.(int64)
+	count := int64(0)
+	for _, e := range s.entries {
+		if !matchFilter(e, op.Children[6]) {
+			continue
+		}
+		if sizeLimit > 0 && count == sizeLimit {
+			s.write(conn, id, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSizeLimitExceeded))
+			return
+		}
+		count++
+		s.write(conn, id, searchEntry(e))
+	}
+	s.write(conn, id, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+}
+
+func (s *testLDAPServer) write(conn net.Conn, id int64, op *ber.Packet) {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	packet.AppendChild(op)
+	_, _ = conn.Write(packet.Bytes())
+}
+
+func ldapResult(tag ber.Tag, code uint16) *ber.Packet {
+	res := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	res.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "resultCode"))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString,
+		ldap.LDAPResultCodeMap[code], "diagnosticMessage"))
+	return res
+}
+
+func searchEntry(e *testEntry) *ber.Packet {
+	res := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Entry")
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, "objectName"))
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+	for name, values := range e.attrs {
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+		vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		for _, v := range values {
+			vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "value"))
+		}
+		attr.AppendChild(vals)
+		attrs.AppendChild(attr)
+	}
+	res.AppendChild(attrs)
+	return res
+}
+
+func matchFilter(e *testEntry, filter *ber.Packet) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !matchFilter(e, child) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if matchFilter(e, child) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return !matchFilter(e, filter.Children[0])
+	case ldap.FilterEqualityMatch:
+		name := filter.Children[0].Data.String()
+		value := filter.Children[1].Data.String()
+		for _, v := range attrValues(e, name) {
+			if strings.EqualFold(v, value) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		return len(attrValues(e, filter.Data.String())) > 0
+	default:
+		return false
+	}
+}
+
+func attrValues(e *testEntry, name string) []string {
+	for key, values := range e.attrs {
+		if strings.EqualFold(key, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+func newTestCertificate(t *testing.T) (*x509.Certificate, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
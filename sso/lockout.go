@@ -0,0 +1,216 @@
+package sso
+
+import (
+	"context"
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultAccountPolicy 同一个账号连续失败 3 次之后开始退避，10 次之后锁定 15 分钟
+var DefaultAccountPolicy = LockoutPolicy{
+	FreeAttempts:       3,
+	BaseDelay:          time.Second,
+	MaxDelay:           time.Minute,
+	LockoutThreshold:   10,
+	LockoutDuration:    time.Minute * 15,
+	ChallengeThreshold: 3,
+}
+
+// DefaultIPPolicy 同一个 IP 可能是公司或者学校的出口，所以阈值要宽松很多
+var DefaultIPPolicy = LockoutPolicy{
+	FreeAttempts:       20,
+	BaseDelay:          time.Second,
+	MaxDelay:           time.Minute,
+	LockoutThreshold:   100,
+	LockoutDuration:    time.Hour,
+	ChallengeThreshold: 10,
+}
+
+// LoginLimiterWithAccountPolicy 设置按照账号计数的策略
+func LoginLimiterWithAccountPolicy(p LockoutPolicy) LoginLimiterOption {
+	return func(l *LoginLimiter) {
+		l.account = p
+	}
+}
+
+// LoginLimiterWithIPPolicy 设置按照 IP 计数的策略
+func LoginLimiterWithIPPolicy(p LockoutPolicy) LoginLimiterOption {
+	return func(l *LoginLimiter) {
+		l.ip = p
+	}
+}
+
+// LoginLimiterWithChallenge 设置人机验证，失败次数达到 ChallengeThreshold 之后，登录表单里面会展示它
+func LoginLimiterWithChallenge(c Challenge) LoginLimiterOption {
+	return func(l *LoginLimiter) {
+		l.challenge = c
+	}
+}
+
+// LoginLimiterWithClientIP 设置获取客户端 IP 的方式，默认使用 RemoteAddr
+// 部署在反向代理后面的时候，要从代理设置的头部里面取，但是只能信任自己的代理设置的值
+func LoginLimiterWithClientIP(fn func(r *http.Request) string) LoginLimiterOption {
+	return func(l *LoginLimiter) {
+		l.clientIP = fn
+	}
+}
+
+// check 在校验密码之前调用，判断这次登录要不要等待，要不要人机验证
+func (l *LoginLimiter) check(ctx context.Context, email string, r *http.Request) (loginStatus, error) {
+	return l.checkKey(ctx, accountKey(email), r)
+}
+
+// fail 记录一次密码错误，返回下一次登录的状态
+func (l *LoginLimiter) fail(ctx context.Context, email string, r *http.Request) (loginStatus, error) {
+	return l.failKey(ctx, accountKey(email), r)
+}
+
+// checkUserCode 在查找 user code 之前调用，user code 的空间很小，不限制的话很容易被穷举
+func (l *LoginLimiter) checkUserCode(ctx context.Context, userID string, r *http.Request) (loginStatus, error) {
+	return l.checkKey(ctx, userCodeAttemptKey(userID), r)
+}
+
+// failUserCode 记录一次错误的 user code，和账号分开计数，输错 user code 不会导致账号被锁定，
+// 但是 IP 是共用的。成功的时候也不清零，因为攻击者自己就能发起设备授权，拿到正确的 user code
+func (l *LoginLimiter) failUserCode(ctx context.Context, userID string, r *http.Request) (loginStatus, error) {
+	return l.failKey(ctx, userCodeAttemptKey(userID), r)
+}
+
+func (l *LoginLimiter) checkKey(ctx context.Context, key string, r *http.Request) (loginStatus, error) {
+	acc, err := l.store.Get(ctx, key)
+	if err != nil {
+		return loginStatus{}, err
+	}
+	ip, err := l.store.Get(ctx, l.ipKey(r))
+	if err != nil {
+		return loginStatus{}, err
+	}
+	return l.status(acc, ip), nil
+}
+
+func (l *LoginLimiter) failKey(ctx context.Context, key string, r *http.Request) (loginStatus, error) {
+	acc, err := l.store.Fail(ctx, key, l.account.LockoutDuration)
+	if err != nil {
+		return loginStatus{}, err
+	}
+	ip, err := l.store.Fail(ctx, l.ipKey(r), l.ip.LockoutDuration)
+	if err != nil {
+		return loginStatus{}, err
+	}
+	return l.status(acc, ip), nil
+}
+
+// succeed 登录成功之后清除账号的失败记录
+// IP 的不清除，否则攻击者可以穿插着登录自己的账号来绕过限制
+func (l *LoginLimiter) succeed(ctx context.Context, email string) error {
+	return l.store.Reset(ctx, accountKey(email))
+}
+
+func (l *LoginLimiter) status(acc LoginAttempts, ip LoginAttempts) loginStatus {
+	now := time.Now()
+	return loginStatus{
+		retryAfter: max(l.account.wait(acc, now), l.ip.wait(ip, now)),
+		challenge: l.challenge != nil &&
+			(l.account.needChallenge(acc) || l.ip.needChallenge(ip)),
+	}
+}
+
+func (l *LoginLimiter) ipKey(r *http.Request) string {
+	return "ip:" + l.clientIP(r)
+}
+
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func userCodeAttemptKey(userID string) string {
+	return "user_code:" + userID
+}
+
+// wait 返回还需要等待的时间
+func (p LockoutPolicy) wait(a LoginAttempts, now time.Time) time.Duration {
+	var delay time.Duration
+	switch {
+	case p.LockoutThreshold > 0 && a.Failures >= p.LockoutThreshold:
+		delay = p.LockoutDuration
+	case a.Failures > p.FreeAttempts:
+		delay = p.BaseDelay
+		for i := p.FreeAttempts + 1; i < a.Failures && delay < p.MaxDelay; i++ {
+			delay *= 2
+		}
+		delay = min(delay, p.MaxDelay)
+	}
+	return max(a.LastFailure.Add(delay).Sub(now), 0)
+}
+
+func (p LockoutPolicy) needChallenge(a LoginAttempts) bool {
+	return p.ChallengeThreshold > 0 && a.Failures >= p.ChallengeThreshold
+}
+
+// remoteIP 去掉 RemoteAddr 里面的端口
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// NewLoginLimiter 创建一个登录限流器，失败记录保存在 store 里面
+// 部署多个 SSO 实例的时候，store 必须是共享的，否则攻击者可以把请求分散到不同的实例上
+func NewLoginLimiter(store AttemptStore, opts ...LoginLimiterOption) *LoginLimiter {
+	l := &LoginLimiter{
+		store:    store,
+		account:  DefaultAccountPolicy,
+		ip:       DefaultIPPolicy,
+		clientIP: remoteIP,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// LoginLimiter 按照账号和 IP 统计登录失败的次数，防止暴力破解密码
+// 失败次数超过阈值之后，下一次登录要等待的时间指数增长，达到锁定阈值之后锁定一段时间
+type LoginLimiter struct {
+	store     AttemptStore
+	account   LockoutPolicy
+	ip        LockoutPolicy
+	challenge Challenge
+	clientIP  func(r *http.Request) string
+}
+
+type LoginLimiterOption func(l *LoginLimiter)
+
+// LockoutPolicy 决定失败多少次之后要等待多久
+type LockoutPolicy struct {
+	// FreeAttempts 前面这么多次失败不需要等待
+	FreeAttempts int
+	// BaseDelay 超过 FreeAttempts 之后第一次要等待的时间，之后每失败一次翻倍，最多 MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// LockoutThreshold 失败这么多次之后锁定 LockoutDuration，0 表示不锁定
+	// 失败记录也只保留 LockoutDuration，这段时间之内没有新的失败就清零
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	// ChallengeThreshold 失败这么多次之后要求人机验证，0 表示不要求，没有设置 Challenge 的时候也不要求
+	ChallengeThreshold int
+}
+
+// Challenge 是人机验证的扩展点，例如图形验证码、reCAPTCHA、hCaptcha
+type Challenge interface {
+	// HTML 返回嵌入到登录表单里面的内容，例如验证码图片和输入框，或者第三方的 JS 组件
+	HTML(ctx context.Context) (template.HTML, error)
+	// Verify 校验登录表单里面提交的人机验证结果
+	Verify(ctx context.Context, r *http.Request) (bool, error)
+}
+
+type loginStatus struct {
+	// retryAfter 大于 0 的时候，直接拒绝这次登录，不校验密码
+	retryAfter time.Duration
+	challenge  bool
+}
@@ -0,0 +1,167 @@
+package sso
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockoutPolicy_Wait(t *testing.T) {
+	p := LockoutPolicy{
+		FreeAttempts:     3,
+		BaseDelay:        time.Second,
+		MaxDelay:         time.Second * 10,
+		LockoutThreshold: 10,
+		LockoutDuration:  time.Minute,
+	}
+	now := time.Now()
+	testCases := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: 0, want: 0},
+		{failures: 3, want: 0},
+		{failures: 4, want: time.Second},
+		{failures: 5, want: time.Second * 2},
+		{failures: 6, want: time.Second * 4},
+		{failures: 7, want: time.Second * 8},
+		{failures: 8, want: time.Second * 10},
+		{failures: 9, want: time.Second * 10},
+		{failures: 10, want: time.Minute},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, p.wait(LoginAttempts{Failures: tc.failures, LastFailure: now}, now), tc.failures)
+	}
+	// 等待时间从最近一次失败开始算
+	assert.Equal(t, time.Second*6, p.wait(LoginAttempts{Failures: 7, LastFailure: now.Add(-time.Second * 2)}, now))
+	assert.Equal(t, time.Duration(0), p.wait(LoginAttempts{Failures: 7, LastFailure: now.Add(-time.Minute)}, now))
+}
+
+func TestMemoryAttemptStore(t *testing.T) {
+	store := NewMemoryAttemptStore()
+	ctx := context.Background()
+	a, err := store.Get(ctx, "account:123@qq.com")
+	require.NoError(t, err)
+	assert.Zero(t, a.Failures)
+
+	_, err = store.Fail(ctx, "account:123@qq.com", time.Minute)
+	require.NoError(t, err)
+	a, err = store.Fail(ctx, "account:123@qq.com", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, 2, a.Failures)
+	assert.WithinDuration(t, time.Now(), a.LastFailure, time.Second)
+
+	require.NoError(t, store.Reset(ctx, "account:123@qq.com"))
+	a, err = store.Get(ctx, "account:123@qq.com")
+	require.NoError(t, err)
+	assert.Zero(t, a.Failures)
+}
+
+// loginFrom 从 ip 登录
+func loginFrom(s *Server, ip string, email string, pwd string, extra url.Values) *httptest.ResponseRecorder {
+	form := url.Values{
+		"continue": {"/authorize"},
+		"email":    {email},
+		"password": {pwd},
+	}
+	for key, vals := range extra {
+		form[key] = vals
+	}
+	form, cookies := csrfForm(s, form, nil)
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = ip + ":12345"
+	for _, ck := range cookies {
+		req.AddCookie(ck)
+	}
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestServer_LoginLockout(t *testing.T) {
+	s := newTestServer(ServerWithLoginLimiter(NewLoginLimiter(NewMemoryAttemptStore(),
+		LoginLimiterWithAccountPolicy(LockoutPolicy{
+			FreeAttempts: 2,
+			BaseDelay:    time.Minute,
+			MaxDelay:     time.Minute,
+		}),
+		LoginLimiterWithIPPolicy(LockoutPolicy{
+			FreeAttempts:     5,
+			LockoutThreshold: 5,
+			LockoutDuration:  time.Hour,
+		}),
+	)))
+
+	for i := 0; i < 3; i++ {
+		resp := loginFrom(s, "10.0.0.1", "123@qq.com", "wrong", nil)
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+	}
+	// 密码正确也不行，而且换一个 IP 也没用
+	resp := loginFrom(s, "10.0.0.2", "123@QQ.com", "123456", nil)
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.Equal(t, "60", resp.Header().Get("Retry-After"))
+
+	// 同一个 IP 试不同的账号
+	resp = loginFrom(s, "10.0.0.1", "456@qq.com", "wrong", nil)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	resp = loginFrom(s, "10.0.0.1", "789@qq.com", "wrong", nil)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	resp = loginFrom(s, "10.0.0.1", "456@qq.com", "123456", nil)
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.Equal(t, "3600", resp.Header().Get("Retry-After"))
+
+	// 登录成功之后，账号的失败记录清零
+	s = newTestServer()
+	for i := 0; i < DefaultAccountPolicy.FreeAttempts; i++ {
+		resp = loginFrom(s, "10.0.0.1", "123@qq.com", "wrong", nil)
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+	}
+	resp = loginFrom(s, "10.0.0.1", "123@qq.com", "123456", nil)
+	require.Equal(t, http.StatusFound, resp.Code)
+	for i := 0; i < DefaultAccountPolicy.FreeAttempts; i++ {
+		resp = loginFrom(s, "10.0.0.1", "123@qq.com", "wrong", nil)
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+	}
+}
+
+type testChallenge struct{}
+
+func (testChallenge) HTML(ctx context.Context) (template.HTML, error) {
+	return `<input name="captcha" type="text">`, nil
+}
+
+func (testChallenge) Verify(ctx context.Context, r *http.Request) (bool, error) {
+	return r.FormValue("captcha") == "ok", nil
+}
+
+func TestServer_LoginChallenge(t *testing.T) {
+	s := newTestServer(ServerWithLoginLimiter(NewLoginLimiter(NewMemoryAttemptStore(),
+		LoginLimiterWithChallenge(testChallenge{}))))
+
+	for i := 1; i < DefaultAccountPolicy.ChallengeThreshold; i++ {
+		resp := loginFrom(s, "10.0.0.1", "123@qq.com", "wrong", nil)
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+		require.NotContains(t, resp.Body.String(), `name="captcha"`)
+	}
+	// 达到阈值之后，登录页面上出现人机验证
+	resp := loginFrom(s, "10.0.0.1", "123@qq.com", "wrong", nil)
+	require.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Contains(t, resp.Body.String(), `<input name="captcha" type="text">`)
+	assert.Contains(t, resp.Body.String(), `value="/authorize"`)
+
+	// 没有通过人机验证，不会校验密码
+	resp = loginFrom(s, "10.0.0.1", "123@qq.com", "123456", url.Values{"captcha": {"wrong"}})
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Contains(t, resp.Body.String(), "请完成人机验证")
+
+	resp = loginFrom(s, "10.0.0.1", "123@qq.com", "123456", url.Values{"captcha": {"ok"}})
+	assert.Equal(t, http.StatusFound, resp.Code)
+}
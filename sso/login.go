@@ -0,0 +1,337 @@
+package sso
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"html/template"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	webContext "ssoauth2/web/context"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ssidKey 这个请求里面新设置的 ssid，存放在 UserValues 里面
+const ssidKey = "ssid"
+
+func (s *Server) login(ctx *webContext.Context) {
+	email, _ := ctx.FormValue("email").String()
+	pwd, _ := ctx.FormValue("password").String()
+	page, client, ok := s.loginTarget(ctx)
+	if !ok {
+		_ = ctx.RespString(http.StatusBadRequest, "登录失败")
+		return
+	}
+
+	reqCtx := ctx.Request.Context()
+	status, err := s.limiter.check(reqCtx, email, ctx.Request)
+	if err != nil {
+		_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+		return
+	}
+	// 还在等待期内的，连密码都不校验，否则等待就没有意义了
+	if status.retryAfter > 0 {
+		seconds := int(math.Ceil(status.retryAfter.Seconds()))
+		ctx.Response.Header().Set("Retry-After", strconv.Itoa(seconds))
+		_ = ctx.RespString(http.StatusTooManyRequests, "登录失败次数过多，请稍后再试")
+		return
+	}
+	if status.challenge {
+		passed, err := s.limiter.challenge.Verify(reqCtx, ctx.Request)
+		if err != nil {
+			_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+			return
+		}
+		if !passed {
+			s.renderChallenge(ctx, page, "请完成人机验证")
+			return
+		}
+	}
+	user, err := s.authn.Authenticate(reqCtx, email, pwd)
+	if err != nil {
+		// LDAP 之类的故障不是用户的错，不计入失败次数
+		if errors.Is(err, ErrInvalidCredentials) {
+			status, err = s.limiter.fail(reqCtx, email, ctx.Request)
+			if err == nil && status.challenge {
+				s.renderChallenge(ctx, page, "登录失败")
+				return
+			}
+		}
+		_ = ctx.RespString(http.StatusBadRequest, "登录失败")
+		return
+	}
+	enrolled, err := s.mfaEnrolled(reqCtx, user.ID)
+	if err != nil {
+		_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+		return
+	}
+	// 绑定过 TOTP 的用户，要等第二步认证通过之后才能清零，
+	// 否则知道密码的人每次重新登录都能把失败次数清掉，然后无限地猜验证码
+	if !enrolled {
+		if err = s.limiter.succeed(reqCtx, email); err != nil {
+			_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+			return
+		}
+	}
+	sess := &Session{
+		ID:       uuid.New().String(),
+		SID:      uuid.New().String(),
+		UserID:   user.ID,
+		Account:  email,
+		AuthTime: time.Now(),
+		AMR:      []string{amrPassword},
+		// 绑定过 TOTP 的用户，还要通过第二步认证，在此之前这个 session 不算登录
+		MFAPending: enrolled,
+	}
+	prev := s.previousSession(ctx)
+	if prev != nil && prev.UserID == user.ID {
+		// 同一个用户重新输入密码，例如 prompt=login 或者 max_age，对业务方来说还是同一次登录
+		sess.SID = prev.SID
+		sess.Clients = prev.Clients
+	}
+	if err = s.sessions.Save(reqCtx, sess); err != nil {
+		_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+		return
+	}
+	if prev != nil {
+		// 换了一个用户登录，原来的用户相当于退出登录了，只是没有机会加载 front-channel 的地址
+		if prev.UserID != user.ID {
+			s.notifyLogout(reqCtx, prev)
+		}
+		_ = s.sessions.Remove(reqCtx, prev.ID)
+	}
+	s.setSessionCookie(ctx, sess.ID, int(s.sessionExpiration.Seconds()))
+	if enrolled {
+		page.CSRFToken = s.csrf.Token(ctx)
+		_ = ctx.Render("mfa.gohtml", page)
+		return
+	}
+	s.finishLogin(ctx, client, sess, page)
+}
+
+// renderChallenge 重新展示登录页面，并且带上人机验证
+func (s *Server) renderChallenge(ctx *webContext.Context, page loginPage, msg string) {
+	var err error
+	page.Error = msg
+	page.Challenge, err = s.limiter.challenge.HTML(ctx.Request.Context())
+	if err != nil {
+		_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+		return
+	}
+	page.CSRFToken = s.csrf.Token(ctx)
+	if err = ctx.Render("login.gohtml", page); err == nil {
+		ctx.RespStatusCode = http.StatusBadRequest
+	}
+}
+
+// loginTarget 校验登录之后要去哪里
+// continue 是 OAuth2 流程里面登录之后要回去的 SSO 页面
+// 没有 continue 的就是老的 app_id + redirect_uri 流程
+func (s *Server) loginTarget(ctx *webContext.Context) (loginPage, *Client, bool) {
+	cont, _ := ctx.FormValue("continue").String()
+	if cont != "" {
+		return loginPage{Continue: cont}, nil, isLocalPath(cont)
+	}
+	client, redirectURI, ok := s.checkRedirect(ctx)
+	if !ok {
+		return loginPage{}, nil, false
+	}
+	return loginPage{AppId: client.ID, RedirectURI: redirectURI}, client, true
+}
+
+// finishLogin 登录完成，回到 continue 或者带上 token 跳转回业务方
+func (s *Server) finishLogin(ctx *webContext.Context, client *Client, sess *Session, page loginPage) {
+	if page.Continue != "" {
+		ctx.Redirect(page.Continue)
+		return
+	}
+	s.redirectWithToken(ctx, client, sess, page.RedirectURI)
+}
+
+// checkLogin 判断登录态，如果没登录就返回登录页面，
+// 如果登录了，就直接带上 token 跳转回业务方
+// 和 /authorize 一样支持 prompt、max_age 和 login_hint
+func (s *Server) checkLogin(ctx *webContext.Context) {
+	// 尽可能在查询 session 之前，过滤掉非法请求
+	client, redirectURI, ok := s.checkRedirect(ctx)
+	if !ok {
+		_ = ctx.RespString(http.StatusBadRequest, "登录失败")
+		return
+	}
+	params, oerr := parseAuthParams(ctx)
+	if oerr != nil {
+		_ = ctx.RespString(http.StatusBadRequest, "登录失败")
+		return
+	}
+	sess, err := s.currentSession(ctx)
+	if err != nil {
+		sess = nil
+	}
+	if params.needLogin(sess, time.Now()) {
+		if params.hasPrompt(promptNone) {
+			query := url.Values{}
+			query.Set("error", errLoginRequired)
+			ctx.Redirect(appendQuery(redirectURI, query))
+			return
+		}
+		_ = ctx.Render("login.gohtml", loginPage{
+			AppId:       client.ID,
+			RedirectURI: redirectURI,
+			Email:       params.loginHint,
+			CSRFToken:   s.csrf.Token(ctx),
+		})
+		return
+	}
+	s.redirectWithToken(ctx, client, sess, redirectURI)
+}
+
+// checkRedirect 校验 app_id 和 redirect_uri，
+// redirect_uri 必须是这个业务方注册过的回调地址，或者是 Host 下面的页面
+func (s *Server) checkRedirect(ctx *webContext.Context) (*Client, string, bool) {
+	redirectURI, err := ctx.FormValue("redirect_uri").String()
+	if err != nil {
+		return nil, "", false
+	}
+	appId, err := ctx.FormValue("app_id").String()
+	if err != nil {
+		return nil, "", false
+	}
+	client, err := s.activeClient(ctx.Request.Context(), appId)
+	if err != nil {
+		return nil, "", false
+	}
+	// 表单里面的值已经解码过了，不能再解码一次，否则 %2F 之类的编码可以绕过校验
+	if !matchRedirectURI(client, redirectURI) && !matchHost(client, redirectURI) {
+		return nil, "", false
+	}
+	return client, redirectURI, true
+}
+
+// currentSession 从 ssid cookie 里面拿到当前的 SSO 登录态
+func (s *Server) currentSession(ctx *webContext.Context) (*Session, error) {
+	ck, err := ctx.Request.Cookie(s.cookieName)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := s.sessions.Get(ctx.Request.Context(), ck.Value)
+	if err != nil {
+		return nil, err
+	}
+	// 还没有通过第二步认证
+	if sess.MFAPending {
+		return nil, ErrSessionNotFound
+	}
+	return sess, nil
+}
+
+// previousSession 返回 cookie 里面原来的 session，包括还没有通过第二步认证的
+// 重新登录的时候要处理掉它，否则退出登录的时候就通知不到在它上面登录过的客户端
+func (s *Server) previousSession(ctx *webContext.Context) *Session {
+	ck, err := ctx.Request.Cookie(s.cookieName)
+	if err != nil {
+		return nil
+	}
+	sess, err := s.sessions.Get(ctx.Request.Context(), ck.Value)
+	if err != nil {
+		return nil
+	}
+	return sess
+}
+
+// redirectWithToken 生成一个短期的 token，然后跳转回业务方。
+// 业务方拿着 token 调用 /introspect 换取用户信息
+func (s *Server) redirectWithToken(ctx *webContext.Context, client *Client, sess *Session, redirectURI string) {
+	if err := s.trackClient(ctx.Request.Context(), sess, client.ID); err != nil {
+		_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+		return
+	}
+	now := time.Now()
+	tk := &Token{
+		Value:     uuid.New().String(),
+		Type:      TokenTypeAccess,
+		ClientID:  client.ID,
+		UserID:    sess.UserID,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(s.tokenExpiration),
+	}
+	if err := s.tokens.Save(ctx.Request.Context(), tk); err != nil {
+		_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+		return
+	}
+	query := url.Values{}
+	query.Set("redirect_uri", redirectURI)
+	query.Set("token", tk.Value)
+	ctx.Redirect(appendQuery(client.CallbackURL, query))
+}
+
+// isLocalPath 判断 path 是不是 SSO 站内的路径，避免被利用来做开放重定向
+func isLocalPath(path string) bool {
+	// //evil.com 和 /\evil.com 都会被浏览器当成别的域名
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") ||
+		strings.HasPrefix(path, "/\\") {
+		return false
+	}
+	u, err := url.Parse(path)
+	return err == nil && u.Scheme == "" && u.Host == ""
+}
+
+// setSessionCookie 设置 ssid cookie，maxAge 为负数的时候删除
+// 同一个请求里面接下来渲染的页面，CSRF token 要和新的 session 绑定，所以要记下来
+func (s *Server) setSessionCookie(ctx *webContext.Context, ssid string, maxAge int) {
+	ctx.SetCookie(s.sessionCookie(ssid, maxAge))
+	if maxAge < 0 {
+		ssid = ""
+	}
+	if ctx.UserValues == nil {
+		ctx.UserValues = make(map[string]any, 1)
+	}
+	ctx.UserValues[ssidKey] = ssid
+}
+
+// csrfSessionID 是 CSRF token 绑定的 session，没有登录的时候是空字符串
+func (s *Server) csrfSessionID(ctx *webContext.Context) string {
+	if ssid, ok := ctx.UserValues[ssidKey].(string); ok {
+		return ssid
+	}
+	ck, err := ctx.Request.Cookie(s.cookieName)
+	if err != nil {
+		return ""
+	}
+	return ck.Value
+}
+
+func (s *Server) sessionCookie(ssid string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:   s.cookieName,
+		Value:  ssid,
+		MaxAge: maxAge,
+		Domain: s.cookieDomain,
+		// 在 https 里面才能用这个 cookie
+		//Secure: true,
+		// 前端没有办法通过 JS 来访问 cookie
+		HttpOnly: true,
+	}
+}
+
+func (sess *Session) clone() *Session {
+	cp := *sess
+	cp.AMR = slices.Clone(sess.AMR)
+	cp.Clients = slices.Clone(sess.Clients)
+	return &cp
+}
+
+type loginPage struct {
+	AppId       string
+	RedirectURI string
+	// Continue 登录成功之后回到的 SSO 页面
+	Continue string
+	// Email 预先填好的邮箱，来自客户端的 login_hint
+	Email string
+	Error string
+	// Challenge 人机验证，失败次数过多的时候才会有
+	Challenge template.HTML
+	CSRFToken string
+}
@@ -0,0 +1,284 @@
+package sso
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"net/http"
+	"net/url"
+	"slices"
+	"ssoauth2/sso/jwt"
+	webContext "ssoauth2/web/context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backchannelLogoutEvent 是 OIDC Back-Channel Logout 规定的 events 里面的 key
+const backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+var errInvalidIDTokenHint = errors.New("sso: 非法的 id_token_hint")
+
+// logoutTokenExpiration logout token 是立刻使用的，有效期很短
+const logoutTokenExpiration = time.Minute * 2
+
+// logout 退出 SSO 的登录，并且通知这个 session 登录过的所有客户端
+// 配置了 back-channel 的由 SSO 直接调用，配置了 front-channel 的在退出页面上用 iframe 加载
+func (s *Server) logout(ctx *webContext.Context) {
+	ck, err := ctx.Request.Cookie(s.cookieName)
+	if err != nil {
+		_ = ctx.RespString(http.StatusUnauthorized, "请登录")
+		return
+	}
+	_ = ctx.Render("logout.gohtml", logoutPage{FrontchannelLogoutURIs: s.terminateSession(ctx, ck.Value)})
+}
+
+// endSession 是 OIDC RP-Initiated Logout 的入口，退出登录之后跳转回 post_logout_redirect_uri
+// 只有 id_token_hint 证明了是当前用户自己的应用发起的，才直接退出，否则要用户确认，
+// 避免别的网站随便放一个链接就能让用户退出登录
+func (s *Server) endSession(ctx *webContext.Context) {
+	req, ok := s.parseEndSessionRequest(ctx)
+	if !ok {
+		return
+	}
+	sess, err := s.currentSession(ctx)
+	if err == nil && req.subject != sess.UserID {
+		page := endSessionPage{
+			PostLogoutRedirectURI: req.redirectURI,
+			State:                 req.state,
+			CSRFToken:             s.csrf.Token(ctx),
+		}
+		if req.client != nil {
+			page.ClientID = req.client.ID
+			page.ClientName = req.client.displayName()
+		}
+		_ = ctx.Render("end_session.gohtml", page)
+		return
+	}
+	s.finishEndSession(ctx, req)
+}
+
+// confirmEndSession 用户在确认页面上确认退出登录
+func (s *Server) confirmEndSession(ctx *webContext.Context) {
+	req, ok := s.parseEndSessionRequest(ctx)
+	if !ok {
+		return
+	}
+	s.finishEndSession(ctx, req)
+}
+
+// finishEndSession 退出登录，然后跳转回业务方
+// 有 front-channel 通知的时候，要先在页面上加载完 iframe 再跳转
+func (s *Server) finishEndSession(ctx *webContext.Context, req *endSessionRequest) {
+	var frontchannel []string
+	// 已经退出登录了的，直接跳转回去
+	if ck, err := ctx.Request.Cookie(s.cookieName); err == nil {
+		frontchannel = s.terminateSession(ctx, ck.Value)
+	}
+	var redirectURI string
+	if req.redirectURI != "" {
+		redirectURI = req.redirectURI
+		if req.state != "" {
+			redirectURI = appendQuery(redirectURI, url.Values{"state": {req.state}})
+		}
+		if len(frontchannel) == 0 {
+			ctx.Redirect(redirectURI)
+			return
+		}
+	}
+	_ = ctx.Render("logout.gohtml", logoutPage{
+		FrontchannelLogoutURIs: frontchannel,
+		RedirectURI:            redirectURI,
+	})
+}
+
+// parseEndSessionRequest 校验 id_token_hint、client_id 和 post_logout_redirect_uri
+// 这里的错误都不能跳转，因为跳转地址本身可能就是非法的
+func (s *Server) parseEndSessionRequest(ctx *webContext.Context) (*endSessionRequest, bool) {
+	hint, _ := ctx.FormValue("id_token_hint").String()
+	clientID, _ := ctx.FormValue("client_id").String()
+	req := &endSessionRequest{}
+	req.redirectURI, _ = ctx.FormValue("post_logout_redirect_uri").String()
+	req.state, _ = ctx.FormValue("state").String()
+	// 校验不了的 id_token_hint，例如签名的密钥已经轮换掉了，当作没有带，让用户确认
+	var claims *idTokenClaims
+	if hint != "" {
+		claims, _ = s.parseIDTokenHint(ctx.Request.Context(), hint)
+	}
+	if claims != nil {
+		if clientID != "" && !claims.Audience.Contains(clientID) {
+			_ = ctx.RespString(http.StatusBadRequest, "client_id 和 id_token_hint 不匹配")
+			return nil, false
+		}
+		if clientID == "" {
+			clientID = claims.AuthorizedParty
+		}
+		req.subject = claims.Subject
+	}
+	if clientID != "" {
+		client, err := s.activeClient(ctx.Request.Context(), clientID)
+		if err != nil {
+			_ = ctx.RespString(http.StatusBadRequest, "非法的 client_id")
+			return nil, false
+		}
+		req.client = client
+	}
+	// 不知道是哪个客户端的话，就没有办法校验跳转地址
+	if req.redirectURI != "" && (req.client == nil ||
+		!slices.Contains(req.client.PostLogoutRedirectURIs, req.redirectURI)) {
+		_ = ctx.RespString(http.StatusBadRequest, "非法的 post_logout_redirect_uri")
+		return nil, false
+	}
+	return req, true
+}
+
+// parseIDTokenHint 校验 SSO 自己颁发的 ID token
+// 用户可能很久之后才退出登录，所以过期了的 ID token 也接受
+func (s *Server) parseIDTokenHint(ctx context.Context, token string) (*idTokenClaims, error) {
+	var claims idTokenClaims
+	header, err := jwt.Parse(token, func(header *jwt.Header) (crypto.PublicKey, error) {
+		return s.keyManager.PublicKey(ctx, header.Kid)
+	}, &claims)
+	if err != nil {
+		return nil, err
+	}
+	// access token 和 logout token 也是同一个密钥签名的，要排除掉
+	if header.Typ != "JWT" || claims.Issuer != s.issuer || claims.Subject == "" {
+		return nil, errInvalidIDTokenHint
+	}
+	return &claims, nil
+}
+
+// terminateSession 删除 SSO 的 session 和 cookie，并且通知登录过的客户端，
+// 返回需要在页面上加载的 front-channel logout 地址
+func (s *Server) terminateSession(ctx *webContext.Context, ssid string) []string {
+	reqCtx := ctx.Request.Context()
+	var frontchannel []string
+	// session 已经过期的，也就没有什么需要通知的了
+	if sess, err := s.sessions.Get(reqCtx, ssid); err == nil {
+		frontchannel = s.notifyLogout(reqCtx, sess)
+	}
+	_ = s.sessions.Remove(reqCtx, ssid)
+	// 强制删除 cookie
+	s.setSessionCookie(ctx, ssid, -1)
+	return frontchannel
+}
+
+// notifyLogout 并发调用 back-channel logout 接口，返回需要在浏览器里面加载的 front-channel logout 地址
+// 某个客户端通知失败不影响 SSO 自身退出登录，只交给 errorHandler 处理
+func (s *Server) notifyLogout(ctx context.Context, sess *Session) []string {
+	var (
+		wg           sync.WaitGroup
+		frontchannel []string
+	)
+	for _, id := range sess.Clients {
+		client, err := s.activeClient(ctx, id)
+		if err != nil {
+			continue
+		}
+		if client.FrontchannelLogoutURI != "" {
+			frontchannel = append(frontchannel, appendQuery(client.FrontchannelLogoutURI, url.Values{
+				"iss": {s.issuer},
+				"sid": {sess.SID},
+			}))
+		}
+		if client.BackchannelLogoutURI == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(client *Client) {
+			defer wg.Done()
+			if err := s.backchannelLogout(ctx, client, sess); err != nil {
+				s.errorHandler(ctx, fmt.Errorf("sso: 通知客户端 %s 退出登录失败: %w", client.ID, err))
+			}
+		}(client)
+	}
+	wg.Wait()
+	return frontchannel
+}
+
+// backchannelLogout 把 logout token POST 给客户端，2xx 都算成功
+func (s *Server) backchannelLogout(ctx context.Context, client *Client, sess *Session) error {
+	token, err := s.issueLogoutToken(ctx, client, sess)
+	if err != nil {
+		return err
+	}
+	form := url.Values{"logout_token": {token}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, client.BackchannelLogoutURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("sso: 客户端返回了 %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// issueLogoutToken 按照 OIDC Back-Channel Logout 的要求颁发 logout token
+// 它不能带 nonce，typ 也和 ID token 不一样，避免被当成 ID token 使用
+func (s *Server) issueLogoutToken(ctx context.Context, client *Client, sess *Session) (string, error) {
+	key, err := s.keyManager.SigningKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := logoutTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.issuer,
+			Subject:   sess.UserID,
+			Audience:  jwt.Audience{client.ID},
+			ExpiresAt: now.Add(logoutTokenExpiration).Unix(),
+			IssuedAt:  now.Unix(),
+			ID:        uuid.New().String(),
+		},
+		SID:    sess.SID,
+		Events: map[string]struct{}{backchannelLogoutEvent: {}},
+	}
+	return jwt.Sign(key, "logout+jwt", claims)
+}
+
+// trackClient 记录 session 登录过的客户端，退出登录的时候要通知它们
+func (s *Server) trackClient(ctx context.Context, sess *Session, clientID string) error {
+	if slices.Contains(sess.Clients, clientID) {
+		return nil
+	}
+	return s.sessions.AddClient(ctx, sess.ID, clientID)
+}
+
+// logoutTokenClaims 是 logout token 里面的 claims
+type logoutTokenClaims struct {
+	jwt.RegisteredClaims
+	SID    string              `json:"sid,omitempty"`
+	Events map[string]struct{} `json:"events"`
+}
+
+type logoutPage struct {
+	FrontchannelLogoutURIs []string
+	// RedirectURI 加载完 front-channel logout 的 iframe 之后，跳转回业务方
+	RedirectURI string
+}
+
+type endSessionPage struct {
+	ClientID              string
+	ClientName            string
+	PostLogoutRedirectURI string
+	State                 string
+	CSRFToken             string
+}
+
+type endSessionRequest struct {
+	// client 通过 client_id 或者 id_token_hint 确定，可能为空
+	client      *Client
+	redirectURI string
+	state       string
+	// subject id_token_hint 里面的用户
+	subject string
+}
@@ -0,0 +1,337 @@
+package sso
+
+import (
+	"context"
+	"crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"ssoauth2/sso/jwt"
+	"ssoauth2/sso/keys"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServer_Logout(t *testing.T) {
+	tokens := make(chan string, 1)
+	rp := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		tokens <- req.FormValue("logout_token")
+	}))
+	t.Cleanup(rp.Close)
+	s := newTestServer(ServerWithIssuer("https://sso.example.com"))
+	require.NoError(t, s.clients.Save(context.Background(), &Client{
+		ID:                    "app1",
+		Secret:                "app1-secret",
+		RedirectURIs:          []string{"http://app1.com:8081/oauth2/callback"},
+		Scopes:                []string{"openid", "profile"},
+		BackchannelLogoutURI:  rp.URL + "/logout",
+		FrontchannelLogoutURI: "http://app1.com:8081/logout?from=sso",
+	}))
+
+	ssid := login(t, s)
+	// 登录了 SSO，但是还没有登录过任何客户端
+	sess, err := s.sessions.Get(context.Background(), ssid.Value)
+	require.NoError(t, err)
+	assert.Empty(t, sess.Clients)
+	query := authorizeQuery()
+	query.Set("scope", "openid")
+	authorizeCode(t, s, ssid, query)
+	authorizeCode(t, s, ssid, query)
+	sess, err = s.sessions.Get(context.Background(), ssid.Value)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"app1"}, sess.Clients)
+
+	resp := postForm(s, "/logout", nil, ssid)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), "退出登录成功")
+	matches := regexp.MustCompile(`<iframe src="([^"]+)"`).FindStringSubmatch(resp.Body.String())
+	require.NotNil(t, matches)
+	iframe, err := url.Parse(html.UnescapeString(matches[1]))
+	require.NoError(t, err)
+	assert.Equal(t, "sso", iframe.Query().Get("from"))
+	assert.Equal(t, "https://sso.example.com", iframe.Query().Get("iss"))
+	assert.Equal(t, sess.SID, iframe.Query().Get("sid"))
+
+	var token string
+	select {
+	case token = <-tokens:
+	default:
+		t.Fatal("没有收到 back-channel logout 通知")
+	}
+	var claims logoutTokenClaims
+	header, err := jwt.Parse(token, func(header *jwt.Header) (crypto.PublicKey, error) {
+		return s.keyManager.PublicKey(context.Background(), header.Kid)
+	}, &claims)
+	require.NoError(t, err)
+	assert.Equal(t, "logout+jwt", header.Typ)
+	assert.NoError(t, claims.Validate(time.Now(), 0))
+	assert.Equal(t, "https://sso.example.com", claims.Issuer)
+	assert.Equal(t, "123", claims.Subject)
+	assert.True(t, claims.Audience.Contains("app1"))
+	assert.Equal(t, sess.SID, claims.SID)
+	assert.NotEmpty(t, claims.ID)
+	assert.Contains(t, claims.Events, backchannelLogoutEvent)
+	assert.NotContains(t, token, "nonce")
+
+	_, err = s.sessions.Get(context.Background(), ssid.Value)
+	assert.Equal(t, ErrSessionNotFound, err)
+}
+
+func TestServer_LogoutClientDown(t *testing.T) {
+	rp := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		writer.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(rp.Close)
+	errs := make(chan error, 1)
+	s := newTestServer(ServerWithErrorHandler(func(ctx context.Context, err error) {
+		errs <- err
+	}))
+	require.NoError(t, s.clients.Save(context.Background(), &Client{
+		ID:                   "app1",
+		Secret:               "app1-secret",
+		RedirectURIs:         []string{"http://app1.com:8081/oauth2/callback"},
+		Scopes:               []string{"openid"},
+		BackchannelLogoutURI: rp.URL,
+	}))
+	ssid := login(t, s)
+	query := authorizeQuery()
+	query.Set("scope", "openid")
+	authorizeCode(t, s, ssid, query)
+
+	// 客户端出错不影响 SSO 自己退出登录
+	resp := postForm(s, "/logout", nil, ssid)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	_, err := s.sessions.Get(context.Background(), ssid.Value)
+	assert.Equal(t, ErrSessionNotFound, err)
+	assert.ErrorContains(t, <-errs, "app1")
+}
+
+func TestServer_LoginAgainKeepsClients(t *testing.T) {
+	s := newTestServer()
+	ssid := login(t, s)
+	authorizeCode(t, s, ssid, authorizeQuery())
+	old, err := s.sessions.Get(context.Background(), ssid.Value)
+	require.NoError(t, err)
+
+	// 例如 prompt=login，同一个用户重新输入密码
+	resp := postForm(s, "/login", url.Values{
+		"continue": {"/authorize"},
+		"email":    {"123@qq.com"},
+		"password": {"123456"},
+	}, ssid)
+	require.Equal(t, http.StatusFound, resp.Code)
+	newSSID := findCookie(resp, "ssid")
+	require.NotNil(t, newSSID)
+	_, err = s.sessions.Get(context.Background(), ssid.Value)
+	assert.Equal(t, ErrSessionNotFound, err)
+	// 退出登录的时候还能通知到原来登录过的客户端
+	sess, err := s.sessions.Get(context.Background(), newSSID.Value)
+	require.NoError(t, err)
+	assert.Equal(t, old.SID, sess.SID)
+	assert.Equal(t, []string{"app1"}, sess.Clients)
+}
+
+func TestServer_LoginAsAnotherUser(t *testing.T) {
+	tokens := make(chan string, 1)
+	rp := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		tokens <- req.FormValue("logout_token")
+	}))
+	t.Cleanup(rp.Close)
+	s := newTestServer(ServerWithAuthenticator(AuthenticatorFunc(
+		func(ctx context.Context, email string, pwd string) (*User, error) {
+			return &User{ID: email, Email: email}, nil
+		})))
+	require.NoError(t, s.clients.Save(context.Background(), &Client{
+		ID:                   "app1",
+		Secret:               "app1-secret",
+		RedirectURIs:         []string{"http://app1.com:8081/oauth2/callback"},
+		Scopes:               []string{"profile"},
+		BackchannelLogoutURI: rp.URL + "/logout",
+	}))
+	ssid := login(t, s)
+	authorizeCode(t, s, ssid, authorizeQuery())
+
+	resp := postForm(s, "/login", url.Values{
+		"continue": {"/authorize"},
+		"email":    {"456@qq.com"},
+		"password": {"123456"},
+	}, ssid)
+	require.Equal(t, http.StatusFound, resp.Code)
+	// 原来的用户被挤掉了，相当于退出登录
+	select {
+	case <-tokens:
+	default:
+		t.Fatal("没有收到 back-channel logout 通知")
+	}
+	_, err := s.sessions.Get(context.Background(), ssid.Value)
+	assert.Equal(t, ErrSessionNotFound, err)
+	sess, err := s.sessions.Get(context.Background(), findCookie(resp, "ssid").Value)
+	require.NoError(t, err)
+	assert.Equal(t, "456@qq.com", sess.UserID)
+	assert.Empty(t, sess.Clients)
+}
+
+func TestServer_TrackClientConcurrently(t *testing.T) {
+	s := newTestServer()
+	ssid := login(t, s)
+	sess, err := s.sessions.Get(context.Background(), ssid.Value)
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(clientID string) {
+			defer wg.Done()
+			assert.NoError(t, s.trackClient(context.Background(), sess, clientID))
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+	// 并发的请求不会互相覆盖
+	sess, err = s.sessions.Get(context.Background(), ssid.Value)
+	require.NoError(t, err)
+	assert.Len(t, sess.Clients, 10)
+	assert.Equal(t, ErrSessionNotFound, s.sessions.AddClient(context.Background(), "unknown", "app1"))
+}
+
+func TestServer_EndSession(t *testing.T) {
+	s := newTestServer(ServerWithIssuer("https://sso.example.com"))
+	require.NoError(t, s.clients.Save(context.Background(), &Client{
+		ID:                     "app1",
+		Secret:                 "app1-secret",
+		RedirectURIs:           []string{"http://app1.com:8081/oauth2/callback"},
+		Scopes:                 []string{"openid", "profile"},
+		PostLogoutRedirectURIs: []string{"http://app1.com:8081/bye"},
+	}))
+	ssid := login(t, s)
+	query := authorizeQuery()
+	query.Set("scope", "openid")
+	idToken := exchangeCode(t, s, authorizeCode(t, s, ssid, query)).IDToken
+	require.NotEmpty(t, idToken)
+
+	testCases := []struct {
+		name  string
+		query url.Values
+
+		wantCode int
+	}{
+		{
+			name:     "没有注册过的跳转地址",
+			query:    url.Values{"client_id": {"app1"}, "post_logout_redirect_uri": {"http://evil.com/bye"}},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "不知道是哪个客户端",
+			query:    url.Values{"post_logout_redirect_uri": {"http://app1.com:8081/bye"}},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "非法的 id_token_hint 要用户确认",
+			query:    url.Values{"id_token_hint": {"a.b.c"}},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "client_id 和 id_token_hint 不匹配",
+			query:    url.Values{"id_token_hint": {idToken}, "client_id": {"spa"}},
+			wantCode: http.StatusBadRequest,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := getWithCookies(s, "/end_session?"+tc.query.Encode(), ssid)
+			assert.Equal(t, tc.wantCode, resp.Code)
+		})
+	}
+	_, err := s.sessions.Get(context.Background(), ssid.Value)
+	require.NoError(t, err)
+
+	// 没有 id_token_hint，要用户确认
+	resp := getWithCookies(s, "/end_session?"+url.Values{
+		"client_id":                {"app1"},
+		"post_logout_redirect_uri": {"http://app1.com:8081/bye"},
+		"state":                    {"xyz"},
+	}.Encode(), ssid)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), `action="/end_session/confirm"`)
+	assert.Contains(t, resp.Body.String(), `value="http://app1.com:8081/bye"`)
+	_, err = s.sessions.Get(context.Background(), ssid.Value)
+	require.NoError(t, err)
+
+	resp = postForm(s, "/end_session/confirm", url.Values{
+		"client_id":                {"app1"},
+		"post_logout_redirect_uri": {"http://app1.com:8081/bye"},
+		"state":                    {"xyz"},
+	}, ssid)
+	require.Equal(t, http.StatusFound, resp.Code)
+	assert.Equal(t, "http://app1.com:8081/bye?state=xyz", resp.Header().Get("Location"))
+	_, err = s.sessions.Get(context.Background(), ssid.Value)
+	assert.Equal(t, ErrSessionNotFound, err)
+
+	// 带了 id_token_hint，直接退出，client_id 可以从 ID token 里面拿到
+	ssid = login(t, s)
+	resp = getWithCookies(s, "/end_session?"+url.Values{
+		"id_token_hint":            {idToken},
+		"post_logout_redirect_uri": {"http://app1.com:8081/bye"},
+	}.Encode(), ssid)
+	require.Equal(t, http.StatusFound, resp.Code)
+	assert.Equal(t, "http://app1.com:8081/bye", resp.Header().Get("Location"))
+	_, err = s.sessions.Get(context.Background(), ssid.Value)
+	assert.Equal(t, ErrSessionNotFound, err)
+
+	// 已经退出登录了，直接跳转回去
+	resp = getWithCookies(s, "/end_session?"+url.Values{
+		"id_token_hint":            {idToken},
+		"post_logout_redirect_uri": {"http://app1.com:8081/bye"},
+	}.Encode())
+	assert.Equal(t, http.StatusFound, resp.Code)
+}
+
+func TestServer_EndSessionUnverifiableHint(t *testing.T) {
+	s := newTestServer()
+	ssid := login(t, s)
+	query := authorizeQuery()
+	query.Set("scope", "openid")
+	idToken := exchangeCode(t, s, authorizeCode(t, s, ssid, query)).IDToken
+
+	// 另外一套密钥，相当于签名 ID token 的密钥已经轮换掉了
+	s = newTestServer(ServerWithKeyManager(keys.NewManager(keys.NewMemoryKeyStore())))
+	ssid = login(t, s)
+	resp := getWithCookies(s, "/end_session?"+url.Values{
+		"id_token_hint": {idToken},
+		"client_id":     {"app1"},
+	}.Encode(), ssid)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), `action="/end_session/confirm"`)
+	_, err := s.sessions.Get(context.Background(), ssid.Value)
+	require.NoError(t, err)
+}
+
+func TestServer_EndSessionFrontchannel(t *testing.T) {
+	s := newTestServer()
+	require.NoError(t, s.clients.Save(context.Background(), &Client{
+		ID:                     "app1",
+		Secret:                 "app1-secret",
+		RedirectURIs:           []string{"http://app1.com:8081/oauth2/callback"},
+		Scopes:                 []string{"openid"},
+		FrontchannelLogoutURI:  "http://app1.com:8081/logout",
+		PostLogoutRedirectURIs: []string{"http://app1.com:8081/bye"},
+	}))
+	ssid := login(t, s)
+	query := authorizeQuery()
+	query.Set("scope", "openid")
+	idToken := exchangeCode(t, s, authorizeCode(t, s, ssid, query)).IDToken
+
+	// 要先加载完 iframe 再跳转
+	resp := getWithCookies(s, "/end_session?"+url.Values{
+		"id_token_hint":            {idToken},
+		"post_logout_redirect_uri": {"http://app1.com:8081/bye"},
+		"state":                    {"xyz"},
+	}.Encode(), ssid)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), `<iframe src="http://app1.com:8081/logout?`)
+	assert.Contains(t, resp.Body.String(), `href="http://app1.com:8081/bye?state=xyz"`)
+}
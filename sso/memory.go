@@ -0,0 +1,540 @@
+package sso
+
+import (
+	"context"
+	cache "github.com/patrickmn/go-cache"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+func (s *MemoryClientStore) Get(ctx context.Context, id string) (*Client, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	c, ok := s.clients[id]
+	if !ok {
+		return nil, ErrClientNotFound
+	}
+	cp := *c
+	return &cp, nil
+}
+
+func (s *MemoryClientStore) List(ctx context.Context) ([]*Client, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	res := make([]*Client, 0, len(s.clients))
+	for _, c := range s.clients {
+		cp := *c
+		res = append(res, &cp)
+	}
+	slices.SortFunc(res, func(a, b *Client) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return res, nil
+}
+
+func (s *MemoryClientStore) Save(ctx context.Context, c *Client) error {
+	c, err := hashClientSecret(c)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.clients[c.ID] = c
+	return nil
+}
+
+func (s *MemoryClientStore) Delete(ctx context.Context, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.clients[id]; !ok {
+		return ErrClientNotFound
+	}
+	delete(s.clients, id)
+	return nil
+}
+
+// NewMemoryClientStore 创建一个内存版本的 ClientStore，
+// 一般用于测试或者业务方固定的场景
+func NewMemoryClientStore(clients ...*Client) *MemoryClientStore {
+	res := &MemoryClientStore{
+		clients: make(map[string]*Client, len(clients)),
+	}
+	for _, c := range clients {
+		_ = res.Save(context.Background(), c)
+	}
+	return res
+}
+
+type MemoryClientStore struct {
+	mutex   sync.RWMutex
+	clients map[string]*Client
+}
+
+func (s *MemoryUserStore) FindByID(ctx context.Context, id string) (*User, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	u, ok := s.users[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	cp := *u
+	return &cp, nil
+}
+
+func (s *MemoryUserStore) FindByEmail(ctx context.Context, email string) (*User, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	id, ok := s.emails[strings.ToLower(email)]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	cp := *s.users[id]
+	return &cp, nil
+}
+
+func (s *MemoryUserStore) Save(ctx context.Context, u *User) error {
+	email := strings.ToLower(u.Email)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if id, ok := s.emails[email]; ok && id != u.ID {
+		return ErrUserExists
+	}
+	if old, ok := s.users[u.ID]; ok {
+		delete(s.emails, strings.ToLower(old.Email))
+	}
+	cp := *u
+	s.users[u.ID] = &cp
+	if email != "" {
+		s.emails[email] = u.ID
+	}
+	return nil
+}
+
+// NewMemoryUserStore 创建一个内存版本的 UserStore，一般用于测试
+// users 里面的 PasswordHash 必须是已经哈希过的，明文密码用 PasswordAuthenticator.SetPassword 设置
+func NewMemoryUserStore(users ...*User) *MemoryUserStore {
+	res := &MemoryUserStore{
+		users:  make(map[string]*User, len(users)),
+		emails: make(map[string]string, len(users)),
+	}
+	for _, u := range users {
+		_ = res.Save(context.Background(), u)
+	}
+	return res
+}
+
+type MemoryUserStore struct {
+	mutex sync.RWMutex
+	users map[string]*User
+	// emails 是小写的邮箱到用户 ID 的索引
+	emails map[string]string
+}
+
+func (s *MemoryMFAStore) Get(ctx context.Context, userID string) (*MFAEnrollment, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	e, ok := s.enrollments[userID]
+	if !ok {
+		return nil, ErrMFANotEnrolled
+	}
+	return e.clone(), nil
+}
+
+func (s *MemoryMFAStore) Create(ctx context.Context, e *MFAEnrollment) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.enrollments[e.UserID]; ok {
+		return ErrMFAEnrolled
+	}
+	s.enrollments[e.UserID] = e.clone()
+	return nil
+}
+
+func (s *MemoryMFAStore) UseStep(ctx context.Context, userID string, step int64) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	e, ok := s.enrollments[userID]
+	if !ok {
+		return false, ErrMFANotEnrolled
+	}
+	if step <= e.LastUsedStep {
+		return false, nil
+	}
+	e.LastUsedStep = step
+	return true, nil
+}
+
+func (s *MemoryMFAStore) UseRecoveryCode(ctx context.Context, userID string, hash string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	e, ok := s.enrollments[userID]
+	if !ok {
+		return false, ErrMFANotEnrolled
+	}
+	i := slices.Index(e.RecoveryCodeHashes, hash)
+	if i < 0 {
+		return false, nil
+	}
+	e.RecoveryCodeHashes = slices.Delete(e.RecoveryCodeHashes, i, i+1)
+	return true, nil
+}
+
+func NewMemoryMFAStore() *MemoryMFAStore {
+	return &MemoryMFAStore{enrollments: map[string]*MFAEnrollment{}}
+}
+
+type MemoryMFAStore struct {
+	mutex       sync.RWMutex
+	enrollments map[string]*MFAEnrollment
+}
+
+func (s *MemoryConsentStore) Get(ctx context.Context, userID string, clientID string) (*Consent, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	c, ok := s.consents[consentKey(userID, clientID)]
+	if !ok {
+		return nil, ErrConsentNotFound
+	}
+	return c.clone(), nil
+}
+
+func (s *MemoryConsentStore) List(ctx context.Context, userID string) ([]*Consent, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var res []*Consent
+	for _, c := range s.consents {
+		if c.UserID == userID {
+			res = append(res, c.clone())
+		}
+	}
+	sortConsents(res)
+	return res, nil
+}
+
+func (s *MemoryConsentStore) Save(ctx context.Context, c *Consent) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.consents[consentKey(c.UserID, c.ClientID)] = c.clone()
+	return nil
+}
+
+func (s *MemoryConsentStore) Delete(ctx context.Context, userID string, clientID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := consentKey(userID, clientID)
+	if _, ok := s.consents[key]; !ok {
+		return ErrConsentNotFound
+	}
+	delete(s.consents, key)
+	return nil
+}
+
+func NewMemoryConsentStore() *MemoryConsentStore {
+	return &MemoryConsentStore{consents: map[string]*Consent{}}
+}
+
+type MemoryConsentStore struct {
+	mutex    sync.RWMutex
+	consents map[string]*Consent
+}
+
+// Save 保存的是副本，和 Get 一样，避免不同的请求共享同一个 Session
+func (s *MemorySessionStore) Save(ctx context.Context, sess *Session) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.c.Set(sess.ID, sess.clone(), s.expiration)
+	return nil
+}
+
+func (s *MemorySessionStore) Get(ctx context.Context, id string) (*Session, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	sess, ok := s.c.Get(id)
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return sess.(*Session).clone(), nil
+}
+
+func (s *MemorySessionStore) AddClient(ctx context.Context, id string, clientID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	val, ok := s.c.Get(id)
+	if !ok {
+		return ErrSessionNotFound
+	}
+	// 缓存里面的是副本，读也是在锁里面复制出去的，所以可以直接修改，也不会改变过期时间
+	sess := val.(*Session)
+	if !slices.Contains(sess.Clients, clientID) {
+		sess.Clients = append(sess.Clients, clientID)
+	}
+	return nil
+}
+
+func (s *MemorySessionStore) Remove(ctx context.Context, id string) error {
+	s.c.Delete(id)
+	return nil
+}
+
+// NewMemorySessionStore 创建一个内存版本的 SessionStore
+// expiration 是 session 的过期时间
+func NewMemorySessionStore(expiration time.Duration) *MemorySessionStore {
+	return &MemorySessionStore{
+		c:          cache.New(expiration, time.Minute),
+		expiration: expiration,
+	}
+}
+
+type MemorySessionStore struct {
+	mutex      sync.RWMutex
+	c          *cache.Cache
+	expiration time.Duration
+}
+
+func (s *MemoryTokenStore) Save(ctx context.Context, tk *Token) error {
+	expiration := time.Until(tk.ExpiresAt)
+	// 已经过期的 token 没必要存，
+	// 而且 go-cache 会把非正数的过期时间当成永不过期
+	if expiration <= 0 {
+		return nil
+	}
+	s.c.Set(tk.Value, tk, expiration)
+	return nil
+}
+
+func (s *MemoryTokenStore) Get(ctx context.Context, value string) (*Token, error) {
+	tk, ok := s.c.Get(value)
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	return tk.(*Token), nil
+}
+
+func (s *MemoryTokenStore) Remove(ctx context.Context, value string) error {
+	s.c.Delete(value)
+	return nil
+}
+
+func (s *MemoryTokenStore) MarkRotated(ctx context.Context, value string) (*Token, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	val, expiration, ok := s.c.GetWithExpiration(value)
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	tk := val.(*Token)
+	if tk.Rotated {
+		return tk, nil
+	}
+	// 不直接修改原本的 token，避免并发读的时候出问题
+	rotated := *tk
+	rotated.Rotated = true
+	s.c.Set(value, &rotated, time.Until(expiration))
+	return tk, nil
+}
+
+func (s *MemoryTokenStore) RemoveFamily(ctx context.Context, familyID string) error {
+	// 老的登录流程颁发的 token 没有家族
+	if familyID == "" {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key, item := range s.c.Items() {
+		if item.Object.(*Token).FamilyID == familyID {
+			s.c.Delete(key)
+		}
+	}
+	return nil
+}
+
+// NewMemoryTokenStore 创建一个内存版本的 TokenStore
+// 每一个 token 的过期时间由 Token.ExpiresAt 决定
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{
+		c: cache.New(cache.NoExpiration, time.Minute),
+	}
+}
+
+type MemoryTokenStore struct {
+	mutex sync.Mutex
+	c     *cache.Cache
+}
+
+func (s *MemoryCodeStore) Save(ctx context.Context, code *AuthorizationCode) error {
+	expiration := time.Until(code.ExpiresAt)
+	if expiration <= 0 {
+		return nil
+	}
+	s.c.Set(code.Code, code, expiration)
+	return nil
+}
+
+func (s *MemoryCodeStore) Take(ctx context.Context, code string) (*AuthorizationCode, error) {
+	// go-cache 没有原子的 get and delete，所以要自己加锁
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	val, ok := s.c.Get(code)
+	if !ok {
+		return nil, ErrCodeNotFound
+	}
+	s.c.Delete(code)
+	return val.(*AuthorizationCode), nil
+}
+
+// NewMemoryCodeStore 创建一个内存版本的 CodeStore
+// 每一个授权码的过期时间由 AuthorizationCode.ExpiresAt 决定
+func NewMemoryCodeStore() *MemoryCodeStore {
+	return &MemoryCodeStore{
+		c: cache.New(cache.NoExpiration, time.Minute),
+	}
+}
+
+type MemoryCodeStore struct {
+	mutex sync.Mutex
+	c     *cache.Cache
+}
+
+func (s *MemoryAttemptStore) Get(ctx context.Context, key string) (LoginAttempts, error) {
+	val, ok := s.c.Get(key)
+	if !ok {
+		return LoginAttempts{}, nil
+	}
+	return val.(LoginAttempts), nil
+}
+
+func (s *MemoryAttemptStore) Fail(ctx context.Context, key string, window time.Duration) (LoginAttempts, error) {
+	// 读出来加一再写回去，要加锁才是原子的
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	a, _ := s.Get(ctx, key)
+	a.Failures++
+	a.LastFailure = time.Now()
+	s.c.Set(key, a, window)
+	return a, nil
+}
+
+func (s *MemoryAttemptStore) Reset(ctx context.Context, key string) error {
+	s.c.Delete(key)
+	return nil
+}
+
+// NewMemoryAttemptStore 创建一个内存版本的 AttemptStore，只适用于单个实例
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{
+		c: cache.New(cache.NoExpiration, time.Minute),
+	}
+}
+
+type MemoryAttemptStore struct {
+	mutex sync.Mutex
+	c     *cache.Cache
+}
+
+func (s *MemoryDeviceCodeStore) Save(ctx context.Context, d *DeviceAuthorization) error {
+	expiration := time.Until(d.ExpiresAt) + deviceCodeGracePeriod
+	if expiration <= 0 {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// 保存副本，避免调用方修改的时候和轮询的请求并发读写
+	s.c.Set(d.DeviceCode, d.clone(), expiration)
+	s.c.Set(userCodeKey(d.UserCode), d.DeviceCode, expiration)
+	return nil
+}
+
+func (s *MemoryDeviceCodeStore) Get(ctx context.Context, deviceCode string) (*DeviceAuthorization, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.get(deviceCode)
+}
+
+func (s *MemoryDeviceCodeStore) GetByUserCode(ctx context.Context, userCode string) (*DeviceAuthorization, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	val, ok := s.c.Get(userCodeKey(userCode))
+	if !ok {
+		return nil, ErrDeviceCodeNotFound
+	}
+	return s.get(val.(string))
+}
+
+func (s *MemoryDeviceCodeStore) Poll(ctx context.Context, deviceCode string,
+	polledAt time.Time, interval time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	val, ok := s.c.Get(deviceCode)
+	if !ok {
+		return ErrDeviceCodeNotFound
+	}
+	// 缓存里面的是副本，读也是在锁里面复制出去的，所以可以直接修改
+	d := val.(*DeviceAuthorization)
+	d.LastPolledAt = polledAt
+	d.Interval = interval
+	return nil
+}
+
+func (s *MemoryDeviceCodeStore) Decide(ctx context.Context, d *DeviceAuthorization) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	val, ok := s.c.Get(d.DeviceCode)
+	if !ok {
+		return ErrDeviceCodeNotFound
+	}
+	cur := val.(*DeviceAuthorization)
+	// 两个人同时提交的时候，只有第一个能生效
+	if cur.Status != DeviceAuthorizationPending {
+		return ErrDeviceCodeNotFound
+	}
+	cur.Status = d.Status
+	cur.Scopes = slices.Clone(d.Scopes)
+	cur.UserID = d.UserID
+	cur.AuthTime = d.AuthTime
+	cur.AMR = slices.Clone(d.AMR)
+	cur.SID = d.SID
+	return nil
+}
+
+func (s *MemoryDeviceCodeStore) Take(ctx context.Context, deviceCode string) (*DeviceAuthorization, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	d, err := s.get(deviceCode)
+	if err != nil {
+		return nil, err
+	}
+	s.c.Delete(deviceCode)
+	s.c.Delete(userCodeKey(d.UserCode))
+	return d, nil
+}
+
+func (s *MemoryDeviceCodeStore) get(deviceCode string) (*DeviceAuthorization, error) {
+	val, ok := s.c.Get(deviceCode)
+	if !ok {
+		return nil, ErrDeviceCodeNotFound
+	}
+	return val.(*DeviceAuthorization).clone(), nil
+}
+
+// userCodeKey user code 和 device code 放在同一个缓存里面，加上前缀避免冲突
+func userCodeKey(userCode string) string {
+	return "user_code:" + userCode
+}
+
+// deviceCodeGracePeriod 设备授权过期之后还要保留的时间，设备的轮询间隔远远小于它
+const deviceCodeGracePeriod = time.Minute * 10
+
+// NewMemoryDeviceCodeStore 创建一个内存版本的 DeviceCodeStore
+// 每一个设备授权的过期时间由 DeviceAuthorization.ExpiresAt 决定，过期之后再保留 10 分钟
+func NewMemoryDeviceCodeStore() *MemoryDeviceCodeStore {
+	return &MemoryDeviceCodeStore{
+		c: cache.New(cache.NoExpiration, time.Minute),
+	}
+}
+
+type MemoryDeviceCodeStore struct {
+	mutex sync.Mutex
+	c     *cache.Cache
+}
@@ -0,0 +1,367 @@
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/skip2/go-qrcode"
+	"html/template"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"ssoauth2/sso/totp"
+	webContext "ssoauth2/web/context"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 认证方式，取值见 RFC 8176
+const (
+	amrPassword = "pwd"
+	amrOTP      = "otp"
+	amrMFA      = "mfa"
+)
+
+const (
+	// maxMFAFailures 第二步认证连续失败这么多次之后，必须重新输入密码
+	maxMFAFailures = 5
+	// mfaTimeout 密码校验通过之后，必须在这个时间内完成第二步认证
+	mfaTimeout        = time.Minute * 5
+	recoveryCodeCount = 10
+)
+
+// loginMFA 是登录的第二步
+// 已经登录的用户，在客户端通过 acr_values 要求多因素认证的时候，也是通过它补充认证
+func (s *Server) loginMFA(ctx *webContext.Context) {
+	page, client, ok := s.loginTarget(ctx)
+	if !ok {
+		_ = ctx.RespString(http.StatusBadRequest, "登录失败")
+		return
+	}
+	reqCtx := ctx.Request.Context()
+	ck, err := ctx.Request.Cookie(s.cookieName)
+	if err != nil {
+		_ = ctx.RespString(http.StatusUnauthorized, "请登录")
+		return
+	}
+	sess, err := s.sessions.Get(reqCtx, ck.Value)
+	if err != nil || (sess.MFAPending && time.Since(sess.AuthTime) > mfaTimeout) {
+		_ = ctx.RespString(http.StatusUnauthorized, "请重新登录")
+		return
+	}
+	// 第二步认证和密码共用失败次数，账号被锁定的时候也不能继续猜验证码
+	status, err := s.limiter.check(reqCtx, sess.Account, ctx.Request)
+	if err != nil {
+		_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+		return
+	}
+	if status.retryAfter > 0 {
+		seconds := int(math.Ceil(status.retryAfter.Seconds()))
+		ctx.Response.Header().Set("Retry-After", strconv.Itoa(seconds))
+		_ = ctx.RespString(http.StatusTooManyRequests, "验证失败次数过多，请稍后再试")
+		return
+	}
+	code, _ := ctx.FormValue("code").String()
+	ok, err = s.verifySecondFactor(reqCtx, sess.UserID, code)
+	if err != nil {
+		_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+		return
+	}
+	if !ok {
+		if _, err = s.limiter.fail(reqCtx, sess.Account, ctx.Request); err != nil {
+			_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+			return
+		}
+		sess.MFAFailures++
+		if sess.MFAFailures >= maxMFAFailures {
+			// 验证码只有一百万种可能，不能让人无限地试下去
+			// 重新登录的时候从原来的 session 带过来的客户端，也要通知它们退出登录
+			s.notifyLogout(reqCtx, sess)
+			_ = s.sessions.Remove(reqCtx, sess.ID)
+			s.setSessionCookie(ctx, sess.ID, -1)
+			_ = ctx.RespString(http.StatusUnauthorized, "验证失败次数过多，请重新登录")
+			return
+		}
+		if err = s.sessions.Save(reqCtx, sess); err != nil {
+			_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+			return
+		}
+		page.Error = "验证码错误"
+		// Render 总是会把响应码设置成 200
+		page.CSRFToken = s.csrf.Token(ctx)
+		if err = ctx.Render("mfa.gohtml", page); err == nil {
+			ctx.RespStatusCode = http.StatusBadRequest
+		}
+		return
+	}
+	if err = s.limiter.succeed(reqCtx, sess.Account); err != nil {
+		_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+		return
+	}
+	sess, err = s.upgradeSession(ctx, sess)
+	if err != nil {
+		_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+		return
+	}
+	s.finishLogin(ctx, client, sess, page)
+}
+
+// enrollMFA 生成 TOTP 密钥，展示绑定页面，用户用 App 扫码之后输入验证码确认
+func (s *Server) enrollMFA(ctx *webContext.Context) {
+	cont, _ := ctx.FormValue("continue").String()
+	if cont != "" && !isLocalPath(cont) {
+		_ = ctx.RespString(http.StatusBadRequest, "非法的请求")
+		return
+	}
+	sess, err := s.currentSession(ctx)
+	if err != nil {
+		_ = ctx.Render("login.gohtml", loginPage{
+			Continue:  "/mfa/enroll?" + ctx.Request.URL.RawQuery,
+			CSRFToken: s.csrf.Token(ctx),
+		})
+		return
+	}
+	reqCtx := ctx.Request.Context()
+	if _, err = s.mfa.Get(reqCtx, sess.UserID); !errors.Is(err, ErrMFANotEnrolled) {
+		if err == nil {
+			_ = ctx.RespString(http.StatusConflict, "已经绑定过了")
+			return
+		}
+		_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+		return
+	}
+	// 刷新页面或者浏览器预加载的时候不能换密钥，否则用户刚扫的码就失效了
+	if sess.EnrollingSecret == "" {
+		secret, err := totp.NewSecret()
+		if err != nil {
+			_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+			return
+		}
+		// 密钥先放在 session 里面，确认之后才保存，避免用户没扫码就把自己锁在外面
+		sess.EnrollingSecret = secret
+		if err = s.sessions.Save(reqCtx, sess); err != nil {
+			_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+			return
+		}
+	}
+	_ = ctx.Render("mfa_enroll.gohtml", s.newEnrollPage(ctx, sess, cont))
+}
+
+// confirmMFA 校验 App 生成的第一个验证码，校验通过才真正开启多因素认证
+func (s *Server) confirmMFA(ctx *webContext.Context) {
+	cont, _ := ctx.FormValue("continue").String()
+	if cont != "" && !isLocalPath(cont) {
+		_ = ctx.RespString(http.StatusBadRequest, "非法的请求")
+		return
+	}
+	sess, err := s.currentSession(ctx)
+	if err != nil {
+		_ = ctx.RespString(http.StatusUnauthorized, "请登录")
+		return
+	}
+	if sess.EnrollingSecret == "" {
+		_ = ctx.RespString(http.StatusBadRequest, "请先获取密钥")
+		return
+	}
+	reqCtx := ctx.Request.Context()
+	code, _ := ctx.FormValue("code").String()
+	step, ok := totp.Validate(sess.EnrollingSecret, strings.TrimSpace(code), time.Now(), 1)
+	if !ok {
+		page := s.newEnrollPage(ctx, sess, cont)
+		page.Error = "验证码错误"
+		if err = ctx.Render("mfa_enroll.gohtml", page); err == nil {
+			ctx.RespStatusCode = http.StatusBadRequest
+		}
+		return
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+		return
+	}
+	// 同时提交两次的时候，只有一次能成功，否则先展示的那一组恢复码就用不了了
+	err = s.mfa.Create(reqCtx, &MFAEnrollment{
+		UserID:             sess.UserID,
+		TOTPSecret:         sess.EnrollingSecret,
+		RecoveryCodeHashes: hashes,
+		LastUsedStep:       step,
+		CreatedAt:          time.Now(),
+	})
+	if errors.Is(err, ErrMFAEnrolled) {
+		_ = ctx.RespString(http.StatusConflict, "已经绑定过了")
+		return
+	}
+	if err != nil {
+		_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+		return
+	}
+	// 刚刚输入了 App 生成的验证码，相当于已经通过了第二步认证
+	if _, err = s.upgradeSession(ctx, sess); err != nil {
+		_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+		return
+	}
+	_ = ctx.Render("mfa_recovery.gohtml", recoveryCodesPage{Codes: codes, Continue: cont})
+}
+
+// stepUpMFA 客户端要求多因素认证，但是用户只通过了密码认证
+// 绑定过 TOTP 的去输入验证码，没有绑定的先去绑定，完成之后再回到授权页面
+func (s *Server) stepUpMFA(ctx *webContext.Context, req *authorizeRequest, sess *Session) {
+	if s.mfa == nil {
+		s.redirectError(ctx, req, newOAuth2Error(errAccessDenied, "multi-factor authentication is not available"))
+		return
+	}
+	cont := "/authorize?" + ctx.Request.URL.RawQuery
+	_, err := s.mfa.Get(ctx.Request.Context(), sess.UserID)
+	switch {
+	case err == nil:
+		_ = ctx.Render("mfa.gohtml", loginPage{Continue: cont, CSRFToken: s.csrf.Token(ctx)})
+	case errors.Is(err, ErrMFANotEnrolled):
+		ctx.Redirect("/mfa/enroll?" + url.Values{"continue": {cont}}.Encode())
+	default:
+		s.redirectError(ctx, req, newOAuth2Error(errServerError, "failed to load mfa enrollment"))
+	}
+}
+
+// verifySecondFactor 校验 TOTP 验证码或者恢复码
+func (s *Server) verifySecondFactor(ctx context.Context, userID string, code string) (bool, error) {
+	e, err := s.mfa.Get(ctx, userID)
+	if errors.Is(err, ErrMFANotEnrolled) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	code = strings.TrimSpace(code)
+	if len(code) == totp.Digits {
+		step, ok := totp.Validate(e.TOTPSecret, code, time.Now(), 1)
+		if !ok {
+			return false, nil
+		}
+		// 同一个验证码不能用两次，两个请求同时提交的时候只有一个能成功
+		return s.mfa.UseStep(ctx, userID, step)
+	}
+	code = normalizeRecoveryCode(code)
+	for _, hash := range e.RecoveryCodeHashes {
+		if verifyHash(hash, code) {
+			return s.mfa.UseRecoveryCode(ctx, userID, hash)
+		}
+	}
+	return false, nil
+}
+
+// upgradeSession 通过第二步认证之后，换一个新的 session，避免会话固定攻击
+func (s *Server) upgradeSession(ctx *webContext.Context, old *Session) (*Session, error) {
+	amr := slices.Clone(old.AMR)
+	for _, method := range []string{amrOTP, amrMFA} {
+		if !slices.Contains(amr, method) {
+			amr = append(amr, method)
+		}
+	}
+	// SID 和登录过的客户端不变，对业务方来说还是同一次登录
+	sess := &Session{
+		ID:       uuid.New().String(),
+		SID:      old.SID,
+		UserID:   old.UserID,
+		Account:  old.Account,
+		AuthTime: time.Now(),
+		AMR:      amr,
+		Clients:  old.Clients,
+	}
+	reqCtx := ctx.Request.Context()
+	if err := s.sessions.Save(reqCtx, sess); err != nil {
+		return nil, err
+	}
+	_ = s.sessions.Remove(reqCtx, old.ID)
+	s.setSessionCookie(ctx, sess.ID, int(s.sessionExpiration.Seconds()))
+	return sess, nil
+}
+
+// mfaEnrolled 判断用户是不是需要第二步认证
+func (s *Server) mfaEnrolled(ctx context.Context, userID string) (bool, error) {
+	if s.mfa == nil {
+		return false, nil
+	}
+	_, err := s.mfa.Get(ctx, userID)
+	if errors.Is(err, ErrMFANotEnrolled) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *Server) newEnrollPage(ctx *webContext.Context, sess *Session, cont string) enrollPage {
+	account := sess.UserID
+	if user, err := s.findUser(ctx.Request.Context(), sess.UserID); err == nil && user.Email != "" {
+		account = user.Email
+	}
+	issuer := s.issuer
+	if u, err := url.Parse(s.issuer); err == nil && u.Host != "" {
+		issuer = u.Host
+	}
+	page := enrollPage{
+		Secret:    sess.EnrollingSecret,
+		URI:       totp.URI(issuer, account, sess.EnrollingSecret),
+		Continue:  cont,
+		CSRFToken: s.csrf.Token(ctx),
+	}
+	// 生成失败的时候用户还可以手动输入密钥，所以不影响绑定
+	if png, err := qrcode.Encode(page.URI, qrcode.Medium, 256); err == nil {
+		page.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	}
+	return page
+}
+
+// hasMFA 判断 session 是不是通过了多因素认证
+func (sess *Session) hasMFA() bool {
+	return slices.Contains(sess.AMR, amrMFA)
+}
+
+func (e *MFAEnrollment) clone() *MFAEnrollment {
+	cp := *e
+	cp.RecoveryCodeHashes = slices.Clone(e.RecoveryCodeHashes)
+	return &cp
+}
+
+// newRecoveryCodes 生成恢复码，返回明文和哈希，明文只会展示给用户一次
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		bs := make([]byte, 5)
+		if _, err := rand.Read(bs); err != nil {
+			return nil, nil, err
+		}
+		// 5 个字节正好是 8 个 base32 字符，分成两段方便抄写
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(bs))
+		hash, err := HashSecret(code)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, code[:4]+"-"+code[4:])
+		hashes = append(hashes, hash)
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+type enrollPage struct {
+	Secret string
+	// URI 是 otpauth:// 地址，QRCode 是它的二维码图片，data URI 格式
+	URI       string
+	QRCode    template.URL
+	Continue  string
+	Error     string
+	CSRFToken string
+}
+
+type recoveryCodesPage struct {
+	Codes    []string
+	Continue string
+}
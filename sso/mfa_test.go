@@ -0,0 +1,322 @@
+package sso
+
+import (
+	"context"
+	"crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/url"
+	"regexp"
+	"ssoauth2/sso/jwt"
+	"ssoauth2/sso/totp"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testTOTPSecret 就是 RFC 6238 里面的 12345678901234567890
+const testTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func totpCode(t *testing.T, secret string, at time.Time) string {
+	code, err := totp.Code(secret, at)
+	require.NoError(t, err)
+	return code
+}
+
+// newMFATestServer 用户 123 已经绑定了 TOTP，恢复码是 aaaa-bbbb
+func newMFATestServer(t *testing.T, opts ...ServerOption) (*Server, *MemoryMFAStore) {
+	hash, err := HashSecret("aaaabbbb")
+	require.NoError(t, err)
+	store := NewMemoryMFAStore()
+	require.NoError(t, store.Create(context.Background(), &MFAEnrollment{
+		UserID:             "123",
+		TOTPSecret:         testTOTPSecret,
+		RecoveryCodeHashes: []string{hash},
+		CreatedAt:          time.Now(),
+	}))
+	return newTestServer(append([]ServerOption{ServerWithMFAStore(store)}, opts...)...), store
+}
+
+// passwordStep 输入密码，返回还没有通过第二步认证的 ssid
+func passwordStep(t *testing.T, s http.Handler) *http.Cookie {
+	resp := postForm(s, "/login", url.Values{
+		"continue": {"/authorize"},
+		"email":    {"123@qq.com"},
+		"password": {"123456"},
+	})
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), `action="/login/mfa"`)
+	ssid := findCookie(resp, "ssid")
+	require.NotNil(t, ssid)
+	return ssid
+}
+
+func TestServer_LoginMFA(t *testing.T) {
+	s, store := newMFATestServer(t)
+
+	ssid := passwordStep(t, s)
+	// 只输入了密码，还不算登录
+	resp := getWithCookies(s, "/authorize?"+authorizeQuery().Encode(), ssid)
+	assert.Contains(t, resp.Body.String(), `action="/login"`)
+
+	code := totpCode(t, testTOTPSecret, time.Now())
+	resp = postForm(s, "/login/mfa", url.Values{"continue": {"/authorize"}, "code": {code}}, ssid)
+	require.Equal(t, http.StatusFound, resp.Code)
+	assert.Equal(t, "/authorize", resp.Header().Get("Location"))
+	newSSID := findCookie(resp, "ssid")
+	require.NotNil(t, newSSID)
+	// 换了一个新的 session，老的作废
+	assert.NotEqual(t, ssid.Value, newSSID.Value)
+	_, err := s.sessions.Get(context.Background(), ssid.Value)
+	assert.Equal(t, ErrSessionNotFound, err)
+	sess, err := s.sessions.Get(context.Background(), newSSID.Value)
+	require.NoError(t, err)
+	assert.Equal(t, []string{amrPassword, amrOTP, amrMFA}, sess.AMR)
+
+	// 同一个验证码不能再用一次
+	ssid = passwordStep(t, s)
+	resp = postForm(s, "/login/mfa", url.Values{"continue": {"/authorize"}, "code": {code}}, ssid)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	// 恢复码只能用一次
+	resp = postForm(s, "/login/mfa", url.Values{"continue": {"/authorize"}, "code": {"AAAA-BBBB"}}, ssid)
+	require.Equal(t, http.StatusFound, resp.Code)
+	e, err := store.Get(context.Background(), "123")
+	require.NoError(t, err)
+	assert.Empty(t, e.RecoveryCodeHashes)
+	ssid = passwordStep(t, s)
+	resp = postForm(s, "/login/mfa", url.Values{"continue": {"/authorize"}, "code": {"aaaa-bbbb"}}, ssid)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	// 老的 app_id + redirect_uri 流程
+	resp = postForm(s, "/login", url.Values{
+		"app_id":       {"app1"},
+		"redirect_uri": {"http://app1.com:8081/profile"},
+		"email":        {"123@qq.com"},
+		"password":     {"123456"},
+	})
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), `value="app1"`)
+}
+
+func TestServer_LoginMFAFailures(t *testing.T) {
+	// 放宽账号的限制，只测试 session 里面的失败次数
+	limiter := NewLoginLimiter(NewMemoryAttemptStore(), LoginLimiterWithAccountPolicy(LockoutPolicy{FreeAttempts: 100}))
+	s, _ := newMFATestServer(t, ServerWithLoginLimiter(limiter))
+	ssid := passwordStep(t, s)
+	for i := 1; i < maxMFAFailures; i++ {
+		resp := postForm(s, "/login/mfa", url.Values{"continue": {"/authorize"}, "code": {"000000"}}, ssid)
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+	}
+	resp := postForm(s, "/login/mfa", url.Values{"continue": {"/authorize"}, "code": {"000000"}}, ssid)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	// 必须重新输入密码
+	resp = postForm(s, "/login/mfa", url.Values{
+		"continue": {"/authorize"},
+		"code":     {totpCode(t, testTOTPSecret, time.Now())},
+	}, ssid)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// 不能跳转到站外
+	ssid = passwordStep(t, s)
+	resp = postForm(s, "/login/mfa", url.Values{
+		"continue": {"//evil.com"},
+		"code":     {totpCode(t, testTOTPSecret, time.Now())},
+	}, ssid)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestServer_EnrollMFA(t *testing.T) {
+	store := NewMemoryMFAStore()
+	s := newTestServer(ServerWithMFAStore(store), ServerWithIssuer("https://sso.example.com"))
+
+	// 没有登录
+	resp := getWithCookies(s, "/mfa/enroll")
+	assert.Contains(t, resp.Body.String(), `action="/login"`)
+
+	ssid := login(t, s)
+	resp = getWithCookies(s, "/mfa/enroll?continue=%2Fauthorize", ssid)
+	require.Equal(t, http.StatusOK, resp.Code)
+	sess, err := s.sessions.Get(context.Background(), ssid.Value)
+	require.NoError(t, err)
+	secret := sess.EnrollingSecret
+	require.NotEmpty(t, secret)
+	assert.Contains(t, resp.Body.String(), "otpauth://totp/sso.example.com:123@qq.com?")
+	assert.Contains(t, resp.Body.String(), `<img src="data:image/png;base64,`)
+	assert.Contains(t, resp.Body.String(), "<code>"+secret+"</code>")
+
+	// 刷新页面不会换密钥
+	resp = getWithCookies(s, "/mfa/enroll?continue=%2Fauthorize", ssid)
+	require.Equal(t, http.StatusOK, resp.Code)
+	sess, err = s.sessions.Get(context.Background(), ssid.Value)
+	require.NoError(t, err)
+	assert.Equal(t, secret, sess.EnrollingSecret)
+
+	resp = postForm(s, "/mfa/enroll", url.Values{"code": {"000000"}}, ssid)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	_, err = store.Get(context.Background(), "123")
+	assert.Equal(t, ErrMFANotEnrolled, err)
+
+	resp = postForm(s, "/mfa/enroll", url.Values{
+		"continue": {"/authorize"},
+		"code":     {totpCode(t, secret, time.Now())},
+	}, ssid)
+	require.Equal(t, http.StatusOK, resp.Code)
+	codes := regexp.MustCompile(`<li>([a-z2-7]{4}-[a-z2-7]{4})</li>`).FindAllStringSubmatch(resp.Body.String(), -1)
+	assert.Len(t, codes, recoveryCodeCount)
+	assert.Contains(t, resp.Body.String(), `href="/authorize"`)
+	newSSID := findCookie(resp, "ssid")
+	require.NotNil(t, newSSID)
+	sess, err = s.sessions.Get(context.Background(), newSSID.Value)
+	require.NoError(t, err)
+	assert.True(t, sess.hasMFA())
+
+	e, err := store.Get(context.Background(), "123")
+	require.NoError(t, err)
+	assert.Equal(t, secret, e.TOTPSecret)
+	assert.Len(t, e.RecoveryCodeHashes, recoveryCodeCount)
+	for _, code := range codes {
+		assert.NotContains(t, e.RecoveryCodeHashes, code[1])
+	}
+
+	// 已经绑定过了
+	resp = getWithCookies(s, "/mfa/enroll", newSSID)
+	assert.Equal(t, http.StatusConflict, resp.Code)
+}
+
+func TestServer_AuthorizeACRValues(t *testing.T) {
+	s := newTestServer(ServerWithMFAStore(NewMemoryMFAStore()), ServerWithIssuer("https://sso.example.com"))
+	ssid := login(t, s)
+	// 另外一个设备上，在绑定之前登录的
+	other := login(t, s)
+	query := authorizeQuery()
+	query.Set("scope", "openid")
+	query.Set("acr_values", acrMFA+" "+acrPassword)
+
+	// 没有绑定，先去绑定，绑定完成之后回到授权页面
+	resp := getWithCookies(s, "/authorize?"+query.Encode(), ssid)
+	require.Equal(t, http.StatusFound, resp.Code)
+	location, err := url.Parse(resp.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "/mfa/enroll", location.Path)
+	assert.Equal(t, "/authorize?"+query.Encode(), location.Query().Get("continue"))
+	// 直接提交授权也不行
+	resp = postForm(s, "/authorize", func() url.Values {
+		form := url.Values{"decision": {"approve"}}
+		for key, vals := range query {
+			form[key] = vals
+		}
+		return form
+	}(), ssid)
+	require.Equal(t, http.StatusFound, resp.Code)
+	location, err = url.Parse(resp.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, errAccessDenied, location.Query().Get("error"))
+
+	getWithCookies(s, "/mfa/enroll", ssid)
+	sess, err := s.sessions.Get(context.Background(), ssid.Value)
+	require.NoError(t, err)
+	resp = postForm(s, "/mfa/enroll", url.Values{"code": {totpCode(t, sess.EnrollingSecret, time.Now())}}, ssid)
+	require.Equal(t, http.StatusOK, resp.Code)
+	ssid = findCookie(resp, "ssid")
+
+	resp = getWithCookies(s, "/authorize?"+query.Encode(), ssid)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), `name="acr_values"`)
+	tkResp := exchangeCode(t, s, authorizeCode(t, s, ssid, query))
+	var claims idTokenClaims
+	_, err = jwt.Parse(tkResp.IDToken, func(header *jwt.Header) (crypto.PublicKey, error) {
+		return s.keyManager.PublicKey(context.Background(), header.Kid)
+	}, &claims)
+	require.NoError(t, err)
+	assert.Equal(t, acrMFA, claims.ACR)
+	assert.Equal(t, []string{amrPassword, amrOTP, amrMFA}, claims.AMR)
+
+	// 已经绑定了，但是这个 session 只通过了密码认证，要补充认证
+	resp = getWithCookies(s, "/authorize?"+query.Encode(), other)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), `action="/login/mfa"`)
+
+	// 没有开启多因素认证
+	s = newTestServer()
+	ssid = login(t, s)
+	resp = getWithCookies(s, "/authorize?"+query.Encode(), ssid)
+	require.Equal(t, http.StatusFound, resp.Code)
+	location, err = url.Parse(resp.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, errAccessDenied, location.Query().Get("error"))
+}
+
+func TestServer_LoginMFALockout(t *testing.T) {
+	s, _ := newMFATestServer(t)
+	ssid := passwordStep(t, s)
+	for i := 0; i <= DefaultAccountPolicy.FreeAttempts; i++ {
+		resp := postForm(s, "/login/mfa", url.Values{"continue": {"/authorize"}, "code": {"000000"}}, ssid)
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+	}
+	// 验证码错误和密码错误一起计入账号的失败次数
+	resp := postForm(s, "/login/mfa", url.Values{"continue": {"/authorize"}, "code": {"000000"}}, ssid)
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	// 重新输入正确的密码也不能清零
+	resp = postForm(s, "/login", url.Values{
+		"continue": {"/authorize"},
+		"email":    {"123@qq.com"},
+		"password": {"123456"},
+	})
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+}
+
+func TestServer_VerifySecondFactorConcurrently(t *testing.T) {
+	s, _ := newMFATestServer(t)
+	for _, code := range []string{totpCode(t, testTOTPSecret, time.Now()), "aaaa-bbbb"} {
+		var (
+			wg     sync.WaitGroup
+			passed atomic.Int32
+		)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ok, err := s.verifySecondFactor(context.Background(), "123", code)
+				assert.NoError(t, err)
+				if ok {
+					passed.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		// 同时提交同一个验证码或者恢复码，只有一个能通过
+		assert.Equal(t, int32(1), passed.Load())
+	}
+}
+
+func TestMemoryMFAStore(t *testing.T) {
+	store := NewMemoryMFAStore()
+	ctx := context.Background()
+	e := &MFAEnrollment{UserID: "123", RecoveryCodeHashes: []string{"a", "b"}}
+	require.NoError(t, store.Create(ctx, e))
+	assert.Equal(t, ErrMFAEnrolled, store.Create(ctx, e))
+
+	ok, err := store.UseStep(ctx, "123", 10)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = store.UseStep(ctx, "123", 10)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = store.UseRecoveryCode(ctx, "123", "a")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = store.UseRecoveryCode(ctx, "123", "a")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	got, err := store.Get(ctx, "123")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b"}, got.RecoveryCodeHashes)
+	assert.Equal(t, int64(10), got.LastUsedStep)
+
+	_, err = store.UseStep(ctx, "456", 10)
+	assert.Equal(t, ErrMFANotEnrolled, err)
+}
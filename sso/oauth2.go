@@ -0,0 +1,162 @@
+package sso
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	webContext "ssoauth2/web/context"
+	"strings"
+)
+
+// RFC 6749 里面定义的错误码
+const (
+	errInvalidRequest          = "invalid_request"
+	errInvalidClient           = "invalid_client"
+	errInvalidGrant            = "invalid_grant"
+	errUnauthorizedClient      = "unauthorized_client"
+	errUnsupportedGrantType    = "unsupported_grant_type"
+	errUnsupportedResponseType = "unsupported_response_type"
+	errInvalidScope            = "invalid_scope"
+	errAccessDenied            = "access_denied"
+	errServerError             = "server_error"
+	// errInvalidRedirectURI 和 errInvalidClientMetadata 是 RFC 7591 定义的
+	errInvalidRedirectURI    = "invalid_redirect_uri"
+	errInvalidClientMetadata = "invalid_client_metadata"
+	// 下面这些是 OIDC 定义的，prompt=none 的时候需要用户参与就返回这些错误
+	errLoginRequired       = "login_required"
+	errConsentRequired     = "consent_required"
+	errInteractionRequired = "interaction_required"
+	// 下面这些是 RFC 8628 定义的，设备轮询 token 接口的时候返回
+	errAuthorizationPending = "authorization_pending"
+	errSlowDown             = "slow_down"
+	errExpiredToken         = "expired_token"
+)
+
+// oauth2Error 是 OAuth2 协议的错误响应
+// 注意 error_description 按照 RFC 只能是 ASCII 字符，所以这里不用中文
+type oauth2Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+	// status 在 JSON 接口上返回的 HTTP 状态码
+	status int
+}
+
+func (e *oauth2Error) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+func newOAuth2Error(code string, description string) *oauth2Error {
+	status := http.StatusBadRequest
+	switch code {
+	case errInvalidClient:
+		status = http.StatusUnauthorized
+	case errServerError:
+		status = http.StatusInternalServerError
+	}
+	return &oauth2Error{Code: code, Description: description, status: status}
+}
+
+// respOAuth2JSON 写回 OAuth2 接口的 JSON 响应，
+// 按照 RFC 的要求，这些响应都不允许缓存
+func respOAuth2JSON(ctx *webContext.Context, code int, val any) {
+	bs, err := json.Marshal(val)
+	if err != nil {
+		_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+		return
+	}
+	header := ctx.Response.Header()
+	header.Set("Content-Type", "application/json;charset=UTF-8")
+	header.Set("Cache-Control", "no-store")
+	header.Set("Pragma", "no-cache")
+	ctx.RespStatusCode = code
+	ctx.RespData = bs
+}
+
+func respOAuth2Error(ctx *webContext.Context, e *oauth2Error) {
+	respOAuth2JSON(ctx, e.status, e)
+}
+
+// authenticateClient 认证调用 token 之类接口的客户端
+// 支持 client_secret_basic 和 client_secret_post 两种方式，但是不允许同时使用。
+// 公开客户端没有密钥，只需要带上 client_id，它的安全性由 PKCE 保证
+func (s *Server) authenticateClient(ctx *webContext.Context) (*Client, *oauth2Error) {
+	id, secret, basic := ctx.Request.BasicAuth()
+	if basic {
+		var err error
+		// Basic 认证里面的 id 和密钥是经过 form 编码的
+		if id, err = url.QueryUnescape(id); err != nil {
+			return nil, s.basicAuthError(ctx)
+		}
+		if secret, err = url.QueryUnescape(secret); err != nil {
+			return nil, s.basicAuthError(ctx)
+		}
+		if postSecret, _ := ctx.FormValue("client_secret").String(); postSecret != "" {
+			return nil, newOAuth2Error(errInvalidRequest, "multiple client authentication methods")
+		}
+	} else {
+		id, _ = ctx.FormValue("client_id").String()
+		secret, _ = ctx.FormValue("client_secret").String()
+	}
+	if id == "" {
+		return nil, newOAuth2Error(errInvalidClient, "client authentication required")
+	}
+	client, err := s.activeClient(ctx.Request.Context(), id)
+	if err == nil && client.Public && secret == "" {
+		return client, nil
+	}
+	if err != nil || client.Public || !client.VerifySecret(secret) {
+		if basic {
+			return nil, s.basicAuthError(ctx)
+		}
+		return nil, newOAuth2Error(errInvalidClient, "client authentication failed")
+	}
+	return client, nil
+}
+
+// basicAuthError 使用 Basic 认证失败的时候，要带上 WWW-Authenticate 头部
+func (s *Server) basicAuthError(ctx *webContext.Context) *oauth2Error {
+	ctx.Response.Header().Set("WWW-Authenticate", `Basic realm="sso"`)
+	return newOAuth2Error(errInvalidClient, "client authentication failed")
+}
+
+// bearerToken 按照 RFC 6750 从 Authorization 头部或者表单里面取出 access token
+func bearerToken(ctx *webContext.Context) string {
+	auth := ctx.Request.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	val, _ := ctx.FormValue("access_token").String()
+	return val
+}
+
+// parseScope 解析用空格分隔的 scope
+func parseScope(scope string) []string {
+	return strings.Fields(scope)
+}
+
+// containsAll 判断 target 里面的元素是不是都在 src 里面
+func containsAll(src []string, target []string) bool {
+	for _, t := range target {
+		if !slices.Contains(src, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// appendQuery 在 rawURL 原有的查询参数之上追加 query
+func appendQuery(rawURL string, query url.Values) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	q := u.Query()
+	for key, vals := range query {
+		for _, val := range vals {
+			q.Add(key, val)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
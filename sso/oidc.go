@@ -0,0 +1,194 @@
+package sso
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"ssoauth2/sso/jwt"
+	webContext "ssoauth2/web/context"
+	"strings"
+	"time"
+)
+
+// OIDC 定义的标准 scope
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+	ScopeGroups  = "groups"
+)
+
+// acrPassword 用户只通过了密码认证
+const acrPassword = "urn:ssoauth2:acr:password"
+
+// acrMFA 用户通过了密码和 TOTP 两步认证，客户端可以通过 acr_values 要求这个级别
+const acrMFA = "urn:ssoauth2:acr:mfa"
+
+// issueIDToken 在申请了 openid scope 的时候，颁发 ID token
+func (s *Server) issueIDToken(ctx context.Context, client *Client, code *AuthorizationCode) (string, error) {
+	key, err := s.keyManager.SigningKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	acr := acrPassword
+	if slices.Contains(code.AMR, amrMFA) {
+		acr = acrMFA
+	}
+	claims := idTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.issuer,
+			Subject:   code.UserID,
+			Audience:  jwt.Audience{client.ID},
+			ExpiresAt: now.Add(s.idTokenExpiration).Unix(),
+			IssuedAt:  now.Unix(),
+		},
+		Nonce:           code.Nonce,
+		AuthTime:        code.AuthTime.Unix(),
+		ACR:             acr,
+		AMR:             code.AMR,
+		SID:             code.SID,
+		AuthorizedParty: client.ID,
+	}
+	return jwt.Sign(key, "JWT", claims)
+}
+
+// userinfo 是 OIDC 的 UserInfo 接口，根据 access token 的 scope 返回用户信息
+func (s *Server) userinfo(ctx *webContext.Context) {
+	value := bearerToken(ctx)
+	if value == "" {
+		ctx.Response.Header().Set("WWW-Authenticate", `Bearer realm="sso"`)
+		_ = ctx.RespString(http.StatusUnauthorized, "")
+		return
+	}
+	reqCtx := ctx.Request.Context()
+	tk, err := s.tokens.Get(reqCtx, value)
+	if err != nil || tk.Type != TokenTypeAccess || tk.UserID == "" || !s.ownerActive(reqCtx, tk) {
+		ctx.Response.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		_ = ctx.RespString(http.StatusUnauthorized, "")
+		return
+	}
+	if !slices.Contains(tk.Scopes, ScopeOpenID) {
+		ctx.Response.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+		_ = ctx.RespString(http.StatusForbidden, "")
+		return
+	}
+	user, err := s.findUser(reqCtx, tk.UserID)
+	if err != nil {
+		respOAuth2Error(ctx, newOAuth2Error(errServerError, "failed to load user"))
+		return
+	}
+	res := userinfoResponse{Sub: tk.UserID}
+	if slices.Contains(tk.Scopes, ScopeProfile) {
+		res.Name = user.Name
+	}
+	if slices.Contains(tk.Scopes, ScopeGroups) {
+		res.Groups = user.Groups
+	}
+	if slices.Contains(tk.Scopes, ScopeEmail) {
+		res.Email = user.Email
+	}
+	respOAuth2JSON(ctx, http.StatusOK, res)
+}
+
+// findUser 查询用户信息，没有配置 UserFinder 的时候只知道用户 ID
+func (s *Server) findUser(ctx context.Context, id string) (*User, error) {
+	if s.users == nil {
+		return &User{ID: id}, nil
+	}
+	return s.users.FindByID(ctx, id)
+}
+
+// discovery 是 /.well-known/openid-configuration，客户端据此发现 SSO 的各种接口
+func (s *Server) discovery(ctx *webContext.Context) {
+	issuer := strings.TrimSuffix(s.issuer, "/")
+	doc := discoveryDocument{
+		Issuer:                            s.issuer,
+		AuthorizationEndpoint:             issuer + "/authorize",
+		TokenEndpoint:                     issuer + "/token",
+		UserinfoEndpoint:                  issuer + "/userinfo",
+		IntrospectionEndpoint:             issuer + "/introspect",
+		RevocationEndpoint:                issuer + "/revoke",
+		DeviceAuthorizationEndpoint:       issuer + "/device_authorization",
+		EndSessionEndpoint:                issuer + "/end_session",
+		JWKSURI:                           issuer + "/.well-known/jwks.json",
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{GrantTypeAuthorizationCode, GrantTypeRefreshToken, GrantTypeClientCredentials, GrantTypeDeviceCode},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{s.keyManager.Algorithm()},
+		ScopesSupported:                   []string{ScopeOpenID, ScopeProfile, ScopeEmail, ScopeGroups},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{pkceMethodS256, pkceMethodPlain},
+		ClaimsSupported: []string{"iss", "sub", "aud", "exp", "iat", "auth_time",
+			"nonce", "acr", "amr", "azp", "sid", "name", "email", "groups"},
+		ACRValuesSupported: []string{acrPassword},
+
+		BackchannelLogoutSupported:         true,
+		BackchannelLogoutSessionSupported:  true,
+		FrontchannelLogoutSupported:        true,
+		FrontchannelLogoutSessionSupported: true,
+	}
+	if s.mfa != nil {
+		doc.ACRValuesSupported = append(doc.ACRValuesSupported, acrMFA)
+	}
+	if s.initialAccessToken != "" {
+		doc.RegistrationEndpoint = issuer + "/register"
+	}
+	ctx.Response.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	_ = ctx.RespJSONOK(doc)
+}
+
+// jwks 发布验证签名用的公钥，包括已经轮换掉但是还在保留期内的
+func (s *Server) jwks(ctx *webContext.Context) {
+	set, err := s.keyManager.JWKS(ctx.Request.Context())
+	if err != nil {
+		respOAuth2Error(ctx, newOAuth2Error(errServerError, "failed to load keys"))
+		return
+	}
+	ctx.Response.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	_ = ctx.RespJSONOK(set)
+}
+
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce           string   `json:"nonce,omitempty"`
+	AuthTime        int64    `json:"auth_time"`
+	ACR             string   `json:"acr,omitempty"`
+	AMR             []string `json:"amr,omitempty"`
+	SID             string   `json:"sid,omitempty"`
+	AuthorizedParty string   `json:"azp,omitempty"`
+}
+
+type userinfoResponse struct {
+	Sub    string   `json:"sub"`
+	Name   string   `json:"name,omitempty"`
+	Email  string   `json:"email,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+type discoveryDocument struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	DeviceAuthorizationEndpoint       string   `json:"device_authorization_endpoint"`
+	EndSessionEndpoint                string   `json:"end_session_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	RegistrationEndpoint              string   `json:"registration_endpoint,omitempty"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	ACRValuesSupported                []string `json:"acr_values_supported"`
+
+	BackchannelLogoutSupported         bool `json:"backchannel_logout_supported"`
+	BackchannelLogoutSessionSupported  bool `json:"backchannel_logout_session_supported"`
+	FrontchannelLogoutSupported        bool `json:"frontchannel_logout_supported"`
+	FrontchannelLogoutSessionSupported bool `json:"frontchannel_logout_session_supported"`
+}
@@ -0,0 +1,163 @@
+package sso
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"ssoauth2/sso/jwt"
+	"testing"
+	"time"
+)
+
+// exchangeCode 用授权码换 token
+func exchangeCode(t *testing.T, s http.Handler, code string) tokenResponse {
+	resp := postForm(s, "/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {"http://app1.com:8081/oauth2/callback"},
+		"client_id":     {"app1"},
+		"client_secret": {"app1-secret"},
+	})
+	require.Equal(t, http.StatusOK, resp.Code)
+	var tkResp tokenResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &tkResp))
+	return tkResp
+}
+
+func TestServer_IDToken(t *testing.T) {
+	s := newTestServer(ServerWithIssuer("https://sso.example.com"))
+	ssid := login(t, s)
+
+	// 没有 openid scope 就没有 ID token
+	tkResp := exchangeCode(t, s, authorizeCode(t, s, ssid, authorizeQuery()))
+	assert.Empty(t, tkResp.IDToken)
+
+	query := authorizeQuery()
+	query.Set("scope", "openid profile")
+	query.Set("nonce", "n-0S6_WzA2Mj")
+	tkResp = exchangeCode(t, s, authorizeCode(t, s, ssid, query))
+	require.NotEmpty(t, tkResp.IDToken)
+
+	var claims idTokenClaims
+	header, err := jwt.Parse(tkResp.IDToken, func(header *jwt.Header) (crypto.PublicKey, error) {
+		return s.keyManager.PublicKey(context.Background(), header.Kid)
+	}, &claims)
+	require.NoError(t, err)
+	assert.Equal(t, testSigningKey.ID, header.Kid)
+	assert.NoError(t, claims.Validate(time.Now(), 0))
+	assert.Equal(t, "https://sso.example.com", claims.Issuer)
+	assert.Equal(t, "123", claims.Subject)
+	assert.True(t, claims.Audience.Contains("app1"))
+	assert.Equal(t, "n-0S6_WzA2Mj", claims.Nonce)
+	assert.Equal(t, acrPassword, claims.ACR)
+	assert.NotZero(t, claims.AuthTime)
+	assert.LessOrEqual(t, claims.AuthTime, claims.IssuedAt)
+	// sid 就是 logout token 里面的 sid，不能是 ssid
+	sess, err := s.sessions.Get(context.Background(), ssid.Value)
+	require.NoError(t, err)
+	assert.Equal(t, sess.SID, claims.SID)
+	assert.NotEqual(t, ssid.Value, claims.SID)
+}
+
+func TestServer_Userinfo(t *testing.T) {
+	s := newTestServer()
+	ssid := login(t, s)
+	accessToken := func(scope string) string {
+		query := authorizeQuery()
+		query.Set("scope", scope)
+		return exchangeCode(t, s, authorizeCode(t, s, ssid, query)).AccessToken
+	}
+	testCases := []struct {
+		name  string
+		token string
+
+		wantCode int
+		wantResp userinfoResponse
+	}{
+		{
+			name:     "只有 openid",
+			token:    accessToken("openid"),
+			wantCode: http.StatusOK,
+			wantResp: userinfoResponse{Sub: "123"},
+		},
+		{
+			name:     "openid profile email",
+			token:    accessToken("openid profile email"),
+			wantCode: http.StatusOK,
+			wantResp: userinfoResponse{Sub: "123", Name: "小明", Email: "123@qq.com"},
+		},
+		{
+			name:     "openid groups",
+			token:    accessToken("openid groups"),
+			wantCode: http.StatusOK,
+			wantResp: userinfoResponse{Sub: "123", Groups: []string{"dev"}},
+		},
+		{
+			name:     "没有 openid",
+			token:    accessToken("profile"),
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "非法的 token",
+			token:    "unknown",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "没有 token",
+			wantCode: http.StatusUnauthorized,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+			assert.Equal(t, tc.wantCode, resp.Code)
+			if tc.wantCode != http.StatusOK {
+				assert.NotEmpty(t, resp.Header().Get("WWW-Authenticate"))
+				return
+			}
+			var res userinfoResponse
+			require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &res))
+			assert.Equal(t, tc.wantResp, res)
+		})
+	}
+}
+
+func TestServer_Discovery(t *testing.T) {
+	s := newTestServer(ServerWithIssuer("https://sso.example.com"))
+	resp := getWithCookies(s, "/.well-known/openid-configuration")
+	require.Equal(t, http.StatusOK, resp.Code)
+	var doc discoveryDocument
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &doc))
+	assert.Equal(t, "https://sso.example.com", doc.Issuer)
+	assert.Equal(t, "https://sso.example.com/token", doc.TokenEndpoint)
+	assert.Equal(t, "https://sso.example.com/userinfo", doc.UserinfoEndpoint)
+	assert.Equal(t, "https://sso.example.com/.well-known/jwks.json", doc.JWKSURI)
+	assert.Equal(t, []string{jwt.ES256}, doc.IDTokenSigningAlgValuesSupported)
+	assert.Contains(t, doc.ScopesSupported, ScopeOpenID)
+	assert.Contains(t, doc.GrantTypesSupported, GrantTypeClientCredentials)
+}
+
+func TestServer_JWKS(t *testing.T) {
+	s := newTestServer()
+	resp := getWithCookies(s, "/.well-known/jwks.json")
+	require.Equal(t, http.StatusOK, resp.Code)
+	var set jwt.JWKSet
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &set))
+	jwk, ok := set.Key(testSigningKey.ID)
+	require.True(t, ok)
+	assert.Equal(t, "EC", jwk.Kty)
+	assert.Equal(t, jwt.ES256, jwk.Alg)
+	pub, err := jwk.PublicKey()
+	require.NoError(t, err)
+	assert.Equal(t, testSigningKey.Private.Public(), pub)
+}
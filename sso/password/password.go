@@ -0,0 +1,174 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+var (
+	ErrMalformedHash = errors.New("password: 非法的密码哈希")
+	ErrUnknownHash   = errors.New("password: 不支持的密码哈希算法")
+)
+
+// Hasher 计算密码的哈希
+// 所有的实现都把算法和参数编码在哈希里面，所以不同的 Hasher 产生的哈希都可以用 Verify 校验
+type Hasher interface {
+	Hash(password string) (string, error)
+	// NeedsRehash 哈希使用的算法或者参数和当前的配置不一致，
+	// 用户下次登录成功的时候应该用当前的配置重新计算
+	NeedsRehash(hash string) bool
+}
+
+// Verify 校验密码，支持 bcrypt 和 argon2id 两种格式的哈希
+// 密码不对的时候返回 false 和 nil，只有哈希本身有问题的时候才返回 error
+func Verify(hash string, password string) (bool, error) {
+	switch {
+	case isBcrypt(hash):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("%w: %w", ErrMalformedHash, err)
+		}
+		return true, nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		params, salt, sum, err := parseArgon2id(hash)
+		if err != nil {
+			return false, err
+		}
+		other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(sum)))
+		return subtle.ConstantTimeCompare(sum, other) == 1, nil
+	default:
+		return false, ErrUnknownHash
+	}
+}
+
+func (b *Bcrypt) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.cost)
+	return string(hash), err
+}
+
+func (b *Bcrypt) NeedsRehash(hash string) bool {
+	if !isBcrypt(hash) {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != b.cost
+}
+
+// NewBcrypt cost 不在 bcrypt 允许的范围内的时候使用 bcrypt.DefaultCost
+// 注意 bcrypt 只会使用密码的前 72 个字节
+func NewBcrypt(cost int) *Bcrypt {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		cost = bcrypt.DefaultCost
+	}
+	return &Bcrypt{cost: cost}
+}
+
+type Bcrypt struct {
+	cost int
+}
+
+// Hash 输出的是 PHC 格式，例如 $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>
+func (a *Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, a.params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	sum := argon2.IDKey([]byte(password), salt, a.params.Time, a.params.Memory, a.params.Threads, a.params.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		a.params.Memory, a.params.Time, a.params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(sum)), nil
+}
+
+func (a *Argon2id) NeedsRehash(hash string) bool {
+	params, salt, sum, err := parseArgon2id(hash)
+	if err != nil {
+		return true
+	}
+	return params.Memory != a.params.Memory || params.Time != a.params.Time ||
+		params.Threads != a.params.Threads ||
+		uint32(len(salt)) != a.params.SaltLength || uint32(len(sum)) != a.params.KeyLength
+}
+
+// NewArgon2id 参数为零值的字段使用 DefaultArgon2idParams 里面的值
+func NewArgon2id(params Argon2idParams) *Argon2id {
+	if params.Memory == 0 {
+		params.Memory = DefaultArgon2idParams.Memory
+	}
+	if params.Time == 0 {
+		params.Time = DefaultArgon2idParams.Time
+	}
+	if params.Threads == 0 {
+		params.Threads = DefaultArgon2idParams.Threads
+	}
+	if params.SaltLength == 0 {
+		params.SaltLength = DefaultArgon2idParams.SaltLength
+	}
+	if params.KeyLength == 0 {
+		params.KeyLength = DefaultArgon2idParams.KeyLength
+	}
+	return &Argon2id{params: params}
+}
+
+type Argon2id struct {
+	params Argon2idParams
+}
+
+// DefaultArgon2idParams 是 OWASP 推荐的最低配置
+var DefaultArgon2idParams = Argon2idParams{
+	Memory:     19 * 1024,
+	Time:       2,
+	Threads:    1,
+	SaltLength: 16,
+	KeyLength:  32,
+}
+
+type Argon2idParams struct {
+	// Memory 单位是 KiB
+	Memory     uint32
+	Time       uint32
+	Threads    uint8
+	SaltLength uint32
+	KeyLength  uint32
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") ||
+		strings.HasPrefix(hash, "$2y$")
+}
+
+func parseArgon2id(hash string) (Argon2idParams, []byte, []byte, error) {
+	var params Argon2idParams
+	// 第一段是空的，然后依次是算法、版本、参数、盐和哈希
+	segs := strings.Split(hash, "$")
+	if len(segs) != 6 || segs[1] != "argon2id" {
+		return params, nil, nil, ErrMalformedHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(segs[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrMalformedHash
+	}
+	if _, err := fmt.Sscanf(segs[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return params, nil, nil, ErrMalformedHash
+	}
+	if params.Memory == 0 || params.Time == 0 || params.Threads == 0 {
+		return params, nil, nil, ErrMalformedHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(segs[4])
+	if err != nil {
+		return params, nil, nil, ErrMalformedHash
+	}
+	sum, err := base64.RawStdEncoding.DecodeString(segs[5])
+	if err != nil || len(sum) == 0 {
+		return params, nil, nil, ErrMalformedHash
+	}
+	return params, salt, sum, nil
+}
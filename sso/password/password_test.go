@@ -0,0 +1,79 @@
+package password
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"testing"
+)
+
+// 测试里面用尽可能小的参数，避免拖慢测试
+var testArgon2idParams = Argon2idParams{Memory: 64, Time: 1, Threads: 1}
+
+func TestHasher(t *testing.T) {
+	testCases := []struct {
+		name   string
+		hasher Hasher
+		prefix string
+	}{
+		{name: "bcrypt", hasher: NewBcrypt(bcrypt.MinCost), prefix: "$2a$04$"},
+		{name: "argon2id", hasher: NewArgon2id(testArgon2idParams), prefix: "$argon2id$v=19$m=64,t=1,p=1$"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			hash, err := tc.hasher.Hash("123456")
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(hash, tc.prefix), hash)
+			assert.False(t, tc.hasher.NeedsRehash(hash))
+
+			ok, err := Verify(hash, "123456")
+			require.NoError(t, err)
+			assert.True(t, ok)
+			ok, err = Verify(hash, "1234567")
+			require.NoError(t, err)
+			assert.False(t, ok)
+
+			// 同样的密码每次的盐都不一样
+			other, err := tc.hasher.Hash("123456")
+			require.NoError(t, err)
+			assert.NotEqual(t, hash, other)
+		})
+	}
+}
+
+func TestHasher_NeedsRehash(t *testing.T) {
+	bcryptHash, err := NewBcrypt(bcrypt.MinCost).Hash("123456")
+	require.NoError(t, err)
+	argon2idHash, err := NewArgon2id(testArgon2idParams).Hash("123456")
+	require.NoError(t, err)
+
+	assert.True(t, NewBcrypt(bcrypt.MinCost+1).NeedsRehash(bcryptHash))
+	assert.True(t, NewBcrypt(bcrypt.MinCost).NeedsRehash(argon2idHash))
+	assert.True(t, NewArgon2id(testArgon2idParams).NeedsRehash(bcryptHash))
+	assert.True(t, NewArgon2id(Argon2idParams{Memory: 128, Time: 1, Threads: 1}).NeedsRehash(argon2idHash))
+	assert.True(t, NewArgon2id(Argon2idParams{Memory: 64, Time: 2, Threads: 1}).NeedsRehash(argon2idHash))
+	assert.True(t, NewArgon2id(testArgon2idParams).NeedsRehash("$argon2id$broken"))
+}
+
+func TestVerify_Malformed(t *testing.T) {
+	testCases := []struct {
+		name    string
+		hash    string
+		wantErr error
+	}{
+		{name: "未知算法", hash: "sha256$abc$def", wantErr: ErrUnknownHash},
+		{name: "空的哈希", hash: "", wantErr: ErrUnknownHash},
+		{name: "argon2id 少了一段", hash: "$argon2id$v=19$m=64,t=1,p=1$c2FsdA", wantErr: ErrMalformedHash},
+		{name: "argon2id 版本不对", hash: "$argon2id$v=16$m=64,t=1,p=1$c2FsdA$aGFzaA", wantErr: ErrMalformedHash},
+		{name: "argon2id 参数为零", hash: "$argon2id$v=19$m=64,t=0,p=1$c2FsdA$aGFzaA", wantErr: ErrMalformedHash},
+		{name: "bcrypt 被截断", hash: "$2a$04$short", wantErr: ErrMalformedHash},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ok, err := Verify(tc.hash, "123456")
+			assert.ErrorIs(t, err, tc.wantErr)
+			assert.False(t, ok)
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package sso
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"regexp"
+)
+
+// RFC 7636 定义的两种 code_challenge_method
+const (
+	pkceMethodPlain = "plain"
+	pkceMethodS256  = "S256"
+)
+
+// code_verifier 和 code_challenge 都只能由 43 到 128 个 unreserved 字符组成
+var pkceValuePattern = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+// requirePKCE 公开客户端保存不了密钥，所以必须使用 PKCE
+func (c *Client) requirePKCE() bool {
+	return c.Public || c.RequirePKCE
+}
+
+// parseCodeChallenge 校验授权请求里面的 PKCE 参数
+func parseCodeChallenge(client *Client, challenge string, method string) (string, *oauth2Error) {
+	if challenge == "" {
+		if client.requirePKCE() {
+			return "", newOAuth2Error(errInvalidRequest, "code_challenge is required")
+		}
+		if method != "" {
+			return "", newOAuth2Error(errInvalidRequest, "code_challenge_method without code_challenge")
+		}
+		return "", nil
+	}
+	if method == "" {
+		// 按照 RFC，没有指定的时候就是 plain
+		method = pkceMethodPlain
+	}
+	if method != pkceMethodPlain && method != pkceMethodS256 {
+		return "", newOAuth2Error(errInvalidRequest, "unsupported code_challenge_method")
+	}
+	if !pkceValuePattern.MatchString(challenge) {
+		return "", newOAuth2Error(errInvalidRequest, "malformed code_challenge")
+	}
+	return method, nil
+}
+
+// verifyCodeVerifier 用 code_verifier 校验授权码上记录的 code_challenge
+func verifyCodeVerifier(code *AuthorizationCode, verifier string) *oauth2Error {
+	if code.CodeChallenge == "" {
+		// 没有用 PKCE 申请的授权码，也不允许带上 code_verifier，避免降级攻击
+		if verifier != "" {
+			return newOAuth2Error(errInvalidGrant, "code_verifier was not expected")
+		}
+		return nil
+	}
+	if !pkceValuePattern.MatchString(verifier) {
+		return newOAuth2Error(errInvalidGrant, "invalid code_verifier")
+	}
+	expected := verifier
+	if code.CodeChallengeMethod == pkceMethodS256 {
+		sum := sha256.Sum256([]byte(verifier))
+		expected = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(code.CodeChallenge)) != 1 {
+		return newOAuth2Error(errInvalidGrant, "code_verifier does not match code_challenge")
+	}
+	return nil
+}
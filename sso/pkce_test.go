@@ -0,0 +1,172 @@
+package sso
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestVerifyCodeVerifier(t *testing.T) {
+	verifier := strings.Repeat("a", 43)
+	sum := sha256.Sum256([]byte(verifier))
+	s256 := base64.RawURLEncoding.EncodeToString(sum[:])
+	testCases := []struct {
+		name     string
+		code     *AuthorizationCode
+		verifier string
+		wantErr  bool
+	}{
+		{
+			name:     "S256",
+			code:     &AuthorizationCode{CodeChallenge: s256, CodeChallengeMethod: pkceMethodS256},
+			verifier: verifier,
+		},
+		{
+			name:     "plain",
+			code:     &AuthorizationCode{CodeChallenge: verifier, CodeChallengeMethod: pkceMethodPlain},
+			verifier: verifier,
+		},
+		{
+			name:     "S256 不匹配",
+			code:     &AuthorizationCode{CodeChallenge: s256, CodeChallengeMethod: pkceMethodS256},
+			verifier: strings.Repeat("b", 43),
+			wantErr:  true,
+		},
+		{
+			name:     "缺少 code_verifier",
+			code:     &AuthorizationCode{CodeChallenge: s256, CodeChallengeMethod: pkceMethodS256},
+			verifier: "",
+			wantErr:  true,
+		},
+		{
+			name:     "code_verifier 太短",
+			code:     &AuthorizationCode{CodeChallenge: "abc", CodeChallengeMethod: pkceMethodPlain},
+			verifier: "abc",
+			wantErr:  true,
+		},
+		{
+			name:     "没有使用 PKCE",
+			code:     &AuthorizationCode{},
+			verifier: "",
+		},
+		{
+			name:     "没有使用 PKCE 却带了 code_verifier",
+			code:     &AuthorizationCode{},
+			verifier: verifier,
+			wantErr:  true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			oerr := verifyCodeVerifier(tc.code, tc.verifier)
+			assert.Equal(t, tc.wantErr, oerr != nil)
+		})
+	}
+}
+
+func TestParseCodeChallenge(t *testing.T) {
+	challenge := strings.Repeat("a", 43)
+	testCases := []struct {
+		name      string
+		client    *Client
+		challenge string
+		method    string
+
+		wantMethod string
+		wantErr    bool
+	}{
+		{
+			name:       "默认是 plain",
+			client:     &Client{},
+			challenge:  challenge,
+			wantMethod: pkceMethodPlain,
+		},
+		{
+			name:       "S256",
+			client:     &Client{},
+			challenge:  challenge,
+			method:     pkceMethodS256,
+			wantMethod: pkceMethodS256,
+		},
+		{
+			name:      "不支持的方法",
+			client:    &Client{},
+			challenge: challenge,
+			method:    "S512",
+			wantErr:   true,
+		},
+		{
+			name:    "公开客户端必须使用 PKCE",
+			client:  &Client{Public: true},
+			wantErr: true,
+		},
+		{
+			name:    "机密客户端要求使用 PKCE",
+			client:  &Client{RequirePKCE: true},
+			wantErr: true,
+		},
+		{
+			name:   "机密客户端可以不使用 PKCE",
+			client: &Client{},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			method, oerr := parseCodeChallenge(tc.client, tc.challenge, tc.method)
+			assert.Equal(t, tc.wantErr, oerr != nil)
+			assert.Equal(t, tc.wantMethod, method)
+		})
+	}
+}
+
+func TestServer_TokenPKCE(t *testing.T) {
+	s := newTestServer()
+	ssid := login(t, s)
+	verifier := strings.Repeat("v", 64)
+	sum := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"spa"},
+		"redirect_uri":          {"http://spa.com/callback"},
+		"scope":                 {"profile"},
+		"state":                 {"xyz"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {pkceMethodS256},
+	}
+
+	// 公开客户端不带 code_challenge 会被拒绝
+	noPKCE := url.Values{}
+	for key, vals := range query {
+		noPKCE[key] = vals
+	}
+	noPKCE.Del("code_challenge")
+	noPKCE.Del("code_challenge_method")
+	resp := getWithCookies(s, "/authorize?"+noPKCE.Encode(), ssid)
+	require.Equal(t, http.StatusFound, resp.Code)
+	assert.Contains(t, resp.Header().Get("Location"), "error="+errInvalidRequest)
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"redirect_uri": {"http://spa.com/callback"},
+		"client_id":    {"spa"},
+	}
+	form.Set("code", authorizeCode(t, s, ssid, query))
+	form.Set("code_verifier", strings.Repeat("x", 64))
+	resp = postForm(s, "/token", form)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assertOAuth2Error(t, resp, errInvalidGrant)
+
+	form.Set("code", authorizeCode(t, s, ssid, query))
+	form.Set("code_verifier", verifier)
+	resp = postForm(s, "/token", form)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var tkResp tokenResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &tkResp))
+	assert.NotEmpty(t, tkResp.AccessToken)
+}
@@ -0,0 +1,81 @@
+package sso
+
+import (
+	"net/url"
+	"slices"
+	webContext "ssoauth2/web/context"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OIDC 定义的 prompt 取值，promptConsent 见 consent.go
+const (
+	// promptNone 不能和用户有任何交互，需要交互的时候直接返回错误
+	promptNone = "none"
+	// promptLogin 即使已经登录了，也要重新输入密码
+	promptLogin = "login"
+)
+
+// parseAuthParams 解析 prompt、max_age 和 login_hint
+func parseAuthParams(ctx *webContext.Context) (authParams, *oauth2Error) {
+	p := authParams{maxAge: -1}
+	prompt, _ := ctx.FormValue("prompt").String()
+	p.prompts = strings.Fields(prompt)
+	for _, val := range p.prompts {
+		if val != promptNone && val != promptLogin && val != promptConsent {
+			return p, newOAuth2Error(errInvalidRequest, "unsupported prompt value "+val)
+		}
+	}
+	if p.hasPrompt(promptNone) && len(p.prompts) > 1 {
+		return p, newOAuth2Error(errInvalidRequest, "prompt none must not be combined with other values")
+	}
+	if maxAge, _ := ctx.FormValue("max_age").String(); maxAge != "" {
+		val, err := strconv.Atoi(maxAge)
+		if err != nil || val < 0 {
+			return p, newOAuth2Error(errInvalidRequest, "invalid max_age")
+		}
+		p.maxAge = val
+	}
+	p.loginHint, _ = ctx.FormValue("login_hint").String()
+	return p, nil
+}
+
+func (p authParams) hasPrompt(prompt string) bool {
+	return slices.Contains(p.prompts, prompt)
+}
+
+// needLogin 没有登录，或者客户端要求重新登录，或者登录的时间太久了
+func (p authParams) needLogin(sess *Session, now time.Time) bool {
+	if sess == nil || p.hasPrompt(promptLogin) {
+		return true
+	}
+	return p.maxAge >= 0 && now.Sub(sess.AuthTime) > time.Duration(p.maxAge)*time.Second
+}
+
+// reauthQuery 重新登录之后要回到的请求参数
+// 去掉 prompt=login 和 max_age，否则刚登录完回来又要求登录，就死循环了
+func reauthQuery(query url.Values) url.Values {
+	res := url.Values{}
+	for key, vals := range query {
+		res[key] = vals
+	}
+	res.Del("max_age")
+	prompts := slices.DeleteFunc(strings.Fields(query.Get("prompt")), func(val string) bool {
+		return val == promptLogin
+	})
+	if len(prompts) == 0 {
+		res.Del("prompt")
+	} else {
+		res.Set("prompt", strings.Join(prompts, " "))
+	}
+	return res
+}
+
+// authParams 客户端对登录交互的要求，/authorize 和老的 /check_login 都支持
+type authParams struct {
+	prompts []string
+	// maxAge 用户输入密码之后最多过去多少秒，-1 表示不限制
+	maxAge    int
+	loginHint string
+}
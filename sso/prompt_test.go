@@ -0,0 +1,156 @@
+package sso
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestServer_AuthorizePrompt(t *testing.T) {
+	s := newTestServer()
+	ssid := login(t, s)
+	// 让登录时间变成十分钟之前
+	sess, err := s.sessions.Get(context.Background(), ssid.Value)
+	require.NoError(t, err)
+	sess.AuthTime = time.Now().Add(-10 * time.Minute)
+	require.NoError(t, s.sessions.Save(context.Background(), sess))
+	authorizeCode(t, s, ssid, authorizeQuery())
+
+	testCases := []struct {
+		name   string
+		query  url.Values
+		cookie bool
+		// wantError 不为空的时候，跳转回客户端并且带上这个错误
+		wantError string
+		wantCode  bool
+		// wantContinue 展示登录页面，登录之后要回到的地址
+		wantContinue string
+	}{
+		{
+			name:      "none without session",
+			query:     url.Values{"prompt": {"none"}},
+			wantError: errLoginRequired,
+		},
+		{
+			name:     "none with session",
+			query:    url.Values{"prompt": {"none"}},
+			cookie:   true,
+			wantCode: true,
+		},
+		{
+			name:      "none without consent",
+			query:     url.Values{"prompt": {"none"}, "scope": {"email"}},
+			cookie:    true,
+			wantError: errConsentRequired,
+		},
+		{
+			name:      "none with login",
+			query:     url.Values{"prompt": {"none login"}},
+			cookie:    true,
+			wantError: errInvalidRequest,
+		},
+		{
+			name:      "unsupported prompt",
+			query:     url.Values{"prompt": {"select_account"}},
+			cookie:    true,
+			wantError: errInvalidRequest,
+		},
+		{
+			name:   "login",
+			query:  url.Values{"prompt": {"login consent"}},
+			cookie: true,
+			// 登录之后回来的时候，不能再要求登录了
+			wantContinue: "prompt=consent",
+		},
+		{
+			name:      "max_age expired with prompt none",
+			query:     url.Values{"prompt": {"none"}, "max_age": {"300"}},
+			cookie:    true,
+			wantError: errLoginRequired,
+		},
+		{
+			name:     "max_age fresh",
+			query:    url.Values{"max_age": {"3600"}},
+			cookie:   true,
+			wantCode: true,
+		},
+		{
+			name:         "max_age expired",
+			query:        url.Values{"max_age": {"300"}},
+			cookie:       true,
+			wantContinue: "scope=profile",
+		},
+		{
+			name:      "invalid max_age",
+			query:     url.Values{"max_age": {"-1"}},
+			cookie:    true,
+			wantError: errInvalidRequest,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			query := authorizeQuery()
+			for key, vals := range tc.query {
+				query[key] = vals
+			}
+			var cookies []*http.Cookie
+			if tc.cookie {
+				cookies = append(cookies, ssid)
+			}
+			resp := getWithCookies(s, "/authorize?"+query.Encode(), cookies...)
+			if tc.wantContinue != "" {
+				require.Equal(t, http.StatusOK, resp.Code)
+				assert.Contains(t, resp.Body.String(), `name="continue"`)
+				assert.Contains(t, resp.Body.String(), tc.wantContinue)
+				assert.NotContains(t, resp.Body.String(), "max_age")
+				assert.NotContains(t, resp.Body.String(), "prompt=login")
+				return
+			}
+			require.Equal(t, http.StatusFound, resp.Code)
+			location, err := url.Parse(resp.Header().Get("Location"))
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantError, location.Query().Get("error"))
+			assert.Equal(t, tc.wantCode, location.Query().Get("code") != "")
+		})
+	}
+}
+
+func TestServer_LoginHint(t *testing.T) {
+	s := newTestServer()
+	query := authorizeQuery()
+	query.Set("login_hint", "123@qq.com")
+	resp := getWithCookies(s, "/authorize?"+query.Encode())
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), `value="123@qq.com"`)
+
+	resp = getWithCookies(s, "/check_login?"+url.Values{
+		"app_id":       {"app1"},
+		"redirect_uri": {"http://app1.com:8081/token"},
+		"login_hint":   {"123@qq.com"},
+	}.Encode())
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), `value="123@qq.com"`)
+}
+
+func TestServer_CheckLoginPrompt(t *testing.T) {
+	s := newTestServer()
+	query := url.Values{
+		"app_id":       {"app1"},
+		"redirect_uri": {"http://app1.com:8081/token"},
+		"prompt":       {"none"},
+	}
+	resp := getWithCookies(s, "/check_login?"+query.Encode())
+	require.Equal(t, http.StatusFound, resp.Code)
+	assert.Equal(t, "http://app1.com:8081/token?error=login_required", resp.Header().Get("Location"))
+
+	// 已经登录了，prompt=login 还是要重新登录
+	ssid := login(t, s)
+	query.Set("prompt", "login")
+	resp = getWithCookies(s, "/check_login?"+query.Encode(), ssid)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), `name="password"`)
+}
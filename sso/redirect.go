@@ -0,0 +1,89 @@
+package sso
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+)
+
+var errInvalidRedirect = errors.New("sso: 非法的跳转地址")
+
+// parseRedirectURI 解析跳转地址，只接受绝对的 http(s) 地址，
+// 并且拒绝 fragment 和 userinfo，http://app1.com@evil.com 这种地址很容易让人看走眼
+func parseRedirectURI(raw string) (*url.URL, error) {
+	// 反斜杠和控制字符在不同的浏览器里面解析结果不一样
+	if strings.ContainsAny(raw, "\\ \t\r\n") {
+		return nil, errInvalidRedirect
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, errInvalidRedirect
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errInvalidRedirect
+	}
+	if u.Opaque != "" || u.Hostname() == "" || u.User != nil ||
+		u.Fragment != "" || strings.Contains(raw, "#") {
+		return nil, errInvalidRedirect
+	}
+	return u, nil
+}
+
+// matchRedirectURI 判断 raw 是不是客户端注册过的回调地址
+// scheme、域名、端口、路径和查询参数都必须完全一致，
+// 唯一的例外是 RFC 8252 里面的 native app：公开客户端注册的是回环地址的话，端口可以不一样
+func matchRedirectURI(client *Client, raw string) bool {
+	u, err := parseRedirectURI(raw)
+	if err != nil {
+		return false
+	}
+	for _, registered := range client.RedirectURIs {
+		r, err := parseRedirectURI(registered)
+		if err != nil {
+			continue
+		}
+		if r.Scheme != u.Scheme || !strings.EqualFold(r.Hostname(), u.Hostname()) ||
+			r.EscapedPath() != u.EscapedPath() || r.RawQuery != u.RawQuery {
+			continue
+		}
+		if portOf(r) == portOf(u) || (client.Public && isLoopback(r)) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHost 用于老的 app_id + redirect_uri 流程，
+// 跳转地址可以是业务方的任何页面，但是 scheme 只能是 http(s)，域名和端口必须和 Host 完全一致
+func matchHost(client *Client, raw string) bool {
+	if client.Host == "" {
+		return false
+	}
+	u, err := parseRedirectURI(raw)
+	if err != nil {
+		return false
+	}
+	host, err := url.Parse("//" + client.Host)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(host.Hostname(), u.Hostname()) && host.Port() == u.Port()
+}
+
+// portOf 返回端口，没有写端口的时候返回 scheme 的默认端口
+func portOf(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	if u.Scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+// isLoopback 只认回环 IP，RFC 8252 不推荐使用 localhost，因为它可能被解析到别的地址
+func isLoopback(u *url.URL) bool {
+	ip := net.ParseIP(u.Hostname())
+	return u.Scheme == "http" && ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,56 @@
+package sso
+
+import (
+	webContext "ssoauth2/web/context"
+)
+
+// exchangeRefreshToken 用 refresh token 换取新的 access token。
+// 每次使用之后 refresh token 都会轮换，旧的那个作废；
+// 如果作废的 refresh token 又被拿来用，说明它可能被偷了，整个家族的 token 都会被吊销
+func (s *Server) exchangeRefreshToken(ctx *webContext.Context, client *Client) (*tokenResponse, *oauth2Error) {
+	value, _ := ctx.FormValue("refresh_token").String()
+	if value == "" {
+		return nil, newOAuth2Error(errInvalidRequest, "refresh_token is required")
+	}
+	reqCtx := ctx.Request.Context()
+	tk, err := s.tokens.Get(reqCtx, value)
+	if err != nil || tk.Type != TokenTypeRefresh {
+		return nil, newOAuth2Error(errInvalidGrant, "invalid refresh token")
+	}
+	if tk.ClientID != client.ID {
+		return nil, newOAuth2Error(errInvalidGrant, "refresh token was issued to another client")
+	}
+	if !s.consentActive(reqCtx, tk) {
+		return nil, newOAuth2Error(errInvalidGrant, "the grant has been revoked")
+	}
+	scopes := tk.Scopes
+	if scope, _ := ctx.FormValue("scope").String(); scope != "" {
+		scopes = parseScope(scope)
+		// 只能缩小范围，不能扩大
+		if !containsAll(tk.Scopes, scopes) {
+			return nil, newOAuth2Error(errInvalidScope, "the requested scope exceeds the original grant")
+		}
+	}
+
+	old, err := s.tokens.MarkRotated(reqCtx, value)
+	if err != nil {
+		return nil, newOAuth2Error(errInvalidGrant, "invalid refresh token")
+	}
+	if old.Rotated {
+		if err = s.tokens.RemoveFamily(reqCtx, old.FamilyID); err != nil {
+			return nil, newOAuth2Error(errServerError, "failed to revoke token family")
+		}
+		return nil, newOAuth2Error(errInvalidGrant, "refresh token has already been used")
+	}
+
+	access, err := s.issueAccessToken(reqCtx, client, old.UserID, scopes, old.FamilyID)
+	if err != nil {
+		return nil, newOAuth2Error(errServerError, "failed to issue access token")
+	}
+	// 新的 refresh token 的范围必须和原来的一样
+	refresh, err := s.issueRefreshToken(reqCtx, client, old.UserID, old.Scopes, old.FamilyID)
+	if err != nil {
+		return nil, newOAuth2Error(errServerError, "failed to issue refresh token")
+	}
+	return newTokenResponse(access, refresh), nil
+}
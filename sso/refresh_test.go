@@ -0,0 +1,119 @@
+package sso
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// issueTestTokens 走完授权码流程，拿到 app1 的 token
+func issueTestTokens(t *testing.T, s http.Handler) tokenResponse {
+	ssid := login(t, s)
+	query := authorizeQuery()
+	query.Set("scope", "profile email")
+	resp := postForm(s, "/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {authorizeCode(t, s, ssid, query)},
+		"redirect_uri":  {"http://app1.com:8081/oauth2/callback"},
+		"client_id":     {"app1"},
+		"client_secret": {"app1-secret"},
+	})
+	require.Equal(t, http.StatusOK, resp.Code)
+	var tkResp tokenResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &tkResp))
+	require.NotEmpty(t, tkResp.RefreshToken)
+	return tkResp
+}
+
+func refreshForm(refreshToken string) url.Values {
+	return url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {"app1"},
+		"client_secret": {"app1-secret"},
+	}
+}
+
+func TestServer_RefreshTokenRotation(t *testing.T) {
+	s := newTestServer()
+	first := issueTestTokens(t, s)
+
+	resp := postForm(s, "/token", refreshForm(first.RefreshToken))
+	require.Equal(t, http.StatusOK, resp.Code)
+	var second tokenResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &second))
+	assert.NotEqual(t, first.RefreshToken, second.RefreshToken)
+	assert.NotEqual(t, first.AccessToken, second.AccessToken)
+	assert.Equal(t, "profile email", second.Scope)
+
+	// 旧的 refresh token 被重复使用，整个家族都被吊销
+	resp = postForm(s, "/token", refreshForm(first.RefreshToken))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assertOAuth2Error(t, resp, errInvalidGrant)
+
+	resp = postForm(s, "/token", refreshForm(second.RefreshToken))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	for _, access := range []string{first.AccessToken, second.AccessToken} {
+		_, err := s.tokens.Get(context.Background(), access)
+		assert.Equal(t, ErrTokenNotFound, err)
+	}
+}
+
+func TestServer_RefreshTokenErrors(t *testing.T) {
+	s := newTestServer()
+	tkResp := issueTestTokens(t, s)
+	testCases := []struct {
+		name string
+		form url.Values
+
+		wantCode  int
+		wantError string
+	}{
+		{
+			name: "扩大 scope",
+			form: func() url.Values {
+				form := refreshForm(tkResp.RefreshToken)
+				form.Set("scope", "profile admin")
+				return form
+			}(),
+			wantCode:  http.StatusBadRequest,
+			wantError: errInvalidScope,
+		},
+		{
+			name:      "使用 access token 刷新",
+			form:      refreshForm(tkResp.AccessToken),
+			wantCode:  http.StatusBadRequest,
+			wantError: errInvalidGrant,
+		},
+		{
+			name: "其它客户端使用",
+			form: url.Values{
+				"grant_type":    {"refresh_token"},
+				"refresh_token": {tkResp.RefreshToken},
+				"client_id":     {"spa"},
+			},
+			wantCode:  http.StatusBadRequest,
+			wantError: errInvalidGrant,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := postForm(s, "/token", tc.form)
+			assert.Equal(t, tc.wantCode, resp.Code)
+			assertOAuth2Error(t, resp, tc.wantError)
+		})
+	}
+
+	// 缩小 scope 是允许的
+	form := refreshForm(tkResp.RefreshToken)
+	form.Set("scope", "profile")
+	resp := postForm(s, "/token", form)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var narrowed tokenResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &narrowed))
+	assert.Equal(t, "profile", narrowed.Scope)
+}
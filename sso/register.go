@@ -0,0 +1,257 @@
+package sso
+
+import (
+	"crypto/subtle"
+	"errors"
+	"github.com/google/uuid"
+	"net/http"
+	"slices"
+	webContext "ssoauth2/web/context"
+	"strings"
+)
+
+// RFC 7591 定义的客户端认证方式
+const (
+	authMethodNone  = "none"
+	authMethodBasic = "client_secret_basic"
+	authMethodPost  = "client_secret_post"
+)
+
+// register 是 RFC 7591 的动态注册接口，需要带上 initial access token
+func (s *Server) register(ctx *webContext.Context) {
+	token := bearerToken(ctx)
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.initialAccessToken)) != 1 {
+		ctx.Response.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		_ = ctx.RespString(http.StatusUnauthorized, "")
+		return
+	}
+	var req registrationRequest
+	// RFC 要求忽略不认识的字段
+	if err := ctx.BindJSONOpt(&req, false, false); err != nil {
+		respOAuth2Error(ctx, newOAuth2Error(errInvalidClientMetadata, "malformed client metadata"))
+		return
+	}
+	client, oerr := s.registrationClient(req, uuid.New().String())
+	if oerr != nil {
+		respOAuth2Error(ctx, oerr)
+		return
+	}
+	regToken, err := NewClientSecret()
+	if err != nil {
+		respOAuth2Error(ctx, newOAuth2Error(errServerError, "failed to generate registration access token"))
+		return
+	}
+	if client.RegistrationTokenHash, err = HashSecret(regToken); err != nil {
+		respOAuth2Error(ctx, newOAuth2Error(errServerError, "failed to generate registration access token"))
+		return
+	}
+	secret, oerr := s.saveClient(ctx, client, !client.Public)
+	if oerr != nil {
+		respOAuth2Error(ctx, oerr)
+		return
+	}
+	res := s.newRegistrationResponse(client)
+	res.Secret = secret
+	res.RegistrationAccessToken = regToken
+	respOAuth2JSON(ctx, http.StatusCreated, res)
+}
+
+// readRegistration 是 RFC 7592 读取注册信息的接口
+func (s *Server) readRegistration(ctx *webContext.Context) {
+	client, ok := s.registeredClient(ctx)
+	if !ok {
+		return
+	}
+	respOAuth2JSON(ctx, http.StatusOK, s.newRegistrationResponse(client))
+}
+
+// updateRegistration 用请求里面的元数据整体替换注册信息，密钥保持不变
+func (s *Server) updateRegistration(ctx *webContext.Context) {
+	old, ok := s.registeredClient(ctx)
+	if !ok {
+		return
+	}
+	var req registrationRequest
+	if err := ctx.BindJSONOpt(&req, false, false); err != nil {
+		respOAuth2Error(ctx, newOAuth2Error(errInvalidClientMetadata, "malformed client metadata"))
+		return
+	}
+	// RFC 7592 要求请求里面的 client_id 必须和注册的一致
+	if req.ID != old.ID {
+		respOAuth2Error(ctx, newOAuth2Error(errInvalidRequest, "client_id does not match"))
+		return
+	}
+	client, oerr := s.registrationClient(req, old.ID)
+	if oerr != nil {
+		respOAuth2Error(ctx, oerr)
+		return
+	}
+	if client.Public != old.Public {
+		respOAuth2Error(ctx, newOAuth2Error(errInvalidClientMetadata, "token_endpoint_auth_method can not be changed"))
+		return
+	}
+	client.SecretHash = old.SecretHash
+	client.RegistrationTokenHash = old.RegistrationTokenHash
+	client.Disabled = old.Disabled
+	// 下面这些是管理员设置的，客户端自己不能修改
+	client.RequirePKCE = old.RequirePKCE
+	client.AccessTokenFormat = old.AccessTokenFormat
+	client.AccessTokenExpiration = old.AccessTokenExpiration
+	client.RefreshTokenExpiration = old.RefreshTokenExpiration
+	client.Host = old.Host
+	client.CallbackURL = old.CallbackURL
+	if _, oerr = s.saveClient(ctx, client, false); oerr != nil {
+		respOAuth2Error(ctx, oerr)
+		return
+	}
+	respOAuth2JSON(ctx, http.StatusOK, s.newRegistrationResponse(client))
+}
+
+// deleteRegistration 删除注册信息，之后这个客户端就不能再使用了
+func (s *Server) deleteRegistration(ctx *webContext.Context) {
+	client, ok := s.registeredClient(ctx)
+	if !ok {
+		return
+	}
+	if err := s.clients.Delete(ctx.Request.Context(), client.ID); err != nil && !errors.Is(err, ErrClientNotFound) {
+		respOAuth2Error(ctx, newOAuth2Error(errServerError, "failed to delete client"))
+		return
+	}
+	ctx.RespStatusCode = http.StatusNoContent
+}
+
+// registeredClient 用 registration access token 认证调用方
+// 不管是客户端不存在还是 token 不对，都返回 401，避免泄露客户端是否存在
+func (s *Server) registeredClient(ctx *webContext.Context) (*Client, bool) {
+	id, _ := ctx.PathValue("id").String()
+	token := bearerToken(ctx)
+	client, err := s.clients.Get(ctx.Request.Context(), id)
+	if err != nil && !errors.Is(err, ErrClientNotFound) {
+		respOAuth2Error(ctx, newOAuth2Error(errServerError, "failed to load client"))
+		return nil, false
+	}
+	if err != nil || client.RegistrationTokenHash == "" || !verifyHash(client.RegistrationTokenHash, token) {
+		ctx.Response.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		_ = ctx.RespString(http.StatusUnauthorized, "")
+		return nil, false
+	}
+	return client, true
+}
+
+func (s *Server) newRegistrationResponse(c *Client) registrationResponse {
+	// 管理员可能改过 Public，所以公开客户端总是 none
+	authMethod := authMethodBasic
+	if c.Public {
+		authMethod = authMethodNone
+	} else if c.TokenEndpointAuthMethod == authMethodPost {
+		authMethod = authMethodPost
+	}
+	grantTypes := c.GrantTypes
+	if len(grantTypes) == 0 {
+		grantTypes = []string{GrantTypeAuthorizationCode, GrantTypeRefreshToken}
+	}
+	var responseTypes []string
+	if slices.Contains(grantTypes, GrantTypeAuthorizationCode) {
+		responseTypes = []string{"code"}
+	}
+	return registrationResponse{
+		ID:                     c.ID,
+		RegistrationClientURI:  strings.TrimSuffix(s.issuer, "/") + "/register/" + c.ID,
+		Name:                   c.Name,
+		RedirectURIs:           c.RedirectURIs,
+		GrantTypes:             grantTypes,
+		ResponseTypes:          responseTypes,
+		AuthMethod:             authMethod,
+		Scope:                  strings.Join(c.Scopes, " "),
+		BackchannelLogoutURI:   c.BackchannelLogoutURI,
+		FrontchannelLogoutURI:  c.FrontchannelLogoutURI,
+		PostLogoutRedirectURIs: c.PostLogoutRedirectURIs,
+	}
+}
+
+// registrationClient 根据注册请求构造客户端，只能申请 registrationScopes 里面的 scope
+func (s *Server) registrationClient(req registrationRequest, id string) (*Client, *oauth2Error) {
+	client, oerr := req.client(id)
+	if oerr != nil {
+		return nil, oerr
+	}
+	if !containsAll(s.registrationScopes, client.Scopes) {
+		return nil, newOAuth2Error(errInvalidClientMetadata, "the requested scope is not allowed")
+	}
+	return client, nil
+}
+
+func (r registrationRequest) client(id string) (*Client, *oauth2Error) {
+	c := &Client{
+		ID:           id,
+		Name:         r.Name,
+		RedirectURIs: r.RedirectURIs,
+		Scopes:       parseScope(r.Scope),
+		GrantTypes:   r.GrantTypes,
+
+		BackchannelLogoutURI:   r.BackchannelLogoutURI,
+		FrontchannelLogoutURI:  r.FrontchannelLogoutURI,
+		PostLogoutRedirectURIs: r.PostLogoutRedirectURIs,
+	}
+	switch r.AuthMethod {
+	case "", authMethodBasic:
+		c.TokenEndpointAuthMethod = authMethodBasic
+	case authMethodPost:
+		c.TokenEndpointAuthMethod = authMethodPost
+	case authMethodNone:
+		c.TokenEndpointAuthMethod = authMethodNone
+		c.Public = true
+	default:
+		return nil, newOAuth2Error(errInvalidClientMetadata, "unsupported token_endpoint_auth_method")
+	}
+	if len(c.GrantTypes) == 0 {
+		// RFC 7591 规定默认是授权码模式
+		c.GrantTypes = []string{GrantTypeAuthorizationCode}
+	}
+	for _, responseType := range r.ResponseTypes {
+		if responseType != "code" {
+			return nil, newOAuth2Error(errInvalidClientMetadata, "unsupported response_type")
+		}
+	}
+	if len(r.ResponseTypes) > 0 && !slices.Contains(c.GrantTypes, GrantTypeAuthorizationCode) {
+		return nil, newOAuth2Error(errInvalidClientMetadata, "response_types requires the authorization_code grant")
+	}
+	if oerr := validateClient(c); oerr != nil {
+		return nil, oerr
+	}
+	return c, nil
+}
+
+// registrationRequest 是 RFC 7591 定义的客户端元数据，这里只支持其中一部分
+type registrationRequest struct {
+	// ID 只有更新的时候才需要
+	ID            string   `json:"client_id"`
+	Name          string   `json:"client_name"`
+	RedirectURIs  []string `json:"redirect_uris"`
+	GrantTypes    []string `json:"grant_types"`
+	ResponseTypes []string `json:"response_types"`
+	AuthMethod    string   `json:"token_endpoint_auth_method"`
+	Scope         string   `json:"scope"`
+	// 下面两个是 OIDC Back-Channel Logout 和 Front-Channel Logout 定义的元数据
+	BackchannelLogoutURI   string   `json:"backchannel_logout_uri"`
+	FrontchannelLogoutURI  string   `json:"frontchannel_logout_uri"`
+	PostLogoutRedirectURIs []string `json:"post_logout_redirect_uris"`
+}
+
+type registrationResponse struct {
+	ID     string `json:"client_id"`
+	Secret string `json:"client_secret,omitempty"`
+	// SecretExpiresAt 为 0 表示密钥不会过期
+	SecretExpiresAt         int64    `json:"client_secret_expires_at"`
+	RegistrationAccessToken string   `json:"registration_access_token,omitempty"`
+	RegistrationClientURI   string   `json:"registration_client_uri"`
+	Name                    string   `json:"client_name,omitempty"`
+	RedirectURIs            []string `json:"redirect_uris,omitempty"`
+	GrantTypes              []string `json:"grant_types"`
+	ResponseTypes           []string `json:"response_types,omitempty"`
+	AuthMethod              string   `json:"token_endpoint_auth_method"`
+	Scope                   string   `json:"scope,omitempty"`
+	BackchannelLogoutURI    string   `json:"backchannel_logout_uri,omitempty"`
+	FrontchannelLogoutURI   string   `json:"frontchannel_logout_uri,omitempty"`
+	PostLogoutRedirectURIs  []string `json:"post_logout_redirect_uris,omitempty"`
+}
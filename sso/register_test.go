@@ -0,0 +1,233 @@
+package sso
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func bearerRequest(s http.Handler, method string, path string, token string, body string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestServer_Register(t *testing.T) {
+	s := newTestServer(ServerWithInitialAccessToken("initial-token"))
+	body := `{
+		"client_name": "库存系统",
+		"redirect_uris": ["https://stock.example.com/callback"],
+		"grant_types": ["authorization_code", "refresh_token"],
+		"response_types": ["code"],
+		"scope": "openid profile",
+		"logo_uri": "https://stock.example.com/logo.png"
+	}`
+
+	// 没有 initial access token 或者不对都不能注册
+	resp := bearerRequest(s, http.MethodPost, "/register", "", body)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	resp = bearerRequest(s, http.MethodPost, "/register", "wrong-token", body)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// 不认识的 logo_uri 会被忽略
+	resp = bearerRequest(s, http.MethodPost, "/register", "initial-token", body)
+	require.Equal(t, http.StatusCreated, resp.Code)
+	var created registrationResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &created))
+	require.NotEmpty(t, created.ID)
+	require.NotEmpty(t, created.Secret)
+	require.NotEmpty(t, created.RegistrationAccessToken)
+	assert.Equal(t, "http://sso.com:8083/register/"+created.ID, created.RegistrationClientURI)
+	assert.Equal(t, "库存系统", created.Name)
+	assert.Equal(t, authMethodBasic, created.AuthMethod)
+	assert.Equal(t, []string{"code"}, created.ResponseTypes)
+	assert.Equal(t, "openid profile", created.Scope)
+
+	// 密钥和 registration access token 都只保存哈希
+	stored, err := s.clients.Get(httptest.NewRequest(http.MethodGet, "/", nil).Context(), created.ID)
+	require.NoError(t, err)
+	assert.Empty(t, stored.Secret)
+	assert.True(t, stored.VerifySecret(created.Secret))
+	assert.NotContains(t, stored.RegistrationTokenHash, created.RegistrationAccessToken)
+
+	path := "/register/" + created.ID
+	resp = bearerRequest(s, http.MethodGet, path, "initial-token", "")
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	resp = bearerRequest(s, http.MethodGet, path, created.RegistrationAccessToken, "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	var got registrationResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &got))
+	assert.Empty(t, got.Secret)
+	assert.Empty(t, got.RegistrationAccessToken)
+	assert.Equal(t, created.RedirectURIs, got.RedirectURIs)
+
+	// client_id 不一致
+	resp = bearerRequest(s, http.MethodPut, path, created.RegistrationAccessToken, `{
+		"client_id": "other",
+		"redirect_uris": ["https://stock.example.com/callback"]
+	}`)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	resp = bearerRequest(s, http.MethodPut, path, created.RegistrationAccessToken, `{
+		"client_id": "`+created.ID+`",
+		"client_name": "新库存系统",
+		"redirect_uris": ["https://stock.example.com/oauth2/callback"],
+		"scope": "openid"
+	}`)
+	require.Equal(t, http.StatusOK, resp.Code)
+	stored, err = s.clients.Get(httptest.NewRequest(http.MethodGet, "/", nil).Context(), created.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "新库存系统", stored.Name)
+	assert.Equal(t, []string{"https://stock.example.com/oauth2/callback"}, stored.RedirectURIs)
+	assert.Equal(t, []string{GrantTypeAuthorizationCode}, stored.GrantTypes)
+	// 更新不会改变密钥
+	assert.True(t, stored.VerifySecret(created.Secret))
+
+	resp = bearerRequest(s, http.MethodDelete, path, created.RegistrationAccessToken, "")
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	resp = bearerRequest(s, http.MethodGet, path, created.RegistrationAccessToken, "")
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+}
+
+func TestServer_RegisterInvalidMetadata(t *testing.T) {
+	s := newTestServer(ServerWithInitialAccessToken("initial-token"))
+	testCases := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{
+			name:    "no redirect uri",
+			body:    `{"grant_types": ["authorization_code"]}`,
+			wantErr: errInvalidRedirectURI,
+		},
+		{
+			name:    "unsupported response type",
+			body:    `{"redirect_uris": ["https://a.com/cb"], "response_types": ["token"]}`,
+			wantErr: errInvalidClientMetadata,
+		},
+		{
+			name:    "unsupported auth method",
+			body:    `{"redirect_uris": ["https://a.com/cb"], "token_endpoint_auth_method": "private_key_jwt"}`,
+			wantErr: errInvalidClientMetadata,
+		},
+		{
+			name:    "invalid post logout redirect uri",
+			body:    `{"redirect_uris": ["https://a.com/cb"], "post_logout_redirect_uris": ["javascript:alert(1)"]}`,
+			wantErr: errInvalidClientMetadata,
+		},
+		{
+			name:    "scope not allowed",
+			body:    `{"redirect_uris": ["https://a.com/cb"], "scope": "openid admin"}`,
+			wantErr: errInvalidClientMetadata,
+		},
+		{
+			name:    "public client credentials",
+			body:    `{"grant_types": ["client_credentials"], "token_endpoint_auth_method": "none"}`,
+			wantErr: errInvalidClientMetadata,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := bearerRequest(s, http.MethodPost, "/register", "initial-token", tc.body)
+			require.Equal(t, http.StatusBadRequest, resp.Code)
+			var oerr oauth2Error
+			require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &oerr))
+			assert.Equal(t, tc.wantErr, oerr.Code)
+		})
+	}
+}
+
+func TestServer_RegisterAdminSettings(t *testing.T) {
+	s := newTestServer(ServerWithInitialAccessToken("initial-token"), ServerWithAdminToken("admin-token"))
+	resp := bearerRequest(s, http.MethodPost, "/register", "initial-token", `{
+		"client_name": "库存系统",
+		"redirect_uris": ["https://stock.example.com/callback"]
+	}`)
+	require.Equal(t, http.StatusCreated, resp.Code)
+	var created registrationResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &created))
+	path := "/register/" + created.ID
+
+	// 管理员修改之后，客户端依旧可以管理自己的注册信息
+	resp = adminRequest(s, http.MethodPut, "/admin/clients/"+created.ID, `{
+		"redirect_uris": ["https://stock.example.com/callback"],
+		"require_pkce": true,
+		"access_token_format": "jwt",
+		"access_token_expires_in": 600
+	}`)
+	require.Equal(t, http.StatusOK, resp.Code)
+	resp = bearerRequest(s, http.MethodGet, path, created.RegistrationAccessToken, "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	var got registrationResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &got))
+	assert.Equal(t, "库存系统", got.Name)
+
+	// 客户端更新自己的时候，不能改掉管理员的设置
+	resp = bearerRequest(s, http.MethodPut, path, created.RegistrationAccessToken, `{
+		"client_id": "`+created.ID+`",
+		"client_name": "新库存系统",
+		"redirect_uris": ["https://stock.example.com/callback"]
+	}`)
+	require.Equal(t, http.StatusOK, resp.Code)
+	stored, err := s.clients.Get(httptest.NewRequest(http.MethodGet, "/", nil).Context(), created.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "新库存系统", stored.Name)
+	assert.True(t, stored.RequirePKCE)
+	assert.Equal(t, AccessTokenFormatJWT, stored.AccessTokenFormat)
+	assert.Equal(t, time.Minute*10, stored.AccessTokenExpiration)
+}
+
+func TestServer_RegisterPublicClient(t *testing.T) {
+	s := newTestServer(ServerWithInitialAccessToken("initial-token"))
+	resp := bearerRequest(s, http.MethodPost, "/register", "initial-token", `{
+		"redirect_uris": ["http://localhost:3000/callback"],
+		"token_endpoint_auth_method": "none"
+	}`)
+	require.Equal(t, http.StatusCreated, resp.Code)
+	var created registrationResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &created))
+	assert.Empty(t, created.Secret)
+	assert.Equal(t, authMethodNone, created.AuthMethod)
+
+	resp = bearerRequest(s, http.MethodGet, "/.well-known/openid-configuration", "", "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	var doc discoveryDocument
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &doc))
+	assert.Equal(t, "http://sso.com:8083/register", doc.RegistrationEndpoint)
+}
+
+func TestServer_RegisterSecretPostClient(t *testing.T) {
+	s := newTestServer(ServerWithInitialAccessToken("initial-token"))
+	resp := bearerRequest(s, http.MethodPost, "/register", "initial-token", `{
+		"redirect_uris": ["https://stock.example.com/callback"],
+		"token_endpoint_auth_method": "client_secret_post"
+	}`)
+	require.Equal(t, http.StatusCreated, resp.Code)
+	var created registrationResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &created))
+	assert.NotEmpty(t, created.Secret)
+	assert.Equal(t, authMethodPost, created.AuthMethod)
+
+	// 读取注册信息的时候也要原样返回
+	resp = bearerRequest(s, http.MethodGet, "/register/"+created.ID, created.RegistrationAccessToken, "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	var got registrationResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &got))
+	assert.Equal(t, authMethodPost, got.AuthMethod)
+}
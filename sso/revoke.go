@@ -0,0 +1,45 @@
+package sso
+
+import (
+	"net/http"
+	webContext "ssoauth2/web/context"
+)
+
+// revoke 是 RFC 7009 定义的 token 吊销接口。
+// 吊销 refresh token 的时候，由它派生出来的 token 也会一并吊销。
+// 按照 RFC 的要求，不存在或者已经失效的 token 也返回 200
+func (s *Server) revoke(ctx *webContext.Context) {
+	client, oerr := s.authenticateClient(ctx)
+	if oerr != nil {
+		respOAuth2Error(ctx, oerr)
+		return
+	}
+	value, _ := ctx.FormValue("token").String()
+	if value == "" {
+		respOAuth2Error(ctx, newOAuth2Error(errInvalidRequest, "token is required"))
+		return
+	}
+	// token_type_hint 只是用来加速查找的，我们所有的 token 都在一起，
+	// RFC 7009 要求不认识的 hint 也要继续查找，所以直接忽略
+	reqCtx := ctx.Request.Context()
+	tk, err := s.tokens.Get(reqCtx, value)
+	if err != nil {
+		respOAuth2JSON(ctx, http.StatusOK, struct{}{})
+		return
+	}
+	// 只能吊销颁发给自己的 token
+	if tk.ClientID != client.ID {
+		respOAuth2Error(ctx, newOAuth2Error(errUnauthorizedClient, "token was issued to another client"))
+		return
+	}
+	if tk.Type == TokenTypeRefresh && tk.FamilyID != "" {
+		err = s.tokens.RemoveFamily(reqCtx, tk.FamilyID)
+	} else {
+		err = s.tokens.Remove(reqCtx, tk.Value)
+	}
+	if err != nil {
+		respOAuth2Error(ctx, newOAuth2Error(errServerError, "failed to revoke token"))
+		return
+	}
+	respOAuth2JSON(ctx, http.StatusOK, struct{}{})
+}
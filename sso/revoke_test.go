@@ -0,0 +1,115 @@
+package sso
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestServer_Revoke(t *testing.T) {
+	testCases := []struct {
+		name string
+		// form 根据颁发的 token 构造吊销请求
+		form func(tkResp tokenResponse) url.Values
+
+		wantCode  int
+		wantError string
+		// 吊销之后，access token 和 refresh token 是否还在
+		wantAccess  bool
+		wantRefresh bool
+	}{
+		{
+			name: "吊销 access token",
+			form: func(tkResp tokenResponse) url.Values {
+				return url.Values{
+					"token":           {tkResp.AccessToken},
+					"token_type_hint": {TokenTypeAccess},
+					"client_id":       {"app1"},
+					"client_secret":   {"app1-secret"},
+				}
+			},
+			wantCode:    http.StatusOK,
+			wantRefresh: true,
+		},
+		{
+			name: "吊销 refresh token，派生出来的 access token 也失效",
+			form: func(tkResp tokenResponse) url.Values {
+				return url.Values{
+					"token":         {tkResp.RefreshToken},
+					"client_id":     {"app1"},
+					"client_secret": {"app1-secret"},
+				}
+			},
+			wantCode: http.StatusOK,
+		},
+		{
+			name: "不存在的 token",
+			form: func(tkResp tokenResponse) url.Values {
+				return url.Values{
+					"token":         {"not-exist"},
+					"client_id":     {"app1"},
+					"client_secret": {"app1-secret"},
+				}
+			},
+			wantCode:    http.StatusOK,
+			wantAccess:  true,
+			wantRefresh: true,
+		},
+		{
+			name: "不认识的 token_type_hint 也照样吊销",
+			form: func(tkResp tokenResponse) url.Values {
+				return url.Values{
+					"token":           {tkResp.AccessToken},
+					"token_type_hint": {"id_token"},
+					"client_id":       {"app1"},
+					"client_secret":   {"app1-secret"},
+				}
+			},
+			wantCode:    http.StatusOK,
+			wantRefresh: true,
+		},
+		{
+			name: "吊销别人的 token",
+			form: func(tkResp tokenResponse) url.Values {
+				return url.Values{
+					"token":         {tkResp.AccessToken},
+					"client_id":     {"billing"},
+					"client_secret": {"billing-secret"},
+				}
+			},
+			wantCode:    http.StatusBadRequest,
+			wantError:   errUnauthorizedClient,
+			wantAccess:  true,
+			wantRefresh: true,
+		},
+		{
+			name: "没有认证",
+			form: func(tkResp tokenResponse) url.Values {
+				return url.Values{
+					"token": {tkResp.AccessToken},
+				}
+			},
+			wantCode:    http.StatusUnauthorized,
+			wantError:   errInvalidClient,
+			wantAccess:  true,
+			wantRefresh: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer()
+			tkResp := issueTestTokens(t, s)
+			resp := postForm(s, "/revoke", tc.form(tkResp))
+			assert.Equal(t, tc.wantCode, resp.Code)
+			if tc.wantError != "" {
+				assertOAuth2Error(t, resp, tc.wantError)
+			}
+			_, err := s.tokens.Get(context.Background(), tkResp.AccessToken)
+			assert.Equal(t, tc.wantAccess, err == nil)
+			_, err = s.tokens.Get(context.Background(), tkResp.RefreshToken)
+			assert.Equal(t, tc.wantRefresh, err == nil)
+		})
+	}
+}
@@ -0,0 +1,407 @@
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"embed"
+	"fmt"
+	"html/template"
+	"maps"
+	"net/http"
+	"ssoauth2/sso/keys"
+	"ssoauth2/web"
+	"ssoauth2/web/middleware/csrf"
+	webTpl "ssoauth2/web/template"
+	"time"
+)
+
+//go:embed template/*.gohtml
+var defaultTemplates embed.FS
+
+// ServerWithClientStore 设置接入方的存储，默认是一个空的内存存储，也就是谁都不能接入
+func ServerWithClientStore(clients ClientStore) ServerOption {
+	return func(s *Server) {
+		s.clients = clients
+	}
+}
+
+// ServerWithAuthenticator 设置用户登录的校验逻辑
+// 默认情况下所有的登录请求都会被拒绝
+func ServerWithAuthenticator(authn Authenticator) ServerOption {
+	return func(s *Server) {
+		s.authn = authn
+	}
+}
+
+func ServerWithSessionStore(sessions SessionStore) ServerOption {
+	return func(s *Server) {
+		s.sessions = sessions
+	}
+}
+
+func ServerWithTokenStore(tokens TokenStore) ServerOption {
+	return func(s *Server) {
+		s.tokens = tokens
+	}
+}
+
+func ServerWithCodeStore(codes CodeStore) ServerOption {
+	return func(s *Server) {
+		s.codes = codes
+	}
+}
+
+func ServerWithDeviceCodeStore(devices DeviceCodeStore) ServerOption {
+	return func(s *Server) {
+		s.devices = devices
+	}
+}
+
+// ServerWithDeviceCodeExpiration 设置设备授权的有效期，默认是 10 分钟
+// 用户需要在这段时间内打开 /device 页面输入 user code
+func ServerWithDeviceCodeExpiration(expiration time.Duration) ServerOption {
+	return func(s *Server) {
+		s.deviceCodeExpiration = expiration
+	}
+}
+
+// ServerWithAccessTokenExpiration 设置 OAuth2 access token 的有效期，默认是一个小时
+func ServerWithAccessTokenExpiration(expiration time.Duration) ServerOption {
+	return func(s *Server) {
+		s.accessTokenExpiration = expiration
+	}
+}
+
+// ServerWithRefreshTokenExpiration 设置 refresh token 的有效期，默认是 30 天
+func ServerWithRefreshTokenExpiration(expiration time.Duration) ServerOption {
+	return func(s *Server) {
+		s.refreshTokenExpiration = expiration
+	}
+}
+
+// ServerWithTemplateEngine 替换默认的登录页面。
+// 模板引擎里面至少要有 login.gohtml 和 confirm.gohtml
+func ServerWithTemplateEngine(engine webTpl.TemplateEngine) ServerOption {
+	return func(s *Server) {
+		s.tplEngine = engine
+	}
+}
+
+// ServerWithCookieDomain 设置 ssid cookie 的 Domain，例如 sso.com
+func ServerWithCookieDomain(domain string) ServerOption {
+	return func(s *Server) {
+		s.cookieDomain = domain
+	}
+}
+
+// ServerWithSessionExpiration 设置 SSO 登录态的有效期
+// 注意如果同时设置了 SessionStore，那么 SessionStore 的过期时间由它自己决定
+func ServerWithSessionExpiration(expiration time.Duration) ServerOption {
+	return func(s *Server) {
+		s.sessionExpiration = expiration
+	}
+}
+
+// ServerWithIssuer 设置 OIDC 的 issuer，它会出现在 ID token 的 iss 和 discovery 文档里面，
+// 默认是 http://sso.com:8083
+func ServerWithIssuer(issuer string) ServerOption {
+	return func(s *Server) {
+		s.issuer = issuer
+	}
+}
+
+// ServerWithAccessTokenAudience 设置 access token 的 aud，默认就是 issuer
+// JWT 格式的 access token 和 /introspect 返回的都是它，资源服务器校验的时候需要检查 aud
+func ServerWithAccessTokenAudience(aud string) ServerOption {
+	return func(s *Server) {
+		s.accessTokenAudience = aud
+	}
+}
+
+// ServerWithKeyManager 设置签名密钥的管理器，
+// 默认把 RS256 的密钥保存在当前目录的 sso_keys.json 文件里面，每 30 天轮换一次，
+// 部署多个实例的时候要换成共享的 KeyStore
+func ServerWithKeyManager(m *keys.Manager) ServerOption {
+	return func(s *Server) {
+		s.keyManager = m
+	}
+}
+
+// ServerWithUserFinder 设置 /userinfo 查询用户信息的方式
+func ServerWithUserFinder(users UserFinder) ServerOption {
+	return func(s *Server) {
+		s.users = users
+	}
+}
+
+// ServerWithAdminToken 开启 /admin/clients 管理接口，
+// 调用的时候需要带上 Authorization: Bearer <token>，没有设置的时候不会注册管理接口
+func ServerWithAdminToken(token string) ServerOption {
+	return func(s *Server) {
+		s.adminToken = token
+	}
+}
+
+// ServerWithInitialAccessToken 开启 /register 动态注册接口，
+// 注册的时候需要带上 Authorization: Bearer <token>，没有设置的时候不会注册这些接口
+func ServerWithInitialAccessToken(token string) ServerOption {
+	return func(s *Server) {
+		s.initialAccessToken = token
+	}
+}
+
+// ServerWithRegistrationScopes 设置动态注册的客户端可以申请的 scope，
+// 默认只有 openid、profile 和 email，申请别的 scope 会注册失败
+func ServerWithRegistrationScopes(scopes ...string) ServerOption {
+	return func(s *Server) {
+		s.registrationScopes = scopes
+	}
+}
+
+// ServerWithMFAStore 开启 TOTP 多因素认证，
+// 绑定过 TOTP 的用户在输入密码之后，还需要输入验证码或者恢复码才能完成登录
+func ServerWithMFAStore(store MFAStore) ServerOption {
+	return func(s *Server) {
+		s.mfa = store
+	}
+}
+
+// ServerWithLoginLimiter 设置登录失败的限流策略，默认按照 DefaultAccountPolicy 和 DefaultIPPolicy 记录在内存里面
+// 部署多个实例的时候要换成共享的 AttemptStore
+func ServerWithLoginLimiter(limiter *LoginLimiter) ServerOption {
+	return func(s *Server) {
+		s.limiter = limiter
+	}
+}
+
+// ServerWithConsentStore 设置保存用户授权的地方，默认保存在内存里面
+func ServerWithConsentStore(store ConsentStore) ServerOption {
+	return func(s *Server) {
+		s.consents = store
+	}
+}
+
+// ServerWithScopeDescriptions 设置授权页面上展示的权限说明，会覆盖 DefaultScopeDescriptions 里面同名的说明
+func ServerWithScopeDescriptions(descriptions map[string]string) ServerOption {
+	return func(s *Server) {
+		for scope, desc := range descriptions {
+			s.scopeDescriptions[scope] = desc
+		}
+	}
+}
+
+// ServerWithCSRFKey 设置计算 CSRF token 的密钥，不设置的时候每次启动随机生成
+// 部署多个实例的时候，所有实例必须使用同一个密钥，否则在一个实例上打开的页面，提交到另一个实例会失败
+func ServerWithCSRFKey(key []byte) ServerOption {
+	return func(s *Server) {
+		s.csrfKey = key
+	}
+}
+
+// ServerWithHTTPClient 设置 SSO 调用业务方接口使用的 http.Client，例如 back-channel logout
+func ServerWithHTTPClient(httpClient *http.Client) ServerOption {
+	return func(s *Server) {
+		s.httpClient = httpClient
+	}
+}
+
+// ServerWithErrorHandler 设置处理后台错误的方法，例如 back-channel logout 通知业务方失败。
+// 这些错误不影响请求的结果，默认直接忽略
+func ServerWithErrorHandler(fn func(ctx context.Context, err error)) ServerOption {
+	return func(s *Server) {
+		s.errorHandler = fn
+	}
+}
+
+// NewServer 创建一个 SSO 服务器，
+// 所有的组件都可以通过 ServerOption 替换，没有替换的就使用内存实现
+func NewServer(opts ...ServerOption) *Server {
+	s := &Server{
+		clients: NewMemoryClientStore(),
+		authn: AuthenticatorFunc(func(ctx context.Context, username string, password string) (*User, error) {
+			return nil, ErrInvalidCredentials
+		}),
+		tokens:                 NewMemoryTokenStore(),
+		codes:                  NewMemoryCodeStore(),
+		devices:                NewMemoryDeviceCodeStore(),
+		consents:               NewMemoryConsentStore(),
+		scopeDescriptions:      maps.Clone(DefaultScopeDescriptions),
+		limiter:                NewLoginLimiter(NewMemoryAttemptStore()),
+		httpClient:             &http.Client{Timeout: time.Second * 5},
+		errorHandler:           func(ctx context.Context, err error) {},
+		cookieName:             "ssid",
+		sessionExpiration:      time.Minute * 15,
+		tokenExpiration:        time.Minute,
+		codeExpiration:         time.Minute,
+		deviceCodeExpiration:   time.Minute * 10,
+		accessTokenExpiration:  time.Hour,
+		refreshTokenExpiration: time.Hour * 24 * 30,
+		idTokenExpiration:      time.Hour,
+		issuer:                 "http://sso.com:8083",
+		registrationScopes:     []string{ScopeOpenID, ScopeProfile, ScopeEmail},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.sessions == nil {
+		s.sessions = NewMemorySessionStore(s.sessionExpiration)
+	}
+	if s.accessTokenAudience == "" {
+		s.accessTokenAudience = s.issuer
+	}
+	if s.users == nil {
+		s.users, _ = s.authn.(UserFinder)
+	}
+	if s.keyManager == nil {
+		s.keyManager = keys.NewManager(keys.NewFileKeyStore("sso_keys.json"))
+	}
+	// 旧的密钥要一直发布到用它签名的 token 都过期了
+	s.keyManager.RetainAtLeast(max(s.accessTokenExpiration, s.idTokenExpiration, s.maxJWTAccessTokenExpiration()))
+	if s.csrfKey == nil {
+		s.csrfKey = make([]byte, 32)
+		if _, err := rand.Read(s.csrfKey); err != nil {
+			panic(err)
+		}
+	}
+	s.csrf = csrf.NewBuilder(s.csrfKey).SessionID(s.csrfSessionID)
+	if s.tplEngine == nil {
+		s.tplEngine = &webTpl.GoTemplateEngine{
+			T: template.Must(template.ParseFS(defaultTemplates, "template/*.gohtml")),
+		}
+	}
+
+	s.HTTPServer = web.NewHTTPServer(web.ServerWithTemplateEngine(s.tplEngine))
+	s.registerRoutes()
+	return s
+}
+
+// maxJWTAccessTokenExpiration 客户端单独设置的 JWT access token 的最长有效期
+// 启动的时候就要算出来，否则重启之后第一次轮换会清理掉还有 token 在用的密钥
+func (s *Server) maxJWTAccessTokenExpiration() time.Duration {
+	ctx := context.Background()
+	clients, err := s.clients.List(ctx)
+	if err != nil {
+		s.errorHandler(ctx, fmt.Errorf("sso: 加载客户端失败: %w", err))
+		return 0
+	}
+	var res time.Duration
+	for _, c := range clients {
+		if c.jwtAccessToken() {
+			res = max(res, c.AccessTokenExpiration)
+		}
+	}
+	return res
+}
+
+func (s *Server) registerRoutes() {
+	// 浏览器提交的表单都要校验 CSRF token
+	// /token 之类的接口用的是客户端凭证，不依赖 cookie，所以不需要
+	protect := s.csrf.Build()
+	s.Post("/login", protect(s.login))
+	s.Post("/logout", protect(s.logout))
+	// OIDC RP-Initiated Logout，业务方通过重定向或者提交表单跳过来
+	s.Get("/end_session", s.endSession)
+	s.Post("/end_session", s.endSession)
+	s.Post("/end_session/confirm", protect(s.confirmEndSession))
+	// 用户管理自己授权过的应用
+	s.Get("/consents", s.listConsents)
+	s.Post("/consents/revoke", protect(s.revokeConsent))
+	// 业务方是通过重定向跳过来的，所以 GET 也要支持
+	s.Get("/check_login", s.checkLogin)
+	s.Post("/check_login", s.checkLogin)
+
+	// OAuth2 授权码模式
+	s.Get("/authorize", s.authorize)
+	s.Post("/authorize", protect(s.authorizeDecision))
+	s.Post("/token", s.token)
+	s.Post("/introspect", s.introspect)
+	s.Post("/revoke", s.revoke)
+
+	// 设备授权模式，设备申请 user code，用户在浏览器上输入并且批准
+	s.Post("/device_authorization", s.deviceAuthorization)
+	s.Get("/device", s.device)
+	s.Post("/device", protect(s.deviceDecision))
+
+	// OpenID Connect
+	s.Get("/userinfo", s.userinfo)
+	s.Post("/userinfo", s.userinfo)
+	s.Get("/.well-known/openid-configuration", s.discovery)
+	s.Get("/.well-known/jwks.json", s.jwks)
+
+	if s.adminToken != "" {
+		s.Get("/admin/clients", s.adminOnly(s.listClients))
+		s.Post("/admin/clients", s.adminOnly(s.createClient))
+		s.Get("/admin/clients/:id", s.adminOnly(s.getClient))
+		s.Put("/admin/clients/:id", s.adminOnly(s.updateClient))
+		s.Post("/admin/clients/:id/secret", s.adminOnly(s.rotateClientSecret))
+		s.Post("/admin/clients/:id/disable", s.adminOnly(s.setClientDisabled(true)))
+		s.Post("/admin/clients/:id/enable", s.adminOnly(s.setClientDisabled(false)))
+	}
+
+	// 动态注册，RFC 7591 和 RFC 7592
+	if s.initialAccessToken != "" {
+		s.Post("/register", s.register)
+		s.Get("/register/:id", s.readRegistration)
+		s.Put("/register/:id", s.updateRegistration)
+		s.Delete("/register/:id", s.deleteRegistration)
+	}
+
+	// TOTP 多因素认证
+	if s.mfa != nil {
+		s.Post("/login/mfa", protect(s.loginMFA))
+		s.Get("/mfa/enroll", s.enrollMFA)
+		s.Post("/mfa/enroll", protect(s.confirmMFA))
+	}
+}
+
+// Server 是一个 SSO 服务器，
+// 它本身就是一个 web.HTTPServer，所以用户可以继续注册自己的路由和 middleware
+type Server struct {
+	*web.HTTPServer
+
+	clients   ClientStore
+	authn     Authenticator
+	sessions  SessionStore
+	tokens    TokenStore
+	codes     CodeStore
+	devices   DeviceCodeStore
+	consents  ConsentStore
+	limiter   *LoginLimiter
+	tplEngine webTpl.TemplateEngine
+	csrf      *csrf.MiddlewareBuilder
+	csrfKey   []byte
+	// httpClient 调用业务方的接口
+	httpClient *http.Client
+	// errorHandler 处理不影响请求结果的错误
+	errorHandler func(ctx context.Context, err error)
+
+	cookieName        string
+	cookieDomain      string
+	sessionExpiration time.Duration
+	// tokenExpiration 跳转回业务方的 token 的有效期，它只是用来换取登录态的，所以很短
+	tokenExpiration time.Duration
+	// codeExpiration 授权码的有效期，RFC 建议最长不超过 10 分钟
+	codeExpiration         time.Duration
+	deviceCodeExpiration   time.Duration
+	accessTokenExpiration  time.Duration
+	refreshTokenExpiration time.Duration
+	idTokenExpiration      time.Duration
+
+	issuer     string
+	keyManager *keys.Manager
+	users      UserFinder
+	// accessTokenAudience JWT 格式的 access token 的 aud
+	accessTokenAudience string
+	// adminToken 调用管理接口的凭证
+	adminToken string
+	// initialAccessToken 调用动态注册接口的凭证
+	initialAccessToken string
+	// registrationScopes 动态注册的客户端可以申请的 scope
+	registrationScopes []string
+	// mfa 为 nil 的时候不开启多因素认证
+	mfa MFAStore
+	// scopeDescriptions 授权页面上展示的权限说明
+	scopeDescriptions map[string]string
+}
+
+type ServerOption func(s *Server)
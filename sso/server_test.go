@@ -0,0 +1,345 @@
+package sso
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"ssoauth2/sso/jwt"
+	"ssoauth2/sso/keys"
+	webContext "ssoauth2/web/context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestServer(opts ...ServerOption) *Server {
+	clients := NewMemoryClientStore(
+		&Client{
+			ID:           "app1",
+			Secret:       "app1-secret",
+			RedirectURIs: []string{"http://app1.com:8081/oauth2/callback"},
+			Scopes:       []string{"openid", "profile", "email", "groups"},
+			Host:         "app1.com:8081",
+			CallbackURL:  "http://app1.com:8081/token",
+		},
+		&Client{
+			ID:           "spa",
+			RedirectURIs: []string{"http://spa.com/callback"},
+			Scopes:       []string{"profile"},
+			Public:       true,
+		},
+		&Client{
+			ID:                    "billing",
+			Secret:                "billing-secret",
+			Scopes:                []string{"orders.read", "orders.write"},
+			GrantTypes:            []string{GrantTypeClientCredentials},
+			AccessTokenExpiration: time.Minute * 5,
+		},
+		&Client{
+			ID:                "reports",
+			Secret:            "reports-secret",
+			Scopes:            []string{"reports.read"},
+			GrantTypes:        []string{GrantTypeClientCredentials},
+			AccessTokenFormat: AccessTokenFormatJWT,
+		},
+		&Client{
+			ID:         "cli",
+			Scopes:     []string{"openid", "profile"},
+			GrantTypes: []string{GrantTypeDeviceCode, GrantTypeRefreshToken},
+			Public:     true,
+		},
+	)
+	authn := AuthenticatorFunc(func(ctx context.Context, email string, pwd string) (*User, error) {
+		if email == "123@qq.com" && pwd == "123456" {
+			return &User{ID: "123", Email: email}, nil
+		}
+		return nil, ErrInvalidCredentials
+	})
+	opts = append([]ServerOption{
+		ServerWithClientStore(clients),
+		ServerWithAuthenticator(authn),
+		ServerWithUserFinder(testUsers{"123": {ID: "123", Email: "123@qq.com", Name: "小明", Groups: []string{"dev"}}}),
+		ServerWithKeyManager(keys.NewManager(keys.NewMemoryKeyStore(testSigningKey),
+			keys.ManagerWithAlgorithm(jwt.ES256))),
+	}, opts...)
+	return NewServer(opts...)
+}
+
+// testSigningKey 所有测试共用，避免每次都生成密钥
+var testSigningKey = func() *keys.Key {
+	key, err := keys.Generate(jwt.ES256)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+type testUsers map[string]*User
+
+func (u testUsers) FindByID(ctx context.Context, id string) (*User, error) {
+	user, ok := u[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func postForm(s http.Handler, path string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	if srv, ok := s.(*Server); ok {
+		form, cookies = csrfForm(srv, form, cookies)
+	}
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, ck := range cookies {
+		req.AddCookie(ck)
+	}
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// csrfForm 模拟浏览器提交页面上的表单，带上 CSRF cookie 和 token
+func csrfForm(s *Server, form url.Values, cookies []*http.Cookie) (url.Values, []*http.Cookie) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, ck := range cookies {
+		req.AddCookie(ck)
+	}
+	recorder := httptest.NewRecorder()
+	token := s.csrf.Token(&webContext.Context{Request: req, Response: recorder})
+	res := url.Values{"csrf_token": {token}}
+	for key, vals := range form {
+		res[key] = vals
+	}
+	return res, append(cookies, recorder.Result().Cookies()...)
+}
+
+// login 走一遍登录流程，返回 SSO 的 ssid cookie
+func login(t *testing.T, s http.Handler) *http.Cookie {
+	resp := postForm(s, "/login", url.Values{
+		"continue": {"/authorize"},
+		"email":    {"123@qq.com"},
+		"password": {"123456"},
+	})
+	require.Equal(t, http.StatusFound, resp.Code)
+	ssid := findCookie(resp, "ssid")
+	require.NotNil(t, ssid)
+	return ssid
+}
+
+func findCookie(resp *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, ck := range resp.Result().Cookies() {
+		if ck.Name == name {
+			return ck
+		}
+	}
+	return nil
+}
+
+func TestServer_CheckLogin(t *testing.T) {
+	s := newTestServer()
+	testCases := []struct {
+		name     string
+		form     url.Values
+		wantCode int
+	}{
+		{
+			name: "未登录返回登录页面",
+			form: url.Values{
+				"app_id":       {"app1"},
+				"redirect_uri": {"http://app1.com:8081/profile"},
+			},
+			wantCode: http.StatusOK,
+		},
+		{
+			name: "未知的业务方",
+			form: url.Values{
+				"app_id":       {"unknown"},
+				"redirect_uri": {"http://app1.com:8081/profile"},
+			},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name: "跳转地址不在白名单",
+			form: url.Values{
+				"app_id":       {"app1"},
+				"redirect_uri": {"http://evil.com/profile"},
+			},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name: "白名单域名作为前缀",
+			form: url.Values{
+				"app_id":       {"app1"},
+				"redirect_uri": {"http:app1.com:8081.evil.com"},
+			},
+			wantCode: http.StatusBadRequest,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := postForm(s, "/check_login", tc.form)
+			assert.Equal(t, tc.wantCode, resp.Code)
+		})
+	}
+}
+
+func TestServer_Login(t *testing.T) {
+	s := newTestServer()
+	form := url.Values{
+		"app_id":       {"app1"},
+		"redirect_uri": {"http://app1.com:8081/profile"},
+		"email":        {"123@qq.com"},
+		"password":     {"wrong"},
+	}
+	resp := postForm(s, "/login", form)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	form.Set("password", "123456")
+	resp = postForm(s, "/login", form)
+	require.Equal(t, http.StatusFound, resp.Code)
+	ssid := findCookie(resp, "ssid")
+	require.NotNil(t, ssid)
+
+	location, err := url.Parse(resp.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "app1.com:8081", location.Host)
+	assert.Equal(t, "/token", location.Path)
+	assert.Equal(t, "http://app1.com:8081/profile", location.Query().Get("redirect_uri"))
+
+	// 业务方拿着 token 换取用户 ID
+	resp = postForm(s, "/introspect", url.Values{
+		"token":         {location.Query().Get("token")},
+		"client_id":     {"app1"},
+		"client_secret": {"app1-secret"},
+	})
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), `"sub":"123"`)
+
+	// 已经登录了，check_login 直接跳转回去
+	resp = postForm(s, "/check_login", url.Values{
+		"app_id":       {"app1"},
+		"redirect_uri": {"http://app1.com:8081/profile"},
+	}, ssid)
+	assert.Equal(t, http.StatusFound, resp.Code)
+
+	// 退出登录之后，又要重新登录了
+	resp = postForm(s, "/logout", nil, ssid)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	resp = postForm(s, "/check_login", url.Values{
+		"app_id":       {"app1"},
+		"redirect_uri": {"http://app1.com:8081/profile"},
+	}, ssid)
+	assert.Equal(t, http.StatusOK, resp.Code)
+}
+
+func TestServer_CheckLoginCallbackWithQuery(t *testing.T) {
+	s := newTestServer()
+	require.NoError(t, s.clients.Save(context.Background(), &Client{
+		ID:          "app1",
+		Secret:      "app1-secret",
+		Host:        "app1.com:8081",
+		CallbackURL: "http://app1.com:8081/token?from=sso",
+	}))
+	ssid := login(t, s)
+	resp := postForm(s, "/check_login", url.Values{
+		"app_id":       {"app1"},
+		"redirect_uri": {"http://app1.com:8081/profile"},
+	}, ssid)
+	require.Equal(t, http.StatusFound, resp.Code)
+	location, err := url.Parse(resp.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "/token", location.Path)
+	assert.Equal(t, "sso", location.Query().Get("from"))
+	assert.NotEmpty(t, location.Query().Get("token"))
+	assert.Equal(t, "http://app1.com:8081/profile", location.Query().Get("redirect_uri"))
+}
+
+func TestServer_LoginContinue(t *testing.T) {
+	s := newTestServer()
+	testCases := []struct {
+		name     string
+		cont     string
+		wantCode int
+	}{
+		{name: "站内路径", cont: "/authorize?client_id=app1", wantCode: http.StatusFound},
+		{name: "绝对地址", cont: "http://evil.com/authorize", wantCode: http.StatusBadRequest},
+		{name: "协议相对地址", cont: "//evil.com/authorize", wantCode: http.StatusBadRequest},
+		{name: "反斜杠", cont: "/\\evil.com/authorize", wantCode: http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := postForm(s, "/login", url.Values{
+				"continue": {tc.cont},
+				"email":    {"123@qq.com"},
+				"password": {"123456"},
+			})
+			assert.Equal(t, tc.wantCode, resp.Code)
+		})
+	}
+}
+
+func TestServer_CSRF(t *testing.T) {
+	s := newTestServer()
+	// 不会自动带上 CSRF token 的表单提交
+	submit := func(path string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, ck := range cookies {
+			req.AddCookie(ck)
+		}
+		recorder := httptest.NewRecorder()
+		s.ServeHTTP(recorder, req)
+		return recorder
+	}
+	tokenOf := func(body string) string {
+		matches := regexp.MustCompile(`name="csrf_token" type="hidden" value="([^"]+)"`).FindStringSubmatch(body)
+		require.NotNil(t, matches)
+		return matches[1]
+	}
+
+	resp := getWithCookies(s, "/authorize?"+authorizeQuery().Encode())
+	require.Equal(t, http.StatusOK, resp.Code)
+	csrf := findCookie(resp, "_csrf")
+	require.NotNil(t, csrf)
+	token := tokenOf(resp.Body.String())
+
+	form := url.Values{
+		"continue": {"/authorize?" + authorizeQuery().Encode()},
+		"email":    {"123@qq.com"},
+		"password": {"123456"},
+	}
+	resp = submit("/login", form, csrf)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	form.Set("csrf_token", token)
+	resp = submit("/login", form)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = submit("/login", form, csrf)
+	require.Equal(t, http.StatusFound, resp.Code)
+	ssid := findCookie(resp, "ssid")
+	require.NotNil(t, ssid)
+
+	// 登录之后换了 session，登录页面上的 token 不能再用了
+	decision := authorizeQuery()
+	decision.Set("decision", "approve")
+	decision.Set("granted_scope", "profile")
+	decision.Set("csrf_token", token)
+	resp = submit("/authorize", decision, ssid, csrf)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = getWithCookies(s, "/authorize?"+authorizeQuery().Encode(), ssid, csrf)
+	require.Equal(t, http.StatusOK, resp.Code)
+	decision.Set("csrf_token", tokenOf(resp.Body.String()))
+	resp = submit("/authorize", decision, ssid, csrf)
+	assert.Equal(t, http.StatusFound, resp.Code)
+
+	// 跨站提交的退出登录不会生效
+	resp = submit("/logout", nil, ssid, csrf)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	// 还是登录状态，而且已经授权过了，直接跳转回去
+	resp = getWithCookies(s, "/authorize?"+authorizeQuery().Encode(), ssid, csrf)
+	require.Equal(t, http.StatusFound, resp.Code)
+	assert.Contains(t, resp.Header().Get("Location"), "code=")
+}
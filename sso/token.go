@@ -0,0 +1,162 @@
+package sso
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"net/http"
+	"slices"
+	webContext "ssoauth2/web/context"
+	"strings"
+	"time"
+)
+
+// token 是 OAuth2 的 token 接口，根据 grant_type 分发
+func (s *Server) token(ctx *webContext.Context) {
+	client, oerr := s.authenticateClient(ctx)
+	if oerr != nil {
+		respOAuth2Error(ctx, oerr)
+		return
+	}
+	grantType, _ := ctx.FormValue("grant_type").String()
+	if grantType == "" {
+		respOAuth2Error(ctx, newOAuth2Error(errInvalidRequest, "grant_type is required"))
+		return
+	}
+	var resp *tokenResponse
+	switch grantType {
+	case GrantTypeAuthorizationCode, GrantTypeRefreshToken, GrantTypeClientCredentials, GrantTypeDeviceCode:
+		if !client.allowGrant(grantType) {
+			respOAuth2Error(ctx, newOAuth2Error(errUnauthorizedClient, "grant_type is not allowed for this client"))
+			return
+		}
+	default:
+		respOAuth2Error(ctx, newOAuth2Error(errUnsupportedGrantType, "unsupported grant_type"))
+		return
+	}
+	switch grantType {
+	case GrantTypeAuthorizationCode:
+		resp, oerr = s.exchangeAuthorizationCode(ctx, client)
+	case GrantTypeRefreshToken:
+		resp, oerr = s.exchangeRefreshToken(ctx, client)
+	case GrantTypeClientCredentials:
+		resp, oerr = s.exchangeClientCredentials(ctx, client)
+	case GrantTypeDeviceCode:
+		resp, oerr = s.exchangeDeviceCode(ctx, client)
+	}
+	if oerr != nil {
+		respOAuth2Error(ctx, oerr)
+		return
+	}
+	respOAuth2JSON(ctx, http.StatusOK, resp)
+}
+
+func (s *Server) exchangeAuthorizationCode(ctx *webContext.Context, client *Client) (*tokenResponse, *oauth2Error) {
+	codeVal, _ := ctx.FormValue("code").String()
+	if codeVal == "" {
+		return nil, newOAuth2Error(errInvalidRequest, "code is required")
+	}
+	reqCtx := ctx.Request.Context()
+	// 不管后面校验能不能通过，这个 code 都已经作废了
+	code, err := s.codes.Take(reqCtx, codeVal)
+	if err != nil {
+		return nil, newOAuth2Error(errInvalidGrant, "invalid authorization code")
+	}
+	if code.ClientID != client.ID {
+		return nil, newOAuth2Error(errInvalidGrant, "authorization code was issued to another client")
+	}
+	redirectURI, _ := ctx.FormValue("redirect_uri").String()
+	if code.RedirectURI != redirectURI {
+		return nil, newOAuth2Error(errInvalidGrant, "redirect_uri mismatch")
+	}
+	verifier, _ := ctx.FormValue("code_verifier").String()
+	if oerr := verifyCodeVerifier(code, verifier); oerr != nil {
+		return nil, oerr
+	}
+	// 一次授权就是一个 token 家族，后续刷新出来的 token 都属于这个家族
+	familyID := uuid.New().String()
+	access, err := s.issueAccessToken(reqCtx, client, code.UserID, code.Scopes, familyID)
+	if err != nil {
+		return nil, newOAuth2Error(errServerError, "failed to issue access token")
+	}
+	// 不允许使用 refresh token 的客户端，给了它也换不了 token
+	var refresh *Token
+	if client.allowGrant(GrantTypeRefreshToken) {
+		refresh, err = s.issueRefreshToken(reqCtx, client, code.UserID, code.Scopes, familyID)
+		if err != nil {
+			return nil, newOAuth2Error(errServerError, "failed to issue refresh token")
+		}
+	}
+	resp := newTokenResponse(access, refresh)
+	if slices.Contains(code.Scopes, ScopeOpenID) {
+		resp.IDToken, err = s.issueIDToken(reqCtx, client, code)
+		if err != nil {
+			return nil, newOAuth2Error(errServerError, "failed to issue id token")
+		}
+	}
+	return resp, nil
+}
+
+func (s *Server) issueAccessToken(ctx context.Context, client *Client,
+	userID string, scopes []string, familyID string) (*Token, error) {
+	expiration := client.AccessTokenExpiration
+	if expiration <= 0 {
+		expiration = s.accessTokenExpiration
+	}
+	return s.issueToken(ctx, TokenTypeAccess, client, userID, scopes, familyID, expiration)
+}
+
+func (s *Server) issueRefreshToken(ctx context.Context, client *Client,
+	userID string, scopes []string, familyID string) (*Token, error) {
+	expiration := client.RefreshTokenExpiration
+	if expiration <= 0 {
+		expiration = s.refreshTokenExpiration
+	}
+	return s.issueToken(ctx, TokenTypeRefresh, client, userID, scopes, familyID, expiration)
+}
+
+func (s *Server) issueToken(ctx context.Context, typ string, client *Client,
+	userID string, scopes []string, familyID string, expiration time.Duration) (*Token, error) {
+	now := time.Now()
+	tk := &Token{
+		Value:     uuid.New().String(),
+		Type:      typ,
+		ClientID:  client.ID,
+		UserID:    userID,
+		Scopes:    scopes,
+		FamilyID:  familyID,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(expiration),
+	}
+	if typ == TokenTypeAccess && client.jwtAccessToken() {
+		// JWT 也一样保存下来，这样 /introspect 和 /revoke 依旧可以用
+		var err error
+		if tk.Value, err = s.signAccessToken(ctx, tk); err != nil {
+			return nil, err
+		}
+	}
+	return tk, s.tokens.Save(ctx, tk)
+}
+
+// newTokenResponse 构造 token 接口的响应，refresh 可以为 nil
+func newTokenResponse(access *Token, refresh *Token) *tokenResponse {
+	res := &tokenResponse{
+		AccessToken: access.Value,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(access.ExpiresAt.Sub(access.IssuedAt).Seconds()),
+		Scope:       strings.Join(access.Scopes, " "),
+	}
+	if refresh != nil {
+		res.RefreshToken = refresh.Value
+	}
+	return res
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	// IDToken 申请了 openid scope 的时候才有
+	IDToken string `json:"id_token,omitempty"`
+}
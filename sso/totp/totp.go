@@ -0,0 +1,106 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// 和 Google Authenticator 等常见 App 的默认值保持一致
+const (
+	Period = time.Second * 30
+	Digits = 6
+)
+
+var ErrInvalidSecret = errors.New("totp: 非法的密钥")
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret 生成一个 160 位的随机密钥，RFC 4226 推荐的长度，使用 base32 编码
+func NewSecret() (string, error) {
+	bs := make([]byte, 20)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(bs), nil
+}
+
+// Code 计算 t 时刻的验证码
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, uint64(step(t)), Digits), nil
+}
+
+// Validate 校验验证码，允许前后 skew 个周期的时钟误差
+// 校验通过的时候返回验证码所在的周期，调用方应该记录下来，拒绝同一个周期或者更早的验证码，避免重放
+func Validate(secret string, code string, t time.Time, skew int) (int64, bool) {
+	key, err := decodeSecret(secret)
+	if err != nil || len(code) != Digits {
+		return 0, false
+	}
+	current := step(t)
+	for i := -skew; i <= skew; i++ {
+		s := current + int64(i)
+		if s < 0 {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(key, uint64(s), Digits)), []byte(code)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// URI 生成 otpauth:// 地址，把它转换成二维码之后，用户就可以用 App 扫码添加
+// 格式见 https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+func URI(issuer string, account string, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(Digits))
+	query.Set("period", fmt.Sprint(int(Period.Seconds())))
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+func step(t time.Time) int64 {
+	return t.Unix() / int64(Period.Seconds())
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	// 用户手动输入的时候可能带有空格或者小写字母
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	key, err := encoding.DecodeString(strings.TrimRight(secret, "="))
+	if err != nil || len(key) == 0 {
+		return nil, ErrInvalidSecret
+	}
+	return key, nil
+}
+
+// hotp 是 RFC 4226 的算法
+func hotp(key []byte, counter uint64, digits int) string {
+	mac := hmac.New(sha1.New, key)
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
@@ -0,0 +1,79 @@
+package totp
+
+import (
+	"encoding/base32"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// RFC 6238 附录 B 里面 SHA1 的测试数据
+func TestHOTP_RFC6238(t *testing.T) {
+	key := []byte("12345678901234567890")
+	testCases := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "94287082"},
+		{unix: 1111111109, want: "07081804"},
+		{unix: 1111111111, want: "14050471"},
+		{unix: 1234567890, want: "89005924"},
+		{unix: 2000000000, want: "69279037"},
+		{unix: 20000000000, want: "65353130"},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, hotp(key, uint64(step(time.Unix(tc.unix, 0))), 8))
+	}
+
+	// 6 位的就是 8 位的后 6 位
+	secret := base32.StdEncoding.EncodeToString(key)
+	code, err := Code(secret, time.Unix(59, 0))
+	require.NoError(t, err)
+	assert.Equal(t, "287082", code)
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := NewSecret()
+	require.NoError(t, err)
+	now := time.Unix(1700000000, 0)
+	code, err := Code(secret, now)
+	require.NoError(t, err)
+
+	s, ok := Validate(secret, code, now, 1)
+	assert.True(t, ok)
+	assert.Equal(t, step(now), s)
+
+	// 允许一个周期的时钟误差
+	_, ok = Validate(secret, code, now.Add(Period), 1)
+	assert.True(t, ok)
+	_, ok = Validate(secret, code, now.Add(Period*2), 1)
+	assert.False(t, ok)
+	_, ok = Validate(secret, code, now.Add(Period), 0)
+	assert.False(t, ok)
+
+	_, ok = Validate(secret, "12345", now, 1)
+	assert.False(t, ok)
+	_, ok = Validate("not base32!", code, now, 1)
+	assert.False(t, ok)
+
+	// 小写和空格
+	_, err = Code("gezd gnbv gy3t qojq", now)
+	assert.NoError(t, err)
+	_, err = Code("", now)
+	assert.Equal(t, ErrInvalidSecret, err)
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("sso.example.com", "123@qq.com", "JBSWY3DPEHPK3PXP")
+	u, err := url.Parse(uri)
+	require.NoError(t, err)
+	assert.Equal(t, "otpauth", u.Scheme)
+	assert.Equal(t, "totp", u.Host)
+	assert.Equal(t, "/sso.example.com:123@qq.com", u.Path)
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", u.Query().Get("secret"))
+	assert.Equal(t, "sso.example.com", u.Query().Get("issuer"))
+	assert.Equal(t, "6", u.Query().Get("digits"))
+	assert.Equal(t, "30", u.Query().Get("period"))
+}
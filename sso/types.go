@@ -0,0 +1,339 @@
+package sso
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrClientNotFound     = errors.New("sso: 客户端不存在")
+	ErrSessionNotFound    = errors.New("sso: session 不存在")
+	ErrTokenNotFound      = errors.New("sso: token 不存在或者已经过期")
+	ErrInvalidCredentials = errors.New("sso: 用户名或者密码错误")
+	ErrCodeNotFound       = errors.New("sso: 授权码不存在或者已经使用过")
+	ErrUserNotFound       = errors.New("sso: 用户不存在")
+	ErrClientExists       = errors.New("sso: 客户端已经存在")
+	ErrUserExists         = errors.New("sso: 邮箱已经被别的用户使用")
+	ErrMFANotEnrolled     = errors.New("sso: 用户没有开启多因素认证")
+	ErrMFAEnrolled        = errors.New("sso: 用户已经开启了多因素认证")
+	ErrConsentNotFound    = errors.New("sso: 用户没有授权过这个客户端")
+	ErrDeviceCodeNotFound = errors.New("sso: 设备码不存在或者已经过期")
+)
+
+// OAuth2 的授权类型
+const (
+	GrantTypeAuthorizationCode = "authorization_code"
+	GrantTypeRefreshToken      = "refresh_token"
+	GrantTypeClientCredentials = "client_credentials"
+	// GrantTypeDeviceCode 是 RFC 8628 定义的设备授权模式，用于命令行工具和电视之类不方便输入的设备
+	GrantTypeDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+)
+
+// 设备授权的状态
+const (
+	DeviceAuthorizationPending  = "pending"
+	DeviceAuthorizationApproved = "approved"
+	DeviceAuthorizationDenied   = "denied"
+)
+
+// token 的类型，和 RFC 7009 里面 token_type_hint 的取值保持一致
+const (
+	TokenTypeAccess  = "access_token"
+	TokenTypeRefresh = "refresh_token"
+)
+
+// ClientStore 管理接入 SSO 的业务方，也就是以前的白名单
+type ClientStore interface {
+	// Get 找不到的时候返回 ErrClientNotFound
+	Get(ctx context.Context, id string) (*Client, error)
+	List(ctx context.Context) ([]*Client, error)
+	// Save 创建或者更新客户端
+	// 如果 Secret 不为空，那么实现必须把它哈希之后保存到 SecretHash 里面，绝对不能保存明文
+	Save(ctx context.Context, c *Client) error
+	// Delete 删除客户端，客户端不存在的时候返回 ErrClientNotFound
+	Delete(ctx context.Context, id string) error
+}
+
+// Authenticator 校验用户提交的登录凭证
+// 校验失败的时候应该返回 ErrInvalidCredentials
+type Authenticator interface {
+	Authenticate(ctx context.Context, username string, password string) (*User, error)
+}
+
+// AuthenticatorFunc 允许直接用一个方法作为 Authenticator
+type AuthenticatorFunc func(ctx context.Context, username string, password string) (*User, error)
+
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, username string, password string) (*User, error) {
+	return f(ctx, username, password)
+}
+
+// UserStore 保存用户和密码哈希，PasswordAuthenticator 基于它实现登录
+// 业务方可以实现这个接口，接入自己的用户库
+type UserStore interface {
+	// FindByID 找不到的时候返回 ErrUserNotFound
+	FindByID(ctx context.Context, id string) (*User, error)
+	// FindByEmail 邮箱不区分大小写，找不到的时候返回 ErrUserNotFound
+	FindByEmail(ctx context.Context, email string) (*User, error)
+	// Save 创建或者更新用户，邮箱已经被别的用户使用的时候返回 ErrUserExists
+	Save(ctx context.Context, u *User) error
+}
+
+// UserFinder 根据用户 ID 查询用户信息，/userinfo 接口需要用到
+// 如果 Authenticator 同时实现了这个接口，那么默认就会使用它
+type UserFinder interface {
+	FindByID(ctx context.Context, id string) (*User, error)
+}
+
+// SessionStore 管理 SSO 自身的登录态，也就是 ssid 对应的 Session
+// 过期时间由 Store 自己管理
+type SessionStore interface {
+	Save(ctx context.Context, sess *Session) error
+	Get(ctx context.Context, id string) (*Session, error)
+	Remove(ctx context.Context, id string) error
+	// AddClient 记录 session 登录过的客户端，已经记录过的不用重复添加，session 不存在的时候返回 ErrSessionNotFound
+	// 同一个 session 可能同时有多个授权请求，而且可能落在不同的 SSO 实例上，
+	// 所以这个操作必须是原子的，不能先 Get 再 Save，否则会漏掉一些客户端，退出登录的时候就通知不到它们
+	AddClient(ctx context.Context, id string, clientID string) error
+}
+
+// TokenStore 管理 SSO 颁发给业务方的 token
+// token 过期之后，Get 应该返回 ErrTokenNotFound
+type TokenStore interface {
+	Save(ctx context.Context, tk *Token) error
+	Get(ctx context.Context, value string) (*Token, error)
+	Remove(ctx context.Context, value string) error
+	// MarkRotated 把 refresh token 标记为已经轮换过，返回的是标记之前的 token。
+	// 这个操作必须是原子的，如果返回的 token 已经是 Rotated，说明它被重复使用了
+	MarkRotated(ctx context.Context, value string) (*Token, error)
+	// RemoveFamily 删除同一个家族的所有 token
+	RemoveFamily(ctx context.Context, familyID string) error
+}
+
+// MFAStore 保存用户的 TOTP 密钥和恢复码
+// TOTP 需要用密钥计算验证码，所以密钥没有办法哈希，实现应该对存储做好保护
+type MFAStore interface {
+	// Get 用户没有开启多因素认证的时候返回 ErrMFANotEnrolled
+	Get(ctx context.Context, userID string) (*MFAEnrollment, error)
+	// Create 开启多因素认证，已经开启过的返回 ErrMFAEnrolled
+	Create(ctx context.Context, e *MFAEnrollment) error
+	// UseStep 把 LastUsedStep 更新成 step，只有 step 比原来的大才会更新，返回是否更新了
+	// 同一个验证码不能用两次，所以这个操作必须是原子的，不能先 Get 再保存
+	UseStep(ctx context.Context, userID string, step int64) (bool, error)
+	// UseRecoveryCode 删除哈希值是 hash 的恢复码，返回是否删除了，已经用过的恢复码返回 false
+	// 和 UseStep 一样必须是原子的
+	UseRecoveryCode(ctx context.Context, userID string, hash string) (bool, error)
+}
+
+// AttemptStore 记录登录失败的次数，key 是账号或者 IP
+// 部署多个 SSO 实例的时候要使用共享的存储，例如用 Redis 的 INCR 和 EXPIRE 实现
+type AttemptStore interface {
+	// Get 没有失败记录的时候返回零值
+	Get(ctx context.Context, key string) (LoginAttempts, error)
+	// Fail 把失败次数加一并且返回加一之后的记录，必须是原子的
+	// window 之内没有新的失败，记录就会被清除
+	Fail(ctx context.Context, key string, window time.Duration) (LoginAttempts, error)
+	Reset(ctx context.Context, key string) error
+}
+
+// CodeStore 管理 OAuth2 授权码
+// 授权码只能使用一次，所以 Take 在返回的同时必须删除它
+type CodeStore interface {
+	Save(ctx context.Context, code *AuthorizationCode) error
+	Take(ctx context.Context, code string) (*AuthorizationCode, error)
+}
+
+// DeviceCodeStore 管理设备授权，设备用 device code 轮询，用户用 user code 批准
+// 过了 ExpiresAt 之后还要再保留一段时间，这样设备轮询的时候才能收到 expired_token，
+// 而不是 invalid_grant。保留期过了之后 Get、GetByUserCode 和 Take 都应该返回 ErrDeviceCodeNotFound
+type DeviceCodeStore interface {
+	// Save 创建或者更新设备授权
+	Save(ctx context.Context, d *DeviceAuthorization) error
+	Get(ctx context.Context, deviceCode string) (*DeviceAuthorization, error)
+	GetByUserCode(ctx context.Context, userCode string) (*DeviceAuthorization, error)
+	// Poll 记录设备的一次轮询，只能更新 LastPolledAt 和 Interval，
+	// 不能用 Save 代替，否则会覆盖掉用户同时提交的批准结果
+	Poll(ctx context.Context, deviceCode string, polledAt time.Time, interval time.Duration) error
+	// Decide 保存用户批准或者拒绝的结果，只能更新 Status、Scopes、UserID、AuthTime、AMR 和 SID，
+	// 而且只有还在等待批准的才能更新，已经处理过的返回 ErrDeviceCodeNotFound
+	Decide(ctx context.Context, d *DeviceAuthorization) error
+	// Take 设备换取 token 的时候调用，返回的同时必须删除它，保证只能换一次
+	Take(ctx context.Context, deviceCode string) (*DeviceAuthorization, error)
+}
+
+type Client struct {
+	ID string
+	// Name 客户端的名字，会展示在授权页面上
+	Name string
+	// Secret 明文的客户端密钥，只在创建客户端的时候使用，ClientStore 保存的时候会把它换成 SecretHash
+	Secret string
+	// SecretHash 哈希之后的客户端密钥，在 /token 之类的接口上认证客户端，见 HashSecret
+	SecretHash string
+	// RedirectURIs 注册的回调地址，OAuth2 流程里面 redirect_uri 必须和其中一个完全一致
+	RedirectURIs []string
+	// Scopes 允许申请的权限范围
+	Scopes []string
+	// Public 公开客户端，例如 SPA 和移动端，它们保存不了 Secret，所以强制使用 PKCE
+	Public bool
+	// RequirePKCE 机密客户端也强制要求使用 PKCE
+	RequirePKCE bool
+	// GrantTypes 允许使用的授权类型，为空的时候允许授权码模式和刷新 token
+	GrantTypes []string
+	// AccessTokenExpiration 和 RefreshTokenExpiration 是这个客户端的 token 有效期
+	// 为 0 的时候使用 Server 的默认配置
+	AccessTokenExpiration  time.Duration
+	RefreshTokenExpiration time.Duration
+	// AccessTokenFormat 是 AccessTokenFormatOpaque 或者 AccessTokenFormatJWT，为空的时候是 opaque
+	AccessTokenFormat string
+	// TokenEndpointAuthMethod 动态注册的时候选择的认证方式，例如 client_secret_post，只用来回显注册信息
+	// 认证的时候 client_secret_basic 和 client_secret_post 都接受
+	TokenEndpointAuthMethod string
+	// RegistrationTokenHash 动态注册的客户端，管理自身注册信息的 registration access token 的哈希
+	RegistrationTokenHash string
+	// Disabled 被禁用的客户端不能再发起授权，也不能使用已经颁发的 token
+	Disabled bool
+	// BackchannelLogoutURI 用户在 SSO 退出登录之后，SSO 会把 logout token POST 到这个地址
+	BackchannelLogoutURI string
+	// FrontchannelLogoutURI 用户在 SSO 退出登录之后，退出页面会用 iframe 打开这个地址
+	FrontchannelLogoutURI string
+	// PostLogoutRedirectURIs RP 发起退出登录之后，允许跳转回去的地址，必须完全一致
+	PostLogoutRedirectURIs []string
+	// Host 允许跳转回去的域名，包含端口，例如 app1.com:8081
+	Host string
+	// CallbackURL 登录成功之后，SSO 会带上 token 跳转到这个地址
+	// 例如 http://app1.com:8081/token
+	CallbackURL string
+}
+
+type User struct {
+	// ID 用户的唯一标识，业务方拿到的就是这个
+	ID    string
+	Email string
+	Name  string
+	// Groups 用户所在的组，例如 LDAP 的 memberOf，scope 包含 groups 的时候才会返回给业务方
+	Groups []string
+	// PasswordHash 只在 UserStore 里面使用，Authenticator 返回的 User 不会带上它
+	PasswordHash string
+}
+
+type Session struct {
+	// ID 就是 ssid cookie 的值，不能泄露给业务方
+	ID string
+	// SID 是公开的 session 标识，会放进 ID token 和 logout token 里面
+	SID    string
+	UserID string
+	// Account 用户登录时输入的账号，第二步认证失败也要计入这个账号的失败次数
+	Account string
+	// AuthTime 用户输入密码登录的时间
+	AuthTime time.Time
+	// AMR 用户通过的认证方式，取值见 RFC 8176，例如 pwd、otp、mfa
+	AMR []string
+	// MFAPending 密码已经校验通过，但是还没有通过第二步认证，这个时候还不算登录
+	MFAPending bool
+	// MFAFailures 第二步认证连续失败的次数
+	MFAFailures int
+	// EnrollingSecret 正在绑定，但是还没有确认的 TOTP 密钥
+	EnrollingSecret string
+	// Clients 通过这个 session 登录过的客户端，退出登录的时候要通知它们
+	Clients []string
+}
+
+type LoginAttempts struct {
+	Failures int
+	// LastFailure 最近一次失败的时间，等待时间从这里开始计算
+	LastFailure time.Time
+}
+
+// ConsentStore 保存用户同意过的授权，用户再次登录同一个客户端的时候就不用再确认了
+type ConsentStore interface {
+	// Get 没有授权过的时候返回 ErrConsentNotFound
+	Get(ctx context.Context, userID string, clientID string) (*Consent, error)
+	// List 返回用户授权过的所有客户端
+	List(ctx context.Context, userID string) ([]*Consent, error)
+	// Save 创建或者更新授权
+	Save(ctx context.Context, c *Consent) error
+	// Delete 撤销授权，没有授权过的时候返回 ErrConsentNotFound
+	Delete(ctx context.Context, userID string, clientID string) error
+}
+
+// MFAEnrollment 是用户绑定的第二因素
+type MFAEnrollment struct {
+	UserID string
+	// TOTPSecret base32 编码的 TOTP 密钥
+	TOTPSecret string
+	// RecoveryCodeHashes 恢复码的哈希，每个恢复码只能用一次
+	RecoveryCodeHashes []string
+	// LastUsedStep 最近一次使用的验证码所在的周期，用来拒绝重放
+	LastUsedStep int64
+	CreatedAt    time.Time
+}
+
+// Consent 是用户对一个客户端的授权
+type Consent struct {
+	UserID   string
+	ClientID string
+	// Scopes 用户同意过的权限，是历次授权的并集
+	Scopes []string
+	// CreatedAt 第一次授权的时间，在这之前颁发的 token 都是上一次授权的，撤销之后不能再用
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+type Token struct {
+	Value string
+	// Type 是 TokenTypeAccess 或者 TokenTypeRefresh
+	Type     string
+	ClientID string
+	UserID   string
+	Scopes   []string
+	// FamilyID 同一次授权，以及由它刷新出来的 token 都属于同一个家族
+	// 发现 refresh token 被重复使用的时候，整个家族都会被吊销
+	FamilyID string
+	// Rotated refresh token 已经被用来换过新的 token 了
+	// 它会一直保留到过期，以便发现重复使用
+	Rotated   bool
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// AuthorizationCode 授权码，用户同意授权之后颁发给客户端，用来换取 access token
+type AuthorizationCode struct {
+	Code     string
+	ClientID string
+	UserID   string
+	// RedirectURI 授权请求里面带的 redirect_uri，
+	// 如果不为空，那么换取 token 的时候必须带上同样的值
+	RedirectURI string
+	Scopes      []string
+	// CodeChallenge 和 CodeChallengeMethod 是 PKCE 的参数，没有使用 PKCE 的时候为空
+	CodeChallenge       string
+	CodeChallengeMethod string
+	// Nonce 是 OIDC 授权请求里面的 nonce，会原样放进 ID token
+	Nonce string
+	// AuthTime 用户登录的时间
+	AuthTime time.Time
+	// AMR 用户登录时通过的认证方式，会放进 ID token
+	AMR []string
+	// SID 颁发授权码的 session，会放进 ID token，业务方用它来匹配 logout token
+	SID       string
+	ExpiresAt time.Time
+}
+
+// DeviceAuthorization 设备授权，设备发起之后等待用户在 /device 页面上批准
+type DeviceAuthorization struct {
+	DeviceCode string
+	// UserCode 用户在 /device 页面上输入的短码，保存的是去掉分隔符之后的大写字母
+	UserCode string
+	ClientID string
+	Scopes   []string
+	Status   string
+	// UserID 批准的用户，下面几个字段都是用户批准之后才有的
+	UserID   string
+	AuthTime time.Time
+	AMR      []string
+	SID      string
+	// Interval 设备轮询的最小间隔，轮询太快的时候会增加
+	Interval     time.Duration
+	LastPolledAt time.Time
+	ExpiresAt    time.Time
+}
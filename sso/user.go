@@ -0,0 +1,97 @@
+package sso
+
+import (
+	"context"
+	"errors"
+	"ssoauth2/sso/password"
+)
+
+var errEmptyPassword = errors.New("sso: 密码不能为空")
+
+// PasswordAuthenticatorWithHasher 设置计算密码哈希的算法，默认是 argon2id
+// 切换算法或者调整参数之后，已有用户的哈希会在下次登录成功的时候自动更新
+func PasswordAuthenticatorWithHasher(hasher password.Hasher) PasswordAuthenticatorOption {
+	return func(a *PasswordAuthenticator) {
+		a.hasher = hasher
+	}
+}
+
+// Authenticate 用邮箱和密码登录
+func (a *PasswordAuthenticator) Authenticate(ctx context.Context, username string, pwd string) (*User, error) {
+	if username == "" || pwd == "" {
+		return nil, ErrInvalidCredentials
+	}
+	u, err := a.users.FindByEmail(ctx, username)
+	if errors.Is(err, ErrUserNotFound) || (err == nil && u.PasswordHash == "") {
+		// 用户不存在的时候也计算一次哈希，避免通过响应时间判断邮箱是否注册过
+		_, _ = a.hasher.Hash(pwd)
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	ok, err := password.Verify(u.PasswordHash, pwd)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	if a.hasher.NeedsRehash(u.PasswordHash) {
+		// 更新失败不影响这次登录，下次登录的时候会再试一次
+		if hash, err := a.hasher.Hash(pwd); err == nil {
+			u.PasswordHash = hash
+			_ = a.users.Save(ctx, u)
+		}
+	}
+	return withoutPassword(u), nil
+}
+
+// FindByID 实现了 UserFinder，所以 /userinfo 默认就会使用它
+func (a *PasswordAuthenticator) FindByID(ctx context.Context, id string) (*User, error) {
+	u, err := a.users.FindByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return withoutPassword(u), nil
+}
+
+// SetPassword 创建用户或者修改用户的密码
+func (a *PasswordAuthenticator) SetPassword(ctx context.Context, u *User, pwd string) error {
+	if pwd == "" {
+		return errEmptyPassword
+	}
+	hash, err := a.hasher.Hash(pwd)
+	if err != nil {
+		return err
+	}
+	cp := *u
+	cp.PasswordHash = hash
+	return a.users.Save(ctx, &cp)
+}
+
+func withoutPassword(u *User) *User {
+	cp := *u
+	cp.PasswordHash = ""
+	return &cp
+}
+
+// NewPasswordAuthenticator 创建一个基于 UserStore 的 Authenticator
+func NewPasswordAuthenticator(users UserStore, opts ...PasswordAuthenticatorOption) *PasswordAuthenticator {
+	a := &PasswordAuthenticator{
+		users:  users,
+		hasher: password.NewArgon2id(password.DefaultArgon2idParams),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// PasswordAuthenticator 是内置的 Authenticator，用户和密码哈希保存在 UserStore 里面
+type PasswordAuthenticator struct {
+	users  UserStore
+	hasher password.Hasher
+}
+
+type PasswordAuthenticatorOption func(a *PasswordAuthenticator)
@@ -0,0 +1,122 @@
+package sso
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/url"
+	"ssoauth2/sso/password"
+	"strings"
+	"testing"
+)
+
+// testHasher 用最小的参数，避免拖慢测试
+var testHasher = password.NewArgon2id(password.Argon2idParams{Memory: 64, Time: 1, Threads: 1})
+
+func TestPasswordAuthenticator(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryUserStore()
+	authn := NewPasswordAuthenticator(store, PasswordAuthenticatorWithHasher(testHasher))
+	require.NoError(t, authn.SetPassword(ctx, &User{ID: "123", Email: "123@qq.com", Name: "小明"}, "123456"))
+	assert.Equal(t, errEmptyPassword, authn.SetPassword(ctx, &User{ID: "456", Email: "456@qq.com"}, ""))
+
+	stored, err := store.FindByID(ctx, "123")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(stored.PasswordHash, "$argon2id$"))
+
+	testCases := []struct {
+		name     string
+		email    string
+		password string
+		wantErr  error
+	}{
+		{name: "登录成功", email: "123@qq.com", password: "123456"},
+		{name: "邮箱不区分大小写", email: "123@QQ.com", password: "123456"},
+		{name: "密码错误", email: "123@qq.com", password: "654321", wantErr: ErrInvalidCredentials},
+		{name: "用户不存在", email: "456@qq.com", password: "123456", wantErr: ErrInvalidCredentials},
+		{name: "空密码", email: "123@qq.com", password: "", wantErr: ErrInvalidCredentials},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := authn.Authenticate(ctx, tc.email, tc.password)
+			assert.Equal(t, tc.wantErr, err)
+			if err != nil {
+				return
+			}
+			assert.Equal(t, "123", u.ID)
+			assert.Equal(t, "小明", u.Name)
+			assert.Empty(t, u.PasswordHash)
+		})
+	}
+
+	u, err := authn.FindByID(ctx, "123")
+	require.NoError(t, err)
+	assert.Empty(t, u.PasswordHash)
+}
+
+func TestPasswordAuthenticator_Rehash(t *testing.T) {
+	ctx := context.Background()
+	old := password.NewBcrypt(bcrypt.MinCost)
+	hash, err := old.Hash("123456")
+	require.NoError(t, err)
+	store := NewMemoryUserStore(&User{ID: "123", Email: "123@qq.com", PasswordHash: hash})
+
+	// 从 bcrypt 切换到 argon2id，密码错误的时候不会更新哈希
+	authn := NewPasswordAuthenticator(store, PasswordAuthenticatorWithHasher(testHasher))
+	_, err = authn.Authenticate(ctx, "123@qq.com", "654321")
+	assert.Equal(t, ErrInvalidCredentials, err)
+	stored, err := store.FindByID(ctx, "123")
+	require.NoError(t, err)
+	assert.Equal(t, hash, stored.PasswordHash)
+
+	_, err = authn.Authenticate(ctx, "123@qq.com", "123456")
+	require.NoError(t, err)
+	stored, err = store.FindByID(ctx, "123")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(stored.PasswordHash, "$argon2id$"))
+	assert.False(t, testHasher.NeedsRehash(stored.PasswordHash))
+
+	// 更新之后依旧可以登录
+	_, err = authn.Authenticate(ctx, "123@qq.com", "123456")
+	assert.NoError(t, err)
+}
+
+func TestMemoryUserStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryUserStore(&User{ID: "123", Email: "123@qq.com"})
+	assert.Equal(t, ErrUserExists, store.Save(ctx, &User{ID: "456", Email: "123@QQ.COM"}))
+
+	// 修改邮箱之后，旧的邮箱就找不到了
+	require.NoError(t, store.Save(ctx, &User{ID: "123", Email: "new@qq.com"}))
+	_, err := store.FindByEmail(ctx, "123@qq.com")
+	assert.Equal(t, ErrUserNotFound, err)
+	u, err := store.FindByEmail(ctx, "new@qq.com")
+	require.NoError(t, err)
+	assert.Equal(t, "123", u.ID)
+	require.NoError(t, store.Save(ctx, &User{ID: "456", Email: "123@qq.com"}))
+}
+
+func TestServer_LoginWithPasswordAuthenticator(t *testing.T) {
+	authn := NewPasswordAuthenticator(NewMemoryUserStore(), PasswordAuthenticatorWithHasher(testHasher))
+	require.NoError(t, authn.SetPassword(context.Background(),
+		&User{ID: "789", Email: "789@qq.com", Name: "小红"}, "abcdef"))
+	s := newTestServer(ServerWithAuthenticator(authn))
+
+	resp := postForm(s, "/login", url.Values{
+		"email":        {"789@qq.com"},
+		"password":     {"abcdef"},
+		"app_id":       {"app1"},
+		"redirect_uri": {"http://app1.com:8081/profile"},
+	})
+	require.Equal(t, http.StatusFound, resp.Code)
+
+	resp = postForm(s, "/login", url.Values{
+		"email":        {"789@qq.com"},
+		"password":     {"123456"},
+		"app_id":       {"app1"},
+		"redirect_uri": {"http://app1.com:8081/profile"},
+	})
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
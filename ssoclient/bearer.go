@@ -0,0 +1,276 @@
+package ssoclient
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/patrickmn/go-cache"
+	"net/http"
+	"net/url"
+	"slices"
+	"ssoauth2/sso/jwt"
+	webContext "ssoauth2/web/context"
+	"ssoauth2/web/handler"
+	"ssoauth2/web/middleware"
+	"strings"
+	"time"
+)
+
+// claimsKey 校验通过的 token 在 ctx.UserValues 里面的 key
+const claimsKey = "ssoclient_claims"
+
+var (
+	errInvalidToken = errors.New("ssoclient: 非法的 token")
+	errKeyNotFound  = errors.New("ssoclient: JWKS 里面找不到对应的公钥")
+)
+
+// BearerAuthWithIntrospection 设置调用 /introspect 的凭证，
+// 不设置的话只能校验 JWT 格式的 access token
+func BearerAuthWithIntrospection(clientID string, clientSecret string) BearerAuthOption {
+	return func(b *BearerAuth) {
+		b.clientID = clientID
+		b.clientSecret = clientSecret
+	}
+}
+
+// BearerAuthWithIssuer 设置 JWT 的 iss，默认就是 ssoURL
+func BearerAuthWithIssuer(issuer string) BearerAuthOption {
+	return func(b *BearerAuth) {
+		b.issuer = issuer
+	}
+}
+
+// BearerAuthWithAudience 设置 JWT 的 aud 必须包含的值，默认就是 issuer
+func BearerAuthWithAudience(aud string) BearerAuthOption {
+	return func(b *BearerAuth) {
+		b.audience = aud
+	}
+}
+
+// BearerAuthWithCacheExpiration 设置 introspection 结果的缓存时间，默认是一分钟
+// 缓存的时间越长，吊销 token 之后生效得越慢
+func BearerAuthWithCacheExpiration(expiration time.Duration) BearerAuthOption {
+	return func(b *BearerAuth) {
+		b.cacheExpiration = expiration
+	}
+}
+
+func BearerAuthWithHTTPClient(httpClient *http.Client) BearerAuthOption {
+	return func(b *BearerAuth) {
+		b.httpClient = httpClient
+	}
+}
+
+// Middleware 校验 Authorization: Bearer 头部里面的 access token
+// 校验通过之后，可以通过 ClaimsFromContext 拿到 token 的信息
+func (b *BearerAuth) Middleware() middleware.Middleware {
+	return func(next handler.HandleFunc) handler.HandleFunc {
+		return func(ctx *webContext.Context) {
+			value := bearerToken(ctx.Request)
+			if value == "" {
+				ctx.Response.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+				_ = ctx.RespString(http.StatusUnauthorized, "")
+				return
+			}
+			claims, err := b.Validate(ctx.Request.Context(), value)
+			if err != nil {
+				ctx.Response.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				_ = ctx.RespString(http.StatusUnauthorized, "")
+				return
+			}
+			if ctx.UserValues == nil {
+				ctx.UserValues = make(map[string]any, 1)
+			}
+			ctx.UserValues[claimsKey] = claims
+			next(ctx)
+		}
+	}
+}
+
+// RequireScopes 要求 token 拥有所有的 scopes，一般用 UseMdls 挂在需要保护的路由上，
+// 它必须在 BearerAuth.Middleware 之后执行
+func RequireScopes(scopes ...string) middleware.Middleware {
+	challenge := fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, strings.Join(scopes, " "))
+	return func(next handler.HandleFunc) handler.HandleFunc {
+		return func(ctx *webContext.Context) {
+			claims, ok := ClaimsFromContext(ctx)
+			if !ok {
+				ctx.Response.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+				_ = ctx.RespString(http.StatusUnauthorized, "")
+				return
+			}
+			if !claims.HasScopes(scopes...) {
+				ctx.Response.Header().Set("WWW-Authenticate", challenge)
+				_ = ctx.RespString(http.StatusForbidden, "")
+				return
+			}
+			next(ctx)
+		}
+	}
+}
+
+// ClaimsFromContext 拿到 BearerAuth 校验过的 token 信息
+func ClaimsFromContext(ctx *webContext.Context) (*Claims, bool) {
+	claims, ok := ctx.UserValues[claimsKey].(*Claims)
+	return claims, ok
+}
+
+// HasScopes 判断 token 是不是拥有所有的 scopes
+func (c *Claims) HasScopes(scopes ...string) bool {
+	for _, scope := range scopes {
+		if !slices.Contains(c.Scopes, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate 校验 access token
+// JWT 格式的在本地用 JWKS 校验，其它的都当成 opaque token 调用 /introspect
+func (b *BearerAuth) Validate(ctx context.Context, token string) (*Claims, error) {
+	if strings.Count(token, ".") == 2 {
+		return b.validateJWT(ctx, token)
+	}
+	return b.introspect(ctx, token)
+}
+
+func (b *BearerAuth) validateJWT(ctx context.Context, token string) (*Claims, error) {
+	var claims accessTokenClaims
+	header, err := jwt.Parse(token, func(header *jwt.Header) (crypto.PublicKey, error) {
+		return b.keys.publicKey(ctx, header.Kid)
+	}, &claims)
+	if err != nil {
+		return nil, err
+	}
+	// RFC 9068 要求校验 typ，避免把 ID token 当成 access token 用
+	typ := strings.ToLower(header.Typ)
+	if typ != "at+jwt" && typ != "application/at+jwt" {
+		return nil, errInvalidToken
+	}
+	if err = claims.Validate(time.Now(), time.Second*30); err != nil {
+		return nil, err
+	}
+	if claims.Issuer != b.issuer || !claims.Audience.Contains(b.audience) || claims.ExpiresAt == 0 {
+		return nil, errInvalidToken
+	}
+	return &Claims{
+		Subject:   claims.Subject,
+		ClientID:  claims.ClientID,
+		Scopes:    strings.Fields(claims.Scope),
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+	}, nil
+}
+
+// introspect 调用 SSO 的 /introspect 接口，校验通过的结果会缓存起来
+func (b *BearerAuth) introspect(ctx context.Context, token string) (*Claims, error) {
+	if b.clientID == "" {
+		return nil, errInvalidToken
+	}
+	// 缓存里面不直接保存 token 本身
+	sum := sha256.Sum256([]byte(token))
+	cacheKey := hex.EncodeToString(sum[:])
+	if val, ok := b.cache.Get(cacheKey); ok {
+		return val.(*Claims), nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.ssoURL+"/introspect",
+		strings.NewReader(url.Values{"token": {token}}.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(b.clientID), url.QueryEscape(b.clientSecret))
+	var res introspectionResponse
+	if err = doJSON(b.httpClient, req, &res); err != nil {
+		return nil, err
+	}
+	// 只接受 access token，refresh token 不能拿来访问资源
+	if !res.Active || res.TokenType != "Bearer" {
+		return nil, errInvalidToken
+	}
+	claims := &Claims{
+		Subject:   res.Sub,
+		ClientID:  res.ClientID,
+		Scopes:    strings.Fields(res.Scope),
+		ExpiresAt: time.Unix(res.Exp, 0),
+	}
+	expiration := b.cacheExpiration
+	if remain := time.Until(claims.ExpiresAt); remain < expiration {
+		expiration = remain
+	}
+	if expiration > 0 {
+		b.cache.Set(cacheKey, claims, expiration)
+	}
+	return claims, nil
+}
+
+// bearerToken 从 Authorization 头部取出 token
+func bearerToken(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// NewBearerAuth 创建一个资源服务器使用的 token 校验器，ssoURL 是 SSO 的地址
+func NewBearerAuth(ssoURL string, opts ...BearerAuthOption) *BearerAuth {
+	b := &BearerAuth{
+		ssoURL:          strings.TrimSuffix(ssoURL, "/"),
+		cacheExpiration: time.Minute,
+		httpClient:      &http.Client{Timeout: time.Second * 10},
+	}
+	b.issuer = b.ssoURL
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.audience == "" {
+		b.audience = b.issuer
+	}
+	b.cache = cache.New(b.cacheExpiration, time.Minute)
+	b.keys = newKeySet(b.ssoURL, b.httpClient)
+	return b
+}
+
+// BearerAuth 是资源服务器校验 access token 的 middleware
+type BearerAuth struct {
+	ssoURL       string
+	issuer       string
+	audience     string
+	clientID     string
+	clientSecret string
+	httpClient   *http.Client
+
+	cache           *cache.Cache
+	cacheExpiration time.Duration
+
+	keys *keySet
+}
+
+type BearerAuthOption func(b *BearerAuth)
+
+// Claims 是校验通过的 access token 的信息
+type Claims struct {
+	// Subject 用户 ID，client_credentials 模式下是客户端 ID
+	Subject   string
+	ClientID  string
+	Scopes    []string
+	ExpiresAt time.Time
+}
+
+type accessTokenClaims struct {
+	jwt.RegisteredClaims
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope"`
+}
+
+type introspectionResponse struct {
+	Active    bool   `json:"active"`
+	Sub       string `json:"sub"`
+	ClientID  string `json:"client_id"`
+	Scope     string `json:"scope"`
+	Exp       int64  `json:"exp"`
+	TokenType string `json:"token_type"`
+}
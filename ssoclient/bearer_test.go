@@ -0,0 +1,228 @@
+package ssoclient
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"ssoauth2/sso"
+	"ssoauth2/sso/jwt"
+	"ssoauth2/sso/keys"
+	webContext "ssoauth2/web/context"
+	"ssoauth2/web/middleware"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type bearerEnv struct {
+	sso        *httptest.Server
+	keys       *keys.Manager
+	introspect *atomic.Int64
+}
+
+func newBearerEnv(t *testing.T) *bearerEnv {
+	env := &bearerEnv{
+		keys:       keys.NewManager(keys.NewMemoryKeyStore(), keys.ManagerWithAlgorithm(jwt.ES256)),
+		introspect: &atomic.Int64{},
+	}
+	clients := sso.NewMemoryClientStore(
+		&sso.Client{
+			ID:         "orders-api",
+			Secret:     "orders-api-secret",
+			GrantTypes: []string{sso.GrantTypeClientCredentials},
+		},
+		&sso.Client{
+			ID:         "billing",
+			Secret:     "billing-secret",
+			Scopes:     []string{"orders.read", "orders.write"},
+			GrantTypes: []string{sso.GrantTypeClientCredentials},
+		},
+		&sso.Client{
+			ID:                "reports",
+			Secret:            "reports-secret",
+			Scopes:            []string{"orders.read"},
+			GrantTypes:        []string{sso.GrantTypeClientCredentials},
+			AccessTokenFormat: sso.AccessTokenFormatJWT,
+		},
+	)
+	ssoServer := sso.NewServer(
+		sso.ServerWithClientStore(clients),
+		sso.ServerWithKeyManager(env.keys),
+		sso.ServerWithIssuer("http://sso.test"),
+	)
+	// 记录 /introspect 被调用的次数
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/introspect" {
+			env.introspect.Add(1)
+		}
+		ssoServer.ServeHTTP(writer, req)
+	}))
+	t.Cleanup(server.Close)
+	env.sso = server
+	return env
+}
+
+// token 用 client_credentials 模式拿到 access token
+func (e *bearerEnv) token(t *testing.T, clientID string, scope string) string {
+	resp, err := http.PostForm(e.sso.URL+"/token", url.Values{
+		"grant_type":    {sso.GrantTypeClientCredentials},
+		"scope":         {scope},
+		"client_id":     {clientID},
+		"client_secret": {clientID + "-secret"},
+	})
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var res tokenResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+	return res.AccessToken
+}
+
+func (e *bearerEnv) newBearerAuth() *BearerAuth {
+	return NewBearerAuth(e.sso.URL,
+		BearerAuthWithIssuer("http://sso.test"),
+		BearerAuthWithIntrospection("orders-api", "orders-api-secret"))
+}
+
+// serve 直接执行 middleware 链，这样可以测试挂在单个路由上的 middleware
+func serve(token string, mdls ...middleware.Middleware) (*webContext.Context, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	ctx := &webContext.Context{Request: req, Response: recorder}
+	h := func(ctx *webContext.Context) {
+		_ = ctx.RespString(http.StatusOK, "orders")
+	}
+	for i := len(mdls) - 1; i >= 0; i-- {
+		h = mdls[i](h)
+	}
+	h(ctx)
+	return ctx, recorder
+}
+
+func TestBearerAuth(t *testing.T) {
+	env := newBearerEnv(t)
+	auth := env.newBearerAuth()
+	testCases := []struct {
+		name   string
+		token  string
+		scopes []string
+
+		wantCode      int
+		wantSubject   string
+		wantChallenge string
+	}{
+		{
+			name:          "没有 token",
+			wantCode:      http.StatusUnauthorized,
+			wantChallenge: `Bearer realm="api"`,
+		},
+		{
+			name:          "非法的 opaque token",
+			token:         "unknown",
+			wantCode:      http.StatusUnauthorized,
+			wantChallenge: `Bearer error="invalid_token"`,
+		},
+		{
+			name:          "非法的 JWT",
+			token:         "a.b.c",
+			wantCode:      http.StatusUnauthorized,
+			wantChallenge: `Bearer error="invalid_token"`,
+		},
+		{
+			name:        "opaque token",
+			token:       env.token(t, "billing", "orders.read orders.write"),
+			scopes:      []string{"orders.write"},
+			wantCode:    http.StatusOK,
+			wantSubject: "billing",
+		},
+		{
+			name:        "JWT token",
+			token:       env.token(t, "reports", "orders.read"),
+			scopes:      []string{"orders.read"},
+			wantCode:    http.StatusOK,
+			wantSubject: "reports",
+		},
+		{
+			name:          "scope 不够",
+			token:         env.token(t, "reports", "orders.read"),
+			scopes:        []string{"orders.write"},
+			wantCode:      http.StatusForbidden,
+			wantChallenge: `Bearer error="insufficient_scope", scope="orders.write"`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, recorder := serve(tc.token, auth.Middleware(), RequireScopes(tc.scopes...))
+			assert.Equal(t, tc.wantCode, ctx.RespStatusCode)
+			assert.Equal(t, tc.wantChallenge, recorder.Header().Get("WWW-Authenticate"))
+			if tc.wantCode != http.StatusOK {
+				return
+			}
+			claims, ok := ClaimsFromContext(ctx)
+			require.True(t, ok)
+			assert.Equal(t, tc.wantSubject, claims.Subject)
+			assert.Equal(t, tc.wantSubject, claims.ClientID)
+		})
+	}
+}
+
+func TestBearerAuth_IntrospectionCache(t *testing.T) {
+	env := newBearerEnv(t)
+	auth := env.newBearerAuth()
+	token := env.token(t, "billing", "orders.read")
+	for i := 0; i < 3; i++ {
+		ctx, _ := serve(token, auth.Middleware())
+		assert.Equal(t, http.StatusOK, ctx.RespStatusCode)
+	}
+	assert.Equal(t, int64(1), env.introspect.Load())
+
+	// 没有配置凭证的时候，只能校验 JWT
+	ctx, _ := serve(token, NewBearerAuth(env.sso.URL).Middleware())
+	assert.Equal(t, http.StatusUnauthorized, ctx.RespStatusCode)
+}
+
+func TestBearerAuth_JWT(t *testing.T) {
+	env := newBearerEnv(t)
+	auth := env.newBearerAuth()
+	ctx, _ := serve(env.token(t, "reports", "orders.read"), auth.Middleware())
+	require.Equal(t, http.StatusOK, ctx.RespStatusCode)
+
+	// SSO 轮换了密钥，会重新拉取 JWKS，但是一分钟之内最多一次
+	require.NoError(t, env.keys.Rotate(context.Background()))
+	token := env.token(t, "reports", "orders.read")
+	ctx, _ = serve(token, auth.Middleware())
+	assert.Equal(t, http.StatusUnauthorized, ctx.RespStatusCode)
+	auth.keys.fetchedAt = auth.keys.fetchedAt.Add(-time.Minute)
+	ctx, _ = serve(token, auth.Middleware())
+	assert.Equal(t, http.StatusOK, ctx.RespStatusCode)
+
+	// 不接受别的 issuer 和 aud
+	ctx, _ = serve(token, NewBearerAuth(env.sso.URL, BearerAuthWithIssuer("http://sso.test"),
+		BearerAuthWithAudience("http://other.test")).Middleware())
+	assert.Equal(t, http.StatusUnauthorized, ctx.RespStatusCode)
+	ctx, _ = serve(token, NewBearerAuth(env.sso.URL).Middleware())
+	assert.Equal(t, http.StatusUnauthorized, ctx.RespStatusCode)
+
+	// typ 不是 at+jwt 的，例如 ID token，不能当成 access token 用
+	key, err := env.keys.SigningKey(context.Background())
+	require.NoError(t, err)
+	idToken, err := jwt.Sign(key, "JWT", accessTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "http://sso.test",
+			Subject:   "123",
+			Audience:  jwt.Audience{"http://sso.test"},
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+		Scope: "orders.read",
+	})
+	require.NoError(t, err)
+	ctx, _ = serve(idToken, auth.Middleware())
+	assert.Equal(t, http.StatusUnauthorized, ctx.RespStatusCode)
+}
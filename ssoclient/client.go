@@ -0,0 +1,418 @@
+package ssoclient
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"net/http"
+	"net/url"
+	"slices"
+	webContext "ssoauth2/web/context"
+	"ssoauth2/web/handler"
+	"ssoauth2/web/middleware"
+	"ssoauth2/web/session"
+	"strings"
+	"time"
+)
+
+// session 里面保存的 key
+const (
+	sessKeyState    = "sso_state"
+	sessKeyVerifier = "sso_code_verifier"
+	sessKeyNonce    = "sso_nonce"
+	sessKeyReturnTo = "sso_return_to"
+	sessKeyUserID   = "sso_uid"
+	sessKeyName     = "sso_name"
+	sessKeyEmail    = "sso_email"
+	sessKeySID      = "sso_sid"
+)
+
+// DefaultCallbackPath 默认的回调路径
+const DefaultCallbackPath = "/oauth2/callback"
+
+// userKey 登录用户在 ctx.UserValues 里面的 key
+const userKey = "ssoclient_user"
+
+var (
+	errInvalidState = errors.New("ssoclient: state 不匹配")
+	errInvalidNonce = errors.New("ssoclient: nonce 不匹配")
+)
+
+// WithCallbackPath 设置 SSO 授权之后跳转回来的路径，默认是 /oauth2/callback
+// 它和当前请求的域名拼起来，就是在 SSO 上注册的 redirect_uri
+func WithCallbackPath(path string) Option {
+	return func(c *Client) {
+		c.callbackPath = path
+	}
+}
+
+// WithExcludedPaths 这些路径不需要登录，例如 /health
+func WithExcludedPaths(paths ...string) Option {
+	return func(c *Client) {
+		c.excludedPaths = append(c.excludedPaths, paths...)
+	}
+}
+
+// WithScopes 设置申请的权限，默认是 openid profile email
+func WithScopes(scopes ...string) Option {
+	return func(c *Client) {
+		c.scopes = scopes
+	}
+}
+
+// WithHTTPClient 设置调用 SSO 接口使用的 http.Client
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// Middleware 校验登录态，没有登录就跳转到 SSO 去授权
+// 登录了的话，可以通过 UserFromContext 拿到用户
+func (c *Client) Middleware() middleware.Middleware {
+	return func(next handler.HandleFunc) handler.HandleFunc {
+		return func(ctx *webContext.Context) {
+			path := ctx.Request.URL.Path
+			if path == c.callbackPath || path == c.backchannelLogoutPath ||
+				path == c.frontchannelLogoutPath || slices.Contains(c.excludedPaths, path) {
+				next(ctx)
+				return
+			}
+			user, err := c.currentUser(ctx)
+			if err == nil {
+				if ctx.UserValues == nil {
+					ctx.UserValues = make(map[string]any, 1)
+				}
+				ctx.UserValues[userKey] = user
+				// 有访问就续期
+				_, _ = c.sessions.RefreshSession(ctx)
+				next(ctx)
+				return
+			}
+			if ctx.Request.Method != http.MethodGet && ctx.Request.Method != http.MethodHead {
+				// 跳转之后原来的请求体就丢了，所以只有 GET 请求才跳转
+				_ = ctx.RespString(http.StatusUnauthorized, "请登录")
+				return
+			}
+			c.redirectToSSO(ctx)
+		}
+	}
+}
+
+// CallbackHandler 处理 SSO 跳转回来的请求，需要注册在 callbackPath 上：
+// 用授权码换取 token，查询用户信息，然后建立本地的登录态
+func (c *Client) CallbackHandler() handler.HandleFunc {
+	return func(ctx *webContext.Context) {
+		sess, err := c.sessions.GetSession(ctx)
+		if err != nil {
+			_ = ctx.RespString(http.StatusBadRequest, "登录已经过期，请重新登录")
+			return
+		}
+		if err = c.checkState(ctx, sess); err != nil {
+			_ = ctx.RespString(http.StatusForbidden, "非法访问")
+			return
+		}
+		if errCode, _ := ctx.QueryValue("error").String(); errCode != "" {
+			_ = ctx.RespString(http.StatusForbidden, "授权失败："+errCode)
+			return
+		}
+		reqCtx := ctx.Request.Context()
+		code, _ := ctx.QueryValue("code").String()
+		verifier, _ := sess.Get(reqCtx, sessKeyVerifier)
+		tk, err := c.exchangeCode(reqCtx, code, c.redirectURI(ctx), verifier)
+		if err != nil {
+			_ = ctx.RespString(http.StatusForbidden, "非法访问")
+			return
+		}
+		// 没有申请 openid 的时候没有 ID token，也就收不到退出登录的通知
+		var sid string
+		if tk.IDToken != "" {
+			nonce, _ := sess.Get(reqCtx, sessKeyNonce)
+			claims, err := c.verifyIDToken(reqCtx, tk.IDToken, nonce)
+			if err != nil {
+				_ = ctx.RespString(http.StatusForbidden, "非法访问")
+				return
+			}
+			sid = claims.SID
+		}
+		user, err := c.userinfo(reqCtx, tk.AccessToken)
+		if err != nil {
+			_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+			return
+		}
+		returnTo, _ := sess.Get(reqCtx, sessKeyReturnTo)
+		// 登录之后换一个新的 session，避免 session fixation
+		if err = c.sessions.RemoveSession(ctx); err != nil {
+			_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+			return
+		}
+		if err = c.initUserSession(ctx, user, sid); err != nil {
+			_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+			return
+		}
+		if !isLocalPath(returnTo) {
+			returnTo = "/"
+		}
+		ctx.Redirect(returnTo)
+	}
+}
+
+// UserFromContext 拿到 Middleware 校验过的登录用户
+func UserFromContext(ctx *webContext.Context) (*User, bool) {
+	user, ok := ctx.UserValues[userKey].(*User)
+	return user, ok
+}
+
+func (c *Client) currentUser(ctx *webContext.Context) (*User, error) {
+	sess, err := c.sessions.GetSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reqCtx := ctx.Request.Context()
+	uid, err := sess.Get(reqCtx, sessKeyUserID)
+	if err != nil {
+		return nil, err
+	}
+	user := &User{ID: uid}
+	user.Name, _ = sess.Get(reqCtx, sessKeyName)
+	user.Email, _ = sess.Get(reqCtx, sessKeyEmail)
+	return user, nil
+}
+
+// redirectToSSO 发起授权码流程
+// state、code_verifier、nonce 和原本要访问的地址都保存在一个临时的 session 里面
+func (c *Client) redirectToSSO(ctx *webContext.Context) {
+	state, err := randomString()
+	if err != nil {
+		_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+		return
+	}
+	nonce, err := randomString()
+	if err != nil {
+		_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+		return
+	}
+	verifier, err := randomString()
+	if err != nil {
+		_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+		return
+	}
+	sess, err := c.sessions.InitSession(ctx, uuid.New().String())
+	if err != nil {
+		_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+		return
+	}
+	reqCtx := ctx.Request.Context()
+	for key, val := range map[string]string{
+		sessKeyState:    state,
+		sessKeyVerifier: verifier,
+		sessKeyNonce:    nonce,
+		sessKeyReturnTo: ctx.Request.URL.RequestURI(),
+	} {
+		if err = sess.Set(reqCtx, key, val); err != nil {
+			_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+			return
+		}
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.clientID},
+		"redirect_uri":          {c.redirectURI(ctx)},
+		"scope":                 {strings.Join(c.scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}
+	ctx.Redirect(c.ssoURL + "/authorize?" + query.Encode())
+}
+
+func (c *Client) checkState(ctx *webContext.Context, sess session.Session) error {
+	want, err := sess.Get(ctx.Request.Context(), sessKeyState)
+	if err != nil {
+		return err
+	}
+	state, _ := ctx.QueryValue("state").String()
+	if state == "" || subtle.ConstantTimeCompare([]byte(want), []byte(state)) != 1 {
+		return errInvalidState
+	}
+	return nil
+}
+
+func (c *Client) initUserSession(ctx *webContext.Context, user *User, sid string) error {
+	sess, err := c.sessions.InitSession(ctx, uuid.New().String())
+	if err != nil {
+		return err
+	}
+	reqCtx := ctx.Request.Context()
+	if err = sess.Set(reqCtx, sessKeyUserID, user.ID); err != nil {
+		return err
+	}
+	if err = sess.Set(reqCtx, sessKeyName, user.Name); err != nil {
+		return err
+	}
+	if err = sess.Set(reqCtx, sessKeyEmail, user.Email); err != nil {
+		return err
+	}
+	if sid == "" {
+		return nil
+	}
+	if err = sess.Set(reqCtx, sessKeySID, sid); err != nil {
+		return err
+	}
+	return c.index.Add(reqCtx, sid, user.ID, sess.ID())
+}
+
+// redirectURI 用当前请求的域名拼出回调地址
+func (c *Client) redirectURI(ctx *webContext.Context) string {
+	scheme := "http"
+	if ctx.Request.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + ctx.Request.Host + c.callbackPath
+}
+
+// exchangeCode 调用 SSO 的 /token 接口，用授权码换取 token
+func (c *Client) exchangeCode(ctx context.Context, code string,
+	redirectURI string, verifier string) (*tokenResponse, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		c.ssoURL+"/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(c.clientID), url.QueryEscape(c.clientSecret))
+	var res tokenResponse
+	if err = doJSON(c.httpClient, req, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// userinfo 调用 SSO 的 /userinfo 接口
+func (c *Client) userinfo(ctx context.Context, accessToken string) (*User, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.ssoURL+"/userinfo", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	var res userinfoResponse
+	if err = doJSON(c.httpClient, req, &res); err != nil {
+		return nil, err
+	}
+	if res.Sub == "" {
+		return nil, errors.New("ssoclient: userinfo 没有返回 sub")
+	}
+	return &User{ID: res.Sub, Name: res.Name, Email: res.Email}, nil
+}
+
+// doJSON 调用 SSO 的接口，并且把 JSON 响应解析到 val 里面
+func doJSON(httpClient *http.Client, req *http.Request, val any) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ssoclient: 调用 %s 失败，状态码 %d", req.URL.Path, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(val)
+}
+
+// randomString 生成 state 和 code_verifier，32 个字节编码之后是 43 个字符
+func randomString() (string, error) {
+	bs := make([]byte, 32)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bs), nil
+}
+
+// isLocalPath 只允许跳转回本站的路径，避免开放重定向
+func isLocalPath(path string) bool {
+	return strings.HasPrefix(path, "/") &&
+		!strings.HasPrefix(path, "//") && !strings.HasPrefix(path, "/\\")
+}
+
+// New 创建一个 SSO 客户端
+// ssoURL 是 SSO 的地址，例如 http://sso.com:8083；
+// clientID 和 clientSecret 是在 SSO 上注册的凭证；
+// sessions 用来保存本地的登录态
+func New(ssoURL string, clientID string, clientSecret string,
+	sessions *session.Manager, opts ...Option) *Client {
+	c := &Client{
+		ssoURL:       strings.TrimSuffix(ssoURL, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		sessions:     sessions,
+		callbackPath: DefaultCallbackPath,
+		scopes:       []string{"openid", "profile", "email"},
+		httpClient:   &http.Client{Timeout: time.Second * 10},
+
+		backchannelLogoutPath:  DefaultBackchannelLogoutPath,
+		frontchannelLogoutPath: DefaultFrontchannelLogoutPath,
+	}
+	c.issuer = c.ssoURL
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.index == nil {
+		c.index = NewMemorySessionIndex(time.Hour * 24)
+	}
+	c.keys = newKeySet(c.ssoURL, c.httpClient)
+	return c
+}
+
+// Client 是业务方接入 SSO 的客户端
+type Client struct {
+	ssoURL        string
+	clientID      string
+	clientSecret  string
+	sessions      *session.Manager
+	callbackPath  string
+	excludedPaths []string
+	scopes        []string
+	httpClient    *http.Client
+
+	issuer                 string
+	keys                   *keySet
+	index                  SessionIndex
+	backchannelLogoutPath  string
+	frontchannelLogoutPath string
+}
+
+type Option func(c *Client)
+
+// User 是从 SSO 拿到的登录用户
+type User struct {
+	ID    string
+	Name  string
+	Email string
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	IDToken      string `json:"id_token"`
+}
+
+type userinfoResponse struct {
+	Sub   string `json:"sub"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
@@ -0,0 +1,392 @@
+package ssoclient
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"html"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"ssoauth2/sso"
+	"ssoauth2/sso/jwt"
+	"ssoauth2/sso/keys"
+	"ssoauth2/web"
+	webContext "ssoauth2/web/context"
+	"ssoauth2/web/session"
+	"ssoauth2/web/session/cookie"
+	"ssoauth2/web/session/memory"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testUsers struct{}
+
+func (testUsers) Authenticate(ctx context.Context, email string, pwd string) (*sso.User, error) {
+	if email == "123@qq.com" && pwd == "123456" {
+		return &sso.User{ID: "123", Email: email, Name: "小明"}, nil
+	}
+	return nil, sso.ErrInvalidCredentials
+}
+
+func (testUsers) FindByID(ctx context.Context, id string) (*sso.User, error) {
+	if id != "123" {
+		return nil, sso.ErrUserNotFound
+	}
+	return &sso.User{ID: "123", Email: "123@qq.com", Name: "小明"}, nil
+}
+
+type testEnv struct {
+	sso     *httptest.Server
+	app     *httptest.Server
+	client  *http.Client
+	clients *sso.MemoryClientStore
+}
+
+// ssoLogin 是浏览器在 SSO 上的登录态，退出登录的时候要用
+type ssoLogin struct {
+	cookies   []*http.Cookie
+	csrfToken string
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	clients := sso.NewMemoryClientStore()
+	ssoServer := httptest.NewServer(sso.NewServer(
+		sso.ServerWithClientStore(clients),
+		sso.ServerWithAuthenticator(testUsers{}),
+		sso.ServerWithKeyManager(keys.NewManager(keys.NewMemoryKeyStore(),
+			keys.ManagerWithAlgorithm(jwt.ES256))),
+	))
+	t.Cleanup(ssoServer.Close)
+
+	sessions := &session.Manager{
+		Store:      memory.NewStore(time.Minute * 15),
+		Propagator: cookie.NewPropagator("app_ssid"),
+		SessCtxKey: "_sess",
+	}
+	c := New(ssoServer.URL, "app1", "app1-secret", sessions,
+		WithExcludedPaths("/health"), WithIssuer("http://sso.com:8083"))
+	app := web.NewHTTPServer()
+	app.Use(c.Middleware())
+	app.Get("/profile", func(ctx *webContext.Context) {
+		user, _ := UserFromContext(ctx)
+		_ = ctx.RespString(http.StatusOK, user.ID+" "+user.Name)
+	})
+	app.Post("/profile", func(ctx *webContext.Context) {
+		_ = ctx.RespString(http.StatusOK, "")
+	})
+	app.Get("/health", func(ctx *webContext.Context) {
+		_ = ctx.RespString(http.StatusOK, "ok")
+	})
+	app.Get("/oauth2/callback", c.CallbackHandler())
+	app.Post(DefaultBackchannelLogoutPath, c.BackchannelLogoutHandler())
+	app.Get(DefaultFrontchannelLogoutPath, c.FrontchannelLogoutHandler())
+	appServer := httptest.NewServer(app)
+	t.Cleanup(appServer.Close)
+
+	require.NoError(t, clients.Save(context.Background(), &sso.Client{
+		ID:           "app1",
+		Secret:       "app1-secret",
+		RedirectURIs: []string{appServer.URL + "/oauth2/callback"},
+		Scopes:       []string{"openid", "profile", "email"},
+
+		BackchannelLogoutURI: appServer.URL + DefaultBackchannelLogoutPath,
+	}))
+	return &testEnv{
+		sso:     ssoServer,
+		app:     appServer,
+		clients: clients,
+		client: &http.Client{
+			// 每一次跳转都要自己检查
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+func (e *testEnv) do(t *testing.T, method string, target string, form url.Values, cookies ...*http.Cookie) *http.Response {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, target, body)
+	require.NoError(t, err)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for _, ck := range cookies {
+		req.AddCookie(ck)
+	}
+	resp, err := e.client.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	return resp
+}
+
+// authorize 在 SSO 上登录并且同意授权，返回跳转回业务方的地址和 SSO 上的登录态
+// 和浏览器一样，先打开页面拿到 CSRF token 再提交表单
+func (e *testEnv) authorize(t *testing.T, authorizeURL string) (*url.URL, ssoLogin) {
+	u, err := url.Parse(authorizeURL)
+	require.NoError(t, err)
+	resp := e.do(t, http.MethodGet, e.sso.URL+"/authorize?"+u.RawQuery, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	csrf := findCookie(resp, "_csrf")
+	require.NotNil(t, csrf)
+	resp = e.do(t, http.MethodPost, e.sso.URL+"/login", url.Values{
+		"continue":   {"/authorize?" + u.RawQuery},
+		"email":      {"123@qq.com"},
+		"password":   {"123456"},
+		"csrf_token": {csrfToken(t, resp)},
+	}, csrf)
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	ssid := findCookie(resp, "ssid")
+	require.NotNil(t, ssid)
+
+	resp = e.do(t, http.MethodGet, e.sso.URL+"/authorize?"+u.RawQuery, nil, ssid, csrf)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	login := ssoLogin{cookies: []*http.Cookie{ssid, csrf}, csrfToken: csrfToken(t, resp)}
+	form := u.Query()
+	form.Set("decision", "approve")
+	form["granted_scope"] = strings.Fields(form.Get("scope"))
+	form.Set("csrf_token", login.csrfToken)
+	resp = e.do(t, http.MethodPost, e.sso.URL+"/authorize", form, login.cookies...)
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	return callback, login
+}
+
+// login 走完整个登录流程，返回业务方的登录态
+func (e *testEnv) login(t *testing.T) (*http.Cookie, ssoLogin) {
+	resp := e.do(t, http.MethodGet, e.app.URL+"/profile", nil)
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	pending := findCookie(resp, "app_ssid")
+	callback, login := e.authorize(t, resp.Header.Get("Location"))
+	resp = e.do(t, http.MethodGet, callback.String(), nil, pending)
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	ssid := findCookie(resp, "app_ssid")
+	require.NotNil(t, ssid)
+	return ssid, login
+}
+
+func TestClient_Login(t *testing.T) {
+	env := newTestEnv(t)
+
+	// 没有登录，跳转到 SSO
+	resp := env.do(t, http.MethodGet, env.app.URL+"/profile?tab=1", nil)
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	location := resp.Header.Get("Location")
+	require.True(t, strings.HasPrefix(location, env.sso.URL+"/authorize?"))
+	pending := findCookie(resp, "app_ssid")
+	require.NotNil(t, pending)
+
+	callback, _ := env.authorize(t, location)
+	assert.Equal(t, env.app.URL+"/oauth2/callback", callback.Scheme+"://"+callback.Host+callback.Path)
+
+	// 回到业务方，建立登录态之后跳回原来的页面
+	resp = env.do(t, http.MethodGet, callback.String(), nil, pending)
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "/profile?tab=1", resp.Header.Get("Location"))
+	ssid := findCookie(resp, "app_ssid")
+	require.NotNil(t, ssid)
+	assert.NotEqual(t, pending.Value, ssid.Value)
+
+	resp = env.do(t, http.MethodGet, env.app.URL+"/profile", nil, ssid)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "123 小明", string(body))
+
+	// 登录前的 session 已经作废了
+	resp = env.do(t, http.MethodGet, env.app.URL+"/profile", nil, pending)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+}
+
+func TestClient_Callback(t *testing.T) {
+	env := newTestEnv(t)
+	resp := env.do(t, http.MethodGet, env.app.URL+"/profile", nil)
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	pending := findCookie(resp, "app_ssid")
+	location := resp.Header.Get("Location")
+	callback, login := env.authorize(t, location)
+
+	// 换一个 nonce 再授权一次，同意过了所以直接跳转回来，拿到的 ID token 不属于这个登录流程
+	u, err := url.Parse(location)
+	require.NoError(t, err)
+	q := u.Query()
+	q.Set("nonce", "other")
+	resp = env.do(t, http.MethodGet, env.sso.URL+"/authorize?"+q.Encode(), nil, login.cookies...)
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	otherNonce, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name    string
+		query   func() url.Values
+		cookies []*http.Cookie
+
+		wantCode int
+	}{
+		{
+			name:     "没有发起过登录",
+			query:    callback.Query,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name: "state 不匹配",
+			query: func() url.Values {
+				q := callback.Query()
+				q.Set("state", "other")
+				return q
+			},
+			cookies:  []*http.Cookie{pending},
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name: "用户拒绝授权",
+			query: func() url.Values {
+				q := callback.Query()
+				q.Del("code")
+				q.Set("error", "access_denied")
+				return q
+			},
+			cookies:  []*http.Cookie{pending},
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "nonce 不匹配",
+			query:    otherNonce.Query,
+			cookies:  []*http.Cookie{pending},
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name: "非法的授权码",
+			query: func() url.Values {
+				q := callback.Query()
+				q.Set("code", "unknown")
+				return q
+			},
+			cookies:  []*http.Cookie{pending},
+			wantCode: http.StatusForbidden,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := env.do(t, http.MethodGet,
+				env.app.URL+"/oauth2/callback?"+tc.query().Encode(), nil, tc.cookies...)
+			assert.Equal(t, tc.wantCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestClient_Middleware(t *testing.T) {
+	env := newTestEnv(t)
+	// 不需要登录的路径
+	resp := env.do(t, http.MethodGet, env.app.URL+"/health", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	// 非 GET 请求不跳转
+	resp = env.do(t, http.MethodPost, env.app.URL+"/profile", url.Values{})
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestClient_BackchannelLogout(t *testing.T) {
+	env := newTestEnv(t)
+	ssid, login := env.login(t)
+	resp := env.do(t, http.MethodGet, env.app.URL+"/profile", nil, ssid)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = env.do(t, http.MethodPost, env.sso.URL+"/logout",
+		url.Values{"csrf_token": {login.csrfToken}}, login.cookies...)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	// SSO 通知了 app1，本地的登录态也没有了
+	resp = env.do(t, http.MethodGet, env.app.URL+"/profile", nil, ssid)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+
+	// 伪造的 logout token
+	resp = env.do(t, http.MethodPost, env.app.URL+DefaultBackchannelLogoutPath,
+		url.Values{"logout_token": {"a.b.c"}})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+}
+
+func TestClient_FrontchannelLogout(t *testing.T) {
+	env := newTestEnv(t)
+	require.NoError(t, env.clients.Save(context.Background(), &sso.Client{
+		ID:           "app1",
+		Secret:       "app1-secret",
+		RedirectURIs: []string{env.app.URL + "/oauth2/callback"},
+		Scopes:       []string{"openid", "profile", "email"},
+
+		FrontchannelLogoutURI: env.app.URL + DefaultFrontchannelLogoutPath,
+	}))
+	ssid, login := env.login(t)
+
+	resp := env.do(t, http.MethodPost, env.sso.URL+"/logout",
+		url.Values{"csrf_token": {login.csrfToken}}, login.cookies...)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	matches := regexp.MustCompile(`<iframe src="([^"]+)"`).FindSubmatch(body)
+	require.NotNil(t, matches)
+	iframe, err := url.Parse(html.UnescapeString(string(matches[1])))
+	require.NoError(t, err)
+	assert.Equal(t, env.app.URL+DefaultFrontchannelLogoutPath, iframe.Scheme+"://"+iframe.Host+iframe.Path)
+	assert.Equal(t, "http://sso.com:8083", iframe.Query().Get("iss"))
+
+	// 别的 issuer 发过来的不处理
+	other := iframe.Query()
+	other.Set("iss", "http://evil.com")
+	resp = env.do(t, http.MethodGet, env.app.URL+DefaultFrontchannelLogoutPath+"?"+other.Encode(), nil, ssid)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = env.do(t, http.MethodGet, env.app.URL+"/profile", nil, ssid)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = env.do(t, http.MethodGet, iframe.String(), nil, ssid)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Cache-Control"), "no-store")
+	resp = env.do(t, http.MethodGet, env.app.URL+"/profile", nil, ssid)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+}
+
+func TestMemorySessionIndex(t *testing.T) {
+	index := NewMemorySessionIndex(time.Minute)
+	ctx := context.Background()
+	require.NoError(t, index.Add(ctx, "sid1", "123", "s1"))
+	require.NoError(t, index.Add(ctx, "sid1", "123", "s2"))
+	require.NoError(t, index.Add(ctx, "sid2", "123", "s3"))
+
+	ids, err := index.Take(ctx, "sid1", "123")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"s1", "s2"}, ids)
+	ids, err = index.Take(ctx, "sid1", "123")
+	require.NoError(t, err)
+	assert.Empty(t, ids)
+	// 没有 sid 的时候，删除这个用户所有的 session
+	ids, err = index.Take(ctx, "", "123")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"s1", "s2", "s3"}, ids)
+}
+
+// csrfToken 从页面的表单里面取出 CSRF token
+func csrfToken(t *testing.T, resp *http.Response) string {
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	matches := regexp.MustCompile(`name="csrf_token" type="hidden" value="([^"]+)"`).FindSubmatch(body)
+	require.NotNil(t, matches)
+	return string(matches[1])
+}
+
+func findCookie(resp *http.Response, name string) *http.Cookie {
+	var res *http.Cookie
+	// 同名的 cookie 以最后一个为准
+	for _, ck := range resp.Cookies() {
+		if ck.Name == name {
+			res = ck
+		}
+	}
+	return res
+}
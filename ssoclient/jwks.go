@@ -0,0 +1,53 @@
+package ssoclient
+
+import (
+	"context"
+	"crypto"
+	"net/http"
+	"ssoauth2/sso/jwt"
+	"sync"
+	"time"
+)
+
+// publicKey 从缓存的 JWKS 里面找公钥
+// 找不到的时候说明 SSO 可能轮换了密钥，重新拉取一次，但是最多一分钟一次，避免被人用随便的 kid 刷接口
+func (k *keySet) publicKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.jwks != nil {
+		if jwk, ok := k.jwks.Key(kid); ok {
+			return jwk.PublicKey()
+		}
+	}
+	if time.Since(k.fetchedAt) < time.Minute {
+		return nil, errKeyNotFound
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.ssoURL+"/.well-known/jwks.json", nil)
+	if err != nil {
+		return nil, err
+	}
+	var set jwt.JWKSet
+	if err = doJSON(k.httpClient, req, &set); err != nil {
+		return nil, err
+	}
+	k.jwks = &set
+	k.fetchedAt = time.Now()
+	if jwk, ok := k.jwks.Key(kid); ok {
+		return jwk.PublicKey()
+	}
+	return nil, errKeyNotFound
+}
+
+func newKeySet(ssoURL string, httpClient *http.Client) *keySet {
+	return &keySet{ssoURL: ssoURL, httpClient: httpClient}
+}
+
+// keySet 缓存 SSO 的 JWKS，BearerAuth 和 Client 都用它来校验 JWT
+type keySet struct {
+	ssoURL     string
+	httpClient *http.Client
+
+	mutex     sync.Mutex
+	jwks      *jwt.JWKSet
+	fetchedAt time.Time
+}
@@ -0,0 +1,240 @@
+package ssoclient
+
+import (
+	"context"
+	"crypto"
+	"crypto/subtle"
+	"github.com/patrickmn/go-cache"
+	"net/http"
+	"slices"
+	"ssoauth2/sso/jwt"
+	webContext "ssoauth2/web/context"
+	"ssoauth2/web/handler"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 默认的退出登录通知路径，在 SSO 上注册的时候要和当前的域名拼起来
+const (
+	DefaultBackchannelLogoutPath  = "/oauth2/backchannel-logout"
+	DefaultFrontchannelLogoutPath = "/oauth2/frontchannel-logout"
+)
+
+// backchannelLogoutEvent 是 OIDC Back-Channel Logout 规定的 events 里面的 key
+const backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// WithIssuer 设置 SSO 的 issuer，用来校验 ID token 和 logout token 的 iss，默认就是 ssoURL
+func WithIssuer(issuer string) Option {
+	return func(c *Client) {
+		c.issuer = issuer
+	}
+}
+
+// WithSessionIndex 设置 SSO session 和本地 session 的对应关系保存在哪里
+// 部署多个实例的时候，必须使用共享的实现，因为 SSO 的通知只会发给其中一个实例
+func WithSessionIndex(index SessionIndex) Option {
+	return func(c *Client) {
+		c.index = index
+	}
+}
+
+// WithBackchannelLogoutPath 设置接收 back-channel logout 的路径，默认是 /oauth2/backchannel-logout
+func WithBackchannelLogoutPath(path string) Option {
+	return func(c *Client) {
+		c.backchannelLogoutPath = path
+	}
+}
+
+// WithFrontchannelLogoutPath 设置接收 front-channel logout 的路径，默认是 /oauth2/frontchannel-logout
+func WithFrontchannelLogoutPath(path string) Option {
+	return func(c *Client) {
+		c.frontchannelLogoutPath = path
+	}
+}
+
+// BackchannelLogoutHandler 接收 SSO 直接 POST 过来的 logout token，
+// 需要注册在 backchannelLogoutPath 上，并且在 SSO 上登记为 backchannel_logout_uri
+func (c *Client) BackchannelLogoutHandler() handler.HandleFunc {
+	return func(ctx *webContext.Context) {
+		ctx.Response.Header().Set("Cache-Control", "no-store")
+		token, _ := ctx.FormValue("logout_token").String()
+		reqCtx := ctx.Request.Context()
+		claims, err := c.verifyLogoutToken(reqCtx, token)
+		if err != nil {
+			_ = ctx.RespString(http.StatusBadRequest, "非法的 logout token")
+			return
+		}
+		if err = c.removeSessions(reqCtx, claims.SID, claims.Subject); err != nil {
+			_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+			return
+		}
+		_ = ctx.RespString(http.StatusOK, "")
+	}
+}
+
+// FrontchannelLogoutHandler 处理 SSO 退出页面上用 iframe 加载的请求，
+// 需要注册在 frontchannelLogoutPath 上，并且在 SSO 上登记为 frontchannel_logout_uri
+func (c *Client) FrontchannelLogoutHandler() handler.HandleFunc {
+	return func(ctx *webContext.Context) {
+		ctx.Response.Header().Set("Cache-Control", "no-cache, no-store")
+		ctx.Response.Header().Set("Pragma", "no-cache")
+		iss, _ := ctx.QueryValue("iss").String()
+		sid, _ := ctx.QueryValue("sid").String()
+		if iss != c.issuer || sid == "" {
+			_ = ctx.RespString(http.StatusBadRequest, "非法访问")
+			return
+		}
+		reqCtx := ctx.Request.Context()
+		if err := c.removeSessions(reqCtx, sid, ""); err != nil {
+			_ = ctx.RespString(http.StatusInternalServerError, "服务器故障")
+			return
+		}
+		// iframe 里面带着浏览器自己的 cookie，顺便把 cookie 也删掉
+		if sess, err := c.sessions.GetSession(ctx); err == nil {
+			if val, _ := sess.Get(reqCtx, sessKeySID); val == sid {
+				_ = c.sessions.RemoveSession(ctx)
+			}
+		}
+		_ = ctx.RespString(http.StatusOK, "")
+	}
+}
+
+// removeSessions 删除 SSO session 对应的所有本地 session
+func (c *Client) removeSessions(ctx context.Context, sid string, sub string) error {
+	ids, err := c.index.Take(ctx, sid, sub)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err = c.sessions.Store.Remove(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyIDToken 校验授权码换回来的 ID token
+// nonce 必须和发起授权的时候带上的一致，否则可能是别的登录流程里面的 ID token
+func (c *Client) verifyIDToken(ctx context.Context, token string, nonce string) (*idTokenClaims, error) {
+	var claims idTokenClaims
+	if _, err := c.parseJWT(ctx, token, &claims, &claims.RegisteredClaims); err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" {
+		return nil, errInvalidToken
+	}
+	if nonce == "" || subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, errInvalidNonce
+	}
+	return &claims, nil
+}
+
+// verifyLogoutToken 按照 OIDC Back-Channel Logout 的要求校验 logout token
+func (c *Client) verifyLogoutToken(ctx context.Context, token string) (*logoutTokenClaims, error) {
+	var claims logoutTokenClaims
+	header, err := c.parseJWT(ctx, token, &claims, &claims.RegisteredClaims)
+	if err != nil {
+		return nil, err
+	}
+	typ := strings.ToLower(header.Typ)
+	if typ != "logout+jwt" && typ != "application/logout+jwt" {
+		return nil, errInvalidToken
+	}
+	if _, ok := claims.Events[backchannelLogoutEvent]; !ok {
+		return nil, errInvalidToken
+	}
+	// 带了 nonce 的有可能是被拿来冒充的 ID token
+	if claims.Nonce != "" || claims.IssuedAt == 0 || (claims.SID == "" && claims.Subject == "") {
+		return nil, errInvalidToken
+	}
+	return &claims, nil
+}
+
+// parseJWT 校验签名、iss、aud 和有效期，registered 必须指向 claims 里面嵌入的 RegisteredClaims
+func (c *Client) parseJWT(ctx context.Context, token string, claims any, registered *jwt.RegisteredClaims) (*jwt.Header, error) {
+	header, err := jwt.Parse(token, func(header *jwt.Header) (crypto.PublicKey, error) {
+		return c.keys.publicKey(ctx, header.Kid)
+	}, claims)
+	if err != nil {
+		return nil, err
+	}
+	if err = registered.Validate(time.Now(), time.Second*30); err != nil {
+		return nil, err
+	}
+	if registered.Issuer != c.issuer || !registered.Audience.Contains(c.clientID) || registered.ExpiresAt == 0 {
+		return nil, errInvalidToken
+	}
+	return header, nil
+}
+
+func (s *MemorySessionIndex) Add(ctx context.Context, sid string, sub string, sessionID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.add("sid:"+sid, sessionID)
+	s.add("sub:"+sub, sessionID)
+	return nil
+}
+
+func (s *MemorySessionIndex) Take(ctx context.Context, sid string, sub string) ([]string, error) {
+	key := "sid:" + sid
+	if sid == "" {
+		key = "sub:" + sub
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	val, ok := s.c.Get(key)
+	if !ok {
+		return nil, nil
+	}
+	s.c.Delete(key)
+	return val.([]string), nil
+}
+
+func (s *MemorySessionIndex) add(key string, sessionID string) {
+	var ids []string
+	if val, ok := s.c.Get(key); ok {
+		ids = val.([]string)
+	}
+	if !slices.Contains(ids, sessionID) {
+		// 不修改原来的切片，Take 出去的结果可能还在被使用
+		ids = append(slices.Clip(ids), sessionID)
+	}
+	s.c.Set(key, ids, s.expiration)
+}
+
+// NewMemorySessionIndex 创建一个内存版本的 SessionIndex
+// expiration 不应该比本地 session 的有效期短，否则过期之后就收不到退出登录的通知了
+func NewMemorySessionIndex(expiration time.Duration) *MemorySessionIndex {
+	return &MemorySessionIndex{
+		c:          cache.New(expiration, time.Minute),
+		expiration: expiration,
+	}
+}
+
+type MemorySessionIndex struct {
+	mutex      sync.Mutex
+	c          *cache.Cache
+	expiration time.Duration
+}
+
+// SessionIndex 记录 SSO 的 session 对应着哪些本地 session，收到退出登录的通知之后据此删除本地 session
+type SessionIndex interface {
+	// Add 记录一个本地 session，sid 是 ID token 里面的 sid，sub 是用户 ID
+	Add(ctx context.Context, sid string, sub string, sessionID string) error
+	// Take 取出并且删除对应的本地 session，sid 为空的时候返回这个用户所有的本地 session
+	Take(ctx context.Context, sid string, sub string) ([]string, error)
+}
+
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	SID   string `json:"sid"`
+	Nonce string `json:"nonce"`
+}
+
+type logoutTokenClaims struct {
+	jwt.RegisteredClaims
+	SID    string              `json:"sid"`
+	Events map[string]struct{} `json:"events"`
+	Nonce  string              `json:"nonce"`
+}
@@ -0,0 +1,149 @@
+package csrf
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"web/context"
+	webHandler "web/handler"
+	"web/middleware"
+)
+
+// secretKey 本次请求使用的 cookie 里面的随机值，缓存在 UserValues 里面
+const secretKey = "csrf_secret"
+
+// Build 校验 POST、PUT、PATCH、DELETE 请求里面的 token，校验失败的请求不会执行后面的 handler
+// GET 之类的安全方法不校验，但是会提前准备好 cookie，handler 再通过 Token 拿到 token 放进表单里面
+func (b *MiddlewareBuilder) Build() middleware.Middleware {
+	return func(next webHandler.HandleFunc) webHandler.HandleFunc {
+		return func(ctx *context.Context) {
+			switch ctx.Request.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+				b.Token(ctx)
+			default:
+				if !b.valid(ctx) {
+					b.errorHandler(ctx)
+					return
+				}
+			}
+			next(ctx)
+		}
+	}
+}
+
+// Token 返回要放进表单里面的 token，浏览器还没有 cookie 的时候会生成一个新的
+// token 是 cookie 里面的随机值和当前 session ID 的 HMAC，
+// 所以攻击者就算能够在子域名下面种 cookie，也没有办法构造出受害者 session 的 token
+func (b *MiddlewareBuilder) Token(ctx *context.Context) string {
+	secret, ok := ctx.UserValues[secretKey].(string)
+	if !ok {
+		if ck, err := ctx.Request.Cookie(b.cookieName); err == nil && ck.Value != "" {
+			secret = ck.Value
+		} else {
+			secret = newSecret()
+			ctx.SetCookie(&http.Cookie{
+				Name:     b.cookieName,
+				Value:    secret,
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		if ctx.UserValues == nil {
+			ctx.UserValues = make(map[string]any, 1)
+		}
+		ctx.UserValues[secretKey] = secret
+	}
+	return b.sign(secret, b.sessionID(ctx))
+}
+
+// CookieName 设置保存随机值的 cookie，默认是 _csrf
+func (b *MiddlewareBuilder) CookieName(name string) *MiddlewareBuilder {
+	b.cookieName = name
+	return b
+}
+
+// FieldName 设置表单里面 token 的字段名，默认是 csrf_token
+func (b *MiddlewareBuilder) FieldName(name string) *MiddlewareBuilder {
+	b.fieldName = name
+	return b
+}
+
+// HeaderName 设置 AJAX 请求携带 token 的头部，默认是 X-CSRF-Token
+func (b *MiddlewareBuilder) HeaderName(name string) *MiddlewareBuilder {
+	b.headerName = name
+	return b
+}
+
+// SessionID 设置获取当前 session ID 的方式，token 会和它绑定，session 变了 token 也就失效了
+// 默认不绑定 session，这个时候就是普通的 double submit cookie
+func (b *MiddlewareBuilder) SessionID(fn func(ctx *context.Context) string) *MiddlewareBuilder {
+	b.sessionID = fn
+	return b
+}
+
+// ErrorHandler 设置校验失败的时候的响应，默认返回 403
+func (b *MiddlewareBuilder) ErrorHandler(fn func(ctx *context.Context)) *MiddlewareBuilder {
+	b.errorHandler = fn
+	return b
+}
+
+func (b *MiddlewareBuilder) valid(ctx *context.Context) bool {
+	ck, err := ctx.Request.Cookie(b.cookieName)
+	if err != nil || ck.Value == "" {
+		return false
+	}
+	token := ctx.Request.Header.Get(b.headerName)
+	if token == "" {
+		token, _ = ctx.FormValue(b.fieldName).String()
+	}
+	return hmac.Equal([]byte(token), []byte(b.sign(ck.Value, b.sessionID(ctx))))
+}
+
+func (b *MiddlewareBuilder) sign(secret string, sessionID string) string {
+	mac := hmac.New(sha256.New, b.key)
+	mac.Write([]byte(secret))
+	// 分隔符避免 secret 和 session ID 拼接之后出现歧义
+	mac.Write([]byte{0})
+	mac.Write([]byte(sessionID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func newSecret() string {
+	bs := make([]byte, 32)
+	if _, err := rand.Read(bs); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(bs)
+}
+
+// NewBuilder 创建一个 CSRF 中间件，key 是计算 token 的 HMAC 密钥
+// 部署多个实例的时候，所有实例必须使用同一个 key
+func NewBuilder(key []byte) *MiddlewareBuilder {
+	return &MiddlewareBuilder{
+		key:        key,
+		cookieName: "_csrf",
+		fieldName:  "csrf_token",
+		headerName: "X-CSRF-Token",
+		sessionID: func(ctx *context.Context) string {
+			return ""
+		},
+		errorHandler: func(ctx *context.Context) {
+			ctx.RespStatusCode = http.StatusForbidden
+			ctx.RespData = []byte("CSRF token 校验失败")
+		},
+	}
+}
+
+// MiddlewareBuilder 使用 signed double submit cookie 防御 CSRF
+// cookie 里面是浏览器的随机值，表单里面是它的签名，服务端不需要保存任何状态
+type MiddlewareBuilder struct {
+	key          []byte
+	cookieName   string
+	fieldName    string
+	headerName   string
+	sessionID    func(ctx *context.Context) string
+	errorHandler func(ctx *context.Context)
+}
@@ -0,0 +1,126 @@
+package csrf
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"web"
+	"web/context"
+)
+
+func newTestServer(b *MiddlewareBuilder) *web.HTTPServer {
+	s := web.NewHTTPServer()
+	s.Use(b.Build())
+	s.Get("/form", func(ctx *context.Context) {
+		_ = ctx.RespString(http.StatusOK, b.Token(ctx))
+	})
+	s.Post("/form", func(ctx *context.Context) {
+		_ = ctx.RespString(http.StatusOK, "ok")
+	})
+	return s
+}
+
+func request(s http.Handler, method string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/form", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, ck := range cookies {
+		req.AddCookie(ck)
+	}
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestMiddlewareBuilder_Build(t *testing.T) {
+	s := newTestServer(NewBuilder([]byte("key")))
+
+	resp := request(s, http.MethodGet, nil)
+	require.Equal(t, http.StatusOK, resp.Code)
+	cookies := resp.Result().Cookies()
+	require.Len(t, cookies, 1)
+	ck := cookies[0]
+	assert.Equal(t, "_csrf", ck.Name)
+	assert.True(t, ck.HttpOnly)
+	token := resp.Body.String()
+
+	// 已经有 cookie 了，不会再生成，token 也不变
+	resp = request(s, http.MethodGet, nil, ck)
+	assert.Empty(t, resp.Result().Cookies())
+	assert.Equal(t, token, resp.Body.String())
+
+	testCases := []struct {
+		name     string
+		form     url.Values
+		header   string
+		cookies  []*http.Cookie
+		wantCode int
+	}{
+		{name: "表单", form: url.Values{"csrf_token": {token}}, cookies: []*http.Cookie{ck}, wantCode: http.StatusOK},
+		{name: "头部", header: token, cookies: []*http.Cookie{ck}, wantCode: http.StatusOK},
+		{name: "没有 token", cookies: []*http.Cookie{ck}, wantCode: http.StatusForbidden},
+		{name: "没有 cookie", form: url.Values{"csrf_token": {token}}, wantCode: http.StatusForbidden},
+		{name: "错误的 token", form: url.Values{"csrf_token": {"wrong"}}, cookies: []*http.Cookie{ck}, wantCode: http.StatusForbidden},
+		{
+			// 攻击者种了自己的 cookie，但是没有 key 算不出 token
+			name:     "cookie 和 token 不匹配",
+			form:     url.Values{"csrf_token": {token}},
+			cookies:  []*http.Cookie{{Name: "_csrf", Value: "attacker"}},
+			wantCode: http.StatusForbidden,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/form", strings.NewReader(tc.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tc.header != "" {
+				req.Header.Set("X-CSRF-Token", tc.header)
+			}
+			for _, ck := range tc.cookies {
+				req.AddCookie(ck)
+			}
+			recorder := httptest.NewRecorder()
+			s.ServeHTTP(recorder, req)
+			assert.Equal(t, tc.wantCode, recorder.Code)
+		})
+	}
+
+	// 换了 key 之后，原来的 token 就失效了
+	s = newTestServer(NewBuilder([]byte("another key")))
+	resp = request(s, http.MethodPost, url.Values{"csrf_token": {token}}, ck)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+}
+
+func TestMiddlewareBuilder_SessionID(t *testing.T) {
+	b := NewBuilder([]byte("key")).
+		CookieName("xsrf").
+		FieldName("_token").
+		SessionID(func(ctx *context.Context) string {
+			ck, err := ctx.Request.Cookie("ssid")
+			if err != nil {
+				return ""
+			}
+			return ck.Value
+		}).
+		ErrorHandler(func(ctx *context.Context) {
+			ctx.RespStatusCode = http.StatusBadRequest
+		})
+	s := newTestServer(b)
+	ssid := &http.Cookie{Name: "ssid", Value: "session-1"}
+	resp := request(s, http.MethodGet, nil, ssid)
+	require.Equal(t, http.StatusOK, resp.Code)
+	ck := resp.Result().Cookies()[0]
+	assert.Equal(t, "xsrf", ck.Name)
+	token := resp.Body.String()
+
+	resp = request(s, http.MethodPost, url.Values{"_token": {token}}, ck, ssid)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	// 同一个浏览器，换了 session 之后，老页面上的 token 就不能用了
+	resp = request(s, http.MethodPost, url.Values{"_token": {token}}, ck, &http.Cookie{Name: "ssid", Value: "session-2"})
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	resp = request(s, http.MethodPost, url.Values{"_token": {token}}, ck)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
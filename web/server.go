@@ -18,6 +18,10 @@ func (s *HTTPServer) Post(path string, handleFunc webHandler.HandleFunc, mdls ..
 	s.addRoute(http.MethodPost, path, handleFunc, mdls...)
 }
 
+func (s *HTTPServer) Put(path string, handleFunc webHandler.HandleFunc, mdls ...middleware.Middleware) {
+	s.addRoute(http.MethodPut, path, handleFunc, mdls...)
+}
+
 func (s *HTTPServer) Get(path string, handleFunc webHandler.HandleFunc, mdls ...middleware.Middleware) {
 	s.addRoute(http.MethodGet, path, handleFunc, mdls...)
 }
@@ -40,6 +44,10 @@ func (s *HTTPServer) Response(ctx *context.Context) {
 	if ctx.RespStatusCode > 0 {
 		ctx.Response.WriteHeader(ctx.RespStatusCode)
 	}
+	// 204 之类的响应不允许有 body，写入的话会报错
+	if len(ctx.RespData) == 0 {
+		return
+	}
 	_, err := ctx.Response.Write(ctx.RespData)
 	if err != nil {
 		log.Fatalln("回写响应失败", err)
@@ -20,6 +20,9 @@ func NewPropagator(cookieName string, opt ...PropagatorOption) *Propagator {
 		cookieName: cookieName,
 		cookieOpt:  func(c *http.Cookie) {},
 	}
+	for _, o := range opt {
+		o(res)
+	}
 	return res
 }
 
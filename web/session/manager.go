@@ -1,17 +1,18 @@
 package session
 
 import (
-	web "web/v9"
+	"web/context"
+	"web/handler"
+	"web/middleware"
 )
 
 // GetSession 将会尝试从 ctx 中拿到 Session，
 // 如果成功了，那么它会将 Session 实例缓存到 ctx 的 UserValues 里面
-func (m *Manager) GetSession(ctx *web.Context) (Session, error) {
-	//if ctx.UserValues == nil {
-	//	ctx.UserValues = make(map[string]any, 1)
-	//}
-	//val, ok := ctx.UserValues[m.SessCtxKey]
-	val, ok := ctx.Get(m.SessCtxKey)
+func (m *Manager) GetSession(ctx *context.Context) (Session, error) {
+	if ctx.UserValues == nil {
+		ctx.UserValues = make(map[string]any, 1)
+	}
+	val, ok := ctx.UserValues[m.SessCtxKey]
 	if ok {
 		return val.(Session), nil
 	}
@@ -26,13 +27,12 @@ func (m *Manager) GetSession(ctx *web.Context) (Session, error) {
 		return nil, err
 	}
 
-	ctx.Set(m.SessCtxKey, sess)
-	// ctx.UserValues[m.SessCtxKey] = sess
+	ctx.UserValues[m.SessCtxKey] = sess
 	return sess, nil
 }
 
 // InitSession 初始化一个 session，并且注入到 http response 里面
-func (m *Manager) InitSession(ctx *web.Context, id string) (Session, error) {
+func (m *Manager) InitSession(ctx *context.Context, id string) (Session, error) {
 	sess, err := m.Generate(ctx.Request.Context(), id)
 	if err != nil {
 		return nil, err
@@ -40,11 +40,16 @@ func (m *Manager) InitSession(ctx *web.Context, id string) (Session, error) {
 	if err = m.Inject(id, ctx.Response); err != nil {
 		return nil, err
 	}
+	if ctx.UserValues == nil {
+		ctx.UserValues = make(map[string]any, 1)
+	}
+	// 同一个请求里面后续调用 GetSession 拿到的就是新的 session
+	ctx.UserValues[m.SessCtxKey] = sess
 	return sess, nil
 }
 
 // RefreshSession 刷新 Session
-func (m *Manager) RefreshSession(ctx *web.Context) (Session, error) {
+func (m *Manager) RefreshSession(ctx *context.Context) (Session, error) {
 	sess, err := m.GetSession(ctx)
 	if err != nil {
 		return nil, err
@@ -63,7 +68,7 @@ func (m *Manager) RefreshSession(ctx *web.Context) (Session, error) {
 }
 
 // RemoveSession 删除 Session
-func (m *Manager) RemoveSession(ctx *web.Context) error {
+func (m *Manager) RemoveSession(ctx *context.Context) error {
 	sess, err := m.GetSession(ctx)
 	if err != nil {
 		return err
@@ -72,20 +77,25 @@ func (m *Manager) RemoveSession(ctx *web.Context) error {
 	if err != nil {
 		return err
 	}
+	delete(ctx.UserValues, m.SessCtxKey)
 	return m.Propagator.Remove(ctx.Response)
 }
 
-func RegisterManager(m *Manager) web.Middleware {
-	return func(next web.HandleFunc) web.HandleFunc {
-		return func(ctx *web.Context) {
-			ctx.Set(managerKey, m)
+func RegisterManager(m *Manager) middleware.Middleware {
+	return func(next handler.HandleFunc) handler.HandleFunc {
+		return func(ctx *context.Context) {
+			if ctx.UserValues == nil {
+				ctx.UserValues = make(map[string]any, 1)
+			}
+			ctx.UserValues[managerKey] = m
 			next(ctx)
 		}
 	}
 }
 
-func GetManager(ctx *web.Context) Manager {
-	return ctx.MustGet(managerKey).(Manager)
+// GetManager 拿到 RegisterManager 注册的 Manager，没有注册的时候会 panic
+func GetManager(ctx *context.Context) *Manager {
+	return ctx.UserValues[managerKey].(*Manager)
 }
 
 type Manager struct {
@@ -6,15 +6,18 @@ import (
 	"net/http"
 	"testing"
 	"time"
+	"web"
+	"web/context"
+	"web/handler"
+	"web/middleware"
 	"web/session"
 	"web/session/cookie"
 	"web/session/memory"
-	web "web/v9"
 )
 
-func LoginMiddleware() web.Middleware {
-	return func(next web.HandleFunc) web.HandleFunc {
-		return func(ctx *web.Context) {
+func LoginMiddleware() middleware.Middleware {
+	return func(next handler.HandleFunc) handler.HandleFunc {
+		return func(ctx *context.Context) {
 			// 是登录请求则执行校验
 			if ctx.Request.URL.Path != "/login" {
 				m := session.GetManager(ctx)
@@ -47,7 +50,7 @@ func TestManager(t *testing.T) {
 
 	s.Use(session.RegisterManager(m), LoginMiddleware())
 
-	s.Post("/login", func(ctx *web.Context) {
+	s.Post("/login", func(ctx *context.Context) {
 		// 前面就是你登录的时候一大堆的登录校验
 		id := uuid.New()
 		m := session.GetManager(ctx)
@@ -63,7 +66,7 @@ func TestManager(t *testing.T) {
 			return
 		}
 	})
-	s.Get("/resource", func(ctx *web.Context) {
+	s.Get("/resource", func(ctx *context.Context) {
 		m := session.GetManager(ctx)
 		sess, err := m.GetSession(ctx)
 		if err != nil {
@@ -74,7 +77,7 @@ func TestManager(t *testing.T) {
 		ctx.RespData = []byte(val)
 	})
 
-	s.Post("/logout", func(ctx *web.Context) {
+	s.Post("/logout", func(ctx *context.Context) {
 		m := session.GetManager(ctx)
 		_ = m.RemoveSession(ctx)
 	})